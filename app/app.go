@@ -1,15 +1,26 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	abci "github.com/cometbft/cometbft/abci/types"
 	"github.com/cometbft/cometbft/libs/log"
 	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
+// Application implements the ABCI application interface
+var _ abci.Application = (*Application)(nil)
+
 // Application implements the ABCI application interface
 type Application struct {
 	abci.BaseApplication
@@ -18,99 +29,362 @@ type Application struct {
 	txProcessor         *TransactionProcessor
 	logger              log.Logger
 	pendingTransactions map[string]*types.Transaction
+	invariants          *InvariantRegistry
+	metrics             *Metrics
+
+	// Limits on proposed blocks, zero means no limit
+	maxBlockTxs int
+	maxBlockOps int
+
+	// Number of blocks between two saves of the state
+	snapshotInterval int64
 }
 
 // NewApplication creates a new ABCI application
 func NewApplication(stateFile string, logger log.Logger) *Application {
 	stateStore := NewStateStore(stateFile)
-	txProcessor := NewTransactionProcessor(stateStore)
+	metrics := NewMetrics()
+	txProcessor := NewTransactionProcessor(stateStore, metrics)
+
+	// Load state from disk so Info reports the last finalized height after a restart
+	if err := stateStore.LoadState(); err != nil {
+		logger.Error("Failed to load state", "error", err)
+	}
 
 	return &Application{
 		stateStore:          stateStore,
 		txProcessor:         txProcessor,
 		logger:              logger,
 		pendingTransactions: make(map[string]*types.Transaction),
+		invariants:          DefaultInvariantRegistry(),
+		metrics:             metrics,
+		snapshotInterval:    1,
+	}
+}
+
+// SetInvariants sets the invariants checked at the end of every block.
+// Passing nil disables invariant checking.
+func (app *Application) SetInvariants(registry *InvariantRegistry) {
+	app.invariants = registry
+}
+
+// SetStatePersistence sets how the state is saved, PersistenceIncremental or PersistenceFull
+func (app *Application) SetStatePersistence(persistence string) error {
+	return app.stateStore.SetPersistence(persistence)
+}
+
+// Close releases the files held by the application
+func (app *Application) Close() error {
+	return app.stateStore.Close()
+}
+
+// StateStore returns the store holding the application state
+func (app *Application) StateStore() *StateStore {
+	return app.stateStore
+}
+
+// Metrics returns the metrics of the application, to be registered with a Prometheus registry
+func (app *Application) Metrics() *Metrics {
+	return app.metrics
+}
+
+// SetBlockLimits limits the number of transactions and operations in the
+// blocks this node proposes. Zero means no limit.
+func (app *Application) SetBlockLimits(maxTxs int, maxOps int) {
+	app.maxBlockTxs = maxTxs
+	app.maxBlockOps = maxOps
+}
+
+// SetSnapshotInterval sets the number of blocks between two saves of the
+// state. After a restart, CometBFT replays the blocks since the last save.
+func (app *Application) SetSnapshotInterval(blocks int64) {
+	if blocks < 1 {
+		blocks = 1
 	}
+	app.snapshotInterval = blocks
 }
 
 // Info returns information about the application state
-func (app *Application) Info(req abci.InfoRequest) abci.InfoResponse {
-	return abci.InfoResponse{
+func (app *Application) Info(_ context.Context, req *abci.InfoRequest) (*abci.InfoResponse, error) {
+	return &abci.InfoResponse{
 		Data:             "Batched Transaction ABCI App",
 		Version:          "1.0.0",
 		AppVersion:       1,
-		LastBlockHeight:  0,
-		LastBlockAppHash: []byte{},
-	}
+		LastBlockHeight:  app.stateStore.GetHeight(),
+		LastBlockAppHash: app.stateStore.GetAppHash(),
+	}, nil
 }
 
 // InitChain initializes the blockchain with validators and initial app state
-func (app *Application) InitChain(req abci.InitChainRequest) abci.InitChainResponse {
+func (app *Application) InitChain(_ context.Context, req *abci.InitChainRequest) (*abci.InitChainResponse, error) {
 	// Load state from disk if available
 	if err := app.stateStore.LoadState(); err != nil {
 		app.logger.Error("Failed to load state", "error", err)
 	}
 
-	// For demo purposes, let's create some initial accounts with balances
-	_ = app.stateStore.UpdateBalance(1, 1000) // User 1 gets 1000 tokens
-	_ = app.stateStore.UpdateBalance(2, 500)  // User 2 gets 500 tokens
-	_ = app.stateStore.UpdateBalance(3, 200)  // User 3 gets 200 tokens
+	// Parse the application state from the genesis file
+	genesis, err := types.ParseGenesisState(req.AppStateBytes)
+	if err == nil {
+		err = genesis.Validate()
+	}
+	if err != nil {
+		app.logger.Error("Invalid genesis state", "error", err)
+		return nil, fmt.Errorf("invalid genesis state: %w", err)
+	}
+
+	if err := app.initGenesis(req.ChainId, genesis); err != nil {
+		app.logger.Error("Failed to apply genesis state", "error", err)
+		return nil, fmt.Errorf("failed to apply genesis state: %w", err)
+	}
 
 	app.logger.Info("Initialized chain", "validators", len(req.Validators))
-	return abci.InitChainResponse{}
+	return &abci.InitChainResponse{}, nil
+}
+
+// initGenesis applies the genesis state, minting the initial balances
+func (app *Application) initGenesis(chainID string, genesis *types.GenesisState) error {
+	// Configure the chain ID, authorities and supply cap first, so the cap applies to genesis balances
+	if err := app.stateStore.UpdateState(func(state *types.State) error {
+		state.ChainID = chainID
+		state.MintAuthority = genesis.MintAuthority
+		state.AdminAuthority = genesis.AdminAuthority
+		state.SupplyCap = genesis.SupplyCap
+		state.Params = genesis.GetParams()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	accounts := genesis.Accounts
+	if len(accounts) == 0 {
+		// For demo purposes, let's create some initial accounts with balances
+		accounts = []types.Account{
+			{ID: 1, Balance: 1000}, // User 1 gets 1000 tokens
+			{ID: 2, Balance: 500},  // User 2 gets 500 tokens
+			{ID: 3, Balance: 200},  // User 3 gets 200 tokens
+		}
+	}
+
+	for _, acc := range accounts {
+		if acc.Balance == 0 {
+			// Crediting nothing creates the empty account
+			if err := app.stateStore.Credit(acc.ID, 0); err != nil {
+				return fmt.Errorf("failed to create account %d: %w", acc.ID, err)
+			}
+			continue
+		}
+		if err := app.stateStore.Mint(acc.ID, acc.Balance); err != nil {
+			return fmt.Errorf("failed to fund account %d: %w", acc.ID, err)
+		}
+	}
+
+	// Apply limits configured at genesis, which only the admin authority can change,
+	// the nonces of exported accounts, so their signed operations cannot be replayed,
+	// and the keys verifying the signatures of the account owners
+	for _, acc := range accounts {
+		if acc.PubKey != "" {
+			keyType, err := crypto.ParseKeyType(acc.KeyType)
+			if err != nil {
+				return fmt.Errorf("account %d: %w", acc.ID, err)
+			}
+			app.stateStore.SetPubKey(acc.ID, keyType, acc.PubKey)
+		}
+		if acc.BLSPubKey != "" {
+			app.stateStore.SetBLSPubKey(acc.ID, acc.BLSPubKey)
+		}
+		if !acc.Limits.IsZero() {
+			app.stateStore.SetLimits(acc.ID, acc.Limits, true)
+		}
+		if acc.Nonce > 0 {
+			app.stateStore.SetNonce(acc.ID, acc.Nonce)
+		}
+	}
+
+	return nil
+}
+
+// CodeParamsExceeded is the result code for transactions that exceed the consensus params
+const CodeParamsExceeded uint32 = 7
+
+// decodeTx checks a raw transaction against the consensus params and parses it.
+// The size is checked before parsing, and the operations before any signature is verified.
+func (app *Application) decodeTx(txBytes []byte) (*types.Transaction, error) {
+	params := app.stateStore.GetParams()
+	if err := params.CheckTxBytes(len(txBytes)); err != nil {
+		return nil, err
+	}
+
+	tx, err := types.ParseTransaction(txBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := params.CheckTransaction(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// decodeErrorCode returns the result code for a transaction that could not be decoded
+func decodeErrorCode(err error) uint32 {
+	if errors.Is(err, types.ErrParamsExceeded) {
+		return CodeParamsExceeded
+	}
+	return 1
 }
 
 // CheckTx validates a transaction before adding it to the mempool
-func (app *Application) CheckTx(req abci.CheckTxRequest) abci.CheckTxResponse {
-	// Parse the transaction
-	tx, err := types.ParseTransaction(req.Tx)
+func (app *Application) CheckTx(_ context.Context, req *abci.CheckTxRequest) (*abci.CheckTxResponse, error) {
+	res := app.checkTx(req.Tx)
+	app.metrics.observeCheckTx(res.Code)
+	return res, nil
+}
+
+// checkTx validates a raw transaction
+func (app *Application) checkTx(txBytes []byte) *abci.CheckTxResponse {
+	// Parse the transaction and check it against the params
+	tx, err := app.decodeTx(txBytes)
 	if err != nil {
-		return abci.CheckTxResponse{
-			Code: 1,
+		return &abci.CheckTxResponse{
+			Code: decodeErrorCode(err),
 			Log:  fmt.Sprintf("Invalid transaction format: %v", err),
 		}
 	}
 
 	// Validate the transaction
 	if err := app.txProcessor.ValidateTransaction(tx); err != nil {
-		return abci.CheckTxResponse{
-			Code: 2,
+		return &abci.CheckTxResponse{
+			Code: resultCode(err),
 			Log:  fmt.Sprintf("Invalid transaction: %v", err),
 		}
 	}
 
 	// Store the transaction for later processing
-	txHash := fmt.Sprintf("%x", req.Tx)
+	txHash := fmt.Sprintf("%x", txBytes)
 	app.pendingTransactions[txHash] = tx
 
-	return abci.CheckTxResponse{
+	return &abci.CheckTxResponse{
 		Code: 0,
 		Log:  "Transaction is valid",
 	}
 }
 
+// PrepareProposal fills a proposed block with mempool transactions, in order, within the
+// byte limit of the request and the block limits. Transactions that ProcessProposal would
+// reject are left out.
+func (app *Application) PrepareProposal(_ context.Context, req *abci.PrepareProposalRequest) (*abci.PrepareProposalResponse, error) {
+	txs := make([][]byte, 0, len(req.Txs))
+	var totalBytes int64
+	var totalOps int
+	for _, txBytes := range req.Txs {
+		if app.maxBlockTxs > 0 && len(txs) >= app.maxBlockTxs {
+			break
+		}
+		if totalBytes+int64(len(txBytes)) > req.MaxTxBytes {
+			break
+		}
+
+		tx, err := app.decodeTx(txBytes)
+		if err != nil {
+			continue
+		}
+		if app.maxBlockOps > 0 && totalOps+len(tx.Operations) > app.maxBlockOps {
+			continue
+		}
+
+		txs = append(txs, txBytes)
+		totalBytes += int64(len(txBytes))
+		totalOps += len(tx.Operations)
+	}
+
+	return &abci.PrepareProposalResponse{Txs: txs}, nil
+}
+
+// ProcessProposal rejects proposed blocks that contain malformed transactions or ones exceeding the
+// consensus params. Signatures and balances are left to FinalizeBlock.
+func (app *Application) ProcessProposal(_ context.Context, req *abci.ProcessProposalRequest) (*abci.ProcessProposalResponse, error) {
+	for i, tx := range req.Txs {
+		if _, err := app.decodeTx(tx); err != nil {
+			app.logger.Error("Rejecting proposal",
+				"height", req.Height,
+				"tx", i,
+				"error", err)
+			return &abci.ProcessProposalResponse{Status: abci.PROCESS_PROPOSAL_STATUS_REJECT}, nil
+		}
+	}
+
+	return &abci.ProcessProposalResponse{Status: abci.PROCESS_PROPOSAL_STATUS_ACCEPT}, nil
+}
+
 // FinalizeBlock processes transactions and updates the application state
-func (app *Application) FinalizeBlock(req abci.FinalizeBlockRequest) abci.FinalizeBlockResponse {
+func (app *Application) FinalizeBlock(ctx context.Context, req *abci.FinalizeBlockRequest) (*abci.FinalizeBlockResponse, error) {
+	defer observeSince(app.metrics.FinalizeBlockDuration, time.Now())
+
 	var txResults []*abci.ExecTxResult
 
 	// Process each transaction
+	app.stateStore.BeginBlock()
+	app.txProcessor.BeginBlock(req.Height)
 	for _, tx := range req.Txs {
 		result := app.processTx(tx)
 		txResults = append(txResults, result)
 	}
+	app.txProcessor.EndBlock()
+	app.stateStore.SetHeight(req.Height)
+
+	// Halt the node if the block broke an invariant. Only mints and burns
+	// change the tracked supply, so the balances of the accounts the block
+	// changed must have changed by as much.
+	app.checkInvariants(app.stateStore.EndBlock(req.Height))
+
+	// Commit to the resulting state, which is saved along with its hash so
+	// that Info reports the hash of the height it was saved at
+	appHash, err := app.stateStore.ComputeAppHash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute app hash: %w", err)
+	}
+	app.stateStore.SetAppHash(appHash)
 
-	return abci.FinalizeBlockResponse{
+	return &abci.FinalizeBlockResponse{
 		TxResults: txResults,
+		AppHash:   appHash,
+	}, nil
+}
+
+// checkInvariants runs the registered invariants and halts the node on violation
+func (app *Application) checkInvariants(input *InvariantInput) {
+	if app.invariants == nil {
+		return
+	}
+
+	if err := app.invariants.Check(input); err != nil {
+		app.logger.Error("Invariant check failed, halting node",
+			"height", input.Height,
+			"error", err)
+		panic(fmt.Sprintf("halting node: %v", err))
 	}
 }
 
+// resultCode returns the result code for a transaction that failed validation or processing
+func resultCode(err error) uint32 {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, ErrInvalidNonce):
+		return CodeInvalidNonce
+	case errors.Is(err, ErrExpired):
+		return CodeExpired
+	}
+	return 2
+}
+
 // processTx processes a single transaction
 func (app *Application) processTx(txBytes []byte) *abci.ExecTxResult {
-	// Parse the transaction
-	tx, err := types.ParseTransaction(txBytes)
+	// Parse the transaction and check it against the params
+	tx, err := app.decodeTx(txBytes)
 	if err != nil {
 		return &abci.ExecTxResult{
-			Code: 1,
+			Code: decodeErrorCode(err),
 			Log:  fmt.Sprintf("Invalid transaction format: %v", err),
 		}
 	}
@@ -118,11 +392,13 @@ func (app *Application) processTx(txBytes []byte) *abci.ExecTxResult {
 	// Process the transaction
 	if err := app.txProcessor.ProcessTransaction(tx); err != nil {
 		return &abci.ExecTxResult{
-			Code: 2,
+			Code: resultCode(err),
 			Log:  fmt.Sprintf("Failed to process transaction: %v", err),
 		}
 	}
 
+	app.metrics.OpsPerTx.Observe(float64(len(tx.Operations)))
+
 	// Log the transaction details
 	app.logger.Info("Processed transaction",
 		"operations", len(tx.Operations),
@@ -130,87 +406,261 @@ func (app *Application) processTx(txBytes []byte) *abci.ExecTxResult {
 
 	// Return success
 	return &abci.ExecTxResult{
-		Code: 0,
-		Log:  fmt.Sprintf("Processed %d operations", len(tx.Operations)),
+		Code:   0,
+		Log:    fmt.Sprintf("Processed %d operations", len(tx.Operations)),
+		Events: app.supplyEvents(tx),
+	}
+}
+
+// supplyEvents returns an event for every mint and burn operation in a processed transaction
+func (app *Application) supplyEvents(tx *types.Transaction) []abci.Event {
+	var events []abci.Event
+	for _, op := range tx.Operations {
+		var account int
+		switch op.OpType() {
+		case types.OpTypeMint:
+			account = op.To
+		case types.OpTypeBurn:
+			account = op.From
+		default:
+			continue
+		}
+
+		events = append(events, abci.Event{
+			Type: op.OpType(),
+			Attributes: []abci.EventAttribute{
+				{Key: "authority", Value: strconv.Itoa(op.From), Index: true},
+				{Key: "account", Value: strconv.Itoa(account), Index: true},
+				{Key: "amount", Value: strconv.FormatUint(op.Amount, 10)},
+			},
+		})
+	}
+
+	if len(events) > 0 {
+		totalSupply, _ := app.stateStore.GetSupply()
+		events = append(events, abci.Event{
+			Type: "supply",
+			Attributes: []abci.EventAttribute{
+				{Key: "total_supply", Value: strconv.FormatUint(totalSupply, 10)},
+			},
+		})
 	}
+
+	return events
 }
 
-// Commit commits the current state and returns a hash of the state
-func (app *Application) Commit() abci.CommitResponse {
-	// Save state to disk
-	if err := app.stateStore.SaveState(); err != nil {
-		app.logger.Error("Failed to save state", "error", err)
+// Commit saves the state finalized by the last block, whose hash
+// FinalizeBlock returned
+func (app *Application) Commit(_ context.Context, _ *abci.CommitRequest) (*abci.CommitResponse, error) {
+	defer observeSince(app.metrics.CommitDuration, time.Now())
+
+	// Save state to disk every snapshot interval
+	if app.stateStore.GetHeight()%app.snapshotInterval == 0 {
+		start := time.Now()
+		if err := app.stateStore.SaveState(); err != nil {
+			app.logger.Error("Failed to save state", "error", err)
+		}
+		observeSince(app.metrics.StateSaveDuration, start)
 	}
 
 	// Clear pending transactions
 	app.pendingTransactions = make(map[string]*types.Transaction)
 
-	// In a real application, you would compute a state hash here
-	return abci.CommitResponse{
+	return &abci.CommitResponse{
 		RetainHeight: 0, // Don't prune any heights
+	}, nil
+}
+
+// maxStatePageSize is the largest number of accounts returned by a state query
+const maxStatePageSize = 1000
+
+// StatePageRequest selects the page of accounts returned by a state query.
+// It is given either as JSON data or as the start and limit parameters of
+// the query path, as in "state?start=100&limit=50".
+type StatePageRequest struct {
+	StartID int `json:"start_id"` // Lowest ID of the accounts returned
+	Limit   int `json:"limit"`    // Up to maxStatePageSize, which zero also means
+}
+
+// parseStatePageRequest reads a state page request from the parameters of
+// the query path, then from the query data
+func parseStatePageRequest(rawQuery string, data []byte) (StatePageRequest, error) {
+	var req StatePageRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return req, err
+		}
+	}
+
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return req, err
+	}
+	if start := params.Get("start"); start != "" {
+		if req.StartID, err = strconv.Atoi(start); err != nil {
+			return req, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if req.Limit, err = strconv.Atoi(limit); err != nil {
+			return req, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+	return req, nil
+}
+
+// StatePage is the result of a state query for a page of accounts, in
+// ascending order of ID
+type StatePage struct {
+	Height   int64            `json:"height"`
+	Accounts []*types.Account `json:"accounts"`
+	// NextStartID is the StartID of the next page. It is unset when the page
+	// is not full, which makes it the last one.
+	NextStartID *int `json:"next_start_id,omitempty"`
+}
+
+// queryStatePage answers a state query for a page of accounts, read with an
+// account iterator so that the state is never copied as a whole
+func (app *Application) queryStatePage(ctx context.Context, rawQuery string, data []byte) *abci.QueryResponse {
+	req, err := parseStatePageRequest(rawQuery, data)
+	if err != nil {
+		return &abci.QueryResponse{
+			Code: 1,
+			Log:  fmt.Sprintf("Invalid state page request: %v", err),
+		}
+	}
+	if req.Limit <= 0 || req.Limit > maxStatePageSize {
+		req.Limit = maxStatePageSize
+	}
+
+	page := StatePage{
+		Height:   app.stateStore.GetHeight(),
+		Accounts: make([]*types.Account, 0, req.Limit),
+	}
+	it := storage.NewAccountIterator(app.stateStore.Accounts(), req.StartID, req.Limit)
+	for len(page.Accounts) < req.Limit && it.Next(ctx) {
+		page.Accounts = append(page.Accounts, it.Account())
+	}
+	if err := it.Err(); err != nil {
+		return &abci.QueryResponse{
+			Code: 2,
+			Log:  fmt.Sprintf("Failed to list accounts: %v", err),
+		}
+	}
+	if len(page.Accounts) == req.Limit {
+		if last := page.Accounts[len(page.Accounts)-1].ID; last < math.MaxInt {
+			next := last + 1
+			page.NextStartID = &next
+		}
+	}
+
+	value, err := json.Marshal(page)
+	if err != nil {
+		return &abci.QueryResponse{
+			Code: 2,
+			Log:  fmt.Sprintf("Failed to serialize state page: %v", err),
+		}
+	}
+	return &abci.QueryResponse{
+		Code:  0,
+		Value: value,
 	}
 }
 
 // Query handles queries to the application state
-func (app *Application) Query(req abci.QueryRequest) abci.QueryResponse {
-	switch req.Path {
+func (app *Application) Query(ctx context.Context, req *abci.QueryRequest) (*abci.QueryResponse, error) {
+	path, rawQuery, _ := strings.Cut(req.Path, "?")
+	switch path {
 	case "state":
-		// Return the entire state
-		data, err := app.stateStore.GetState().Serialize()
+		// Return a page of accounts, the first one unless asked for another
+		return app.queryStatePage(ctx, rawQuery, req.Data), nil
+
+	case "supply":
+		// Return the tracked total supply and the supply cap
+		totalSupply, supplyCap := app.stateStore.GetSupply()
+		data, err := json.Marshal(map[string]uint64{
+			"total_supply": totalSupply,
+			"supply_cap":   supplyCap,
+		})
 		if err != nil {
-			return abci.QueryResponse{
+			return &abci.QueryResponse{
 				Code: 1,
-				Log:  fmt.Sprintf("Failed to serialize state: %v", err),
-			}
+				Log:  fmt.Sprintf("Failed to serialize supply: %v", err),
+			}, nil
 		}
-		return abci.QueryResponse{
+		return &abci.QueryResponse{
 			Code:  0,
 			Value: data,
+		}, nil
+
+	case "params":
+		// Return the consensus params
+		data, err := json.Marshal(app.stateStore.GetParams())
+		if err != nil {
+			return &abci.QueryResponse{
+				Code: 1,
+				Log:  fmt.Sprintf("Failed to serialize params: %v", err),
+			}, nil
 		}
+		return &abci.QueryResponse{
+			Code:  0,
+			Value: data,
+		}, nil
 
 	case "account":
 		// Parse account ID from data
 		var accountID int
 		if err := json.Unmarshal(req.Data, &accountID); err != nil {
-			return abci.QueryResponse{
+			return &abci.QueryResponse{
 				Code: 1,
 				Log:  fmt.Sprintf("Invalid account ID format: %v", err),
-			}
+			}, nil
 		}
 
-		// Get account
+		// Get account, without creating it
+		if !app.stateStore.HasAccount(accountID) {
+			return &abci.QueryResponse{
+				Code: 4,
+				Log:  fmt.Sprintf("Account %d not found", accountID),
+			}, nil
+		}
 		account := app.stateStore.GetAccount(accountID)
 		data, err := json.Marshal(account)
 		if err != nil {
-			return abci.QueryResponse{
+			return &abci.QueryResponse{
 				Code: 2,
 				Log:  fmt.Sprintf("Failed to serialize account: %v", err),
-			}
+			}, nil
 		}
 
-		return abci.QueryResponse{
+		return &abci.QueryResponse{
 			Code:  0,
 			Value: data,
-		}
+		}, nil
 
 	default:
-		return abci.QueryResponse{
+		return &abci.QueryResponse{
 			Code: 3,
 			Log:  fmt.Sprintf("Unknown query path: %s", req.Path),
-		}
+		}, nil
 	}
 }
 
-// RegisterUserKey registers a public key for a user
-func (app *Application) RegisterUserKey(userID int, pubKeyBase64 string) error {
-	pubKey, exists := app.txProcessor.GetUserKey(userID)
-	if exists {
+// RegisterUserKey registers a public key of the given type for a user.
+// An empty key type registers an ed25519 key. Keys are part of the state, so
+// on a network they are set in the genesis accounts instead, which every
+// node registers in InitChain.
+func (app *Application) RegisterUserKey(userID int, keyTypeName string, pubKeyBase64 string) error {
+	if _, exists := app.txProcessor.GetUserKey(userID); exists {
 		return fmt.Errorf("user %d already has a registered key", userID)
 	}
 
 	// Parse the public key
-	var err error
-	pubKey, err = crypto.PublicKeyFromBase64(pubKeyBase64)
+	keyType, err := crypto.ParseKeyType(keyTypeName)
+	if err != nil {
+		return err
+	}
+	pubKey, err := crypto.PublicKeyFromBase64OfType(keyType, pubKeyBase64)
 	if err != nil {
 		return fmt.Errorf("invalid public key: %w", err)
 	}
@@ -219,3 +669,21 @@ func (app *Application) RegisterUserKey(userID int, pubKeyBase64 string) error {
 	app.txProcessor.RegisterUserKey(userID, pubKey)
 	return nil
 }
+
+// RegisterBLSKey registers a BLS public key for a user, used to verify
+// aggregate-signed transactions
+func (app *Application) RegisterBLSKey(userID int, pubKeyBase64 string) error {
+	if _, exists := app.txProcessor.GetBLSKey(userID); exists {
+		return fmt.Errorf("user %d already has a registered BLS key", userID)
+	}
+
+	// Parse the public key
+	pubKey, err := crypto.BLSPublicKeyFromBase64(pubKeyBase64)
+	if err != nil {
+		return fmt.Errorf("invalid BLS public key: %w", err)
+	}
+
+	// Register the key
+	app.txProcessor.RegisterBLSKey(userID, pubKey)
+	return nil
+}
@@ -0,0 +1,429 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/libs/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xmonader/test_batched_tx_tendermint/client"
+	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+func TestTransactionParams(t *testing.T) {
+	sender := client.NewClient(1)
+	application := NewApplication("", log.NewNopLogger())
+	application.txProcessor.RegisterUserKey(1, sender.GetPublicKey())
+
+	// Genesis sets the params
+	params := types.Params{MaxOpsPerTx: 2, MaxTxBytes: 1000, MaxAmountPerOp: 100}
+	genesis, err := json.Marshal(types.GenesisState{Params: &params})
+	if err != nil {
+		t.Fatalf("Failed to marshal genesis state: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := application.InitChain(ctx, &abci.InitChainRequest{ChainId: "test-chain", AppStateBytes: genesis}); err != nil {
+		t.Fatalf("Failed to init chain: %v", err)
+	}
+	sender.SetChainID("test-chain")
+
+	// The params can be queried
+	res, err := application.Query(ctx, &abci.QueryRequest{Path: "params"})
+	if err != nil {
+		t.Fatalf("Failed to query params: %v", err)
+	}
+	var queried types.Params
+	if err := json.Unmarshal(res.Value, &queried); err != nil || queried != params {
+		t.Errorf("Params query mismatch: got %+v (%v), want %+v", queried, err, params)
+	}
+
+	encode := func(ops ...types.Operation) []byte {
+		data, err := signedTx(t, sender, ops...).Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize transaction: %v", err)
+		}
+		return data
+	}
+
+	valid := encode(sender.CreateTransferOperation(2, 10))
+	tooManyOps := encode(
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(2, 10))
+	tooLargeAmount := encode(sender.CreateTransferOperation(2, 101))
+	tooManyBytes := make([]byte, 1001)
+
+	checkTx := func(tx []byte) *abci.CheckTxResponse {
+		res, err := application.CheckTx(ctx, &abci.CheckTxRequest{Tx: tx})
+		if err != nil {
+			t.Fatalf("CheckTx failed: %v", err)
+		}
+		return res
+	}
+	processProposal := func(txs ...[]byte) abci.ProcessProposalStatus {
+		res, err := application.ProcessProposal(ctx, &abci.ProcessProposalRequest{Txs: txs})
+		if err != nil {
+			t.Fatalf("ProcessProposal failed: %v", err)
+		}
+		return res.Status
+	}
+
+	if res := checkTx(valid); res.Code != 0 {
+		t.Errorf("Valid transaction rejected: %s", res.Log)
+	}
+	for name, tx := range map[string][]byte{"operations": tooManyOps, "amount": tooLargeAmount, "bytes": tooManyBytes} {
+		if res := checkTx(tx); res.Code != CodeParamsExceeded {
+			t.Errorf("Transaction exceeding max %s got code %d, want %d: %s", name, res.Code, CodeParamsExceeded, res.Log)
+		}
+		if processProposal(valid, tx) != abci.PROCESS_PROPOSAL_STATUS_REJECT {
+			t.Errorf("Proposal with a transaction exceeding max %s was not rejected", name)
+		}
+	}
+
+	if processProposal(valid) != abci.PROCESS_PROPOSAL_STATUS_ACCEPT {
+		t.Error("Valid proposal was rejected")
+	}
+}
+
+func TestPrepareProposalBlockLimits(t *testing.T) {
+	sender := client.NewClient(1)
+	application := NewApplication("", log.NewNopLogger())
+	application.SetBlockLimits(3, 4)
+
+	encode := func(ops ...types.Operation) []byte {
+		data, err := signedTx(t, sender, ops...).Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize transaction: %v", err)
+		}
+		return data
+	}
+
+	single := encode(sender.CreateTransferOperation(2, 10))
+	triple := encode(
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(2, 10))
+	malformed := []byte("not a transaction")
+
+	// The triple no longer fits in the operation limit after two singles, the malformed
+	// transaction is dropped, and the fourth valid transaction exceeds the transaction limit
+	req := &abci.PrepareProposalRequest{
+		Txs:        [][]byte{single, malformed, single, triple, single, single},
+		MaxTxBytes: 1 << 20,
+	}
+	res, err := application.PrepareProposal(context.Background(), req)
+	if err != nil {
+		t.Fatalf("PrepareProposal failed: %v", err)
+	}
+	if len(res.Txs) != 3 {
+		t.Fatalf("Got %d transactions, want 3", len(res.Txs))
+	}
+	for i, tx := range res.Txs {
+		if string(tx) != string(single) {
+			t.Errorf("Transaction %d is not a single transfer", i)
+		}
+	}
+}
+
+func TestCheckTxMetrics(t *testing.T) {
+	sender := client.NewClient(1)
+	application := NewApplication("", log.NewNopLogger())
+	application.txProcessor.RegisterUserKey(1, sender.GetPublicKey())
+
+	// Fund the sender
+	genesis, err := json.Marshal(types.GenesisState{Accounts: []types.Account{{ID: 1, Balance: 100}}})
+	if err != nil {
+		t.Fatalf("Failed to marshal genesis state: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := application.InitChain(ctx, &abci.InitChainRequest{AppStateBytes: genesis}); err != nil {
+		t.Fatalf("Failed to init chain: %v", err)
+	}
+
+	valid, err := signedTx(t, sender, sender.CreateTransferOperation(2, 10)).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize transaction: %v", err)
+	}
+
+	for _, tx := range [][]byte{valid, []byte("not a transaction"), []byte("{}")} {
+		if _, err := application.CheckTx(ctx, &abci.CheckTxRequest{Tx: tx}); err != nil {
+			t.Fatalf("CheckTx failed: %v", err)
+		}
+	}
+
+	checkTxTotal := application.Metrics().CheckTxTotal
+	for _, labels := range [][2]string{{"accepted", "ok"}, {"rejected", "invalid_format"}, {"rejected", "invalid_transaction"}} {
+		if got := testutil.ToFloat64(checkTxTotal.WithLabelValues(labels[0], labels[1])); got != 1 {
+			t.Errorf("CheckTx %s with reason %s counted %v times, want 1", labels[0], labels[1], got)
+		}
+	}
+
+	// Only the valid transaction had a signature to verify, in a single series
+	if got := testutil.CollectAndCount(application.Metrics().SignatureVerifyDuration); got != 1 {
+		t.Errorf("Got %d signature verification series, want 1", got)
+	}
+}
+
+func TestStatePageQuery(t *testing.T) {
+	application := NewApplication("", log.NewNopLogger())
+	genesis, err := json.Marshal(types.GenesisState{Accounts: []types.Account{
+		{ID: 30, Balance: 3}, {ID: 10, Balance: 1}, {ID: 20, Balance: 2},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to marshal genesis state: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := application.InitChain(ctx, &abci.InitChainRequest{ChainId: "test-chain", AppStateBytes: genesis}); err != nil {
+		t.Fatalf("Failed to init chain: %v", err)
+	}
+
+	// Pages follow each other in order of ID until one is not full
+	var ids []int
+	req := StatePageRequest{StartID: 0, Limit: 2}
+	for pages := 0; ; pages++ {
+		data, _ := json.Marshal(req)
+		res, err := application.Query(ctx, &abci.QueryRequest{Path: "state", Data: data})
+		if err != nil || res.Code != 0 {
+			t.Fatalf("State page query failed: %v %s", err, res.Log)
+		}
+		var page StatePage
+		if err := json.Unmarshal(res.Value, &page); err != nil {
+			t.Fatalf("Failed to parse state page: %v", err)
+		}
+		for _, acc := range page.Accounts {
+			ids = append(ids, acc.ID)
+		}
+		if page.NextStartID == nil {
+			if pages != 1 {
+				t.Errorf("Read %d pages, want 2", pages+1)
+			}
+			break
+		}
+		req.StartID = *page.NextStartID
+	}
+	if len(ids) != 3 || ids[0] != 10 || ids[1] != 20 || ids[2] != 30 {
+		t.Errorf("Paged through accounts %v, want [10 20 30]", ids)
+	}
+
+	// The page can be given as parameters of the path instead
+	res, err := application.Query(ctx, &abci.QueryRequest{Path: "state?start=15&limit=1"})
+	if err != nil || res.Code != 0 {
+		t.Fatalf("State page query failed: %v %s", err, res.Log)
+	}
+	var page StatePage
+	if err := json.Unmarshal(res.Value, &page); err != nil {
+		t.Fatalf("Failed to parse state page: %v", err)
+	}
+	if len(page.Accounts) != 1 || page.Accounts[0].ID != 20 || page.NextStartID == nil || *page.NextStartID != 21 {
+		t.Errorf("Got page %+v, want account 20 followed by a page from 21", page)
+	}
+	if res, _ := application.Query(ctx, &abci.QueryRequest{Path: "state?limit=many"}); res.Code != 1 {
+		t.Errorf("Invalid limit returned code %d, want 1", res.Code)
+	}
+
+	// Without a request, the query returns the first page
+	res, err = application.Query(ctx, &abci.QueryRequest{Path: "state"})
+	if err != nil || res.Code != 0 {
+		t.Fatalf("State query failed: %v %s", err, res.Log)
+	}
+	page = StatePage{}
+	if err := json.Unmarshal(res.Value, &page); err != nil || len(page.Accounts) != 3 || page.NextStartID != nil {
+		t.Errorf("State query returned %+v (%v), want the 3 accounts", page, err)
+	}
+}
+
+func TestAggregateSignedBlock(t *testing.T) {
+	alice := client.NewClient(1)
+	bob := client.NewClient(2)
+	application := NewApplication("", log.NewNopLogger())
+	for _, c := range []*client.Client{alice, bob} {
+		if err := c.GenerateBLSKey(); err != nil {
+			t.Fatalf("Failed to generate BLS key: %v", err)
+		}
+		if err := application.RegisterBLSKey(c.GetUserID(), crypto.BLSPublicKeyToBase64(c.GetBLSPublicKey())); err != nil {
+			t.Fatalf("Failed to register BLS key: %v", err)
+		}
+	}
+
+	// Keys are validated and registered once
+	if err := application.RegisterBLSKey(1, crypto.BLSPublicKeyToBase64(alice.GetBLSPublicKey())); err == nil {
+		t.Error("Registering a second BLS key for a user succeeded")
+	}
+	if err := application.RegisterBLSKey(3, "not a key"); err == nil {
+		t.Error("Registering an invalid BLS key succeeded")
+	}
+
+	genesis, err := json.Marshal(types.GenesisState{Accounts: []types.Account{{ID: 1, Balance: 100}, {ID: 2, Balance: 100}}})
+	if err != nil {
+		t.Fatalf("Failed to marshal genesis state: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := application.InitChain(ctx, &abci.InitChainRequest{AppStateBytes: genesis}); err != nil {
+		t.Fatalf("Failed to init chain: %v", err)
+	}
+
+	// Each sender signs its own transfer and the signatures are aggregated
+	operations := []types.Operation{
+		alice.CreateTransferOperation(3, 10),
+		bob.CreateTransferOperation(3, 20),
+	}
+	signatures := make([]string, len(operations))
+	for i, c := range []*client.Client{alice, bob} {
+		if signatures[i], err = c.SignOperationBLS(operations[i]); err != nil {
+			t.Fatalf("Failed to sign operation: %v", err)
+		}
+	}
+	tx, err := client.CreateAggregateTransaction(operations, signatures)
+	if err != nil {
+		t.Fatalf("Failed to create aggregate transaction: %v", err)
+	}
+	data, err := tx.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize transaction: %v", err)
+	}
+
+	res, err := application.FinalizeBlock(ctx, &abci.FinalizeBlockRequest{Height: 1, Txs: [][]byte{data}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if code := res.TxResults[0].Code; code != 0 {
+		t.Fatalf("Aggregate-signed transaction failed with code %d: %s", code, res.TxResults[0].Log)
+	}
+	if balance := application.stateStore.GetAccount(3).Balance; balance != 30 {
+		t.Errorf("Recipient balance mismatch: got %d, want %d", balance, 30)
+	}
+}
+
+func TestStorageMetrics(t *testing.T) {
+	backend, err := storage.GetContextStorage("memory", nil)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	metrics := NewMetrics()
+	store := storage.NewInstrumentedStorage(backend, metrics.StorageObserver("memory"))
+
+	ctx := context.Background()
+	if err := store.Initialize(ctx); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer store.Close()
+	if err := store.CreateAccount(ctx, 1, 100); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	// Each call is observed in the series of its backend and method,
+	// for Initialize and CreateAccount
+	if got := testutil.CollectAndCount(metrics.StorageCallDuration); got != 2 {
+		t.Errorf("Got %d storage call series, want 2", got)
+	}
+}
+
+func TestReadsDoNotCreateAccounts(t *testing.T) {
+	sender := client.NewClient(4)
+	application := NewApplication("", log.NewNopLogger())
+	application.txProcessor.RegisterUserKey(4, sender.GetPublicKey())
+	genesis, err := json.Marshal(types.GenesisState{Accounts: []types.Account{{ID: 1, Balance: 100}}})
+	if err != nil {
+		t.Fatalf("Failed to marshal genesis state: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := application.InitChain(ctx, &abci.InitChainRequest{AppStateBytes: genesis}); err != nil {
+		t.Fatalf("Failed to init chain: %v", err)
+	}
+
+	// Checking a transfer from an empty account to one that does not exist rejects it
+	tx, err := signedTx(t, sender, sender.CreateTransferOperation(5, 10)).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize transaction: %v", err)
+	}
+	res, err := application.CheckTx(ctx, &abci.CheckTxRequest{Tx: tx})
+	if err != nil || res.Code == 0 {
+		t.Errorf("Transfer from an empty account was accepted: %v", err)
+	}
+
+	// Querying an account that does not exist reports it
+	data, _ := json.Marshal(6)
+	query, err := application.Query(ctx, &abci.QueryRequest{Path: "account", Data: data})
+	if err != nil || query.Code != 4 {
+		t.Errorf("Query of a missing account returned code %d (%v), want 4", query.Code, err)
+	}
+
+	// Neither created an account
+	for _, id := range []int{5, 6} {
+		if application.stateStore.HasAccount(id) {
+			t.Errorf("Account %d was created", id)
+		}
+	}
+}
+
+func TestAppHash(t *testing.T) {
+	sender := client.NewClient(1)
+	sender.SetChainID("test-chain")
+	newApp := func(stateFile string, balance uint64) *Application {
+		t.Helper()
+		application := NewApplication(stateFile, log.NewNopLogger())
+		genesis, err := json.Marshal(types.GenesisState{Accounts: []types.Account{{
+			ID:      1,
+			Balance: balance,
+			PubKey:  sender.GetPublicKeyBase64(),
+			KeyType: string(sender.GetKeyType()),
+		}}})
+		if err != nil {
+			t.Fatalf("Failed to marshal genesis state: %v", err)
+		}
+		if _, err := application.InitChain(context.Background(), &abci.InitChainRequest{ChainId: "test-chain", AppStateBytes: genesis}); err != nil {
+			t.Fatalf("Failed to init chain: %v", err)
+		}
+		return application
+	}
+	tx, err := signedTx(t, sender, sender.CreateTransferOperation(2, 30)).Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize transaction: %v", err)
+	}
+	finalize := func(application *Application) []byte {
+		t.Helper()
+		ctx := context.Background()
+		res, err := application.FinalizeBlock(ctx, &abci.FinalizeBlockRequest{Height: 1, Txs: [][]byte{tx}})
+		if err != nil || res.TxResults[0].Code != 0 {
+			t.Fatalf("FinalizeBlock failed: %v %s", err, res.TxResults[0].Log)
+		}
+		if _, err := application.Commit(ctx, &abci.CommitRequest{}); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		if len(res.AppHash) == 0 {
+			t.Fatal("FinalizeBlock returned no app hash")
+		}
+		return res.AppHash
+	}
+
+	// Two nodes executing the same block from the same state agree
+	dir := t.TempDir()
+	first := newApp(filepath.Join(dir, "first.json"), 100)
+	hash := finalize(first)
+	if other := finalize(newApp("", 100)); !bytes.Equal(hash, other) {
+		t.Errorf("Same state hashed to %X and %X", hash, other)
+	}
+
+	// A different balance changes the hash
+	if other := finalize(newApp("", 101)); bytes.Equal(hash, other) {
+		t.Errorf("Different balances hashed to the same %X", hash)
+	}
+
+	// The hash is saved with the state and reported after a restart
+	first.Close()
+	restarted := NewApplication(filepath.Join(dir, "first.json"), log.NewNopLogger())
+	defer restarted.Close()
+	info, err := restarted.Info(context.Background(), &abci.InfoRequest{})
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if info.LastBlockHeight != 1 || !bytes.Equal(info.LastBlockAppHash, hash) {
+		t.Errorf("Info reported height %d and app hash %X, want 1 and %X", info.LastBlockHeight, info.LastBlockAppHash, hash)
+	}
+}
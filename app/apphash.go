@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// AppHashHeader holds the fields of the state other than the accounts that
+// are part of the app hash
+type AppHashHeader struct {
+	TotalSupply    uint64           `json:"total_supply"`
+	SupplyCap      uint64           `json:"supply_cap"`
+	MintAuthority  *types.Authority `json:"mint_authority"`
+	AdminAuthority *types.Authority `json:"admin_authority"`
+	Params         types.Params     `json:"params"`
+}
+
+// ComputeAppHash hashes the header and every account listed by accounts,
+// which are read in ascending order of ID so that any two nodes holding the
+// same state compute the same hash. Each account is hashed as its JSON
+// encoding, prefixed with its length, so that the keys and limits of the
+// accounts are covered as well as their balances.
+func ComputeAppHash(ctx context.Context, accounts storage.AccountLister, header AppHashHeader) ([]byte, error) {
+	h := sha256.New()
+	if err := writeHashRecord(h, header); err != nil {
+		return nil, fmt.Errorf("failed to hash state header: %w", err)
+	}
+
+	it := storage.NewAccountIterator(accounts, storage.MinAccountID, 0)
+	for it.Next(ctx) {
+		if err := writeHashRecord(h, it.Account()); err != nil {
+			return nil, fmt.Errorf("failed to hash account %d: %w", it.Account().ID, err)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list accounts: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// writeHashRecord writes the JSON encoding of v to h, prefixed with its length
+func writeHashRecord(h hash.Hash, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var length [binary.MaxVarintLen64]byte
+	h.Write(length[:binary.PutUvarint(length[:], uint64(len(data)))])
+	h.Write(data)
+	return nil
+}
+
+// stateAccounts lists the accounts of a state for storage.AccountIterator,
+// see StateStore.Accounts
+type stateAccounts struct {
+	state *types.State
+}
+
+// ListAccounts returns a page of accounts ordered by ID
+func (s stateAccounts) ListAccounts(_ context.Context, startID, limit int) ([]*types.Account, error) {
+	return s.state.ListAccounts(startID, limit), nil
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// Invariant checks a property that must always hold over the application state.
+// It returns a descriptive error when the property is violated.
+type Invariant func(input *InvariantInput) error
+
+// InvariantInput holds the data invariants are checked against. At the end
+// of a block, it only holds the accounts the block changed, so the cost of
+// the check does not grow with the number of accounts.
+type InvariantInput struct {
+	Height int64
+	// Accounts holds every account, or the accounts changed by the block
+	// when PreviousBalances is set
+	Accounts []*types.Account
+	// ExpectedSupply is the total supply the accounts must add up to.
+	// Nil disables the supply check.
+	ExpectedSupply *uint64
+	// PreviousBalances holds the balances the changed accounts had before
+	// the block, zero for the accounts it created. Nil when Accounts holds
+	// every account.
+	PreviousBalances map[int]uint64
+	// PreviousSupply is the total supply before the block, set along with
+	// PreviousBalances
+	PreviousSupply uint64
+}
+
+// AccountSource provides the accounts checked by invariants.
+// It is implemented by StateStore and by every storage.Storage backend.
+type AccountSource interface {
+	ListAccounts(startID, limit int) ([]*types.Account, error)
+}
+
+// InvariantViolation describes a broken invariant
+type InvariantViolation struct {
+	Name   string
+	Height int64
+	Err    error
+}
+
+// Error returns a diagnostic message for the violation
+func (v *InvariantViolation) Error() string {
+	return fmt.Sprintf("invariant %q violated at height %d: %v", v.Name, v.Height, v.Err)
+}
+
+// Unwrap returns the underlying error
+func (v *InvariantViolation) Unwrap() error {
+	return v.Err
+}
+
+// InvariantRegistry keeps track of the invariants to check, in registration order
+type InvariantRegistry struct {
+	names      []string
+	invariants map[string]Invariant
+}
+
+// NewInvariantRegistry creates an empty invariant registry
+func NewInvariantRegistry() *InvariantRegistry {
+	return &InvariantRegistry{
+		invariants: make(map[string]Invariant),
+	}
+}
+
+// DefaultInvariantRegistry creates a registry with the built-in invariants
+func DefaultInvariantRegistry() *InvariantRegistry {
+	registry := NewInvariantRegistry()
+	registry.Register("balance-sum", BalanceSumInvariant)
+	registry.Register("total-supply", TotalSupplyInvariant)
+	return registry
+}
+
+// Register registers an invariant, replacing any invariant with the same name
+func (r *InvariantRegistry) Register(name string, invariant Invariant) {
+	if _, exists := r.invariants[name]; !exists {
+		r.names = append(r.names, name)
+	}
+	r.invariants[name] = invariant
+}
+
+// Unregister removes an invariant from the registry
+func (r *InvariantRegistry) Unregister(name string) {
+	if _, exists := r.invariants[name]; !exists {
+		return
+	}
+	delete(r.invariants, name)
+	for i, n := range r.names {
+		if n == name {
+			r.names = append(r.names[:i], r.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Names returns the names of the registered invariants
+func (r *InvariantRegistry) Names() []string {
+	names := make([]string, len(r.names))
+	copy(names, r.names)
+	return names
+}
+
+// Check runs every registered invariant and returns the first violation
+func (r *InvariantRegistry) Check(input *InvariantInput) error {
+	for _, name := range r.names {
+		if err := r.invariants[name](input); err != nil {
+			return &InvariantViolation{
+				Name:   name,
+				Height: input.Height,
+				Err:    err,
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSource loads all accounts from the source and runs every registered invariant.
+// Any storage.Storage backend can be passed to check its data offline.
+func (r *InvariantRegistry) CheckSource(source AccountSource, height int64, expectedSupply *uint64) error {
+	accounts, err := source.ListAccounts(math.MinInt, 0)
+	if err != nil {
+		return fmt.Errorf("failed to load accounts: %w", err)
+	}
+
+	return r.Check(&InvariantInput{
+		Height:         height,
+		Accounts:       accounts,
+		ExpectedSupply: expectedSupply,
+	})
+}
+
+// BalanceSumInvariant checks that the balances add up to an amount that can
+// be represented, which the total supply must be. Given only the accounts
+// changed by a block, it checks their balances, and the total supply
+// invariant keeps the sum of all of them equal to the supply.
+func BalanceSumInvariant(input *InvariantInput) error {
+	_, err := totalBalance(input.Accounts)
+	return err
+}
+
+// TotalSupplyInvariant checks that the sum of all balances equals the expected
+// supply. Given only the accounts changed by a block, it checks that their
+// balances changed by as much as the supply did, which keeps the sum of all
+// balances equal to the supply if it was before the block.
+func TotalSupplyInvariant(input *InvariantInput) error {
+	if input.ExpectedSupply == nil {
+		return nil
+	}
+	if input.PreviousBalances != nil {
+		return supplyChangeInvariant(input)
+	}
+
+	total, err := totalBalance(input.Accounts)
+	if err != nil {
+		return err
+	}
+	if expected := *input.ExpectedSupply; total != expected {
+		difference := fmt.Sprintf("+%d", total-expected)
+		if total < expected {
+			difference = fmt.Sprintf("-%d", expected-total)
+		}
+		return fmt.Errorf("total supply is %d, expected %d (difference %s)", total, expected, difference)
+	}
+	return nil
+}
+
+// supplyChangeInvariant checks that the balances of the changed accounts
+// changed by as much as the supply
+func supplyChangeInvariant(input *InvariantInput) error {
+	balanceChange := new(big.Int)
+	for _, acc := range input.Accounts {
+		balanceChange.Add(balanceChange, new(big.Int).SetUint64(acc.Balance))
+	}
+	for _, balance := range input.PreviousBalances {
+		balanceChange.Sub(balanceChange, new(big.Int).SetUint64(balance))
+	}
+	supplyChange := new(big.Int).SetUint64(*input.ExpectedSupply)
+	supplyChange.Sub(supplyChange, new(big.Int).SetUint64(input.PreviousSupply))
+
+	if balanceChange.Cmp(supplyChange) != 0 {
+		return fmt.Errorf("balances of %d changed accounts changed by %s, but the total supply by %s (from %d to %d)",
+			len(input.Accounts), signed(balanceChange), signed(supplyChange), input.PreviousSupply, *input.ExpectedSupply)
+	}
+	return nil
+}
+
+// signed formats a change with its sign
+func signed(change *big.Int) string {
+	if change.Sign() < 0 {
+		return change.String()
+	}
+	return "+" + change.String()
+}
+
+// totalBalance sums the balances of the given accounts
+func totalBalance(accounts []*types.Account) (uint64, error) {
+	var total uint64
+	for _, acc := range accounts {
+		sum, err := types.AddAmounts(total, acc.Balance)
+		if err != nil {
+			return 0, fmt.Errorf("sum of balances up to account %d: %w", acc.ID, err)
+		}
+		total = sum
+	}
+	return total, nil
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+func TestInvariantRegistry(t *testing.T) {
+	registry := DefaultInvariantRegistry()
+	supply := uint64(1000)
+
+	// Valid state
+	input := &InvariantInput{
+		Height: 1,
+		Accounts: []*types.Account{
+			{ID: 1, Balance: 700},
+			{ID: 2, Balance: 300},
+		},
+		ExpectedSupply: &supply,
+	}
+	if err := registry.Check(input); err != nil {
+		t.Errorf("Valid state failed invariant check: %v", err)
+	}
+
+	// Supply mismatch
+	supply = 900
+	var violation *InvariantViolation
+	if err := registry.Check(input); !errors.As(err, &violation) || violation.Name != "total-supply" {
+		t.Errorf("Expected total-supply violation, got %v", err)
+	}
+
+	// Supply check disabled
+	input.ExpectedSupply = nil
+	if err := registry.Check(input); err != nil {
+		t.Errorf("Disabled supply check reported a violation: %v", err)
+	}
+
+	// Balances too large to add up
+	input.Accounts = append(input.Accounts, &types.Account{ID: 3, Balance: math.MaxUint64})
+	if err := registry.Check(input); !errors.As(err, &violation) || violation.Name != "balance-sum" || !errors.Is(err, types.ErrBalanceOverflow) {
+		t.Errorf("Expected balance-sum violation, got %v", err)
+	}
+
+	// Unregistered invariants are not checked
+	registry.Unregister("balance-sum")
+	if err := registry.Check(input); err != nil {
+		t.Errorf("Unregistered invariant was checked: %v", err)
+	}
+}
+
+func TestBlockInvariants(t *testing.T) {
+	store := NewStateStore("")
+	for id := 1; id <= 3; id++ {
+		if err := store.Mint(id, 100); err != nil {
+			t.Fatalf("Failed to mint: %v", err)
+		}
+	}
+	registry := DefaultInvariantRegistry()
+
+	// Only the accounts changed by the block are checked, against the
+	// balances they had before it
+	store.BeginBlock()
+	if err := store.Debit(1, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Credit(4, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Mint(2, 50); err != nil {
+		t.Fatal(err)
+	}
+	input := store.EndBlock(1)
+	if got := len(input.Accounts); got != 3 {
+		t.Errorf("Checked %d accounts, want the 3 changed", got)
+	}
+	if input.PreviousBalances[1] != 100 || input.PreviousBalances[4] != 0 || input.PreviousSupply != 300 {
+		t.Errorf("Got previous balances %v and supply %d", input.PreviousBalances, input.PreviousSupply)
+	}
+	if err := registry.Check(input); err != nil {
+		t.Errorf("Valid block failed invariant check: %v", err)
+	}
+
+	// Funds created outside of a mint break the supply
+	store.BeginBlock()
+	if err := store.Credit(3, 5); err != nil {
+		t.Fatal(err)
+	}
+	var violation *InvariantViolation
+	if err := registry.Check(store.EndBlock(2)); !errors.As(err, &violation) || violation.Name != "total-supply" {
+		t.Errorf("Expected total-supply violation, got %v", err)
+	}
+
+	// A block that may have changed any account checks all of them
+	store.BeginBlock()
+	store.UpdateState(func(*types.State) error { return nil })
+	if input := store.EndBlock(3); input.PreviousBalances != nil || len(input.Accounts) != 4 {
+		t.Errorf("Got %d accounts and previous balances %v, want every account", len(input.Accounts), input.PreviousBalances)
+	}
+}
+
+func TestInvariantsAgainstStorage(t *testing.T) {
+	store, err := storage.GetStorage("memory", nil)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	if err := store.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.CreateAccount(1, 1000); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+	if err := store.CreateAccount(2, 500); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	registry := DefaultInvariantRegistry()
+	supply := uint64(1500)
+	if err := registry.CheckSource(store, 0, &supply); err != nil {
+		t.Errorf("Valid storage failed invariant check: %v", err)
+	}
+	supply = 1200
+	if err := registry.CheckSource(store, 0, &supply); err == nil {
+		t.Error("Storage with wrong supply passed invariant check")
+	}
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// CodeRateLimited is the result code for transactions rejected by account limits
+const CodeRateLimited uint32 = 4
+
+// ErrRateLimited is returned when an operation exceeds the sender's limits
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// pendingUsage accumulates the usage of operations validated together in one transaction
+type pendingUsage map[int]*types.UsageEntry
+
+// checkLimits checks an operation against the limits of its sender.
+// When pending is not nil, the operation's usage is added to it.
+func (tp *TransactionProcessor) checkLimits(op *types.Operation, pending pendingUsage) error {
+	account := tp.stateStore.GetAccount(op.From)
+	if account.Limits == nil {
+		return nil
+	}
+
+	// Usage already recorded in state plus usage of earlier operations in the transaction
+	height := tp.currentHeight()
+	amount, ops := account.WindowUsage(height)
+	if usage, exists := pending[op.From]; exists {
+		amount = types.SaturatingAdd(amount, usage.Amount)
+		ops += usage.Ops
+	}
+
+	if max := account.Limits.MaxOpsPerBlock; max > 0 && ops+1 > max {
+		return fmt.Errorf("%w: account %d already sent %d operations at height %d (max %d)",
+			ErrRateLimited, op.From, ops, height, max)
+	}
+	if max := account.Limits.MaxAmountPerWindow; max > 0 && types.SaturatingAdd(amount, op.Amount) > max {
+		return fmt.Errorf("%w: account %d would send %d within %d blocks (max %d)",
+			ErrRateLimited, op.From, types.SaturatingAdd(amount, op.Amount), account.Limits.WindowBlocks, max)
+	}
+
+	if pending != nil {
+		usage, exists := pending[op.From]
+		if !exists {
+			usage = &types.UsageEntry{Height: height}
+			pending[op.From] = usage
+		}
+		usage.Amount = types.SaturatingAdd(usage.Amount, op.Amount)
+		usage.Ops++
+	}
+
+	return nil
+}
+
+// setLimitsSignerKey returns the key that must have signed a set_limits operation.
+// The admin authority may configure any account; owners may only configure their
+// own account, and only if the admin authority has not set its limits.
+func (tp *TransactionProcessor) setLimitsSignerKey(op *types.Operation) (crypto.PubKey, error) {
+	if admin := tp.stateStore.GetAdminAuthority(); admin != nil && op.From == admin.AccountID {
+		pubKey, err := admin.Key()
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin authority key: %w", err)
+		}
+		return pubKey, nil
+	}
+
+	if op.From != op.To {
+		return nil, fmt.Errorf("user %d may not set the limits of account %d", op.From, op.To)
+	}
+	if tp.stateStore.GetAccount(op.To).LimitsByAdmin {
+		return nil, fmt.Errorf("limits of account %d were set by the admin authority", op.To)
+	}
+
+	// Get the owner's public key
+	pubKey, exists := tp.GetUserKey(op.From)
+	if !exists {
+		return nil, fmt.Errorf("no public key registered for user %d", op.From)
+	}
+	return pubKey, nil
+}
+
+// isAdmin reports whether an account is the admin authority
+func (tp *TransactionProcessor) isAdmin(id int) bool {
+	admin := tp.stateStore.GetAdminAuthority()
+	return admin != nil && admin.AccountID == id
+}
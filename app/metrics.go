@@ -0,0 +1,142 @@
+package app
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsNamespace prefixes the names of all application metrics
+const MetricsNamespace = "batched_tx"
+
+// Metrics holds the Prometheus metrics of the application. They are always
+// recorded, and exported once registered with a registry.
+type Metrics struct {
+	// CheckTxTotal counts CheckTx calls by result and rejection reason
+	CheckTxTotal *prometheus.CounterVec
+
+	// OpsPerTx is the number of operations in each executed transaction
+	OpsPerTx prometheus.Histogram
+
+	// FinalizeBlockDuration is the time spent executing a block
+	FinalizeBlockDuration prometheus.Histogram
+
+	// CommitDuration is the time spent committing a block
+	CommitDuration prometheus.Histogram
+
+	// SignatureVerifyDuration is the time spent verifying a signature, by scheme
+	SignatureVerifyDuration *prometheus.HistogramVec
+
+	// StateSaveDuration is the time spent saving the state to disk
+	StateSaveDuration prometheus.Histogram
+
+	// StorageCallDuration is the latency of storage backend calls, by backend and method
+	StorageCallDuration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the application metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		CheckTxTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_tx_total",
+			Help:      "Number of CheckTx calls by result (accepted or rejected) and rejection reason.",
+		}, []string{"result", "reason"}),
+		OpsPerTx: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "ops_per_tx",
+			Help:      "Number of operations in each executed transaction.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+		}),
+		FinalizeBlockDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "finalize_block_duration_seconds",
+			Help:      "Time spent executing a block in FinalizeBlock.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		CommitDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "commit_duration_seconds",
+			Help:      "Time spent in Commit.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		SignatureVerifyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "signature_verify_duration_seconds",
+			Help:      "Time spent verifying a signature, by scheme (operation, batch or aggregate).",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 2, 14),
+		}, []string{"scheme"}),
+		StateSaveDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "state_save_duration_seconds",
+			Help:      "Time spent saving the state to disk.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		StorageCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "storage_call_duration_seconds",
+			Help:      "Latency of storage backend calls, by backend and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.000005, 2, 16),
+		}, []string{"backend", "method"}),
+	}
+}
+
+// Register registers the metrics with a Prometheus registry
+func (m *Metrics) Register(registry prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		m.CheckTxTotal,
+		m.OpsPerTx,
+		m.FinalizeBlockDuration,
+		m.CommitDuration,
+		m.SignatureVerifyDuration,
+		m.StateSaveDuration,
+		m.StorageCallDuration,
+	}
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StorageObserver returns a function recording the latency of calls to a
+// storage backend, for use with storage.NewInstrumentedStorage
+func (m *Metrics) StorageObserver(backend string) func(method string, duration time.Duration) {
+	return func(method string, duration time.Duration) {
+		m.StorageCallDuration.WithLabelValues(backend, method).Observe(duration.Seconds())
+	}
+}
+
+// resultReason returns the metric label for a result code
+func resultReason(code uint32) string {
+	switch code {
+	case 0:
+		return "ok"
+	case 1:
+		return "invalid_format"
+	case CodeRateLimited:
+		return "rate_limited"
+	case CodeInvalidNonce:
+		return "invalid_nonce"
+	case CodeExpired:
+		return "expired"
+	case CodeParamsExceeded:
+		return "params_exceeded"
+	}
+	return "invalid_transaction"
+}
+
+// observeCheckTx records the result of a CheckTx call
+func (m *Metrics) observeCheckTx(code uint32) {
+	result := "accepted"
+	if code != 0 {
+		result = "rejected"
+	}
+	m.CheckTxTotal.WithLabelValues(result, resultReason(code)).Inc()
+}
+
+// observeSince records the time elapsed since start in a histogram
+func observeSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
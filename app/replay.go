@@ -0,0 +1,48 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// Result codes for operations rejected by replay protection
+const (
+	CodeInvalidNonce uint32 = 5
+	CodeExpired      uint32 = 6
+)
+
+var (
+	// ErrInvalidNonce is returned when an operation reuses a nonce of its sender
+	ErrInvalidNonce = errors.New("invalid nonce")
+	// ErrExpired is returned when an operation is past its expiry height
+	ErrExpired = errors.New("operation expired")
+)
+
+// pendingNonces holds the last nonce of each sender among the operations validated together in one transaction
+type pendingNonces map[int]uint64
+
+// checkReplay checks that an operation has not expired and that its nonce is greater
+// than the last one used by its sender. When pending is not nil, the nonce is added to it.
+func (tp *TransactionProcessor) checkReplay(op *types.Operation, pending pendingNonces) error {
+	if op.Expiry > 0 {
+		if height := tp.currentHeight(); height > op.Expiry {
+			return fmt.Errorf("%w: valid until height %d, current height is %d", ErrExpired, op.Expiry, height)
+		}
+	}
+
+	// Nonces must increase across transactions and within a transaction
+	last := tp.stateStore.GetAccount(op.From).Nonce
+	if nonce, exists := pending[op.From]; exists {
+		last = nonce
+	}
+	if op.Nonce <= last {
+		return fmt.Errorf("%w: %d for account %d, must be greater than %d", ErrInvalidNonce, op.Nonce, op.From, last)
+	}
+
+	if pending != nil {
+		pending[op.From] = op.Nonce
+	}
+	return nil
+}
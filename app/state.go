@@ -1,30 +1,143 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
+// Ways of persisting the state
+const (
+	// PersistenceIncremental appends the accounts changed since the last save
+	// to a log, and compacts the log into the state file once it outgrows it
+	PersistenceIncremental = "incremental"
+	// PersistenceFull rewrites the whole state file on every save
+	PersistenceFull = "full"
+)
+
+// minCompactionSize is the state log size below which the log is not compacted
+const minCompactionSize = 1 << 20
+
 // StateStore manages the application state
 type StateStore struct {
 	state      *types.State
 	stateMutex sync.RWMutex
 	stateFile  string
+
+	persistence  string
+	dirty        map[int]struct{} // Accounts changed since the last save
+	allDirty     bool             // Set when any account may have changed, forcing a snapshot
+	log          *stateLog        // Opened on the first incremental save
+	logSize      int64            // Size of the complete records found in the log when loading
+	snapshotSize int64            // Size of the last snapshot written or loaded
+
+	block *blockChanges // Changes of the block being executed, nil outside of a block
+}
+
+// blockChanges records what the block being executed changed, to check the
+// invariants against the changed accounts only
+type blockChanges struct {
+	balances map[int]uint64 // Balance of each changed account before the block
+	supply   uint64         // Total supply before the block
+	all      bool           // Set when the block may have changed any account
 }
 
 // NewStateStore creates a new state store
 func NewStateStore(stateFile string) *StateStore {
 	return &StateStore{
-		state:     types.NewState(),
-		stateFile: stateFile,
+		state:       types.NewState(),
+		stateFile:   stateFile,
+		persistence: PersistenceIncremental,
+		dirty:       make(map[int]struct{}),
+	}
+}
+
+// SetPersistence sets how the state is saved, PersistenceIncremental or PersistenceFull
+func (s *StateStore) SetPersistence(persistence string) error {
+	if persistence != PersistenceIncremental && persistence != PersistenceFull {
+		return fmt.Errorf("unknown state persistence %q", persistence)
+	}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.persistence = persistence
+	return nil
+}
+
+// logFile returns the path of the state log
+func (s *StateStore) logFile() string {
+	return s.stateFile + ".log"
+}
+
+// markDirty records that an account changed since the last save, and
+// its balance before the block when it is the first change of the block
+func (s *StateStore) markDirty(id int) {
+	s.dirty[id] = struct{}{}
+	if s.block != nil {
+		if _, exists := s.block.balances[id]; !exists {
+			s.block.balances[id] = s.state.GetBalance(id)
+		}
 	}
 }
 
+// BeginBlock starts recording the accounts changed by a block
+func (s *StateStore) BeginBlock() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	supply, _ := s.state.GetSupply()
+	s.block = &blockChanges{
+		balances: make(map[int]uint64),
+		supply:   supply,
+	}
+}
+
+// EndBlock stops recording the changes of the block and returns the input
+// the invariants are checked against at its height: the changed accounts
+// with their balances before the block, or every account when the block may
+// have changed any of them or none was begun
+func (s *StateStore) EndBlock(height int64) *InvariantInput {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	block := s.block
+	s.block = nil
+	supply, _ := s.state.GetSupply()
+	input := &InvariantInput{
+		Height:         height,
+		ExpectedSupply: &supply,
+	}
+	if block == nil || block.all {
+		input.Accounts = s.state.GetAllAccounts()
+		return input
+	}
+
+	ids := make([]int, 0, len(block.balances))
+	for id := range block.balances {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	changes := s.state.Changes(ids)
+	for _, id := range ids {
+		if acc, exists := changes.Accounts[id]; exists {
+			input.Accounts = append(input.Accounts, acc)
+		}
+	}
+	input.PreviousBalances = block.balances
+	input.PreviousSupply = block.supply
+	return input
+}
+
 // GetState returns the current state
 func (s *StateStore) GetState() *types.State {
 	s.stateMutex.RLock()
@@ -37,6 +150,11 @@ func (s *StateStore) UpdateState(updateFn func(*types.State) error) error {
 	s.stateMutex.Lock()
 	defer s.stateMutex.Unlock()
 
+	// The function may change any account
+	s.allDirty = true
+	if s.block != nil {
+		s.block.all = true
+	}
 	if err := updateFn(s.state); err != nil {
 		return err
 	}
@@ -44,85 +162,454 @@ func (s *StateStore) UpdateState(updateFn func(*types.State) error) error {
 	return nil
 }
 
-// SaveState saves the state to disk
+// SaveState saves the state to disk. With incremental persistence, only the
+// accounts changed since the last save are appended to the state log, unless
+// the log has grown larger than the state file and is compacted into it.
 func (s *StateStore) SaveState() error {
-	s.stateMutex.RLock()
-	defer s.stateMutex.RUnlock()
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
 
 	if s.stateFile == "" {
 		return nil // No state file configured, skip saving
 	}
 
-	// Create directory if it doesn't exist
-	dir := filepath.Dir(s.stateFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create state directory: %w", err)
+	if s.persistence == PersistenceFull || s.allDirty {
+		return s.writeSnapshot()
+	}
+
+	// Open the log on the first save, dropping any torn record
+	if s.log == nil {
+		log, err := openStateLog(s.logFile(), s.logSize)
+		if err != nil {
+			return err
+		}
+		s.log = log
+	}
+
+	// Append the changed accounts
+	ids := make([]int, 0, len(s.dirty))
+	for id := range s.dirty {
+		ids = append(ids, id)
+	}
+	payload, err := json.Marshal(s.state.Changes(ids))
+	if err != nil {
+		return fmt.Errorf("failed to serialize state changes: %w", err)
+	}
+	if err := s.log.append(payload); err != nil {
+		return err
+	}
+	s.dirty = make(map[int]struct{})
+
+	// Compact the log once replaying it would cost more than reading a snapshot
+	if s.log.size > max(minCompactionSize, s.snapshotSize) {
+		return s.writeSnapshot()
 	}
+	return nil
+}
 
+// writeSnapshot writes the whole state to the state file and empties the state log
+func (s *StateStore) writeSnapshot() error {
 	// Serialize state
 	data, err := s.state.Serialize()
 	if err != nil {
 		return fmt.Errorf("failed to serialize state: %w", err)
 	}
 
-	// Write to temporary file first
-	tempFile := s.stateFile + ".tmp"
-	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write state to temp file: %w", err)
+	if err := writeFileAtomic(s.stateFile, data); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
 	}
+	s.snapshotSize = int64(len(data))
+	s.dirty = make(map[int]struct{})
+	s.allDirty = false
 
-	// Rename to actual file (atomic operation)
-	if err := os.Rename(tempFile, s.stateFile); err != nil {
-		return fmt.Errorf("failed to rename temp state file: %w", err)
+	// The log only holds changes older than the snapshot now. Were the process
+	// to crash before it is emptied, loading skips them by height.
+	if s.log != nil {
+		return s.log.reset()
+	}
+	s.logSize = 0
+	if err := os.Remove(s.logFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state log: %w", err)
 	}
-
 	return nil
 }
 
-// LoadState loads the state from disk
+// LoadState loads the state from disk: the state file, then the changes in
+// the state log. A state saved by an older version is migrated, after the old
+// files are backed up, and saved as a new snapshot.
 func (s *StateStore) LoadState() error {
+	_, err := s.loadState()
+	return err
+}
+
+// loadState loads the state from disk and returns the migrations applied to it
+func (s *StateStore) loadState() ([]types.StateMigration, error) {
 	s.stateMutex.Lock()
 	defer s.stateMutex.Unlock()
 
 	if s.stateFile == "" {
-		return nil // No state file configured, skip loading
+		return nil, nil // No state file configured, skip loading
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(s.stateFile); os.IsNotExist(err) {
-		// File doesn't exist, use default state
-		s.state = types.NewState()
-		return nil
+	loaded, err := readStateFiles(s.stateFile)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read file
-	data, err := ioutil.ReadFile(s.stateFile)
-	if err != nil {
-		return fmt.Errorf("failed to read state file: %w", err)
+	s.state = loaded.state
+	s.logSize = loaded.logSize
+	s.snapshotSize = loaded.snapshotSize
+	s.dirty = make(map[int]struct{})
+	s.allDirty = false
+
+	// Persist the migrated state, keeping the old files
+	if len(loaded.migrations) > 0 {
+		if err := backupStateFiles(s.stateFile, loaded.version); err != nil {
+			return nil, err
+		}
+		if err := s.writeSnapshot(); err != nil {
+			return nil, fmt.Errorf("failed to save migrated state: %w", err)
+		}
+	}
+	return loaded.migrations, nil
+}
+
+// loadedState is the state read from a state file and its log
+type loadedState struct {
+	state        *types.State
+	version      int                    // Version the state was saved with
+	migrations   []types.StateMigration // Migrations applied while reading
+	logSize      int64
+	snapshotSize int64
+}
+
+// readStateFiles reads the state file and replays its log, migrating both in memory
+func readStateFiles(stateFile string) (*loadedState, error) {
+	loaded := &loadedState{state: types.NewState(), version: types.StateVersion}
+
+	// Check if file exists
+	if _, err := os.Stat(stateFile); err == nil {
+		// Read file
+		data, err := ioutil.ReadFile(stateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state file: %w", err)
+		}
+		loaded.snapshotSize = int64(len(data))
+
+		// Upgrade states saved by older versions
+		if loaded.version, err = types.StateVersionOf(data); err != nil {
+			return nil, err
+		}
+		if data, loaded.migrations, err = types.MigrateState(data); err != nil {
+			return nil, fmt.Errorf("failed to migrate state: %w", err)
+		}
+
+		// Parse state
+		loaded.state, err = types.LoadState(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse state: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
 	}
 
-	// Parse state
-	state, err := types.LoadState(data)
+	// Replay the changes saved after the snapshot. Records have the layout of
+	// the state, so they are migrated the same way.
+	snapshotHeight := loaded.state.GetHeight()
+	logSize, err := readStateLog(stateFile+".log", func(payload []byte) error {
+		payload, migrations, err := types.MigrateState(payload)
+		if err != nil {
+			return fmt.Errorf("failed to migrate state log record: %w", err)
+		}
+		if len(loaded.migrations) == 0 {
+			loaded.migrations = migrations
+		}
+
+		var changes types.State
+		if err := json.Unmarshal(payload, &changes); err != nil {
+			return fmt.Errorf("failed to parse state log record: %w", err)
+		}
+		if changes.Height > snapshotHeight {
+			loaded.state.ApplyChanges(&changes)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to parse state: %w", err)
+		return nil, err
 	}
 
-	s.state = state
+	loaded.logSize = logSize
+	return loaded, nil
+}
+
+// backupStateFiles copies the state file and its log next to them, with the
+// version they were saved with and the time in their names
+func backupStateFiles(stateFile string, version int) error {
+	suffix := fmt.Sprintf(".v%d-%s.bak", version, time.Now().UTC().Format("20060102T150405"))
+	for _, path := range []string{stateFile, stateFile + ".log"} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s for backup: %w", path, err)
+		}
+		if err := writeFileAtomic(path+suffix, data); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+	}
 	return nil
 }
 
-// GetAccount gets an account by ID
+// MigrateStateFile upgrades a state file and its log to types.StateVersion,
+// backing them up first, and returns the migrations applied. With dryRun,
+// the migrations only run in memory and nothing is written.
+func MigrateStateFile(stateFile string, dryRun bool) ([]types.StateMigration, error) {
+	if dryRun {
+		loaded, err := readStateFiles(stateFile)
+		if err != nil {
+			return nil, err
+		}
+		return loaded.migrations, nil
+	}
+
+	store := NewStateStore(stateFile)
+	defer store.Close()
+	return store.loadState()
+}
+
+// Close closes the state log
+func (s *StateStore) Close() error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.close()
+	s.log = nil
+	return err
+}
+
+// GetAccount returns a copy of an account. A missing account is returned
+// empty, with only its ID set, and is not created: accounts are only created
+// by the operations that change them.
 func (s *StateStore) GetAccount(id int) *types.Account {
 	s.stateMutex.RLock()
 	defer s.stateMutex.RUnlock()
-	return s.state.GetAccount(id)
+	acc, _ := s.state.PeekAccount(id)
+	return acc
+}
+
+// HasAccount reports whether an account exists
+func (s *StateStore) HasAccount(id int) bool {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	_, exists := s.state.PeekAccount(id)
+	return exists
+}
+
+// GetAllAccounts returns a copy of every account, ordered by ID
+func (s *StateStore) GetAllAccounts() ([]*types.Account, error) {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetAllAccounts(), nil
 }
 
-// UpdateBalance updates an account's balance
-func (s *StateStore) UpdateBalance(id int, delta int) error {
+// ListAccounts returns a copy of up to limit accounts ordered by ID, from
+// startID on, see types.State.ListAccounts
+func (s *StateStore) ListAccounts(startID, limit int) ([]*types.Account, error) {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.ListAccounts(startID, limit), nil
+}
+
+// Accounts returns the accounts of the state as a storage.AccountLister, to
+// go through them one page at a time with storage.NewAccountIterator
+func (s *StateStore) Accounts() storage.AccountLister {
+	return stateAccounts{s.GetState()}
+}
+
+// Credit adds an amount to an account's balance
+func (s *StateStore) Credit(id int, amount uint64) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	return s.state.Credit(id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (s *StateStore) Debit(id int, amount uint64) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	return s.state.Debit(id, amount)
+}
+
+// Mint creates new tokens in an account
+func (s *StateStore) Mint(id int, amount uint64) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	return s.state.Mint(id, amount)
+}
+
+// Burn destroys tokens from an account
+func (s *StateStore) Burn(id int, amount uint64) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	return s.state.Burn(id, amount)
+}
+
+// StateSnapshot holds accounts and the total supply as they were before a
+// transaction, to undo its changes
+type StateSnapshot struct {
+	accounts    map[int]*types.Account // Copies of the accounts, nil for the ones that did not exist
+	totalSupply uint64
+}
+
+// Snapshot copies the given accounts and the total supply
+func (s *StateStore) Snapshot(ids []int) *StateSnapshot {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	accounts, totalSupply := s.state.SnapshotAccounts(ids)
+	return &StateSnapshot{accounts: accounts, totalSupply: totalSupply}
+}
+
+// Restore puts back the accounts and total supply of a snapshot
+func (s *StateStore) Restore(snapshot *StateSnapshot) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	for id := range snapshot.accounts {
+		s.markDirty(id)
+	}
+	s.state.RestoreAccounts(snapshot.accounts, snapshot.totalSupply)
+}
+
+// GetSupply returns the tracked total supply and the supply cap
+func (s *StateStore) GetSupply() (uint64, uint64) {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetSupply()
+}
+
+// GetMintAuthority returns the mint authority, or nil if minting is disabled
+func (s *StateStore) GetMintAuthority() *types.Authority {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetMintAuthority()
+}
+
+// GetAdminAuthority returns the admin authority, or nil if none is configured
+func (s *StateStore) GetAdminAuthority() *types.Authority {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetAdminAuthority()
+}
+
+// SetLimits sets or clears the limits of an account
+func (s *StateStore) SetLimits(id int, limits *types.AccountLimits, byAdmin bool) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	s.state.SetLimits(id, limits, byAdmin)
+}
+
+// RecordUsage records an amount sent by an account at the given height
+func (s *StateStore) RecordUsage(id int, height int64, amount uint64) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	s.state.RecordUsage(id, height, amount)
+}
+
+// GetHeight returns the height of the last finalized block
+func (s *StateStore) GetHeight() int64 {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetHeight()
+}
+
+// SetHeight sets the height of the last finalized block
+func (s *StateStore) SetHeight(height int64) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.state.SetHeight(height)
+}
+
+// ComputeAppHash hashes the current state, see ComputeAppHash
+func (s *StateStore) ComputeAppHash(ctx context.Context) ([]byte, error) {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+
+	totalSupply, supplyCap := s.state.GetSupply()
+	return ComputeAppHash(ctx, stateAccounts{s.state}, AppHashHeader{
+		TotalSupply:    totalSupply,
+		SupplyCap:      supplyCap,
+		MintAuthority:  s.state.GetMintAuthority(),
+		AdminAuthority: s.state.GetAdminAuthority(),
+		Params:         s.state.GetParams(),
+	})
+}
+
+// GetAppHash returns the hash of the state after the last finalized block
+func (s *StateStore) GetAppHash() []byte {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetAppHash()
+}
+
+// SetAppHash sets the hash of the state after the last finalized block
+func (s *StateStore) SetAppHash(appHash []byte) {
 	s.stateMutex.Lock()
 	defer s.stateMutex.Unlock()
-	return s.state.UpdateBalance(id, delta)
+	s.state.SetAppHash(appHash)
+}
+
+// GetChainID returns the chain ID signed messages are bound to
+func (s *StateStore) GetChainID() string {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetChainID()
+}
+
+// SetChainID sets the chain ID signed messages are bound to
+func (s *StateStore) SetChainID(chainID string) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.state.SetChainID(chainID)
+}
+
+// SetNonce records the last nonce used by an account
+func (s *StateStore) SetNonce(id int, nonce uint64) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	s.state.SetNonce(id, nonce)
+}
+
+// SetPubKey sets the public key of an account's owner
+func (s *StateStore) SetPubKey(id int, keyType crypto.KeyType, pubKey string) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	s.state.SetPubKey(id, keyType, pubKey)
+}
+
+// SetBLSPubKey sets the BLS public key of an account's owner
+func (s *StateStore) SetBLSPubKey(id int, pubKey string) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.markDirty(id)
+	s.state.SetBLSPubKey(id, pubKey)
+}
+
+// GetParams returns the consensus params
+func (s *StateStore) GetParams() types.Params {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+	return s.state.GetParams()
 }
 
 // String returns a string representation of the state
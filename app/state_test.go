@@ -0,0 +1,207 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// newFundedStore creates a store with a snapshot of the given number of funded accounts
+func newFundedStore(tb testing.TB, stateFile string, accounts int) *StateStore {
+	tb.Helper()
+
+	store := NewStateStore(stateFile)
+	if err := store.LoadState(); err != nil {
+		tb.Fatalf("Failed to load state: %v", err)
+	}
+	store.UpdateState(func(state *types.State) error {
+		state.ChainID = "test-chain"
+		return nil
+	})
+	for id := 1; id <= accounts; id++ {
+		if err := store.Mint(id, 1000); err != nil {
+			tb.Fatalf("Failed to mint: %v", err)
+		}
+	}
+	if err := store.SaveState(); err != nil {
+		tb.Fatalf("Failed to save state: %v", err)
+	}
+	return store
+}
+
+// transferBlock moves funds between the given number of accounts and saves the state
+func transferBlock(tb testing.TB, store *StateStore, height int64, accounts int, changed int) {
+	tb.Helper()
+
+	for i := 0; i < changed; i += 2 {
+		from := (int(height)*changed+i)%accounts + 1
+		to := (from % accounts) + 1
+		store.Debit(from, 1)
+		store.Credit(to, 1)
+		store.SetNonce(from, uint64(height))
+	}
+	store.SetHeight(height)
+	if err := store.SaveState(); err != nil {
+		tb.Fatalf("Failed to save state at height %d: %v", height, err)
+	}
+}
+
+func TestIncrementalPersistence(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	store := newFundedStore(t, stateFile, 100)
+	snapshot, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks only append to the log
+	for height := int64(1); height <= 5; height++ {
+		transferBlock(t, store, height, 100, 10)
+	}
+	if data, _ := os.ReadFile(stateFile); string(data) != string(snapshot) {
+		t.Error("State file was rewritten by an incremental save")
+	}
+
+	// A torn record at the end of the log, as left by a crash, is dropped
+	logFile, err := os.OpenFile(store.logFile(), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	logFile.Close()
+
+	reloaded := NewStateStore(stateFile)
+	if err := reloaded.LoadState(); err != nil {
+		t.Fatalf("Failed to reload state: %v", err)
+	}
+	want, _ := store.GetAllAccounts()
+	got, _ := reloaded.GetAllAccounts()
+	if !reflect.DeepEqual(got, want) || reloaded.GetHeight() != 5 || reloaded.GetChainID() != "test-chain" {
+		t.Fatalf("Reloaded state differs: height %d, chain %q", reloaded.GetHeight(), reloaded.GetChainID())
+	}
+
+	// Saving after the reload continues the log past the torn record
+	transferBlock(t, reloaded, 6, 100, 10)
+	reloaded.Close()
+	again := NewStateStore(stateFile)
+	if err := again.LoadState(); err != nil || again.GetHeight() != 6 {
+		t.Fatalf("Failed to reload state after the torn record: height %d, %v", again.GetHeight(), err)
+	}
+}
+
+func TestStateLogCompaction(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	store := newFundedStore(t, stateFile, 10000)
+	defer store.Close()
+
+	// Every block changes 2000 accounts, so the log outgrows the minimum compaction size
+	var height int64
+	for height = 1; store.log == nil || store.log.size > 0; height++ {
+		if height > 100 {
+			t.Fatal("State log was never compacted")
+		}
+		transferBlock(t, store, height, 10000, 2000)
+	}
+
+	reloaded := NewStateStore(stateFile)
+	if err := reloaded.LoadState(); err != nil {
+		t.Fatalf("Failed to reload state: %v", err)
+	}
+	if reloaded.logSize != 0 || reloaded.GetHeight() != height-1 {
+		t.Errorf("Compacted state not in the snapshot: log size %d, height %d", reloaded.logSize, reloaded.GetHeight())
+	}
+}
+
+func TestStateMigration(t *testing.T) {
+	// A state saved before versioning and supply tracking
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+	old := `{"accounts":{"1":{"id":1,"balance":700},"2":{"id":2,"balance":300}},"chain_id":"test-chain","height":7}`
+	if err := os.WriteFile(stateFile, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run reports the migration without writing anything
+	migrations, err := MigrateStateFile(stateFile, true)
+	if err != nil || len(migrations) != 2 || migrations[0].From != 0 {
+		t.Fatalf("Dry run returned %v, %v", migrations, err)
+	}
+	if data, _ := os.ReadFile(stateFile); string(data) != old {
+		t.Fatal("Dry run changed the state file")
+	}
+
+	// Loading migrates the state, after backing it up
+	store := NewStateStore(stateFile)
+	if err := store.LoadState(); err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	defer store.Close()
+	if supply, _ := store.GetSupply(); supply != 1000 || store.GetHeight() != 7 {
+		t.Errorf("Migrated state has supply %d at height %d", supply, store.GetHeight())
+	}
+	if params := store.GetParams(); params != types.DefaultParams() {
+		t.Errorf("Migrated state has params %+v, want the defaults", params)
+	}
+
+	backups, _ := filepath.Glob(stateFile + ".v0-*.bak")
+	if len(backups) != 1 {
+		t.Fatalf("Expected one backup, found %v", backups)
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != old {
+		t.Error("Backup differs from the old state file")
+	}
+
+	// The state file was rewritten at the current version
+	migrations, err = MigrateStateFile(stateFile, false)
+	if err != nil || len(migrations) != 0 {
+		t.Errorf("Migrated state still has migrations %v, %v", migrations, err)
+	}
+}
+
+func TestParamsMigration(t *testing.T) {
+	// States saved before params existed get the defaults, while params set
+	// at genesis are kept even when they disable every limit
+	for name, test := range map[string]struct {
+		state string
+		want  types.Params
+	}{
+		"without params": {`{"version":1,"accounts":{},"height":3,"total_supply":0}`, types.DefaultParams()},
+		"with params":    {`{"version":1,"accounts":{},"height":3,"total_supply":0,"params":{"max_ops_per_tx":0,"max_tx_bytes":0,"max_amount_per_op":0}}`, types.Params{}},
+	} {
+		stateFile := filepath.Join(t.TempDir(), "state.json")
+		if err := os.WriteFile(stateFile, []byte(test.state), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store := NewStateStore(stateFile)
+		if err := store.LoadState(); err != nil {
+			t.Fatalf("Failed to load state %s: %v", name, err)
+		}
+		if params := store.GetParams(); params != test.want {
+			t.Errorf("State %s loaded with params %+v, want %+v", name, params, test.want)
+		}
+		store.Close()
+	}
+}
+
+// BenchmarkSaveState compares rewriting the whole state with appending the
+// changed accounts, for blocks changing 1000 accounts
+func BenchmarkSaveState(b *testing.B) {
+	for _, accounts := range []int{10000, 100000, 1000000} {
+		for _, persistence := range []string{PersistenceFull, PersistenceIncremental} {
+			b.Run(fmt.Sprintf("%s/accounts=%d", persistence, accounts), func(b *testing.B) {
+				store := newFundedStore(b, filepath.Join(b.TempDir(), "state.json"), accounts)
+				defer store.Close()
+				store.SetPersistence(persistence)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					transferBlock(b, store, int64(i+1), accounts, 1000)
+				}
+			})
+		}
+	}
+}
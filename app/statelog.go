@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The state log is an append-only file next to the state snapshot, holding
+// one record per save with the accounts changed since the previous one.
+// Each record is framed as:
+//
+//	length    uint32, big endian
+//	checksum  uint32, CRC-32C of the payload
+//	payload   JSON changes, as returned by types.State.Changes
+//
+// A record is durable once Commit returns. A crash in the middle of an
+// append leaves a torn record at the end of the log, which is dropped
+// when the log is read back.
+
+// stateLogHeaderSize is the size of a record's length and checksum
+const stateLogHeaderSize = 8
+
+// maxStateLogRecord bounds the length of a record, so a corrupted length
+// cannot make the reader allocate an arbitrary amount of memory
+const maxStateLogRecord = 1 << 30
+
+// crcTable is the CRC-32C table used for record checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// stateLog appends records to the state log
+type stateLog struct {
+	file *os.File
+	size int64
+}
+
+// openStateLog opens a state log for appending, after dropping any torn
+// record at its end. validSize is the size of the complete records.
+func openStateLog(path string, validSize int64) (*stateLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state log: %w", err)
+	}
+
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate state log: %w", err)
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek state log: %w", err)
+	}
+
+	return &stateLog{file: file, size: validSize}, nil
+}
+
+// append writes a record and syncs it to disk
+func (l *stateLog) append(payload []byte) error {
+	record := make([]byte, stateLogHeaderSize, stateLogHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	record = append(record, payload...)
+
+	if _, err := l.file.Write(record); err != nil {
+		return fmt.Errorf("failed to append to state log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync state log: %w", err)
+	}
+
+	l.size += int64(len(record))
+	return nil
+}
+
+// reset empties the log once its records are part of a snapshot
+func (l *stateLog) reset() error {
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate state log: %w", err)
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek state log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync state log: %w", err)
+	}
+
+	l.size = 0
+	return nil
+}
+
+// close closes the log file
+func (l *stateLog) close() error {
+	return l.file.Close()
+}
+
+// readStateLog calls apply with the payload of every complete record in a
+// state log, in order, and returns the size of those records. Reading stops
+// at the first torn or corrupted record. A missing log has no records.
+func readStateLog(path string, apply func(payload []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open state log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var size int64
+	header := make([]byte, stateLogHeaderSize)
+	for {
+		// Read the header, ending at a clean or torn end of file
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return size, nil
+			}
+			return 0, fmt.Errorf("failed to read state log: %w", err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxStateLogRecord {
+			return size, nil
+		}
+
+		// Read and check the payload
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return size, nil
+			}
+			return 0, fmt.Errorf("failed to read state log: %w", err)
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return size, nil
+		}
+
+		if err := apply(payload); err != nil {
+			return 0, err
+		}
+		size += stateLogHeaderSize + int64(length)
+	}
+}
+
+// writeFileAtomic writes a file through a synced temporary file and a
+// rename, so the file holds either its old or its new content after a crash
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write to temporary file first
+	tempFile := path + ".tmp"
+	file, err := os.OpenFile(tempFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	// Rename to actual file (atomic operation), then sync the directory so the rename is durable
+	if err := os.Rename(tempFile, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+)
+
+// syncApplication serializes all calls to an ABCI application.
+// The socket server and local clients already hold a mutex around the
+// application, but the gRPC server calls it concurrently.
+type syncApplication struct {
+	mutex sync.Mutex
+	app   abci.Application
+}
+
+// NewSyncApplication wraps an application so that only one ABCI call runs at a time
+func NewSyncApplication(app abci.Application) abci.Application {
+	return &syncApplication{app: app}
+}
+
+// Info returns information about the application state
+func (s *syncApplication) Info(ctx context.Context, req *abci.InfoRequest) (*abci.InfoResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.Info(ctx, req)
+}
+
+// Query handles queries to the application state
+func (s *syncApplication) Query(ctx context.Context, req *abci.QueryRequest) (*abci.QueryResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.Query(ctx, req)
+}
+
+// CheckTx validates a transaction before adding it to the mempool
+func (s *syncApplication) CheckTx(ctx context.Context, req *abci.CheckTxRequest) (*abci.CheckTxResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.CheckTx(ctx, req)
+}
+
+// InitChain initializes the blockchain
+func (s *syncApplication) InitChain(ctx context.Context, req *abci.InitChainRequest) (*abci.InitChainResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.InitChain(ctx, req)
+}
+
+// PrepareProposal prepares the transactions of a proposed block
+func (s *syncApplication) PrepareProposal(ctx context.Context, req *abci.PrepareProposalRequest) (*abci.PrepareProposalResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.PrepareProposal(ctx, req)
+}
+
+// ProcessProposal accepts or rejects a proposed block
+func (s *syncApplication) ProcessProposal(ctx context.Context, req *abci.ProcessProposalRequest) (*abci.ProcessProposalResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.ProcessProposal(ctx, req)
+}
+
+// FinalizeBlock processes the transactions of a decided block
+func (s *syncApplication) FinalizeBlock(ctx context.Context, req *abci.FinalizeBlockRequest) (*abci.FinalizeBlockResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.FinalizeBlock(ctx, req)
+}
+
+// ExtendVote creates a vote extension
+func (s *syncApplication) ExtendVote(ctx context.Context, req *abci.ExtendVoteRequest) (*abci.ExtendVoteResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.ExtendVote(ctx, req)
+}
+
+// VerifyVoteExtension verifies a vote extension
+func (s *syncApplication) VerifyVoteExtension(ctx context.Context, req *abci.VerifyVoteExtensionRequest) (*abci.VerifyVoteExtensionResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.VerifyVoteExtension(ctx, req)
+}
+
+// Commit persists the application state
+func (s *syncApplication) Commit(ctx context.Context, req *abci.CommitRequest) (*abci.CommitResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.Commit(ctx, req)
+}
+
+// ListSnapshots lists the available state sync snapshots
+func (s *syncApplication) ListSnapshots(ctx context.Context, req *abci.ListSnapshotsRequest) (*abci.ListSnapshotsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.ListSnapshots(ctx, req)
+}
+
+// OfferSnapshot offers a state sync snapshot to the application
+func (s *syncApplication) OfferSnapshot(ctx context.Context, req *abci.OfferSnapshotRequest) (*abci.OfferSnapshotResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.OfferSnapshot(ctx, req)
+}
+
+// LoadSnapshotChunk loads a chunk of a state sync snapshot
+func (s *syncApplication) LoadSnapshotChunk(ctx context.Context, req *abci.LoadSnapshotChunkRequest) (*abci.LoadSnapshotChunkResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.LoadSnapshotChunk(ctx, req)
+}
+
+// ApplySnapshotChunk applies a chunk of a state sync snapshot
+func (s *syncApplication) ApplySnapshotChunk(ctx context.Context, req *abci.ApplySnapshotChunkRequest) (*abci.ApplySnapshotChunkResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.app.ApplySnapshotChunk(ctx, req)
+}
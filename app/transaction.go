@@ -1,38 +1,90 @@
 package app
 
 import (
+	"bytes"
 	"fmt"
+	"time"
 
-	"github.com/cometbft/cometbft/crypto/ed25519"
 	"github.com/xmonader/test_batched_tx_tendermint/crypto"
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
 // TransactionProcessor processes transactions
 type TransactionProcessor struct {
+	// State holding the accounts, along with the keys verifying their owners' signatures
 	stateStore *StateStore
-	// Map of user ID to public key for signature verification
-	// In a real application, this would be more sophisticated
-	userKeys map[int]ed25519.PubKey
+	// Height of the block being executed, zero outside of FinalizeBlock
+	blockHeight int64
+	// Metrics recording signature verification time
+	metrics *Metrics
 }
 
-// NewTransactionProcessor creates a new transaction processor
-func NewTransactionProcessor(stateStore *StateStore) *TransactionProcessor {
+// NewTransactionProcessor creates a new transaction processor recording
+// signature verification time in metrics
+func NewTransactionProcessor(stateStore *StateStore, metrics *Metrics) *TransactionProcessor {
 	return &TransactionProcessor{
 		stateStore: stateStore,
-		userKeys:   make(map[int]ed25519.PubKey),
+		metrics:    metrics,
 	}
 }
 
-// RegisterUserKey registers a public key for a user
-func (tp *TransactionProcessor) RegisterUserKey(userID int, pubKey ed25519.PubKey) {
-	tp.userKeys[userID] = pubKey
+// RegisterUserKey registers a public key for a user, in the user's account
+func (tp *TransactionProcessor) RegisterUserKey(userID int, pubKey crypto.PubKey) {
+	tp.stateStore.SetPubKey(userID, crypto.KeyTypeOf(pubKey), crypto.PublicKeyToBase64(pubKey))
 }
 
-// GetUserKey gets a user's public key
-func (tp *TransactionProcessor) GetUserKey(userID int) (ed25519.PubKey, bool) {
-	key, exists := tp.userKeys[userID]
-	return key, exists
+// GetUserKey gets a user's public key from the user's account
+func (tp *TransactionProcessor) GetUserKey(userID int) (crypto.PubKey, bool) {
+	account := tp.stateStore.GetAccount(userID)
+	if account.PubKey == "" {
+		return nil, false
+	}
+	key, err := account.Key()
+	return key, err == nil
+}
+
+// RegisterBLSKey registers a BLS public key for a user, in the user's account
+func (tp *TransactionProcessor) RegisterBLSKey(userID int, pubKey crypto.BLSPubKey) {
+	tp.stateStore.SetBLSPubKey(userID, crypto.BLSPublicKeyToBase64(pubKey))
+}
+
+// GetBLSKey gets a user's BLS public key from the user's account
+func (tp *TransactionProcessor) GetBLSKey(userID int) (crypto.BLSPubKey, bool) {
+	account := tp.stateStore.GetAccount(userID)
+	if account.BLSPubKey == "" {
+		return nil, false
+	}
+	key, err := account.BLSKey()
+	return key, err == nil
+}
+
+// BeginBlock marks the start of executing the block at the given height
+func (tp *TransactionProcessor) BeginBlock(height int64) {
+	tp.blockHeight = height
+}
+
+// EndBlock marks the end of block execution
+func (tp *TransactionProcessor) EndBlock() {
+	tp.blockHeight = 0
+}
+
+// currentHeight returns the height operations are validated at: the block
+// being executed, or the next block when checking mempool transactions
+func (tp *TransactionProcessor) currentHeight() int64 {
+	if tp.blockHeight > 0 {
+		return tp.blockHeight
+	}
+	return tp.stateStore.GetHeight() + 1
+}
+
+// txValidation carries the state shared by the operations of one transaction
+type txValidation struct {
+	pending    pendingUsage   // Usage of the operations validated so far
+	nonces     pendingNonces  // Nonces of the operations validated so far
+	debits     map[int]uint64 // Amounts debited from each sender by the operations validated so far
+	minted     uint64         // Amount minted by the operations validated so far
+	signedBy   crypto.PubKey  // Key that signed the whole batch, nil for per-operation signatures
+	aggregated bool           // Operation signatures were verified together as one aggregate
 }
 
 // ValidateTransaction validates a transaction
@@ -42,9 +94,40 @@ func (tp *TransactionProcessor) ValidateTransaction(tx *types.Transaction) error
 		return err
 	}
 
+	// Limits, balances and the supply cap are checked against the
+	// combined operations
+	v := &txValidation{
+		pending: make(pendingUsage),
+		nonces:  make(pendingNonces),
+		debits:  make(map[int]uint64),
+	}
+
+	// A batch-signed transaction is verified once for all operations
+	if tx.IsBatchSigned() {
+		pubKey, err := tp.verifyBatchSignature(tx)
+		if err != nil {
+			return err
+		}
+		v.signedBy = pubKey
+
+		// Every operation debits the batch sender, so their total must fit in
+		// its balance before any of them is applied
+		if err := tp.checkBatchTotal(tx); err != nil {
+			return err
+		}
+	}
+
+	// An aggregate-signed transaction is verified once for all senders
+	if tx.IsAggregateSigned() {
+		if err := tp.verifyAggregateSignature(tx); err != nil {
+			return err
+		}
+		v.aggregated = true
+	}
+
 	// Validate each operation individually, including signature verification
 	for i, op := range tx.Operations {
-		if err := tp.ValidateOperation(&op); err != nil {
+		if err := tp.validateOperation(&op, v); err != nil {
 			return fmt.Errorf("operation %d: %w", i, err)
 		}
 	}
@@ -54,25 +137,226 @@ func (tp *TransactionProcessor) ValidateTransaction(tx *types.Transaction) error
 
 // ValidateOperation validates a single operation
 func (tp *TransactionProcessor) ValidateOperation(op *types.Operation) error {
-	// Basic validation
-	if err := types.ValidateOperation(op); err != nil {
+	return tp.validateOperation(op, nil)
+}
+
+// validateOperation validates a single operation as part of a transaction
+func (tp *TransactionProcessor) validateOperation(op *types.Operation, v *txValidation) error {
+	batchSigned := v != nil && v.signedBy != nil
+	aggregated := v != nil && v.aggregated
+
+	// Basic validation and signature verification, already done by the
+	// transaction for aggregate-signed operations
+	if !aggregated {
+		// Basic validation, already done by the transaction for batch-signed operations
+		if !batchSigned {
+			if err := types.ValidateOperation(op); err != nil {
+				return err
+			}
+		}
+
+		// Get the key that must have signed the operation
+		pubKey, err := tp.signerKey(op)
+		if err != nil {
+			return err
+		}
+
+		// Verify the signature
+		if batchSigned {
+			if !sameKey(pubKey, v.signedBy) {
+				return fmt.Errorf("signer of user %d does not match the batch signature", op.From)
+			}
+		} else if err := tp.verifyOperationSignature(op, pubKey); err != nil {
+			return err
+		}
+	}
+
+	// Check the nonce and expiry
+	var nonces pendingNonces
+	if v != nil {
+		nonces = v.nonces
+	}
+	if err := tp.checkReplay(op, nonces); err != nil {
 		return err
 	}
 
+	switch op.OpType() {
+	case types.OpTypeMint:
+		// Check the supply cap, including the earlier mints of the transaction
+		totalSupply, supplyCap := tp.stateStore.GetSupply()
+		minted := op.Amount
+		if v != nil {
+			var err error
+			if minted, err = types.AddAmounts(v.minted, op.Amount); err != nil {
+				return fmt.Errorf("total supply: %w", err)
+			}
+		}
+		newSupply, err := types.AddAmounts(totalSupply, minted)
+		if err != nil {
+			return fmt.Errorf("total supply: %w", err)
+		}
+		if supplyCap > 0 && newSupply > supplyCap {
+			return fmt.Errorf("supply cap exceeded: %d + %d > %d", totalSupply, minted, supplyCap)
+		}
+		if v != nil {
+			v.minted = minted
+		}
+		return nil
+	case types.OpTypeSetLimits:
+		return nil
+	}
+
+	// Check if sender has sufficient balance, including the earlier debits
+	// of the transaction
+	account := tp.stateStore.GetAccount(op.From)
+	debited := op.Amount
+	if v != nil {
+		var err error
+		if debited, err = types.AddAmounts(v.debits[op.From], op.Amount); err != nil {
+			return fmt.Errorf("%w: %v", types.ErrInsufficientBalance, err)
+		}
+	}
+	if account.Balance < debited {
+		return fmt.Errorf("%w: %d < %d", types.ErrInsufficientBalance, account.Balance, debited)
+	}
+	if v != nil {
+		v.debits[op.From] = debited
+	}
+
+	// Check the sender's limits
+	var pending pendingUsage
+	if v != nil {
+		pending = v.pending
+	}
+	return tp.checkLimits(op, pending)
+}
+
+// signerKey returns the public key that must have signed an operation,
+// checking that the sender is allowed to perform it
+func (tp *TransactionProcessor) signerKey(op *types.Operation) (crypto.PubKey, error) {
+	switch op.OpType() {
+	case types.OpTypeMint, types.OpTypeBurn:
+		// Supply operations are signed with the authority key from genesis
+		authority := tp.stateStore.GetMintAuthority()
+		if authority == nil {
+			return nil, fmt.Errorf("no mint authority configured")
+		}
+		if op.From != authority.AccountID {
+			return nil, fmt.Errorf("user %d is not the mint authority", op.From)
+		}
+		pubKey, err := authority.Key()
+		if err != nil {
+			return nil, fmt.Errorf("invalid mint authority key: %w", err)
+		}
+		return pubKey, nil
+	case types.OpTypeSetLimits:
+		return tp.setLimitsSignerKey(op)
+	}
+
 	// Get the sender's public key
 	pubKey, exists := tp.GetUserKey(op.From)
 	if !exists {
-		return fmt.Errorf("no public key registered for user %d", op.From)
+		return nil, fmt.Errorf("no public key registered for user %d", op.From)
+	}
+	return pubKey, nil
+}
+
+// verifyBatchSignature verifies the single signature of a batch-signed transaction
+// and returns the key that signed it
+func (tp *TransactionProcessor) verifyBatchSignature(tx *types.Transaction) (crypto.PubKey, error) {
+	// Every operation is sent by the batch sender, so the first one determines the key
+	pubKey, err := tp.signerKey(&tx.Operations[0])
+	if err != nil {
+		return nil, err
 	}
 
 	// Get the data that was signed
-	dataToVerify, err := op.GetDataForSigning()
+	dataToVerify := tx.BatchSignBytes(tp.stateStore.GetChainID())
+
+	// Verify the signature
+	start := time.Now()
+	valid, err := crypto.VerifySignature(pubKey, dataToVerify, tx.Signature)
+	observeSince(tp.metrics.SignatureVerifyDuration.WithLabelValues("batch"), start)
 	if err != nil {
-		return fmt.Errorf("failed to get operation data for signing: %w", err)
+		return nil, fmt.Errorf("batch signature verification error: %w", err)
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid batch signature")
+	}
+
+	return pubKey, nil
+}
+
+// checkBatchTotal checks that the sender of a batch-signed transaction can
+// pay for the transfers and burns of all its operations
+func (tp *TransactionProcessor) checkBatchTotal(tx *types.Transaction) error {
+	var total uint64
+	for i, op := range tx.Operations {
+		switch op.OpType() {
+		case types.OpTypeMint, types.OpTypeSetLimits:
+			continue
+		}
+		var err error
+		if total, err = types.AddAmounts(total, op.Amount); err != nil {
+			return fmt.Errorf("batch total at operation %d: %w", i, err)
+		}
+	}
+
+	account := tp.stateStore.GetAccount(tx.Sender)
+	if account.Balance < total {
+		return fmt.Errorf("batch total: %w for account %d: %d < %d", types.ErrInsufficientBalance, tx.Sender, account.Balance, total)
+	}
+	return nil
+}
+
+// verifyAggregateSignature verifies the aggregate BLS signature of a transaction
+// against the BLS key of each operation's sender
+func (tp *TransactionProcessor) verifyAggregateSignature(tx *types.Transaction) error {
+	chainID := tp.stateStore.GetChainID()
+	pubKeys := make([]crypto.BLSPubKey, len(tx.Operations))
+	messages := make([][]byte, len(tx.Operations))
+	for i := range tx.Operations {
+		op := &tx.Operations[i]
+
+		// Get the sender's BLS public key
+		pubKey, exists := tp.GetBLSKey(op.From)
+		if !exists {
+			return fmt.Errorf("operation %d: no BLS public key registered for user %d", i, op.From)
+		}
+		pubKeys[i] = pubKey
+
+		// Get the data that was signed
+		messages[i] = op.SignBytes(chainID)
 	}
 
+	// Verify the aggregate signature
+	start := time.Now()
+	valid, err := crypto.AggregateVerifyBLS(pubKeys, messages, tx.AggregateSignature)
+	observeSince(tp.metrics.SignatureVerifyDuration.WithLabelValues("aggregate"), start)
+	if err != nil {
+		return fmt.Errorf("aggregate signature verification error: %w", err)
+	}
+	if !valid {
+		return fmt.Errorf("invalid aggregate signature")
+	}
+
+	return nil
+}
+
+// sameKey reports whether two public keys are the same key of the same type
+func sameKey(a, b crypto.PubKey) bool {
+	return a.Type() == b.Type() && bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+// verifyOperationSignature verifies an operation's signature against a public key
+func (tp *TransactionProcessor) verifyOperationSignature(op *types.Operation, pubKey crypto.PubKey) error {
+	// Get the data that was signed
+	dataToVerify := op.SignBytes(tp.stateStore.GetChainID())
+
 	// Verify the signature
+	start := time.Now()
 	valid, err := crypto.VerifySignature(pubKey, dataToVerify, op.Signature)
+	observeSince(tp.metrics.SignatureVerifyDuration.WithLabelValues("operation"), start)
 	if err != nil {
 		return fmt.Errorf("signature verification error: %w", err)
 	}
@@ -80,36 +364,66 @@ func (tp *TransactionProcessor) ValidateOperation(op *types.Operation) error {
 		return fmt.Errorf("invalid signature")
 	}
 
-	// Check if sender has sufficient balance
-	account := tp.stateStore.GetAccount(op.From)
-	if account.Balance < op.Amount {
-		return fmt.Errorf("insufficient balance: %d < %d", account.Balance, op.Amount)
-	}
-
 	return nil
 }
 
-// ProcessTransaction processes a transaction
+// ProcessTransaction processes a transaction. Its operations are applied
+// all or nothing: when one fails, the ones applied before it are undone.
 func (tp *TransactionProcessor) ProcessTransaction(tx *types.Transaction) error {
 	// Validate the transaction
 	if err := tp.ValidateTransaction(tx); err != nil {
 		return err
 	}
 
-	// Process all operations
+	// Keep the accounts the operations change, with their nonces, and the supply
+	ids := make([]int, 0, 2*len(tx.Operations))
+	for _, op := range tx.Operations {
+		ids = append(ids, op.From, op.To)
+	}
+	snapshot := tp.stateStore.Snapshot(ids)
+
+	if err := tp.applyOperations(tx); err != nil {
+		tp.stateStore.Restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+// applyOperations applies the operations of a validated transaction in
+// order, stopping at the first that fails
+func (tp *TransactionProcessor) applyOperations(tx *types.Transaction) error {
+	height := tp.currentHeight()
 	for i, op := range tx.Operations {
+		tp.stateStore.SetNonce(op.From, op.Nonce)
+
+		switch op.OpType() {
+		case types.OpTypeMint:
+			if err := tp.stateStore.Mint(op.To, op.Amount); err != nil {
+				return fmt.Errorf("failed to mint in operation %d: %w", i, err)
+			}
+			continue
+		case types.OpTypeBurn:
+			if err := tp.stateStore.Burn(op.From, op.Amount); err != nil {
+				return fmt.Errorf("failed to burn in operation %d: %w", i, err)
+			}
+			tp.stateStore.RecordUsage(op.From, height, op.Amount)
+			continue
+		case types.OpTypeSetLimits:
+			tp.stateStore.SetLimits(op.To, op.Limits, tp.isAdmin(op.From))
+			continue
+		}
+
 		// Deduct from sender
-		if err := tp.stateStore.UpdateBalance(op.From, -op.Amount); err != nil {
+		if err := tp.stateStore.Debit(op.From, op.Amount); err != nil {
 			return fmt.Errorf("failed to deduct from sender in operation %d: %w", i, err)
 		}
 
 		// Add to recipient
-		if err := tp.stateStore.UpdateBalance(op.To, op.Amount); err != nil {
-			// This should never happen, but if it does, we need to revert the sender's deduction
-			// In a real application, you'd use a proper transaction mechanism
-			_ = tp.stateStore.UpdateBalance(op.From, op.Amount)
+		if err := tp.stateStore.Credit(op.To, op.Amount); err != nil {
 			return fmt.Errorf("failed to add to recipient in operation %d: %w", i, err)
 		}
+
+		tp.stateStore.RecordUsage(op.From, height, op.Amount)
 	}
 
 	return nil
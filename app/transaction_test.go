@@ -0,0 +1,315 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/xmonader/test_batched_tx_tendermint/client"
+	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// newTestProcessor creates a transaction processor with funded accounts for the given clients
+func newTestProcessor(t *testing.T, clients ...*client.Client) *TransactionProcessor {
+	t.Helper()
+
+	stateStore := NewStateStore("")
+	txProcessor := NewTransactionProcessor(stateStore, NewMetrics())
+	for _, c := range clients {
+		if err := stateStore.Mint(c.GetUserID(), 1000); err != nil {
+			t.Fatalf("Failed to fund user %d: %v", c.GetUserID(), err)
+		}
+		txProcessor.RegisterUserKey(c.GetUserID(), c.GetPublicKey())
+	}
+	return txProcessor
+}
+
+// signedTx creates a signed transaction or fails the test
+func signedTx(t *testing.T, c *client.Client, ops ...types.Operation) *types.Transaction {
+	t.Helper()
+
+	tx, err := c.CreateTransaction(ops)
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	return tx
+}
+
+func TestRateLimits(t *testing.T) {
+	sender := client.NewClient(1)
+	txProcessor := newTestProcessor(t, sender)
+
+	// The owner limits its own account to 100 per 3 blocks and 2 operations per block
+	limits := &types.AccountLimits{MaxAmountPerWindow: 100, WindowBlocks: 3, MaxOpsPerBlock: 2}
+	setLimits := signedTx(t, sender, sender.CreateSetLimitsOperation(1, limits))
+	if err := txProcessor.ProcessTransaction(setLimits); err != nil {
+		t.Fatalf("Failed to set limits: %v", err)
+	}
+
+	// Too many operations in one transaction
+	tx := signedTx(t, sender,
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(2, 10))
+	if err := txProcessor.ValidateTransaction(tx); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected rate limit error for operation count, got %v", err)
+	}
+
+	// Spend 80 at height 1
+	txProcessor.BeginBlock(1)
+	if err := txProcessor.ProcessTransaction(signedTx(t, sender, sender.CreateTransferOperation(2, 80))); err != nil {
+		t.Fatalf("Failed to process transfer: %v", err)
+	}
+	txProcessor.EndBlock()
+
+	// Another 30 within the window exceeds the cap
+	txProcessor.BeginBlock(3)
+	if err := txProcessor.ValidateTransaction(signedTx(t, sender, sender.CreateTransferOperation(2, 30))); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected rate limit error for amount, got %v", err)
+	}
+	txProcessor.EndBlock()
+
+	// Once height 1 leaves the window the transfer is accepted
+	txProcessor.BeginBlock(4)
+	if err := txProcessor.ProcessTransaction(signedTx(t, sender, sender.CreateTransferOperation(2, 30))); err != nil {
+		t.Errorf("Transfer after window failed: %v", err)
+	}
+	txProcessor.EndBlock()
+}
+
+func TestBatchSignedTransaction(t *testing.T) {
+	sender := client.NewClient(1)
+	other := client.NewClient(2)
+	txProcessor := newTestProcessor(t, sender, other)
+
+	operations := []types.Operation{
+		sender.CreateTransferOperation(2, 10),
+		sender.CreateTransferOperation(3, 20),
+	}
+	tx, err := sender.CreateBatchTransaction(operations)
+	if err != nil {
+		t.Fatalf("Failed to create batch transaction: %v", err)
+	}
+	if err := txProcessor.ProcessTransaction(tx); err != nil {
+		t.Fatalf("Failed to process batch transaction: %v", err)
+	}
+	if balance := txProcessor.stateStore.GetAccount(1).Balance; balance != 970 {
+		t.Errorf("Sender balance mismatch: got %d, want %d", balance, 970)
+	}
+
+	// Tampering with any operation invalidates the batch signature
+	tx.Operations[1].Amount = 200
+	if err := txProcessor.ValidateTransaction(tx); err == nil {
+		t.Error("Tampered batch transaction passed validation")
+	}
+
+	// A batch signed by another user is rejected
+	forged, err := other.CreateBatchTransaction([]types.Operation{other.CreateTransferOperation(3, 10)})
+	if err != nil {
+		t.Fatalf("Failed to create batch transaction: %v", err)
+	}
+	forged.Sender = 1
+	forged.Operations[0].From = 1
+	if err := txProcessor.ValidateTransaction(forged); err == nil {
+		t.Error("Forged batch transaction passed validation")
+	}
+}
+
+func TestAggregateSignedTransaction(t *testing.T) {
+	alice := client.NewClient(1)
+	bob := client.NewClient(2)
+	txProcessor := newTestProcessor(t, alice, bob)
+	for _, c := range []*client.Client{alice, bob} {
+		if err := c.GenerateBLSKey(); err != nil {
+			t.Fatalf("Failed to generate BLS key: %v", err)
+		}
+		txProcessor.RegisterBLSKey(c.GetUserID(), c.GetBLSPublicKey())
+	}
+
+	// Each sender signs its own operation and the signatures are aggregated
+	operations := []types.Operation{
+		alice.CreateTransferOperation(3, 10),
+		bob.CreateTransferOperation(3, 20),
+	}
+	signatures := make([]string, len(operations))
+	for i, c := range []*client.Client{alice, bob} {
+		signature, err := c.SignOperationBLS(operations[i])
+		if err != nil {
+			t.Fatalf("Failed to sign operation: %v", err)
+		}
+		signatures[i] = signature
+	}
+	tx, err := client.CreateAggregateTransaction(operations, signatures)
+	if err != nil {
+		t.Fatalf("Failed to create aggregate transaction: %v", err)
+	}
+	if err := txProcessor.ProcessTransaction(tx); err != nil {
+		t.Fatalf("Failed to process aggregate transaction: %v", err)
+	}
+	if balance := txProcessor.stateStore.GetAccount(3).Balance; balance != 30 {
+		t.Errorf("Recipient balance mismatch: got %d, want %d", balance, 30)
+	}
+
+	// Tampering with any operation invalidates the aggregate signature
+	tx.Operations[0].Amount = 100
+	if err := txProcessor.ValidateTransaction(tx); err == nil {
+		t.Error("Tampered aggregate transaction passed validation")
+	}
+}
+
+func TestSecp256k1Keys(t *testing.T) {
+	sender, err := client.NewClientWithKeyType(1, crypto.KeyTypeSecp256k1)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	txProcessor := newTestProcessor(t, sender)
+
+	// Per-operation and batch signatures are verified with the registered secp256k1 key
+	if err := txProcessor.ProcessTransaction(signedTx(t, sender, sender.CreateTransferOperation(2, 10))); err != nil {
+		t.Fatalf("Failed to process secp256k1-signed transaction: %v", err)
+	}
+	batch, err := sender.CreateBatchTransaction([]types.Operation{sender.CreateTransferOperation(2, 10)})
+	if err != nil {
+		t.Fatalf("Failed to create batch transaction: %v", err)
+	}
+	if err := txProcessor.ProcessTransaction(batch); err != nil {
+		t.Fatalf("Failed to process secp256k1 batch transaction: %v", err)
+	}
+
+	// An ed25519 signature does not verify against the registered secp256k1 key
+	impostor := client.NewClient(1)
+	if err := txProcessor.ValidateTransaction(signedTx(t, impostor, impostor.CreateTransferOperation(2, 10))); err == nil {
+		t.Error("Transaction signed with another key type passed validation")
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	sender := client.NewClient(1)
+	txProcessor := newTestProcessor(t, sender)
+	txProcessor.stateStore.SetChainID("test-chain")
+	sender.SetChainID("test-chain")
+
+	// A processed transaction cannot be replayed
+	tx := signedTx(t, sender, sender.CreateTransferOperation(2, 10))
+	if err := txProcessor.ProcessTransaction(tx); err != nil {
+		t.Fatalf("Failed to process transaction: %v", err)
+	}
+	if err := txProcessor.ValidateTransaction(tx); !errors.Is(err, ErrInvalidNonce) {
+		t.Errorf("Expected nonce error for replayed transaction, got %v", err)
+	}
+
+	// Nonces must also increase within a transaction
+	first := sender.CreateTransferOperation(2, 10)
+	second := sender.CreateTransferOperation(2, 10)
+	if err := txProcessor.ValidateTransaction(signedTx(t, sender, second, first)); !errors.Is(err, ErrInvalidNonce) {
+		t.Errorf("Expected nonce error for out-of-order operations, got %v", err)
+	}
+
+	// Operations past their expiry height are rejected
+	txProcessor.stateStore.SetHeight(5)
+	op := sender.CreateTransferOperation(2, 10)
+	op.Expiry = 5
+	if err := txProcessor.ValidateTransaction(signedTx(t, sender, op)); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected expiry error, got %v", err)
+	}
+
+	// Signatures for another chain are rejected
+	other := client.NewClient(1)
+	other.SetChainID("other-chain")
+	other.SetNonce(10)
+	txProcessor.RegisterUserKey(1, other.GetPublicKey())
+	if err := txProcessor.ValidateTransaction(signedTx(t, other, other.CreateTransferOperation(2, 10))); err == nil {
+		t.Error("Transaction signed for another chain passed validation")
+	}
+}
+
+func TestTransferOverflow(t *testing.T) {
+	sender := client.NewClient(1)
+	txProcessor := newTestProcessor(t, sender)
+	txProcessor.stateStore.state.Accounts[2] = &types.Account{ID: 2, Balance: math.MaxUint64 - 5}
+
+	// The credit overflows, so the transfer fails and the debit is reverted
+	err := txProcessor.ProcessTransaction(signedTx(t, sender, sender.CreateTransferOperation(2, 10)))
+	if !errors.Is(err, types.ErrBalanceOverflow) {
+		t.Errorf("Expected balance overflow, got %v", err)
+	}
+	if balance := txProcessor.stateStore.GetAccount(1).Balance; balance != 1000 {
+		t.Errorf("Sender balance mismatch: got %d, want %d", balance, 1000)
+	}
+}
+
+func TestTransactionTotals(t *testing.T) {
+	authority := client.NewClient(1)
+	sender := client.NewClient(2)
+	txProcessor := newTestProcessor(t, sender)
+	txProcessor.stateStore.UpdateState(func(state *types.State) error {
+		state.MintAuthority = &types.Authority{AccountID: 1, PubKey: authority.GetPublicKeyBase64()}
+		state.SupplyCap = 1100
+		return nil
+	})
+
+	// Each mint fits under the cap, but not both
+	mints := signedTx(t, authority, authority.CreateMintOperation(3, 60), authority.CreateMintOperation(3, 60))
+	if err := txProcessor.ProcessTransaction(mints); err == nil {
+		t.Error("Mints exceeding the supply cap together were accepted")
+	}
+	if totalSupply, _ := txProcessor.stateStore.GetSupply(); totalSupply != 1000 {
+		t.Errorf("Total supply mismatch: got %d, want %d", totalSupply, 1000)
+	}
+
+	// Each transfer fits in the balance, but not both
+	transfers := signedTx(t, sender, sender.CreateTransferOperation(3, 600), sender.CreateTransferOperation(4, 600))
+	if err := txProcessor.ProcessTransaction(transfers); !errors.Is(err, types.ErrInsufficientBalance) {
+		t.Errorf("Expected insufficient balance, got %v", err)
+	}
+	if balance := txProcessor.stateStore.GetAccount(2).Balance; balance != 1000 {
+		t.Errorf("Sender balance mismatch: got %d, want %d", balance, 1000)
+	}
+}
+
+func TestTransactionAtomicity(t *testing.T) {
+	sender := client.NewClient(1)
+	txProcessor := newTestProcessor(t, sender)
+	txProcessor.stateStore.state.Accounts[3] = &types.Account{ID: 3, Balance: math.MaxUint64 - 5}
+
+	// The second credit overflows, so the first transfer is undone as well
+	tx := signedTx(t, sender, sender.CreateTransferOperation(2, 10), sender.CreateTransferOperation(3, 10))
+	if err := txProcessor.ProcessTransaction(tx); !errors.Is(err, types.ErrBalanceOverflow) {
+		t.Errorf("Expected balance overflow, got %v", err)
+	}
+	if account := txProcessor.stateStore.GetAccount(1); account.Balance != 1000 || account.Nonce != 0 {
+		t.Errorf("Sender has balance %d and nonce %d, want 1000 and 0", account.Balance, account.Nonce)
+	}
+	if _, exists := txProcessor.stateStore.state.Accounts[2]; exists {
+		t.Error("Recipient of the undone transfer still exists")
+	}
+}
+
+func TestBatchTotalExceedsBalance(t *testing.T) {
+	sender := client.NewClient(1)
+	txProcessor := newTestProcessor(t, sender)
+
+	// Each transfer fits in the balance, but the batch does not
+	tx, err := sender.CreateBatchTransaction([]types.Operation{
+		sender.CreateTransferOperation(2, 400),
+		sender.CreateTransferOperation(3, 400),
+		sender.CreateTransferOperation(4, 400),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create batch transaction: %v", err)
+	}
+	if err := txProcessor.ProcessTransaction(tx); !errors.Is(err, types.ErrInsufficientBalance) {
+		t.Errorf("Expected insufficient balance, got %v", err)
+	}
+
+	// No operation of the batch was applied
+	if account := txProcessor.stateStore.GetAccount(1); account.Balance != 1000 || account.Nonce != 0 {
+		t.Errorf("Sender has balance %d and nonce %d, want 1000 and 0", account.Balance, account.Nonce)
+	}
+	for _, id := range []int{2, 3, 4} {
+		if balance := txProcessor.stateStore.GetAccount(id).Balance; balance != 0 {
+			t.Errorf("Recipient %d balance mismatch: got %d, want 0", id, balance)
+		}
+	}
+}
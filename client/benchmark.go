@@ -15,6 +15,7 @@ type BenchmarkConfig struct {
 	NumUsers         int   // Number of users to simulate
 	MaxAmount        int   // Maximum amount per operation
 	RandomRecipients bool  // Whether to use random recipients
+	BatchSigned      bool  // Whether to sign each batch once instead of every operation
 }
 
 // DefaultBenchmarkConfig returns a default benchmark configuration
@@ -84,7 +85,7 @@ func Benchmark(config *BenchmarkConfig, client *Client, processFunc func(*types.
 					// Use a fixed recipient (user 2) for simplicity
 					recipient = 2
 				}
-				amount := rand.Intn(config.MaxAmount) + 1
+				amount := uint64(rand.Intn(config.MaxAmount) + 1)
 
 				// Create operation
 				operation := client.CreateTransferOperation(recipient, amount)
@@ -92,7 +93,13 @@ func Benchmark(config *BenchmarkConfig, client *Client, processFunc func(*types.
 			}
 
 			// Create transaction
-			tx, err := client.CreateTransaction(operations)
+			var tx *types.Transaction
+			var err error
+			if config.BatchSigned {
+				tx, err = client.CreateBatchTransaction(operations)
+			} else {
+				tx, err = client.CreateTransaction(operations)
+			}
 			if err != nil {
 				return nil, fmt.Errorf("failed to create transaction: %w", err)
 			}
@@ -6,19 +6,23 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
-	"github.com/cometbft/cometbft/crypto/ed25519"
 	"github.com/xmonader/test_batched_tx_tendermint/crypto"
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
 // Client represents a client for creating and signing transactions
 type Client struct {
-	keyPair *crypto.KeyPair
-	userID  int
+	keyPair    *crypto.KeyPair
+	blsKeyPair *crypto.BLSKeyPair // Optional, used for aggregate-signed transactions
+	userID     int
+	chainID    string        // Chain the client's signatures are valid on
+	encoding   string        // Codec of serialized transactions, the default codec when empty
+	nonce      atomic.Uint64 // Last nonce assigned to an operation
 }
 
-// NewClient creates a new client with a generated key pair
+// NewClient creates a new client with a generated ed25519 key pair
 func NewClient(userID int) *Client {
 	keyPair := crypto.GenerateKeyPair()
 	return &Client{
@@ -27,6 +31,18 @@ func NewClient(userID int) *Client {
 	}
 }
 
+// NewClientWithKeyType creates a new client with a generated key pair of the given type
+func NewClientWithKeyType(userID int, keyType crypto.KeyType) (*Client, error) {
+	keyPair, err := crypto.GenerateKeyPairOfType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		keyPair: keyPair,
+		userID:  userID,
+	}, nil
+}
+
 // LoadClient loads a client from a key file
 func LoadClient(keyFile string) (*Client, error) {
 	// Read key file
@@ -37,45 +53,69 @@ func LoadClient(keyFile string) (*Client, error) {
 
 	// Parse key file
 	var keyData struct {
-		UserID     int    `json:"user_id"`
-		PrivateKey string `json:"private_key"`
-		PublicKey  string `json:"public_key"`
+		UserID        int    `json:"user_id"`
+		KeyType       string `json:"key_type"`
+		PrivateKey    string `json:"private_key"`
+		PublicKey     string `json:"public_key"`
+		BLSPrivateKey string `json:"bls_private_key"`
 	}
 	if err := json.Unmarshal(data, &keyData); err != nil {
 		return nil, fmt.Errorf("failed to parse key file: %w", err)
 	}
 
-	// Parse keys
-	privKey, err := crypto.PrivateKeyFromBase64(keyData.PrivateKey)
+	// Parse keys, which are ed25519 in key files without a key type
+	keyType, err := crypto.ParseKeyType(keyData.KeyType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file: %w", err)
+	}
+	privKey, err := crypto.PrivateKeyFromBase64OfType(keyType, keyData.PrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid private key: %w", err)
 	}
-	pubKey, err := crypto.PublicKeyFromBase64(keyData.PublicKey)
+	pubKey, err := crypto.PublicKeyFromBase64OfType(keyType, keyData.PublicKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid public key: %w", err)
 	}
 
-	return &Client{
+	c := &Client{
 		keyPair: &crypto.KeyPair{
 			PrivateKey: privKey,
 			PublicKey:  pubKey,
 		},
 		userID: keyData.UserID,
-	}, nil
+	}
+
+	// Parse the BLS key, if the client has one
+	if keyData.BLSPrivateKey != "" {
+		c.blsKeyPair, err = crypto.BLSKeyPairFromBase64(keyData.BLSPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BLS private key: %w", err)
+		}
+	}
+
+	return c, nil
 }
 
 // SaveClient saves a client to a key file
 func (c *Client) SaveClient(keyFile string) error {
 	// Create key data
 	keyData := struct {
-		UserID     int    `json:"user_id"`
-		PrivateKey string `json:"private_key"`
-		PublicKey  string `json:"public_key"`
+		UserID        int    `json:"user_id"`
+		KeyType       string `json:"key_type"`
+		PrivateKey    string `json:"private_key"`
+		PublicKey     string `json:"public_key"`
+		BLSPrivateKey string `json:"bls_private_key,omitempty"`
+		BLSPublicKey  string `json:"bls_public_key,omitempty"`
 	}{
 		UserID:     c.userID,
+		KeyType:    string(c.keyPair.KeyType()),
 		PrivateKey: crypto.PrivateKeyToBase64(c.keyPair.PrivateKey),
 		PublicKey:  crypto.PublicKeyToBase64(c.keyPair.PublicKey),
 	}
+	if c.blsKeyPair != nil {
+		keyData.BLSPrivateKey = crypto.BLSPrivateKeyToBase64(c.blsKeyPair.PrivateKey)
+		keyData.BLSPublicKey = crypto.BLSPublicKeyToBase64(c.blsKeyPair.PublicKey)
+	}
 
 	// Serialize key data
 	data, err := json.MarshalIndent(keyData, "", "  ")
@@ -103,15 +143,73 @@ func (c *Client) GetUserID() int {
 }
 
 // GetPublicKey returns the client's public key
-func (c *Client) GetPublicKey() ed25519.PubKey {
+func (c *Client) GetPublicKey() crypto.PubKey {
 	return c.keyPair.PublicKey
 }
 
+// GetKeyType returns the type of the client's key
+func (c *Client) GetKeyType() crypto.KeyType {
+	return c.keyPair.KeyType()
+}
+
 // GetPublicKeyBase64 returns the client's public key as a base64 string
 func (c *Client) GetPublicKeyBase64() string {
 	return crypto.PublicKeyToBase64(c.keyPair.PublicKey)
 }
 
+// SetChainID sets the chain the client signs operations for
+func (c *Client) SetChainID(chainID string) {
+	c.chainID = chainID
+}
+
+// GetChainID returns the chain the client signs operations for
+func (c *Client) GetChainID() string {
+	return c.chainID
+}
+
+// SetEncoding sets the name of the registered codec EncodeTransaction uses,
+// such as types.EncodingProtobuf or types.EncodingCompact
+func (c *Client) SetEncoding(encoding string) {
+	c.encoding = encoding
+}
+
+// EncodeTransaction serializes a transaction for broadcasting, using the client's encoding
+func (c *Client) EncodeTransaction(tx *types.Transaction) ([]byte, error) {
+	if c.encoding == "" {
+		return tx.Serialize()
+	}
+	return tx.SerializeAs(c.encoding)
+}
+
+// SetNonce sets the last nonce used by the client's account, for example from
+// the account's state on chain. The next operation gets the following nonce.
+func (c *Client) SetNonce(nonce uint64) {
+	c.nonce.Store(nonce)
+}
+
+// nextNonce returns the nonce for a new operation
+func (c *Client) nextNonce() uint64 {
+	return c.nonce.Add(1)
+}
+
+// GenerateBLSKey generates a BLS key pair for the client, replacing any existing one
+func (c *Client) GenerateBLSKey() error {
+	blsKeyPair, err := crypto.GenerateBLSKeyPair()
+	if err != nil {
+		return err
+	}
+	c.blsKeyPair = blsKeyPair
+	return nil
+}
+
+// GetBLSPublicKey returns the client's BLS public key, or nil if it has none
+func (c *Client) GetBLSPublicKey() crypto.BLSPubKey {
+	if c.blsKeyPair == nil {
+		return nil
+	}
+	return c.blsKeyPair.PublicKey
+}
+
 // CreateTransaction creates a new transaction with the given operations
 func (c *Client) CreateTransaction(operations []types.Operation) (*types.Transaction, error) {
 	// Sign each operation
@@ -123,10 +221,7 @@ func (c *Client) CreateTransaction(operations []types.Operation) (*types.Transac
 		}
 
 		// Get data to sign
-		dataToSign, err := op.GetDataForSigning()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get operation %d data for signing: %w", i, err)
-		}
+		dataToSign := op.SignBytes(c.chainID)
 
 		// Sign operation
 		signature, err := c.keyPair.Sign(dataToSign)
@@ -148,12 +243,82 @@ func (c *Client) CreateTransaction(operations []types.Operation) (*types.Transac
 	return tx, nil
 }
 
-// CreateTransferOperation creates a new transfer operation (unsigned)
-func (c *Client) CreateTransferOperation(to int, amount int) types.Operation {
+// CreateBatchTransaction creates a new transaction in which the client signs all operations once.
+// This saves a signature per operation, but every operation must be sent by this client.
+func (c *Client) CreateBatchTransaction(operations []types.Operation) (*types.Transaction, error) {
+	// Make sure every operation is from this client and unsigned
+	unsignedOperations := make([]types.Operation, len(operations))
+	for i, op := range operations {
+		if op.From != c.userID {
+			return nil, fmt.Errorf("operation %d has sender %d, but client is for user %d", i, op.From, c.userID)
+		}
+		op.Signature = ""
+		unsignedOperations[i] = op
+	}
+
+	// Create transaction with the client as batch sender
+	tx := &types.Transaction{
+		Operations: unsignedOperations,
+		Sender:     c.userID,
+	}
+
+	// Get data to sign
+	dataToSign := tx.BatchSignBytes(c.chainID)
+
+	// Sign the whole batch
+	signature, err := c.keyPair.Sign(dataToSign)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign batch: %w", err)
+	}
+	tx.Signature = signature
+
+	return tx, nil
+}
+
+// CreateTransferOperation creates a new transfer operation (unsigned).
+// Like the other Create*Operation methods, it assigns the client's next nonce.
+func (c *Client) CreateTransferOperation(to int, amount uint64) types.Operation {
 	return types.Operation{
 		From:   c.userID,
 		To:     to,
 		Amount: amount,
+		Nonce:  c.nextNonce(),
+	}
+}
+
+// CreateMintOperation creates a new mint operation (unsigned).
+// The client must hold the mint authority key configured at genesis.
+func (c *Client) CreateMintOperation(to int, amount uint64) types.Operation {
+	return types.Operation{
+		Type:   types.OpTypeMint,
+		From:   c.userID,
+		To:     to,
+		Amount: amount,
+		Nonce:  c.nextNonce(),
+	}
+}
+
+// CreateBurnOperation creates a new burn operation (unsigned) that destroys
+// tokens from the mint authority's own balance
+func (c *Client) CreateBurnOperation(amount uint64) types.Operation {
+	return types.Operation{
+		Type:   types.OpTypeBurn,
+		From:   c.userID,
+		Amount: amount,
+		Nonce:  c.nextNonce(),
+	}
+}
+
+// CreateSetLimitsOperation creates a new operation (unsigned) that configures the limits
+// of an account. Owners may configure their own account; the admin authority may configure any.
+// Passing nil limits clears them.
+func (c *Client) CreateSetLimitsOperation(account int, limits *types.AccountLimits) types.Operation {
+	return types.Operation{
+		Type:   types.OpTypeSetLimits,
+		From:   c.userID,
+		To:     account,
+		Limits: limits,
+		Nonce:  c.nextNonce(),
 	}
 }
 
@@ -165,10 +330,7 @@ func (c *Client) SignOperation(op types.Operation) (types.Operation, error) {
 	}
 
 	// Get data to sign
-	dataToSign, err := op.GetDataForSigning()
-	if err != nil {
-		return op, fmt.Errorf("failed to get operation data for signing: %w", err)
-	}
+	dataToSign := op.SignBytes(c.chainID)
 
 	// Sign operation
 	signature, err := c.keyPair.Sign(dataToSign)
@@ -182,8 +344,57 @@ func (c *Client) SignOperation(op types.Operation) (types.Operation, error) {
 	return signedOp, nil
 }
 
+// SignOperationBLS signs an operation with the client's BLS key and returns the
+// signature, to be aggregated with other senders' signatures by CreateAggregateTransaction
+func (c *Client) SignOperationBLS(op types.Operation) (string, error) {
+	if c.blsKeyPair == nil {
+		return "", fmt.Errorf("client for user %d has no BLS key", c.userID)
+	}
+
+	// Make sure the operation is from this client
+	if op.From != c.userID {
+		return "", fmt.Errorf("operation has sender %d, but client is for user %d", op.From, c.userID)
+	}
+
+	// Get data to sign
+	dataToSign := op.SignBytes(c.chainID)
+
+	// Sign operation
+	signature, err := c.blsKeyPair.Sign(dataToSign)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign operation: %w", err)
+	}
+	return signature, nil
+}
+
+// CreateAggregateTransaction creates a transaction from operations of any senders,
+// given each operation's BLS signature. The signatures are aggregated into one.
+func CreateAggregateTransaction(operations []types.Operation, signatures []string) (*types.Transaction, error) {
+	if len(operations) != len(signatures) {
+		return nil, fmt.Errorf("got %d signatures for %d operations", len(signatures), len(operations))
+	}
+
+	// Aggregate the signatures
+	aggregate, err := crypto.AggregateBLSSignatures(signatures)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate signatures: %w", err)
+	}
+
+	// Operations carry no signature of their own
+	unsignedOperations := make([]types.Operation, len(operations))
+	for i, op := range operations {
+		op.Signature = ""
+		unsignedOperations[i] = op
+	}
+
+	return &types.Transaction{
+		Operations:         unsignedOperations,
+		AggregateSignature: aggregate,
+	}, nil
+}
+
 // CreateBatchedTransferOperations creates a batch of transfer operations
-func (c *Client) CreateBatchedTransferOperations(recipients []int, amounts []int) ([]types.Operation, error) {
+func (c *Client) CreateBatchedTransferOperations(recipients []int, amounts []uint64) ([]types.Operation, error) {
 	if len(recipients) != len(amounts) {
 		return nil, fmt.Errorf("recipients and amounts must have the same length")
 	}
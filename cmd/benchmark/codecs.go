@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/client"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// CodecResult represents the result of a single codec benchmark run
+type CodecResult struct {
+	Codec       string
+	BatchSize   int
+	Operations  int
+	BytesPerOp  float64 // Encoded transaction bytes per operation
+	EncodePerOp float64 // Encoding time per operation in nanoseconds
+	DecodePerOp float64 // Decoding time per operation in nanoseconds
+}
+
+// runCodecBenchmarks measures the size and speed of every registered transaction codec
+// on the same per-operation signed transactions
+func runCodecBenchmarks(batchSizes []int, numOperations int) ([]CodecResult, error) {
+	var results []CodecResult
+
+	for _, batchSize := range batchSizes {
+		// Sign the transactions once, so every codec encodes the same data
+		sender := client.NewClient(1)
+		var txs []*types.Transaction
+		for i := 0; i < numOperations; i += batchSize {
+			end := i + batchSize
+			if end > numOperations {
+				end = numOperations
+			}
+
+			operations := make([]types.Operation, 0, end-i)
+			for j := i; j < end; j++ {
+				operations = append(operations, sender.CreateTransferOperation(2+j%10, uint64(1+j%100)))
+			}
+
+			tx, err := sender.CreateTransaction(operations)
+			if err != nil {
+				return nil, fmt.Errorf("failed to sign transaction: %w", err)
+			}
+			txs = append(txs, tx)
+		}
+
+		for _, name := range types.CodecNames() {
+			fmt.Printf("Running codec benchmark with batch size %d and codec %s...\n", batchSize, name)
+
+			// Encode the transactions
+			encoded := make([][]byte, len(txs))
+			totalBytes := 0
+			encodeStart := time.Now()
+			for i, tx := range txs {
+				data, err := tx.SerializeAs(name)
+				if err != nil {
+					return nil, fmt.Errorf("failed to encode transaction with %s: %w", name, err)
+				}
+				encoded[i] = data
+				totalBytes += len(data)
+			}
+			encodeElapsed := time.Since(encodeStart)
+
+			// Decode the transactions, detecting the codec as the application does
+			decodeStart := time.Now()
+			for _, data := range encoded {
+				if _, err := types.ParseTransaction(data); err != nil {
+					return nil, fmt.Errorf("failed to decode %s transaction: %w", name, err)
+				}
+			}
+			decodeElapsed := time.Since(decodeStart)
+
+			// Record the result
+			result := CodecResult{
+				Codec:       name,
+				BatchSize:   batchSize,
+				Operations:  numOperations,
+				BytesPerOp:  float64(totalBytes) / float64(numOperations),
+				EncodePerOp: float64(encodeElapsed.Nanoseconds()) / float64(numOperations),
+				DecodePerOp: float64(decodeElapsed.Nanoseconds()) / float64(numOperations),
+			}
+			results = append(results, result)
+
+			fmt.Printf("Codec: %s, Batch Size: %d, Bytes/op: %.1f, Encode: %.0f ns/op, Decode: %.0f ns/op\n",
+				name, batchSize, result.BytesPerOp, result.EncodePerOp, result.DecodePerOp)
+		}
+	}
+
+	return results, nil
+}
+
+// generateCodecCSV generates a CSV file from the codec benchmark results
+func generateCodecCSV(results []CodecResult, outputFile string) error {
+	// Create the file
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %w", err)
+	}
+	defer file.Close()
+
+	// Create the CSV writer
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	// Write the header
+	header := []string{"Codec", "BatchSize", "Operations", "BytesPerOp", "EncodeNsPerOp", "DecodeNsPerOp"}
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	// Write the results
+	for _, result := range results {
+		row := []string{
+			result.Codec,
+			fmt.Sprintf("%d", result.BatchSize),
+			fmt.Sprintf("%d", result.Operations),
+			fmt.Sprintf("%.2f", result.BytesPerOp),
+			fmt.Sprintf("%.2f", result.EncodePerOp),
+			fmt.Sprintf("%.2f", result.DecodePerOp),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"text/template"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/xmonader/test_batched_tx_tendermint/app"
 	"github.com/xmonader/test_batched_tx_tendermint/storage"
 )
 
@@ -19,11 +24,20 @@ var (
 	batchSizes      = flag.String("batch-sizes", "1,10,50,100,500,1000", "Comma-separated list of batch sizes to benchmark")
 	numAccounts     = flag.Int("num-accounts", 1000, "Number of accounts to create")
 	numOperations   = flag.Int("num-operations", 10000, "Number of operations to perform")
-	storageBackends = flag.String("storage-backends", "memory,badger,sqlite,redis,tigerbeetle", "Comma-separated list of storage backends to benchmark")
+	storageBackends = flag.String("storage-backends", "memory,badger,sqlite,redis,tigerbeetle,postgres", "Comma-separated list of storage backends to benchmark")
 	outputDir       = flag.String("output-dir", "benchmark_results", "Directory to store benchmark results")
 	genCharts       = flag.Bool("generate-charts", true, "Whether to generate charts from the results")
+	codecBench      = flag.Bool("codec-benchmarks", true, "Whether to benchmark the size and speed of every registered transaction codec")
+	sigModes        = flag.String("signature-modes", "per-op,batch,bls-aggregate", "Comma-separated list of signature modes to benchmark (per-op, batch, bls-aggregate), empty to skip")
+	storageAPIBench = flag.Bool("storage-api-benchmarks", true, "Whether to compare per-call balance updates with ApplyTransfers batches on every storage backend")
+	storageTimeout  = flag.Duration("storage-timeout", 0, "Maximum duration of each storage call, such as 5s, 0 for no limit")
+	postgresDSN     = flag.String("postgres-dsn", "postgres://postgres@localhost:5432/postgres", "Connection string of the PostgreSQL server of the postgres backend")
+	postgresIso     = flag.String("postgres-isolation", "serializable", "Isolation level of the postgres backend transactions (serializable, read_committed)")
 )
 
+// storageMetrics records the latency of the storage calls of every benchmark
+var storageMetrics = app.NewMetrics()
+
 // BenchmarkResult represents the result of a single benchmark run
 type BenchmarkResult struct {
 	BatchSize      int
@@ -55,14 +69,54 @@ func main() {
 		log.Fatalf("Failed to parse storage backends: %v", err)
 	}
 
-	// Run benchmarks
-	results := runBenchmarks(batchSizeList, storageBackendList, *numAccounts, *numOperations)
+	// Run benchmarks, stopping the storage calls on interrupt
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	results := runBenchmarks(ctx, batchSizeList, storageBackendList, *numAccounts, *numOperations)
 
 	// Generate report
 	if err := generateReport(results, *outputDir); err != nil {
 		log.Fatalf("Failed to generate report: %v", err)
 	}
 
+	// Run storage API benchmarks
+	if *storageAPIBench {
+		apiResults, err := runStorageAPIBenchmarks(ctx, batchSizeList, storageBackendList, *numAccounts, *numOperations)
+		if err != nil {
+			log.Fatalf("Failed to run storage API benchmarks: %v", err)
+		}
+		if err := generateStorageAPICSV(apiResults, filepath.Join(*outputDir, "storage_api_results.csv")); err != nil {
+			log.Fatalf("Failed to generate storage API CSV file: %v", err)
+		}
+	}
+
+	// Run signature benchmarks
+	if *sigModes != "" {
+		var sigModeList []string
+		if err := parseStringList(*sigModes, &sigModeList); err != nil {
+			log.Fatalf("Failed to parse signature modes: %v", err)
+		}
+
+		sigResults, err := runSignatureBenchmarks(batchSizeList, sigModeList, *numOperations)
+		if err != nil {
+			log.Fatalf("Failed to run signature benchmarks: %v", err)
+		}
+		if err := generateSignatureCSV(sigResults, filepath.Join(*outputDir, "signature_results.csv")); err != nil {
+			log.Fatalf("Failed to generate signature CSV file: %v", err)
+		}
+	}
+
+	// Run codec benchmarks
+	if *codecBench {
+		codecResults, err := runCodecBenchmarks(batchSizeList, *numOperations)
+		if err != nil {
+			log.Fatalf("Failed to run codec benchmarks: %v", err)
+		}
+		if err := generateCodecCSV(codecResults, filepath.Join(*outputDir, "codec_results.csv")); err != nil {
+			log.Fatalf("Failed to generate codec CSV file: %v", err)
+		}
+	}
+
 	// Generate charts
 	if *genCharts {
 		if err := generateCharts(filepath.Join(*outputDir, "benchmark_results.csv")); err != nil {
@@ -111,63 +165,32 @@ func parseStringList(s string, result *[]string) error {
 }
 
 // runBenchmarks runs benchmarks with different batch sizes and storage backends
-func runBenchmarks(batchSizes []int, storageBackends []string, numAccounts, numOperations int) []BenchmarkResult {
+func runBenchmarks(ctx context.Context, batchSizes []int, storageBackends []string, numAccounts, numOperations int) []BenchmarkResult {
 	var results []BenchmarkResult
 
 	for _, storageBackend := range storageBackends {
 		for _, batchSize := range batchSizes {
-			fmt.Printf("Running benchmark with batch size %d and storage backend %s...\n", batchSize, storageBackend)
-
-			// Create a storage instance
-			storageConfig := make(map[string]interface{})
-			switch storageBackend {
-			case "memory":
-				// No additional configuration needed
-			case "badger":
-				storageConfig["db_path"] = filepath.Join(*outputDir, "badger")
-			case "sqlite":
-				storageConfig["db_path"] = filepath.Join(*outputDir, "sqlite.db")
-			case "redis":
-				storageConfig["address"] = "localhost:6379"
-			case "tigerbeetle":
-				storageConfig["addresses"] = []interface{}{"localhost:3000"}
-				storageConfig["cluster_id"] = float64(0)
+			if ctx.Err() != nil {
+				return results
 			}
+			fmt.Printf("Running benchmark with batch size %d and storage backend %s...\n", batchSize, storageBackend)
 
 			// Create the storage
-			var store storage.Storage
-			var err error
-
-			switch storageBackend {
-			case "memory":
-				store, err = storage.NewMemoryStorage(storageConfig)
-			case "badger":
-				store, err = storage.NewBadgerStorage(storageConfig)
-			case "sqlite":
-				store, err = storage.NewSQLiteStorage(storageConfig)
-			case "redis":
-				store, err = storage.NewRedisStorage(storageConfig)
-			case "tigerbeetle":
-				store, err = storage.NewTigerBeetleStorage(storageConfig)
-			default:
-				log.Printf("Unknown storage backend: %s", storageBackend)
-				continue
-			}
-
+			store, err := openBenchmarkStorage(storageBackend, *outputDir)
 			if err != nil {
 				log.Printf("Failed to create storage %s: %v", storageBackend, err)
 				continue
 			}
 
 			// Initialize the storage
-			if err := store.Initialize(); err != nil {
+			if err := store.Initialize(ctx); err != nil {
 				log.Printf("Failed to initialize storage %s: %v", storageBackend, err)
 				continue
 			}
 
 			// Create accounts
 			for i := 1; i <= numAccounts; i++ {
-				if err := store.CreateAccount(i, 1000000); err != nil {
+				if err := store.CreateAccount(ctx, i, 1000000); err != nil {
 					log.Printf("Failed to create account %d: %v", i, err)
 					continue
 				}
@@ -177,7 +200,7 @@ func runBenchmarks(batchSizes []int, storageBackends []string, numAccounts, numO
 			type Transfer struct {
 				From   int
 				To     int
-				Amount int
+				Amount uint64
 			}
 
 			transfers := make([]Transfer, numOperations)
@@ -191,40 +214,47 @@ func runBenchmarks(batchSizes []int, storageBackends []string, numAccounts, numO
 
 			// Run the benchmark
 			start := time.Now()
-			for i := 0; i < numOperations; i += batchSize {
+			for i := 0; i < numOperations && ctx.Err() == nil; i += batchSize {
 				end := i + batchSize
 				if end > numOperations {
 					end = numOperations
 				}
 
 				// Begin transaction
-				if err := store.BeginTransaction(); err != nil {
+				tx, err := store.Begin(ctx)
+				if err != nil {
 					log.Printf("Failed to begin transaction: %v", err)
 					continue
 				}
 
 				// Execute transfers in batch
 				for _, transfer := range transfers[i:end] {
-					if err := store.UpdateBalance(transfer.From, -transfer.Amount); err != nil {
+					if err := tx.Debit(ctx, transfer.From, transfer.Amount); err != nil {
 						log.Printf("Failed to debit account %d: %v", transfer.From, err)
-						store.Rollback()
-						continue
+						tx.Rollback(ctx)
+						break
 					}
-					if err := store.UpdateBalance(transfer.To, transfer.Amount); err != nil {
+					if err := tx.Credit(ctx, transfer.To, transfer.Amount); err != nil {
 						log.Printf("Failed to credit account %d: %v", transfer.To, err)
-						store.Rollback()
-						continue
+						tx.Rollback(ctx)
+						break
 					}
 				}
 
-				// Commit transaction
-				if err := store.Commit(); err != nil {
+				// Commit transaction, unless it was rolled back
+				if err := tx.Commit(ctx); err != nil && !errors.Is(err, storage.ErrTransactionDone) {
 					log.Printf("Failed to commit transaction: %v", err)
 					continue
 				}
 			}
 			elapsed := time.Since(start)
 
+			// An interrupted run is not recorded
+			if ctx.Err() != nil {
+				store.Close()
+				return results
+			}
+
 			// Calculate metrics
 			numBatches := (numOperations + batchSize - 1) / batchSize
 			tps := float64(numBatches) / elapsed.Seconds()
@@ -254,6 +284,65 @@ func runBenchmarks(batchSizes []int, storageBackends []string, numAccounts, numO
 	return results
 }
 
+// newBenchmarkStorage creates a storage backend keeping its files in dataDir
+func newBenchmarkStorage(backend string, dataDir string) (storage.ContextStorage, error) {
+	storageConfig := make(map[string]interface{})
+	switch backend {
+	case "memory":
+		return storage.NewMemoryStorage(storageConfig)
+	case "badger":
+		storageConfig["db_path"] = filepath.Join(dataDir, "badger")
+		return storage.NewBadgerStorage(storageConfig)
+	case "sqlite":
+		storageConfig["db_path"] = filepath.Join(dataDir, "sqlite.db")
+		return storage.NewSQLiteStorage(storageConfig)
+	case "redis":
+		storageConfig["address"] = "localhost:6379"
+		return storage.NewRedisStorage(storageConfig)
+	case "tigerbeetle":
+		storageConfig["addresses"] = []interface{}{"localhost:3000"}
+		storageConfig["cluster_id"] = float64(0)
+		return storage.NewTigerBeetleStorage(storageConfig)
+	case "postgres":
+		// The table takes the place of the data directory, emptied so the
+		// run starts like the file-based backends
+		table := "benchmark_" + filepath.Base(dataDir)
+		if err := dropPostgresTable(*postgresDSN, table); err != nil {
+			return nil, err
+		}
+		storageConfig["dsn"] = *postgresDSN
+		storageConfig["table"] = table
+		storageConfig["isolation"] = *postgresIso
+		return storage.NewPostgresStorage(storageConfig)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+// openBenchmarkStorage creates a storage backend for a benchmark, limiting
+// every call to the storage timeout and recording its latency
+func openBenchmarkStorage(backend string, dataDir string) (storage.ContextStorage, error) {
+	store, err := newBenchmarkStorage(backend, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewInstrumentedStorage(storage.WithCallTimeout(store, *storageTimeout), storageMetrics.StorageObserver(backend)), nil
+}
+
+// dropPostgresTable drops a table left by an earlier run of the benchmark
+func dropPostgresTable(dsn, table string) error {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{table}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to drop table %s: %w", table, err)
+	}
+	return nil
+}
+
 // Import the benchmark report package
 // This is a workaround since we're in the same package as benchmark_report.go
 // In a real project, this would be a separate package
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/client"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// SignatureResult represents the result of a single signature mode benchmark run
+type SignatureResult struct {
+	Mode         string
+	BatchSize    int
+	Transactions int
+	Operations   int
+	Signatures   int     // Number of signatures verified
+	BytesPerOp   float64 // Serialized transaction bytes per operation
+	SignPerOp    float64 // Signing time per operation in microseconds
+	VerifyPerOp  float64 // Verification time per operation in microseconds
+	VerifiedOPS  float64 // Operations verified per second
+}
+
+// numSignatureSenders is the number of senders whose operations are mixed
+// in the transactions of multi-sender signature modes
+const numSignatureSenders = 10
+
+// signatureMode describes how the transactions of a signature mode are created
+type signatureMode struct {
+	multiSender bool // Operations come from all senders rather than the first one
+	sign        func(senders []*client.Client, operations []types.Operation) (*types.Transaction, error)
+}
+
+// signatureModes holds the benchmarked signature modes
+var signatureModes = map[string]signatureMode{
+	"per-op":        {multiSender: true, sign: signPerOperation},
+	"batch":         {multiSender: false, sign: signBatch},
+	"bls-aggregate": {multiSender: true, sign: signAggregate},
+}
+
+// signPerOperation signs every operation with its sender's ed25519 key
+func signPerOperation(senders []*client.Client, operations []types.Operation) (*types.Transaction, error) {
+	signedOperations := make([]types.Operation, len(operations))
+	for i, op := range operations {
+		signedOp, err := senders[op.From-1].SignOperation(op)
+		if err != nil {
+			return nil, err
+		}
+		signedOperations[i] = signedOp
+	}
+	return &types.Transaction{Operations: signedOperations}, nil
+}
+
+// signBatch signs all operations of the single sender at once
+func signBatch(senders []*client.Client, operations []types.Operation) (*types.Transaction, error) {
+	return senders[0].CreateBatchTransaction(operations)
+}
+
+// signAggregate signs every operation with its sender's BLS key and aggregates the signatures
+func signAggregate(senders []*client.Client, operations []types.Operation) (*types.Transaction, error) {
+	signatures := make([]string, len(operations))
+	for i, op := range operations {
+		signature, err := senders[op.From-1].SignOperationBLS(op)
+		if err != nil {
+			return nil, err
+		}
+		signatures[i] = signature
+	}
+	return client.CreateAggregateTransaction(operations, signatures)
+}
+
+// countSignatures returns the number of signatures carried by a transaction
+func countSignatures(tx *types.Transaction) int {
+	if tx.IsBatchSigned() || tx.IsAggregateSigned() {
+		return 1
+	}
+	return len(tx.Operations)
+}
+
+// runSignatureBenchmarks measures signing and verification cost of each signature mode
+// by running the generated transactions through the application's TransactionProcessor
+func runSignatureBenchmarks(batchSizes []int, modes []string, numOperations int) ([]SignatureResult, error) {
+	var results []SignatureResult
+
+	for _, mode := range modes {
+		signatureMode, exists := signatureModes[mode]
+		if !exists {
+			return nil, fmt.Errorf("unknown signature mode: %s", mode)
+		}
+
+		for _, batchSize := range batchSizes {
+			fmt.Printf("Running signature benchmark with batch size %d and mode %s...\n", batchSize, mode)
+
+			// Set up a processor with funded, registered senders
+			stateStore := app.NewStateStore("")
+			txProcessor := app.NewTransactionProcessor(stateStore, app.NewMetrics())
+			senders := make([]*client.Client, numSignatureSenders)
+			for i := range senders {
+				sender := client.NewClient(i + 1)
+				if err := sender.GenerateBLSKey(); err != nil {
+					return nil, fmt.Errorf("failed to generate BLS key: %w", err)
+				}
+				if err := stateStore.Mint(sender.GetUserID(), uint64(numOperations+1)); err != nil {
+					return nil, fmt.Errorf("failed to fund sender: %w", err)
+				}
+				txProcessor.RegisterUserKey(sender.GetUserID(), sender.GetPublicKey())
+				txProcessor.RegisterBLSKey(sender.GetUserID(), sender.GetBLSPublicKey())
+				senders[i] = sender
+			}
+
+			// Sign the transactions
+			var txs []*types.Transaction
+			totalBytes := 0
+			signStart := time.Now()
+			for i := 0; i < numOperations; i += batchSize {
+				end := i + batchSize
+				if end > numOperations {
+					end = numOperations
+				}
+
+				operations := make([]types.Operation, 0, end-i)
+				for j := i; j < end; j++ {
+					sender := senders[0]
+					if signatureMode.multiSender {
+						sender = senders[j%len(senders)]
+					}
+					operations = append(operations, sender.CreateTransferOperation(numSignatureSenders+1+j%10, 1))
+				}
+
+				tx, err := signatureMode.sign(senders, operations)
+				if err != nil {
+					return nil, fmt.Errorf("failed to sign transaction: %w", err)
+				}
+				txs = append(txs, tx)
+			}
+			signElapsed := time.Since(signStart)
+
+			for _, tx := range txs {
+				data, err := tx.Serialize()
+				if err != nil {
+					return nil, fmt.Errorf("failed to serialize transaction: %w", err)
+				}
+				totalBytes += len(data)
+			}
+
+			// Verify the transactions
+			signatures := 0
+			verifyStart := time.Now()
+			for _, tx := range txs {
+				if err := txProcessor.ValidateTransaction(tx); err != nil {
+					return nil, fmt.Errorf("failed to validate transaction: %w", err)
+				}
+				signatures += countSignatures(tx)
+			}
+			verifyElapsed := time.Since(verifyStart)
+
+			// Record the result
+			result := SignatureResult{
+				Mode:         mode,
+				BatchSize:    batchSize,
+				Transactions: len(txs),
+				Operations:   numOperations,
+				Signatures:   signatures,
+				BytesPerOp:   float64(totalBytes) / float64(numOperations),
+				SignPerOp:    float64(signElapsed.Microseconds()) / float64(numOperations),
+				VerifyPerOp:  float64(verifyElapsed.Microseconds()) / float64(numOperations),
+				VerifiedOPS:  float64(numOperations) / verifyElapsed.Seconds(),
+			}
+			results = append(results, result)
+
+			fmt.Printf("Mode: %s, Batch Size: %d, Signatures: %d, Bytes/op: %.1f, Sign: %.2f us/op, Verify: %.2f us/op, Verified OPS: %.2f\n",
+				mode, batchSize, signatures, result.BytesPerOp, result.SignPerOp, result.VerifyPerOp, result.VerifiedOPS)
+		}
+	}
+
+	return results, nil
+}
+
+// generateSignatureCSV generates a CSV file from the signature benchmark results
+func generateSignatureCSV(results []SignatureResult, outputFile string) error {
+	// Create the file
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %w", err)
+	}
+	defer file.Close()
+
+	// Create the CSV writer
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	// Write the header
+	header := []string{"Mode", "BatchSize", "Transactions", "Operations", "Signatures", "BytesPerOp", "SignUsPerOp", "VerifyUsPerOp", "VerifiedOPS"}
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	// Write the results
+	for _, result := range results {
+		row := []string{
+			result.Mode,
+			fmt.Sprintf("%d", result.BatchSize),
+			fmt.Sprintf("%d", result.Transactions),
+			fmt.Sprintf("%d", result.Operations),
+			fmt.Sprintf("%d", result.Signatures),
+			fmt.Sprintf("%.2f", result.BytesPerOp),
+			fmt.Sprintf("%.2f", result.SignPerOp),
+			fmt.Sprintf("%.2f", result.VerifyPerOp),
+			fmt.Sprintf("%.2f", result.VerifiedOPS),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// Storage APIs compared by the storage API benchmarks
+const (
+	// apiCalls runs each batch as a transaction with a Debit and a Credit
+	// call per transfer
+	apiCalls = "calls"
+	// apiApplyTransfers runs each batch as one atomic ApplyTransfers call on
+	// the storage, which each backend implements natively
+	apiApplyTransfers = "apply-transfers"
+	// apiTxApplyTransfers runs each batch as one atomic ApplyTransfers call
+	// in a transaction, which can hold savepoints
+	apiTxApplyTransfers = "tx-apply-transfers"
+)
+
+// StorageAPIResult represents the result of a single storage API benchmark run
+type StorageAPIResult struct {
+	API            string
+	StorageBackend string
+	BatchSize      int
+	Operations     int
+	OPS            float64
+	Latency        float64 // Time per batch in milliseconds
+	Failed         int     // Transfers that were not applied
+	Calls          string  // Storage methods called by the batches, with their counts
+}
+
+// callCounter counts the calls of each storage method, as the observer of
+// an instrumented storage
+type callCounter map[string]int
+
+// observe counts a call
+func (c callCounter) observe(method string, _ time.Duration) {
+	c[method]++
+}
+
+// String lists the methods called with their counts, in order of name
+func (c callCounter) String() string {
+	methods := make([]string, 0, len(c))
+	for method := range c {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for i, method := range methods {
+		methods[i] = fmt.Sprintf("%s=%d", method, c[method])
+	}
+	return strings.Join(methods, " ")
+}
+
+// runStorageAPIBenchmarks measures batching at the storage layer, running the
+// same transfers through per-call updates and through ApplyTransfers, on the
+// storage and in a transaction, on every storage backend
+func runStorageAPIBenchmarks(ctx context.Context, batchSizes []int, storageBackends []string, numAccounts, numOperations int) ([]StorageAPIResult, error) {
+	var results []StorageAPIResult
+
+	transfers := make([]storage.Transfer, numOperations)
+	for i := range transfers {
+		transfers[i] = storage.Transfer{
+			From:   1 + (i % (numAccounts - 1)),
+			To:     1 + ((i + 1) % (numAccounts - 1)),
+			Amount: 1,
+		}
+	}
+
+	for _, storageBackend := range storageBackends {
+		for _, batchSize := range batchSizes {
+			for _, api := range []string{apiCalls, apiApplyTransfers, apiTxApplyTransfers} {
+				if err := ctx.Err(); err != nil {
+					return results, err
+				}
+				fmt.Printf("Running storage API benchmark with %s, batch size %d and storage backend %s...\n", api, batchSize, storageBackend)
+
+				result, err := runStorageAPIBenchmark(ctx, api, storageBackend, batchSize, numAccounts, transfers)
+				if err != nil {
+					fmt.Printf("Skipping %s storage: %v\n", storageBackend, err)
+					continue
+				}
+				results = append(results, *result)
+
+				fmt.Printf("API: %s, Batch Size: %d, OPS: %.2f, Latency: %.2f ms, Failed: %d, Calls: %s\n",
+					api, batchSize, result.OPS, result.Latency, result.Failed, result.Calls)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// runStorageAPIBenchmark runs the transfers in batches through one API, on a
+// new storage instance with funded accounts
+func runStorageAPIBenchmark(ctx context.Context, api string, storageBackend string, batchSize, numAccounts int, transfers []storage.Transfer) (*StorageAPIResult, error) {
+	// Keep the files of every run apart, so each starts empty
+	dataDir := filepath.Join(*outputDir, "storage_api", fmt.Sprintf("%s-%s-%d", storageBackend, api, batchSize))
+	defer os.RemoveAll(dataDir)
+
+	store, err := openBenchmarkStorage(storageBackend, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Initialize(ctx); err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer store.Close()
+
+	// Fund the accounts in one transaction
+	tx, err := store.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	accounts := make([]*types.Account, numAccounts)
+	for i := range accounts {
+		accounts[i] = &types.Account{ID: i + 1, Balance: 1000000}
+	}
+	if err := tx.CreateAccounts(ctx, accounts); err != nil {
+		tx.Rollback(ctx)
+		return nil, fmt.Errorf("failed to create accounts: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit accounts: %w", err)
+	}
+
+	// Run the benchmark, counting the storage calls each API makes
+	calls := make(callCounter)
+	store = storage.NewInstrumentedStorage(store, calls.observe)
+	failed := 0
+	start := time.Now()
+	for i := 0; i < len(transfers); i += batchSize {
+		batch := transfers[i:min(i+batchSize, len(transfers))]
+
+		var err error
+		var batchResults []storage.TransferResult
+		switch api {
+		case apiApplyTransfers:
+			batchResults, err = store.ApplyTransfers(ctx, batch, storage.TransfersAtomic)
+		case apiTxApplyTransfers:
+			batchResults, err = applyInTx(ctx, store, batch)
+		default:
+			err = applyWithCalls(ctx, store, batch)
+			if err != nil && ctx.Err() == nil {
+				failed += len(batch)
+				err = nil
+			}
+		}
+		for _, r := range batchResults {
+			if r.Err != nil {
+				failed++
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	elapsed := time.Since(start)
+
+	numBatches := (len(transfers) + batchSize - 1) / batchSize
+	return &StorageAPIResult{
+		API:            api,
+		StorageBackend: storageBackend,
+		BatchSize:      batchSize,
+		Operations:     len(transfers),
+		OPS:            float64(len(transfers)) / elapsed.Seconds(),
+		Latency:        elapsed.Seconds() * 1000 / float64(numBatches),
+		Failed:         failed,
+		Calls:          calls.String(),
+	}, nil
+}
+
+// applyWithCalls applies a batch of transfers in a transaction of per-account updates
+func applyWithCalls(ctx context.Context, store storage.ContextStorage, batch []storage.Transfer) error {
+	tx, err := store.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range batch {
+		err := tx.Debit(ctx, t.From, t.Amount)
+		if err == nil {
+			err = tx.Credit(ctx, t.To, t.Amount)
+		}
+		if err != nil {
+			tx.Rollback(ctx)
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// applyInTx applies a batch of transfers with ApplyTransfers in a transaction
+func applyInTx(ctx context.Context, store storage.ContextStorage, batch []storage.Transfer) ([]storage.TransferResult, error) {
+	tx, err := store.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results, err := tx.ApplyTransfers(ctx, batch, storage.TransfersAtomic)
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, err
+	}
+	return results, tx.Commit(ctx)
+}
+
+// generateStorageAPICSV generates a CSV file from the storage API benchmark results
+func generateStorageAPICSV(results []StorageAPIResult, outputFile string) error {
+	// Create the file
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file: %w", err)
+	}
+	defer file.Close()
+
+	// Create the CSV writer
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	// Write the header
+	header := []string{"API", "StorageBackend", "BatchSize", "Operations", "OPS", "Latency", "Failed", "Calls"}
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	// Write the results
+	for _, result := range results {
+		row := []string{
+			result.API,
+			result.StorageBackend,
+			fmt.Sprintf("%d", result.BatchSize),
+			fmt.Sprintf("%d", result.Operations),
+			fmt.Sprintf("%.2f", result.OPS),
+			fmt.Sprintf("%.2f", result.Latency),
+			fmt.Sprintf("%d", result.Failed),
+			result.Calls,
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+
+	return nil
+}
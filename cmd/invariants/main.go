@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+)
+
+// Command-line flags
+var (
+	storageBackend = flag.String("storage-backend", "badger", "Storage backend to check")
+	storageConfig  = flag.String("storage-config", "{}", "JSON configuration passed to the storage backend")
+	expectedSupply = flag.String("expected-supply", "", "Expected total supply (empty to skip the supply check)")
+	height         = flag.Int64("height", 0, "Height reported in violation diagnostics")
+)
+
+func main() {
+	// Parse command-line flags
+	flag.Parse()
+
+	// Exit only once run has closed the storage
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run checks the invariants of the configured storage backend
+func run() error {
+	// Parse the storage configuration
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(*storageConfig), &config); err != nil {
+		return fmt.Errorf("failed to parse storage configuration: %w", err)
+	}
+
+	// Parse the expected supply
+	var supply *uint64
+	if *expectedSupply != "" {
+		value, err := strconv.ParseUint(*expectedSupply, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expected supply %q: %w", *expectedSupply, err)
+		}
+		supply = &value
+	}
+
+	// Create the storage
+	store, err := storage.GetStorage(*storageBackend, config)
+	if err != nil {
+		return fmt.Errorf("failed to create storage %s: %w", *storageBackend, err)
+	}
+
+	// Initialize the storage
+	if err := store.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize storage %s: %w", *storageBackend, err)
+	}
+	defer store.Close()
+
+	// Check the invariants
+	registry := app.DefaultInvariantRegistry()
+	if err := registry.CheckSource(store, *height, supply); err != nil {
+		return err
+	}
+
+	fmt.Printf("All invariants hold for storage backend %s: %v\n", *storageBackend, registry.Names())
+	return nil
+}
@@ -0,0 +1,407 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+)
+
+// Run modes of the application
+const (
+	// ModeABCI serves the application to an external CometBFT node
+	ModeABCI = "abci"
+	// ModeNode runs a CometBFT node in the same process, using a local client
+	ModeNode = "node"
+)
+
+// ABCI server transports
+const (
+	TransportSocket = "socket"
+	TransportGRPC   = "grpc"
+)
+
+// State persistence modes
+const (
+	PersistenceIncremental = "incremental"
+	PersistenceFull        = "full"
+)
+
+// Log formats
+const (
+	LogFormatPlain = "plain"
+	LogFormatJSON  = "json"
+)
+
+// EnvPrefix starts the name of every environment variable that overrides the configuration
+const EnvPrefix = "BATCHED_TX_"
+
+// Config is the application configuration
+type Config struct {
+	// Mode is either "abci" or "node"
+	Mode string `json:"mode"`
+
+	// StateFile is the file the application state is saved to
+	StateFile string `json:"state_file"`
+
+	// StatePersistence is either "incremental" or "full"
+	StatePersistence string `json:"state_persistence"`
+
+	// CometBFTHome is the CometBFT home directory read in node mode
+	CometBFTHome string `json:"cometbft_home"`
+
+	// SnapshotInterval is the number of blocks between two saves of the state
+	SnapshotInterval int64 `json:"snapshot_interval"`
+
+	ABCI    ABCIConfig    `json:"abci"`
+	Storage StorageConfig `json:"storage"`
+	Log     LogConfig     `json:"log"`
+	Block   BlockConfig   `json:"block"`
+	Metrics MetricsConfig `json:"metrics"`
+}
+
+// ABCIConfig configures the ABCI server used in abci mode
+type ABCIConfig struct {
+	// Address is the address the ABCI server listens on
+	Address string `json:"address"`
+
+	// Transport is either "socket" or "grpc"
+	Transport string `json:"transport"`
+}
+
+// StorageConfig selects a storage backend and its options
+type StorageConfig struct {
+	// Backend is the name of a registered storage backend, or empty for none
+	Backend string `json:"backend"`
+
+	// Config holds the backend's options, as passed to its factory
+	Config map[string]interface{} `json:"config"`
+
+	// CallTimeout limits the duration of each storage call, such as "5s",
+	// or is empty for no limit
+	CallTimeout string `json:"call_timeout"`
+}
+
+// Timeout returns the duration of CallTimeout, zero when it is empty or invalid
+func (c StorageConfig) Timeout() time.Duration {
+	timeout, _ := time.ParseDuration(c.CallTimeout)
+	return timeout
+}
+
+// LogConfig configures logging
+type LogConfig struct {
+	// Level is one of "debug", "info", "error" or "none"
+	Level string `json:"level"`
+
+	// Format is either "plain" or "json"
+	Format string `json:"format"`
+}
+
+// BlockConfig limits the blocks this node proposes. Zero means no limit.
+type BlockConfig struct {
+	// MaxTxs is the maximum number of transactions in a proposed block
+	MaxTxs int `json:"max_txs"`
+
+	// MaxOps is the maximum number of operations in a proposed block
+	MaxOps int `json:"max_ops"`
+}
+
+// MetricsConfig configures the metrics endpoint
+type MetricsConfig struct {
+	// ListenAddress is the address of the metrics HTTP server, or empty to disable it
+	ListenAddress string `json:"listen_address"`
+}
+
+// Default returns the default configuration
+func Default() *Config {
+	return &Config{
+		Mode:             ModeABCI,
+		StateFile:        "data/state.json",
+		StatePersistence: PersistenceIncremental,
+		CometBFTHome:     defaultCometBFTHome(),
+		SnapshotInterval: 1,
+		ABCI: ABCIConfig{
+			Address:   "tcp://0.0.0.0:26658",
+			Transport: TransportSocket,
+		},
+		Storage: StorageConfig{
+			Config: map[string]interface{}{},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: LogFormatPlain,
+		},
+	}
+}
+
+// defaultCometBFTHome returns $HOME/.cometbft, the home directory the cometbft command uses
+func defaultCometBFTHome() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".cometbft"
+	}
+	return filepath.Join(home, ".cometbft")
+}
+
+// Load reads a configuration file on top of the defaults, applies the
+// environment overrides and validates the result
+func Load(path string) (*Config, error) {
+	// Read the file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("configuration file %s not found, create one with \"config init\"", path)
+		}
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	// Decode the file over the defaults
+	config := Default()
+	if err := config.decode(data); err != nil {
+		return nil, fmt.Errorf("failed to decode configuration file %s: %w", path, err)
+	}
+
+	// Apply environment overrides
+	if err := config.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	// An empty CometBFT home means the default one
+	if config.CometBFTHome == "" {
+		config.CometBFTHome = defaultCometBFTHome()
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// decode decodes JSON with line comments into the configuration, rejecting unknown fields
+func (c *Config) decode(data []byte) error {
+	data = stripComments(data)
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return fmt.Errorf("line %d: %w", lineOf(data, syntaxErr.Offset), err)
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("line %d: %s must be a %s, got %s", lineOf(data, typeErr.Offset), typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return err
+	}
+
+	// A null storage config leaves no map for environment options
+	if c.Storage.Config == nil {
+		c.Storage.Config = map[string]interface{}{}
+	}
+	return nil
+}
+
+// envOverride sets a configuration field from an environment variable
+type envOverride struct {
+	name string
+	set  func(c *Config, value string) error
+}
+
+// envOverrides lists the environment variables that override configuration
+// fields. Their names are EnvPrefix followed by the upper-cased field path.
+var envOverrides = []envOverride{
+	{"MODE", stringField(func(c *Config) *string { return &c.Mode })},
+	{"STATE_FILE", stringField(func(c *Config) *string { return &c.StateFile })},
+	{"STATE_PERSISTENCE", stringField(func(c *Config) *string { return &c.StatePersistence })},
+	{"COMETBFT_HOME", stringField(func(c *Config) *string { return &c.CometBFTHome })},
+	{"SNAPSHOT_INTERVAL", jsonField(func(c *Config) interface{} { return &c.SnapshotInterval })},
+	{"ABCI_ADDRESS", stringField(func(c *Config) *string { return &c.ABCI.Address })},
+	{"ABCI_TRANSPORT", stringField(func(c *Config) *string { return &c.ABCI.Transport })},
+	{"STORAGE_BACKEND", stringField(func(c *Config) *string { return &c.Storage.Backend })},
+	{"STORAGE_CALL_TIMEOUT", stringField(func(c *Config) *string { return &c.Storage.CallTimeout })},
+	{"LOG_LEVEL", stringField(func(c *Config) *string { return &c.Log.Level })},
+	{"LOG_FORMAT", stringField(func(c *Config) *string { return &c.Log.Format })},
+	{"BLOCK_MAX_TXS", jsonField(func(c *Config) interface{} { return &c.Block.MaxTxs })},
+	{"BLOCK_MAX_OPS", jsonField(func(c *Config) interface{} { return &c.Block.MaxOps })},
+	{"METRICS_LISTEN_ADDRESS", stringField(func(c *Config) *string { return &c.Metrics.ListenAddress })},
+}
+
+// storageEnvPrefix starts the environment variables that set storage backend
+// options, such as BATCHED_TX_STORAGE_CONFIG_DB_PATH for "db_path"
+const storageEnvPrefix = EnvPrefix + "STORAGE_CONFIG_"
+
+// stringField returns a setter for a string field
+func stringField(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+// jsonField returns a setter that parses the value as JSON into a field
+func jsonField(field func(c *Config) interface{}) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		return json.Unmarshal([]byte(value), field(c))
+	}
+}
+
+// ApplyEnv applies the overrides found in a list of KEY=value environment entries
+func (c *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, entry := range environ {
+		if key, value, ok := strings.Cut(entry, "="); ok && strings.HasPrefix(key, EnvPrefix) {
+			env[key] = value
+		}
+	}
+
+	var errs []error
+	for _, override := range envOverrides {
+		value, ok := env[EnvPrefix+override.name]
+		if !ok {
+			continue
+		}
+		if err := override.set(c, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s%s: invalid value %q", EnvPrefix, override.name, value))
+		}
+	}
+
+	// Storage options are parsed as JSON when possible, so numbers and
+	// booleans keep their types, and taken as strings otherwise
+	for key, value := range env {
+		option, ok := strings.CutPrefix(key, storageEnvPrefix)
+		if !ok || option == "" {
+			continue
+		}
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+			parsed = value
+		}
+		c.Storage.Config[strings.ToLower(option)] = parsed
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks every field and reports all invalid ones
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Mode != ModeABCI && c.Mode != ModeNode {
+		invalid("mode", "must be %q or %q, got %q", ModeABCI, ModeNode, c.Mode)
+	}
+	if c.StateFile == "" {
+		invalid("state_file", "must not be empty")
+	}
+	if c.StatePersistence != PersistenceIncremental && c.StatePersistence != PersistenceFull {
+		invalid("state_persistence", "must be %q or %q, got %q", PersistenceIncremental, PersistenceFull, c.StatePersistence)
+	}
+	if c.SnapshotInterval < 1 {
+		invalid("snapshot_interval", "must be at least 1 block, got %d", c.SnapshotInterval)
+	}
+
+	if c.ABCI.Transport != TransportSocket && c.ABCI.Transport != TransportGRPC {
+		invalid("abci.transport", "must be %q or %q, got %q", TransportSocket, TransportGRPC, c.ABCI.Transport)
+	}
+	if c.Mode == ModeABCI && c.ABCI.Address == "" {
+		invalid("abci.address", "must not be empty in abci mode")
+	}
+
+	if c.Storage.Backend != "" {
+		if _, exists := storage.StorageRegistry[c.Storage.Backend]; !exists {
+			invalid("storage.backend", "unknown backend %q, available: %s", c.Storage.Backend, strings.Join(storageBackends(), ", "))
+		}
+	}
+	if c.Storage.CallTimeout != "" {
+		if timeout, err := time.ParseDuration(c.Storage.CallTimeout); err != nil || timeout <= 0 {
+			invalid("storage.call_timeout", "must be a positive duration such as \"5s\", got %q", c.Storage.CallTimeout)
+		}
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "error", "none":
+	default:
+		invalid("log.level", "must be one of debug, info, error or none, got %q", c.Log.Level)
+	}
+	if c.Log.Format != LogFormatPlain && c.Log.Format != LogFormatJSON {
+		invalid("log.format", "must be %q or %q, got %q", LogFormatPlain, LogFormatJSON, c.Log.Format)
+	}
+
+	if c.Block.MaxTxs < 0 {
+		invalid("block.max_txs", "must not be negative, got %d", c.Block.MaxTxs)
+	}
+	if c.Block.MaxOps < 0 {
+		invalid("block.max_ops", "must not be negative, got %d", c.Block.MaxOps)
+	}
+
+	if c.Metrics.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.ListenAddress); err != nil {
+			invalid("metrics.listen_address", "must be host:port, got %q", c.Metrics.ListenAddress)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// storageBackends returns the names of the registered storage backends, sorted
+func storageBackends() []string {
+	names := make([]string, 0, len(storage.StorageRegistry))
+	for name := range storage.StorageRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stripComments blanks out // line comments outside of strings, keeping
+// line breaks and offsets so decoding errors point at the right place
+func stripComments(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	inString, escaped, inComment := false, false, false
+	for i := 0; i < len(out); i++ {
+		switch {
+		case inComment:
+			if out[i] == '\n' {
+				inComment = false
+			} else {
+				out[i] = ' '
+			}
+		case inString:
+			if escaped {
+				escaped = false
+			} else if out[i] == '\\' {
+				escaped = true
+			} else if out[i] == '"' {
+				inString = false
+			}
+		case out[i] == '"':
+			inString = true
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			inComment = true
+			out[i] = ' '
+		}
+	}
+	return out
+}
+
+// lineOf returns the line number of a byte offset
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
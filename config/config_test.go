@@ -0,0 +1,86 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateMatchesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := WriteTemplate(path, false); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	if err := WriteTemplate(path, false); err == nil {
+		t.Error("Template overwrote an existing file without force")
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load template: %v", err)
+	}
+	if want := Default(); !reflect.DeepEqual(loaded, want) {
+		t.Errorf("Template does not match the defaults:\ngot  %+v\nwant %+v", loaded, want)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config := Default()
+	err := config.ApplyEnv([]string{
+		"BATCHED_TX_LOG_LEVEL=debug",
+		"BATCHED_TX_BLOCK_MAX_OPS=5000",
+		"BATCHED_TX_STORAGE_BACKEND=redis",
+		"BATCHED_TX_STORAGE_CONFIG_ADDRESS=localhost:6379",
+		"BATCHED_TX_STORAGE_CONFIG_DB=2",
+		"OTHER_LOG_LEVEL=error",
+	})
+	if err != nil {
+		t.Fatalf("Failed to apply environment: %v", err)
+	}
+
+	if config.Log.Level != "debug" || config.Block.MaxOps != 5000 || config.Storage.Backend != "redis" {
+		t.Errorf("Overrides not applied: %+v", config)
+	}
+	// Numeric storage options keep the type the backends expect from JSON
+	if config.Storage.Config["address"] != "localhost:6379" || config.Storage.Config["db"] != float64(2) {
+		t.Errorf("Storage options not applied: %v", config.Storage.Config)
+	}
+
+	if err := config.ApplyEnv([]string{"BATCHED_TX_SNAPSHOT_INTERVAL=often"}); err == nil {
+		t.Error("Invalid number was accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+  // Comments are allowed
+  "mode": "standalone",
+  "snapshot_interval": 0,
+  "storage": {"backend": "mongo", "call_timeout": "soon"},
+  "log": {"level": "verbose"},
+  "metrics": {"listen_address": "9090"}
+}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("Invalid configuration was accepted")
+	}
+	for _, field := range []string{"mode", "snapshot_interval", "storage.backend", "storage.call_timeout", "log.level", "metrics.listen_address"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Error does not report %s: %v", field, err)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"state_fle": "state.json"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "state_fle") {
+		t.Errorf("Unknown field was not reported: %v", err)
+	}
+}
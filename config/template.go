@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Template is the documented configuration written by "config init".
+// Its values are the defaults, except for the CometBFT home directory.
+const Template = `// Batched transaction application configuration.
+//
+// Lines starting with // are comments. Every field can be overridden with an
+// environment variable named BATCHED_TX_ followed by the upper-cased field
+// path, such as BATCHED_TX_LOG_LEVEL or BATCHED_TX_ABCI_TRANSPORT. Storage
+// options are set with BATCHED_TX_STORAGE_CONFIG_<OPTION>.
+{
+  // "abci" serves the application to an external CometBFT node,
+  // "node" runs a CometBFT node in this process.
+  "mode": "abci",
+
+  // File the application state is saved to.
+  "state_file": "data/state.json",
+
+  // "incremental" appends the accounts changed by each save to
+  // <state_file>.log and compacts the log into state_file once it grows
+  // larger than it. "full" rewrites state_file on every save.
+  "state_persistence": "incremental",
+
+  // CometBFT home directory with config/config.toml, keys and genesis,
+  // read in node mode. Defaults to $HOME/.cometbft.
+  "cometbft_home": "",
+
+  // Number of blocks between two saves of the state. After a restart,
+  // CometBFT replays the blocks committed since the last save.
+  "snapshot_interval": 1,
+
+  "abci": {
+    // Address the ABCI server listens on in abci mode.
+    "address": "tcp://0.0.0.0:26658",
+
+    // "socket" or "grpc".
+    "transport": "socket"
+  },
+
+  "storage": {
+    // Storage backend: memory, badger, sqlite, redis or tigerbeetle.
+    // Empty keeps the state in state_file only.
+    "backend": "",
+
+    // Backend options, such as {"db_path": "data/badger"} for badger
+    // or {"address": "localhost:6379"} for redis.
+    "config": {},
+
+    // Maximum duration of each storage call, such as "5s". A call to a
+    // backend that does not respond in time fails. Empty means no limit.
+    "call_timeout": ""
+  },
+
+  "log": {
+    // debug, info, error or none.
+    "level": "info",
+
+    // "plain" or "json".
+    "format": "plain"
+  },
+
+  // Limits on the blocks this node proposes. 0 means no limit.
+  "block": {
+    "max_txs": 0,
+    "max_ops": 0
+  },
+
+  "metrics": {
+    // Address of the metrics HTTP server, such as "127.0.0.1:9090".
+    // Empty disables it.
+    "listen_address": ""
+  }
+}
+`
+
+// WriteTemplate writes the documented configuration template to a file.
+// It refuses to overwrite an existing file unless force is set.
+func WriteTemplate(path string, force bool) error {
+	if !force {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to check %s: %w", path, err)
+		}
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(Template), 0644); err != nil {
+		return fmt.Errorf("failed to write configuration template: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	blst "github.com/supranational/blst/bindings/go"
+)
+
+// BLS12-381 keys use the minimal-pubkey-size variant: public keys are
+// compressed G1 points and signatures are compressed G2 points.
+const (
+	BLSPublicKeySize  = 48
+	BLSPrivateKeySize = 32
+	BLSSignatureSize  = 96
+)
+
+// blsDST is the domain separation tag of the message augmentation scheme.
+// Every message is prefixed with the signer's public key before hashing,
+// which makes aggregation safe against rogue-key attacks without
+// proofs of possession.
+var blsDST = []byte("BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_AUG_")
+
+// BLSPubKey is a compressed BLS12-381 public key
+type BLSPubKey []byte
+
+// BLSKeyPair represents a BLS12-381 key pair
+type BLSKeyPair struct {
+	PrivateKey *blst.SecretKey
+	PublicKey  BLSPubKey
+}
+
+// GenerateBLSKeyPair generates a new BLS12-381 key pair
+func GenerateBLSKeyPair() (*BLSKeyPair, error) {
+	ikm := make([]byte, 32)
+	if _, err := rand.Read(ikm); err != nil {
+		return nil, fmt.Errorf("failed to read key material: %w", err)
+	}
+
+	privKey := blst.KeyGen(ikm)
+	if privKey == nil {
+		return nil, fmt.Errorf("failed to generate BLS key")
+	}
+	return newBLSKeyPair(privKey), nil
+}
+
+// newBLSKeyPair derives the public key of a BLS private key
+func newBLSKeyPair(privKey *blst.SecretKey) *BLSKeyPair {
+	pubKey := new(blst.P1Affine).From(privKey)
+	return &BLSKeyPair{
+		PrivateKey: privKey,
+		PublicKey:  pubKey.Compress(),
+	}
+}
+
+// Sign signs a message with the private key
+func (kp *BLSKeyPair) Sign(message []byte) (string, error) {
+	signature := new(blst.P2Affine).Sign(kp.PrivateKey, message, blsDST, []byte(kp.PublicKey))
+	if signature == nil {
+		return "", fmt.Errorf("failed to sign message")
+	}
+	return base64.StdEncoding.EncodeToString(signature.Compress()), nil
+}
+
+// VerifyBLSSignature verifies a single BLS signature against a message and public key
+func VerifyBLSSignature(pubKey BLSPubKey, message []byte, signatureBase64 string) (bool, error) {
+	return AggregateVerifyBLS([]BLSPubKey{pubKey}, [][]byte{message}, signatureBase64)
+}
+
+// AggregateBLSSignatures combines BLS signatures into a single signature
+func AggregateBLSSignatures(signaturesBase64 []string) (string, error) {
+	if len(signaturesBase64) == 0 {
+		return "", fmt.Errorf("no signatures to aggregate")
+	}
+
+	signatures := make([][]byte, len(signaturesBase64))
+	for i, encoded := range signaturesBase64 {
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode signature %d: %w", i, err)
+		}
+		signatures[i] = signature
+	}
+
+	var aggregate blst.P2Aggregate
+	if !aggregate.AggregateCompressed(signatures, true) {
+		return "", fmt.Errorf("invalid signature in aggregate")
+	}
+	return base64.StdEncoding.EncodeToString(aggregate.ToAffine().Compress()), nil
+}
+
+// AggregateVerifyBLS verifies an aggregate signature over one message per public key
+func AggregateVerifyBLS(pubKeys []BLSPubKey, messages [][]byte, signatureBase64 string) (bool, error) {
+	if len(pubKeys) == 0 || len(pubKeys) != len(messages) {
+		return false, fmt.Errorf("got %d public keys for %d messages", len(pubKeys), len(messages))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	if len(signature) != BLSSignatureSize {
+		return false, fmt.Errorf("invalid signature size: got %d, want %d", len(signature), BLSSignatureSize)
+	}
+
+	keys := make([][]byte, len(pubKeys))
+	msgs := make([]blst.Message, len(messages))
+	for i := range pubKeys {
+		keys[i] = pubKeys[i]
+		msgs[i] = messages[i]
+	}
+
+	// Public keys are used as the augmentation of their messages
+	return new(blst.P2Affine).AggregateVerifyCompressed(signature, true, keys, true, msgs, blsDST, true, true), nil
+}
+
+// BLSPublicKeyFromBytes creates a BLS public key from bytes
+func BLSPublicKeyFromBytes(data []byte) (BLSPubKey, error) {
+	if len(data) != BLSPublicKeySize {
+		return nil, fmt.Errorf("invalid BLS public key size: got %d, want %d", len(data), BLSPublicKeySize)
+	}
+	pubKey := new(blst.P1Affine).Uncompress(data)
+	if pubKey == nil || !pubKey.KeyValidate() {
+		return nil, fmt.Errorf("invalid BLS public key")
+	}
+	return BLSPubKey(data), nil
+}
+
+// BLSKeyPairFromBytes creates a BLS key pair from private key bytes
+func BLSKeyPairFromBytes(data []byte) (*BLSKeyPair, error) {
+	if len(data) != BLSPrivateKeySize {
+		return nil, fmt.Errorf("invalid BLS private key size: got %d, want %d", len(data), BLSPrivateKeySize)
+	}
+	privKey := new(blst.SecretKey).Deserialize(data)
+	if privKey == nil {
+		return nil, fmt.Errorf("invalid BLS private key")
+	}
+	return newBLSKeyPair(privKey), nil
+}
+
+// BLSPublicKeyToBase64 encodes a BLS public key to base64
+func BLSPublicKeyToBase64(pubKey BLSPubKey) string {
+	return base64.StdEncoding.EncodeToString(pubKey)
+}
+
+// BLSPrivateKeyToBase64 encodes a BLS private key to base64
+func BLSPrivateKeyToBase64(privKey *blst.SecretKey) string {
+	return base64.StdEncoding.EncodeToString(privKey.Serialize())
+}
+
+// BLSPublicKeyFromBase64 decodes a BLS public key from base64
+func BLSPublicKeyFromBase64(encoded string) (BLSPubKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode BLS public key: %w", err)
+	}
+	return BLSPublicKeyFromBytes(data)
+}
+
+// BLSKeyPairFromBase64 decodes a BLS key pair from a base64 private key
+func BLSKeyPairFromBase64(encoded string) (*BLSKeyPair, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode BLS private key: %w", err)
+	}
+	return BLSKeyPairFromBytes(data)
+}
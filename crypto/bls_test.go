@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newBLSBatch signs one distinct message per key pair and aggregates the signatures
+func newBLSBatch(tb testing.TB, n int) ([]BLSPubKey, [][]byte, string) {
+	tb.Helper()
+
+	pubKeys := make([]BLSPubKey, n)
+	messages := make([][]byte, n)
+	signatures := make([]string, n)
+	for i := 0; i < n; i++ {
+		keyPair, err := GenerateBLSKeyPair()
+		if err != nil {
+			tb.Fatalf("Failed to generate key pair: %v", err)
+		}
+		pubKeys[i] = keyPair.PublicKey
+		messages[i] = []byte(fmt.Sprintf(`{"from":%d,"to":1,"amount":1}`, i+1))
+		signatures[i], err = keyPair.Sign(messages[i])
+		if err != nil {
+			tb.Fatalf("Failed to sign message: %v", err)
+		}
+	}
+
+	aggregate, err := AggregateBLSSignatures(signatures)
+	if err != nil {
+		tb.Fatalf("Failed to aggregate signatures: %v", err)
+	}
+	return pubKeys, messages, aggregate
+}
+
+func TestBLSAggregateSignature(t *testing.T) {
+	pubKeys, messages, aggregate := newBLSBatch(t, 4)
+
+	valid, err := AggregateVerifyBLS(pubKeys, messages, aggregate)
+	if err != nil || !valid {
+		t.Fatalf("Valid aggregate signature rejected: valid=%v err=%v", valid, err)
+	}
+
+	// A changed message invalidates the aggregate
+	messages[2] = []byte(`{"from":3,"to":1,"amount":100}`)
+	if valid, _ := AggregateVerifyBLS(pubKeys, messages, aggregate); valid {
+		t.Error("Aggregate signature accepted for a tampered message")
+	}
+
+	// So does attributing a message to another key
+	pubKeys, messages, aggregate = newBLSBatch(t, 2)
+	pubKeys[0], pubKeys[1] = pubKeys[1], pubKeys[0]
+	if valid, _ := AggregateVerifyBLS(pubKeys, messages, aggregate); valid {
+		t.Error("Aggregate signature accepted with swapped keys")
+	}
+
+	// Keys survive a round trip through their encodings
+	keyPair, err := GenerateBLSKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	decoded, err := BLSKeyPairFromBase64(BLSPrivateKeyToBase64(keyPair.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to decode private key: %v", err)
+	}
+	if BLSPublicKeyToBase64(decoded.PublicKey) != BLSPublicKeyToBase64(keyPair.PublicKey) {
+		t.Error("Decoded key pair has a different public key")
+	}
+}
+
+// BenchmarkVerifyEd25519 verifies one ed25519 signature per operation,
+// as done for per-operation signed transactions
+func BenchmarkVerifyEd25519(b *testing.B) {
+	for _, n := range []int{10, 100} {
+		b.Run(fmt.Sprintf("ops=%d", n), func(b *testing.B) {
+			keyPairs := make([]*KeyPair, n)
+			messages := make([][]byte, n)
+			signatures := make([]string, n)
+			for i := 0; i < n; i++ {
+				keyPairs[i] = GenerateKeyPair()
+				messages[i] = []byte(fmt.Sprintf(`{"from":%d,"to":1,"amount":1}`, i+1))
+				signatures[i], _ = keyPairs[i].Sign(messages[i])
+			}
+
+			b.ResetTimer()
+			for j := 0; j < b.N; j++ {
+				for i := 0; i < n; i++ {
+					if valid, _ := VerifySignature(keyPairs[i].PublicKey, messages[i], signatures[i]); !valid {
+						b.Fatal("invalid signature")
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAggregateVerifyBLS verifies one aggregate BLS signature over all operations,
+// as done for aggregate-signed transactions
+func BenchmarkAggregateVerifyBLS(b *testing.B) {
+	for _, n := range []int{10, 100} {
+		b.Run(fmt.Sprintf("ops=%d", n), func(b *testing.B) {
+			pubKeys, messages, aggregate := newBLSBatch(b, n)
+
+			b.ResetTimer()
+			for j := 0; j < b.N; j++ {
+				if valid, _ := AggregateVerifyBLS(pubKeys, messages, aggregate); !valid {
+					b.Fatal("invalid aggregate signature")
+				}
+			}
+		})
+	}
+}
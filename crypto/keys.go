@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	cmtcrypto "github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	"github.com/cometbft/cometbft/crypto/secp256k1"
+)
+
+// KeyType identifies the signature scheme of a key
+type KeyType string
+
+// Supported key types
+const (
+	KeyTypeEd25519   KeyType = ed25519.KeyType
+	KeyTypeSecp256k1 KeyType = secp256k1.KeyType
+)
+
+// PubKey is a public key of any supported key type
+type PubKey = cmtcrypto.PubKey
+
+// PrivKey is a private key of any supported key type
+type PrivKey = cmtcrypto.PrivKey
+
+// ParseKeyType parses a key type name. An empty name is ed25519,
+// the key type of key files and genesis entries that predate key types.
+func ParseKeyType(name string) (KeyType, error) {
+	switch KeyType(name) {
+	case "", KeyTypeEd25519:
+		return KeyTypeEd25519, nil
+	case KeyTypeSecp256k1:
+		return KeyTypeSecp256k1, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %q", name)
+	}
+}
+
+// KeyTypeOf returns the key type of a public key
+func KeyTypeOf(pubKey PubKey) KeyType {
+	return KeyType(pubKey.Type())
+}
+
+// GenerateKeyPairOfType generates a new key pair of the given type
+func GenerateKeyPairOfType(keyType KeyType) (*KeyPair, error) {
+	var privKey PrivKey
+	switch keyType {
+	case KeyTypeEd25519:
+		privKey = ed25519.GenPrivKey()
+	case KeyTypeSecp256k1:
+		privKey = secp256k1.GenPrivKey()
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+
+	return &KeyPair{
+		PrivateKey: privKey,
+		PublicKey:  privKey.PubKey(),
+	}, nil
+}
+
+// PublicKeyFromBytesOfType creates a public key of the given type from bytes
+func PublicKeyFromBytesOfType(keyType KeyType, data []byte) (PubKey, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		return PublicKeyFromBytes(data)
+	case KeyTypeSecp256k1:
+		// Secp256k1 public keys are 33-byte compressed points
+		if len(data) != secp256k1.PubKeySize {
+			return nil, fmt.Errorf("invalid public key size: got %d, want %d", len(data), secp256k1.PubKeySize)
+		}
+		return secp256k1.PubKey(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// PrivateKeyFromBytesOfType creates a private key of the given type from bytes
+func PrivateKeyFromBytesOfType(keyType KeyType, data []byte) (PrivKey, error) {
+	switch keyType {
+	case KeyTypeEd25519:
+		return PrivateKeyFromBytes(data)
+	case KeyTypeSecp256k1:
+		// Secp256k1 private keys are 32-byte scalars
+		if len(data) != secp256k1.PrivKeySize {
+			return nil, fmt.Errorf("invalid private key size: got %d, want %d", len(data), secp256k1.PrivKeySize)
+		}
+		return secp256k1.PrivKey(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// PublicKeyFromBase64OfType decodes a public key of the given type from base64
+func PublicKeyFromBase64OfType(keyType KeyType, encoded string) (PubKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	return PublicKeyFromBytesOfType(keyType, data)
+}
+
+// PrivateKeyFromBase64OfType decodes a private key of the given type from base64
+func PrivateKeyFromBase64OfType(keyType KeyType, encoded string) (PrivKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode private key: %w", err)
+	}
+	return PrivateKeyFromBytesOfType(keyType, data)
+}
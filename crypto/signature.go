@@ -7,10 +7,10 @@ import (
 	"github.com/cometbft/cometbft/crypto/ed25519"
 )
 
-// KeyPair represents an Ed25519 key pair
+// KeyPair represents a key pair of any supported key type
 type KeyPair struct {
-	PrivateKey ed25519.PrivKey
-	PublicKey  ed25519.PubKey
+	PrivateKey PrivKey
+	PublicKey  PubKey
 }
 
 // GenerateKeyPair generates a new Ed25519 key pair
@@ -33,8 +33,13 @@ func (kp *KeyPair) Sign(message []byte) (string, error) {
 	return base64.StdEncoding.EncodeToString(signature), nil
 }
 
+// KeyType returns the key type of the key pair
+func (kp *KeyPair) KeyType() KeyType {
+	return KeyTypeOf(kp.PublicKey)
+}
+
 // VerifySignature verifies a signature against a message and public key
-func VerifySignature(pubKey ed25519.PubKey, message []byte, signatureBase64 string) (bool, error) {
+func VerifySignature(pubKey PubKey, message []byte, signatureBase64 string) (bool, error) {
 	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
 	if err != nil {
 		return false, fmt.Errorf("failed to decode signature: %w", err)
@@ -62,13 +67,13 @@ func PrivateKeyFromBytes(data []byte) (ed25519.PrivKey, error) {
 }
 
 // PublicKeyToBase64 encodes a public key to base64
-func PublicKeyToBase64(pubKey ed25519.PubKey) string {
-	return base64.StdEncoding.EncodeToString(pubKey)
+func PublicKeyToBase64(pubKey PubKey) string {
+	return base64.StdEncoding.EncodeToString(pubKey.Bytes())
 }
 
 // PrivateKeyToBase64 encodes a private key to base64
-func PrivateKeyToBase64(privKey ed25519.PrivKey) string {
-	return base64.StdEncoding.EncodeToString(privKey)
+func PrivateKeyToBase64(privKey PrivKey) string {
+	return base64.StdEncoding.EncodeToString(privKey.Bytes())
 }
 
 // PublicKeyFromBase64 decodes a public key from base64
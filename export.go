@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
+	"github.com/xmonader/test_batched_tx_tendermint/export"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// runExportCommand exports the state to a file, from the state file or the storage backend
+func runExportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "Path to the configuration file")
+	source := flags.String("source", "state", "Where to read the accounts: \"state\" for the state file or \"storage\" for the storage backend")
+	output := flags.String("o", "-", "Path of the export file, - for standard output")
+	height := flags.Int64("height", 0, "Fail unless the state is at this height")
+	flags.Parse(args)
+
+	// Storage backends do not record the height of their accounts, so it
+	// could not be checked
+	if *source == "storage" && *height != 0 {
+		return errors.New("-height can only be checked with -source state")
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	// Write to the output file, removing it if the export fails
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return fmt.Errorf("failed to create export file: %w", err)
+		}
+		defer out.Close()
+	}
+
+	switch *source {
+	case "state":
+		err = exportStateFile(cfg.StateFile, *height, out)
+	case "storage":
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		err = exportStorage(ctx, cfg.Storage, app.NewMetrics(), out)
+	default:
+		err = fmt.Errorf("unknown source %q", *source)
+	}
+	if err != nil {
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return err
+	}
+	return nil
+}
+
+// exportStateFile exports the state saved by the application
+func exportStateFile(stateFile string, height int64, w io.Writer) error {
+	store := app.NewStateStore(stateFile)
+	if err := store.LoadState(); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	state := store.GetState()
+	if height != 0 && state.GetHeight() != height {
+		return fmt.Errorf("state is at height %d, not %d", state.GetHeight(), height)
+	}
+
+	return writeAccountsExport(context.Background(), w, export.NewHeader(state), store.Accounts())
+}
+
+// exportStorage exports the accounts of a storage backend. Backends only hold
+// balances and no height, so the export has no authorities, params, supply
+// or height.
+func exportStorage(ctx context.Context, cfg config.StorageConfig, metrics *app.Metrics, w io.Writer) error {
+	store, err := openStorage(ctx, cfg, metrics)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return writeAccountsExport(ctx, w, export.Header{}, store)
+}
+
+// writeAccountsExport writes the accounts of a storage backend or of the
+// state to an export, in ascending order of ID, reading them one page at a time
+func writeAccountsExport(ctx context.Context, w io.Writer, header export.Header, accounts storage.AccountLister) error {
+	writer, err := export.NewWriter(w, header)
+	if err != nil {
+		return err
+	}
+	it := storage.NewAccountIterator(accounts, storage.MinAccountID, 0)
+	for it.Next(ctx) {
+		if err := writer.WriteAccount(it.Account()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to read accounts: %w", err)
+	}
+	return writer.Close()
+}
+
+// runImportCommand imports an export into a CometBFT genesis file or the storage backend
+func runImportCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "Path to the configuration file, for -storage")
+	input := flags.String("i", "", "Path of the export file")
+	genesisFile := flags.String("genesis", "", "CometBFT genesis file whose app_state is replaced by the export")
+	chainID := flags.String("chain-id", "", "Chain ID to set in the genesis file")
+	toStorage := flags.Bool("storage", false, "Import the accounts into the configured storage backend")
+	flags.Parse(args)
+
+	if *input == "" {
+		return errors.New("usage: import -i export.jsonl (-genesis genesis.json | -storage)")
+	}
+	if (*genesisFile == "") == !*toStorage {
+		return errors.New("import needs exactly one of -genesis or -storage")
+	}
+
+	if *genesisFile != "" {
+		return importGenesis(*input, *genesisFile, *chainID)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	return importStorage(ctx, *input, cfg.Storage, app.NewMetrics())
+}
+
+// importGenesis sets the app_state of a CometBFT genesis file to the exported state
+func importGenesis(input string, genesisFile string, chainID string) error {
+	file, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("failed to open export file: %w", err)
+	}
+	defer file.Close()
+
+	// Read and validate the whole export before touching the genesis file
+	genesis, header, err := export.ReadGenesis(file)
+	if err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+
+	// Keep every other field of the genesis file as it is
+	data, err := os.ReadFile(genesisFile)
+	if err != nil {
+		return fmt.Errorf("failed to read genesis file: %w", err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse genesis file: %w", err)
+	}
+
+	if doc["app_state"], err = json.Marshal(genesis); err != nil {
+		return fmt.Errorf("failed to encode genesis state: %w", err)
+	}
+	if chainID != "" {
+		doc["chain_id"], _ = json.Marshal(chainID)
+	}
+
+	data, err = json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode genesis file: %w", err)
+	}
+	if err := os.WriteFile(genesisFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write genesis file: %w", err)
+	}
+
+	fmt.Printf("Imported %d accounts from height %d of chain %q into %s\n", len(genesis.Accounts), header.Height, header.ChainID, genesisFile)
+	return nil
+}
+
+// importStorage creates the exported accounts in a storage backend, in a
+// single transaction unless the backend cannot hold them all in one
+func importStorage(ctx context.Context, input string, cfg config.StorageConfig, metrics *app.Metrics) error {
+	file, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("failed to open export file: %w", err)
+	}
+	defer file.Close()
+
+	// Check the totals and checksum in a first pass, then apply in a second one
+	_, footer, err := export.Verify(file)
+	if err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+
+	store, err := openStorage(ctx, cfg, metrics)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// A BadgerDB transaction holds about a hundred thousand writes, so larger
+	// exports are committed a page at a time instead
+	err = importAccounts(ctx, store, file, false)
+	if errors.Is(err, storage.ErrTransactionTooLarge) {
+		fmt.Printf("The export is too large for one %s transaction, importing it a page at a time\n", cfg.Backend)
+		err = importAccounts(ctx, store, file, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d accounts into %s storage\n", footer.Accounts, cfg.Backend)
+	return nil
+}
+
+// importAccounts creates the accounts of an export in a storage backend,
+// reading the export a page at a time. Unless perPage is set, the accounts
+// are all created in one transaction, so a failed import changes nothing, but
+// the memory, Redis, TigerBeetle and BadgerDB transactions hold every account
+// they create in memory until they commit. With perPage, each page is
+// committed on its own, and a failed import keeps the pages committed before.
+// Accounts that already exist with the exported balance are skipped, so that
+// an import that failed that way can be run again to finish it.
+func importAccounts(ctx context.Context, store storage.ContextStorage, file io.ReadSeeker, perPage bool) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind export file: %w", err)
+	}
+	reader, err := export.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { tx.Rollback(ctx) }()
+
+	batch := make([]*types.Account, 0, storage.DefaultPageSize)
+	for {
+		acc, err := reader.Next()
+		if err == nil {
+			batch = append(batch, acc)
+		} else if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to import accounts: %w", err)
+		}
+		if len(batch) == cap(batch) || (err != nil && len(batch) > 0) {
+			if err := createMissingAccounts(ctx, tx, batch); err != nil {
+				return fmt.Errorf("failed to import accounts: %w", err)
+			}
+			batch = batch[:0]
+
+			if perPage && err == nil {
+				if err := tx.Commit(ctx); err != nil {
+					return fmt.Errorf("failed to commit imported accounts: %w", err)
+				}
+				next, err := store.Begin(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to begin transaction: %w", err)
+				}
+				tx = next
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit imported accounts: %w", err)
+	}
+	return nil
+}
+
+// createMissingAccounts creates a page of accounts, skipping the ones that
+// already exist with the same balance. It fails with
+// storage.ErrAccountAlreadyExists for an account with another balance.
+func createMissingAccounts(ctx context.Context, tx storage.ContextTx, accounts []*types.Account) error {
+	err := tx.CreateAccounts(ctx, accounts)
+	if !errors.Is(err, storage.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	// Look the accounts up one at a time only for pages where some exist
+	missing := make([]*types.Account, 0, len(accounts))
+	for _, acc := range accounts {
+		existing, err := tx.GetAccount(ctx, acc.ID)
+		if errors.Is(err, storage.ErrAccountNotFound) {
+			missing = append(missing, acc)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if existing.Balance != acc.Balance {
+			return fmt.Errorf("%w: account %d with balance %d, not %d", storage.ErrAccountAlreadyExists, acc.ID, existing.Balance, acc.Balance)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return tx.CreateAccounts(ctx, missing)
+}
+
+// openStorage creates and initializes the configured storage backend,
+// checking that its data is at the current schema version
+func openStorage(ctx context.Context, cfg config.StorageConfig, metrics *app.Metrics) (storage.ContextStorage, error) {
+	store, err := newStorage(ctx, cfg, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.CheckSchemaVersion(ctx, store); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("%s storage: %w", cfg.Backend, err)
+	}
+	return store, nil
+}
+
+// newStorage creates and initializes the configured storage backend. Its
+// calls are limited to the configured call timeout, and their latency is
+// recorded in the metrics.
+func newStorage(ctx context.Context, cfg config.StorageConfig, metrics *app.Metrics) (storage.ContextStorage, error) {
+	if cfg.Backend == "" {
+		return nil, errors.New("no storage backend configured")
+	}
+
+	backend, err := storage.GetContextStorage(cfg.Backend, cfg.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s storage: %w", cfg.Backend, err)
+	}
+	store := storage.NewInstrumentedStorage(storage.WithCallTimeout(backend, cfg.Timeout()), metrics.StorageObserver(cfg.Backend))
+	if err := store.Initialize(ctx); err != nil {
+		return nil, fmt.Errorf("failed to initialize %s storage: %w", cfg.Backend, err)
+	}
+	return store, nil
+}
@@ -0,0 +1,315 @@
+// Package export reads and writes state exports: the accounts and authorities
+// of a chain at a given height, in a streaming format from which a new chain
+// can be started.
+//
+// An export is a JSON Lines file. The first line is a Header, each following
+// line is an account, and the last line is a Footer holding the number of
+// accounts, their total balance and a SHA-256 checksum of every line before
+// the footer. The header and accounts carry the fields of a genesis state, so
+// each account line holds the user and BLS keys of the account, which the
+// checksum covers like its balance.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// Format identifies state export files
+const Format = "batched-tx-export"
+
+// Version is the version of the export format written by this package
+const Version = 1
+
+// maxLineSize bounds the length of a line, so a corrupted file cannot make the reader buffer it whole
+const maxLineSize = 1 << 20
+
+// Header is the first line of an export
+type Header struct {
+	Format         string           `json:"format"`
+	Version        int              `json:"version"`
+	ChainID        string           `json:"chain_id,omitempty"`
+	Height         int64            `json:"height"`
+	TotalSupply    uint64           `json:"total_supply"` // Zero when the source does not track the supply
+	SupplyCap      uint64           `json:"supply_cap,omitempty"`
+	MintAuthority  *types.Authority `json:"mint_authority,omitempty"`
+	AdminAuthority *types.Authority `json:"admin_authority,omitempty"`
+	Params         *types.Params    `json:"params,omitempty"`
+}
+
+// Footer is the last line of an export
+type Footer struct {
+	Accounts     int    `json:"accounts"`
+	TotalBalance uint64 `json:"total_balance"`
+	Checksum     string `json:"checksum"` // "sha256:" followed by the hex digest
+}
+
+// NewHeader returns the header of an export of a state
+func NewHeader(state *types.State) Header {
+	params := state.GetParams()
+	totalSupply, supplyCap := state.GetSupply()
+	return Header{
+		Format:         Format,
+		Version:        Version,
+		ChainID:        state.GetChainID(),
+		Height:         state.GetHeight(),
+		TotalSupply:    totalSupply,
+		SupplyCap:      supplyCap,
+		MintAuthority:  state.GetMintAuthority(),
+		AdminAuthority: state.GetAdminAuthority(),
+		Params:         &params,
+	}
+}
+
+// Writer writes an export one account at a time
+type Writer struct {
+	w        *bufio.Writer
+	checksum hash.Hash
+	footer   Footer
+}
+
+// NewWriter writes the header of an export and returns a writer for its accounts
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	header.Format = Format
+	header.Version = Version
+
+	writer := &Writer{
+		w:        bufio.NewWriter(w),
+		checksum: sha256.New(),
+	}
+	if err := writer.writeLine(header, true); err != nil {
+		return nil, fmt.Errorf("failed to write export header: %w", err)
+	}
+	return writer, nil
+}
+
+// WriteAccount writes an account. Usage windows are left out, since heights
+// restart with the new chain.
+func (w *Writer) WriteAccount(acc *types.Account) error {
+	totalBalance, err := types.AddAmounts(w.footer.TotalBalance, acc.Balance)
+	if err != nil {
+		return fmt.Errorf("failed to write account %d: total balance: %w", acc.ID, err)
+	}
+
+	exported := acc.Copy()
+	exported.Usage = nil
+	if err := w.writeLine(exported, true); err != nil {
+		return fmt.Errorf("failed to write account %d: %w", acc.ID, err)
+	}
+
+	w.footer.Accounts++
+	w.footer.TotalBalance = totalBalance
+	return nil
+}
+
+// Close writes the footer and flushes the export
+func (w *Writer) Close() error {
+	w.footer.Checksum = "sha256:" + hex.EncodeToString(w.checksum.Sum(nil))
+	if err := w.writeLine(w.footer, false); err != nil {
+		return fmt.Errorf("failed to write export footer: %w", err)
+	}
+	return w.w.Flush()
+}
+
+// writeLine writes a value as a JSON line, adding it to the checksum if requested
+func (w *Writer) writeLine(v interface{}, checksummed bool) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if checksummed {
+		w.checksum.Write(line)
+	}
+	_, err = w.w.Write(line)
+	return err
+}
+
+// Reader reads an export one account at a time. The totals and checksum
+// are verified when the footer is reached, so an export must be read to
+// the end before any of it is trusted.
+type Reader struct {
+	scanner  *bufio.Scanner
+	checksum hash.Hash
+	header   Header
+	footer   Footer
+	line     int
+	done     bool
+}
+
+// NewReader reads the header of an export
+func NewReader(r io.Reader) (*Reader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	reader := &Reader{
+		scanner:  scanner,
+		checksum: sha256.New(),
+	}
+
+	line, err := reader.nextLine()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export header: %w", err)
+	}
+	if err := json.Unmarshal(line, &reader.header); err != nil {
+		return nil, fmt.Errorf("failed to parse export header: %w", err)
+	}
+	if reader.header.Format != Format {
+		return nil, fmt.Errorf("not a state export: format %q", reader.header.Format)
+	}
+	if reader.header.Version != Version {
+		return nil, fmt.Errorf("unsupported export version %d, want %d", reader.header.Version, Version)
+	}
+	reader.checksum.Write(line)
+	reader.checksum.Write([]byte{'\n'})
+
+	return reader, nil
+}
+
+// Header returns the header of the export
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Footer returns the footer of the export, once Next has returned io.EOF
+func (r *Reader) Footer() Footer {
+	return r.footer
+}
+
+// Next returns the next account. It returns io.EOF after the footer, once
+// the number of accounts, their total balance and the checksum match it.
+func (r *Reader) Next() (*types.Account, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	line, err := r.nextLine()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("export is truncated: no footer after line %d", r.line)
+		}
+		return nil, err
+	}
+
+	// Accounts have an ID, the footer does not
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, fmt.Errorf("line %d: %w", r.line, err)
+	}
+	if _, isAccount := fields["id"]; !isAccount {
+		return nil, r.readFooter(line)
+	}
+
+	var acc types.Account
+	if err := json.Unmarshal(line, &acc); err != nil {
+		return nil, fmt.Errorf("line %d: %w", r.line, err)
+	}
+	r.checksum.Write(line)
+	r.checksum.Write([]byte{'\n'})
+
+	// Count the account towards the totals checked against the footer
+	totalBalance, err := types.AddAmounts(r.footer.TotalBalance, acc.Balance)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: total balance: %w", r.line, err)
+	}
+	r.footer.Accounts++
+	r.footer.TotalBalance = totalBalance
+	return &acc, nil
+}
+
+// readFooter parses the footer and checks it against the accounts read
+func (r *Reader) readFooter(line []byte) error {
+	var footer Footer
+	if err := json.Unmarshal(line, &footer); err != nil {
+		return fmt.Errorf("line %d: failed to parse footer: %w", r.line, err)
+	}
+	if r.scanner.Scan() {
+		return fmt.Errorf("line %d: data after the footer", r.line+1)
+	}
+
+	if checksum := "sha256:" + hex.EncodeToString(r.checksum.Sum(nil)); footer.Checksum != checksum {
+		return fmt.Errorf("checksum mismatch: footer has %s, content is %s", footer.Checksum, checksum)
+	}
+	if footer.Accounts != r.footer.Accounts {
+		return fmt.Errorf("footer lists %d accounts, export has %d", footer.Accounts, r.footer.Accounts)
+	}
+	if footer.TotalBalance != r.footer.TotalBalance {
+		return fmt.Errorf("footer lists a total balance of %d, accounts add up to %d", footer.TotalBalance, r.footer.TotalBalance)
+	}
+	if r.header.TotalSupply != 0 && r.header.TotalSupply != r.footer.TotalBalance {
+		return fmt.Errorf("accounts add up to %d, but the total supply is %d", r.footer.TotalBalance, r.header.TotalSupply)
+	}
+
+	r.footer = footer
+	r.done = true
+	return io.EOF
+}
+
+// nextLine returns the next non-empty line
+func (r *Reader) nextLine() ([]byte, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if line := bytes.TrimSpace(r.scanner.Bytes()); len(line) > 0 {
+			return line, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", r.line+1, err)
+	}
+	return nil, io.EOF
+}
+
+// Verify reads an export to the end, checking its totals and checksum
+func Verify(r io.Reader) (Header, Footer, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return Header{}, Footer{}, err
+	}
+	for {
+		if _, err := reader.Next(); errors.Is(err, io.EOF) {
+			return reader.Header(), reader.Footer(), nil
+		} else if err != nil {
+			return Header{}, Footer{}, err
+		}
+	}
+}
+
+// ReadGenesis reads a whole export into a genesis state, validated like the one passed to InitChain
+func ReadGenesis(r io.Reader) (*types.GenesisState, Header, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, Header{}, err
+	}
+
+	header := reader.Header()
+	genesis := &types.GenesisState{
+		MintAuthority:  header.MintAuthority,
+		AdminAuthority: header.AdminAuthority,
+		SupplyCap:      header.SupplyCap,
+		Params:         header.Params,
+	}
+	for {
+		acc, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, Header{}, err
+		}
+		genesis.Accounts = append(genesis.Accounts, *acc)
+	}
+
+	if err := genesis.Validate(); err != nil {
+		return nil, Header{}, fmt.Errorf("invalid genesis state: %w", err)
+	}
+	return genesis, header, nil
+}
@@ -0,0 +1,112 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// writeTestExport exports a state with three funded accounts, the first with
+// a secp256k1 key and the third with a BLS key, and returns it with the state
+func writeTestExport(t *testing.T) ([]byte, *types.State) {
+	t.Helper()
+
+	state := types.NewState()
+	state.SetChainID("old-chain")
+	state.SetHeight(42)
+	for id, balance := range map[int]uint64{1: 700, 2: 200, 3: 100} {
+		if err := state.Mint(id, balance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state.SetNonce(1, 9)
+	state.SetLimits(2, &types.AccountLimits{MaxAmountPerWindow: 50, WindowBlocks: 10}, true)
+	state.RecordUsage(2, 40, 20)
+
+	keyPair, err := crypto.GenerateKeyPairOfType(crypto.KeyTypeSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SetPubKey(1, crypto.KeyTypeSecp256k1, crypto.PublicKeyToBase64(keyPair.PublicKey))
+	blsKeyPair, err := crypto.GenerateBLSKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SetBLSPubKey(3, crypto.BLSPublicKeyToBase64(blsKeyPair.PublicKey))
+
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, NewHeader(state))
+	if err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	for _, acc := range state.GetAllAccounts() {
+		if err := writer.WriteAccount(acc); err != nil {
+			t.Fatalf("Failed to write account: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to write footer: %v", err)
+	}
+	return buf.Bytes(), state
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	data, state := writeTestExport(t)
+
+	genesis, header, err := ReadGenesis(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	if header.ChainID != "old-chain" || header.Height != 42 || header.TotalSupply != 1000 {
+		t.Errorf("Unexpected header: %+v", header)
+	}
+	if len(genesis.Accounts) != 3 {
+		t.Fatalf("Got %d accounts, want 3", len(genesis.Accounts))
+	}
+	if acc := genesis.Accounts[0]; acc.ID != 1 || acc.Balance != 700 || acc.Nonce != 9 {
+		t.Errorf("Unexpected account: %+v", acc)
+	}
+	if acc := genesis.Accounts[1]; acc.Limits == nil || acc.Usage != nil {
+		t.Errorf("Account should keep its limits but not its usage: %+v", acc)
+	}
+	want1 := state.GetAccount(1)
+	if acc := genesis.Accounts[0]; acc.PubKey != want1.PubKey || acc.KeyType != want1.KeyType {
+		t.Errorf("Account should keep its key: %+v", acc)
+	}
+	want3 := state.GetAccount(3)
+	if acc := genesis.Accounts[2]; acc.BLSPubKey != want3.BLSPubKey {
+		t.Errorf("Account should keep its BLS key: %+v", acc)
+	}
+}
+
+func TestExportVerification(t *testing.T) {
+	raw, state := writeTestExport(t)
+	data := string(raw)
+	lines := strings.SplitAfter(data, "\n")
+
+	otherKey, err := crypto.GenerateBLSKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc3 := state.GetAccount(3)
+
+	tests := map[string]struct {
+		data string
+		want string
+	}{
+		"tampered balance":  {strings.Replace(data, `"balance":700`, `"balance":701`, 1), "checksum mismatch"},
+		"tampered key type": {strings.Replace(data, `"key_type":"secp256k1"`, `"key_type":"ed25519"`, 1), "checksum mismatch"},
+		"tampered BLS key":  {strings.Replace(data, acc3.BLSPubKey, crypto.BLSPublicKeyToBase64(otherKey.PublicKey), 1), "checksum mismatch"},
+		"missing footer":    {strings.Join(lines[:len(lines)-2], ""), "truncated"},
+		"missing account":   {lines[0] + lines[2] + lines[3] + lines[4], "checksum mismatch"},
+		"wrong version":     {strings.Replace(data, `"version":1`, `"version":2`, 1), "unsupported export version"},
+	}
+	for name, tc := range tests {
+		if _, _, err := Verify(strings.NewReader(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", name, err, tc.want)
+		}
+	}
+}
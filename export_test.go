@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
+	"github.com/xmonader/test_batched_tx_tendermint/export"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// writeAccountsFile writes an export of accounts with IDs 1 to n, each
+// holding its ID as balance
+func writeAccountsFile(t *testing.T, path string, n int) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer, err := export.NewWriter(file, export.Header{})
+	if err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	for id := 1; id <= n; id++ {
+		if err := writer.WriteAccount(&types.Account{ID: id, Balance: uint64(id)}); err != nil {
+			t.Fatalf("Failed to write account: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to write footer: %v", err)
+	}
+}
+
+func TestImportStorageLargerThanTransaction(t *testing.T) {
+	// More accounts than a BadgerDB transaction holds with the default options
+	const accounts = 200000
+	dir := t.TempDir()
+	input := filepath.Join(dir, "export.jsonl")
+	writeAccountsFile(t, input, accounts)
+
+	ctx := context.Background()
+	cfg := config.StorageConfig{
+		Backend: "badger",
+		Config:  map[string]interface{}{"db_path": filepath.Join(dir, "badger")},
+	}
+	metrics := app.NewMetrics()
+	if err := importStorage(ctx, input, cfg, metrics); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	// Running the import again skips the accounts already imported
+	if err := importStorage(ctx, input, cfg, metrics); err != nil {
+		t.Fatalf("Failed to import again: %v", err)
+	}
+
+	store, err := openStorage(ctx, cfg, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, total := 0, uint64(0)
+	it := storage.NewAccountIterator(store, storage.MinAccountID, 0)
+	for it.Next(ctx) {
+		count++
+		total += it.Account().Balance
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != accounts || total != accounts*(accounts+1)/2 {
+		t.Errorf("Got %d accounts holding %d, want %d holding %d", count, total, accounts, accounts*(accounts+1)/2)
+	}
+
+	// An account already holding another balance fails the import
+	if err := store.CreateAccount(ctx, accounts+1, 1); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	writeAccountsFile(t, input, accounts+1)
+	if err := importStorage(ctx, input, cfg, metrics); !errors.Is(err, storage.ErrAccountAlreadyExists) {
+		t.Errorf("Got error %v, want %v", err, storage.ErrAccountAlreadyExists)
+	}
+}
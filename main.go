@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -10,51 +9,85 @@ import (
 	"syscall"
 
 	abciserver "github.com/cometbft/cometbft/abci/server"
+	abci "github.com/cometbft/cometbft/abci/types"
 	cmtlog "github.com/cometbft/cometbft/libs/log"
+	"github.com/cometbft/cometbft/libs/service"
 	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
 )
 
-// Configuration represents the application configuration
-type Configuration struct {
-	StateFile  string `json:"state_file"`
-	PrivateKey string `json:"private_key"`
-}
-
 var (
 	configFile = flag.String("config", "config.json", "Path to the configuration file")
-	abciAddr   = flag.String("abci", "tcp://0.0.0.0:26658", "ABCI server address")
+	abciAddr   = flag.String("abci", "", "ABCI server address in abci mode, overriding abci.address")
 )
 
+// commands maps subcommand names to the functions running them with their arguments.
+// Without a subcommand, the application is started.
+var commands = map[string]func(args []string) error{
+	"config":  runConfigCommand,
+	"export":  runExportCommand,
+	"import":  runImportCommand,
+	"migrate": runMigrateCommand,
+	"replay":  runReplayCommand,
+}
+
 func main() {
+	// Run subcommands
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	// Parse command-line flags
 	flag.Parse()
 
 	// Load configuration
-	config, err := loadConfig(*configFile)
+	cfg, err := config.Load(*configFile)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if *abciAddr != "" {
+		cfg.ABCI.Address = *abciAddr
+	}
 
 	// Create logger
-	logger := cmtlog.NewTMLogger(cmtlog.NewSyncWriter(os.Stdout))
+	logger, err := newLogger(cfg.Log)
+	if err != nil {
+		log.Fatalf("Failed to create logger: %v", err)
+	}
 
 	// Create application
-	application := app.NewApplication(config.StateFile, logger)
-
-	// Create ABCI server
-	srv, err := abciserver.NewServer(*abciAddr, "socket", application)
+	application, err := newApplication(cfg, logger)
 	if err != nil {
-		log.Fatalf("Failed to create ABCI server: %v", err)
+		log.Fatalf("Failed to create application: %v", err)
+	}
+	defer application.Close()
+
+	// Serve metrics
+	if cfg.Metrics.ListenAddress != "" {
+		metricsServer, err := startMetricsServer(cfg.Metrics.ListenAddress, application.Metrics(), logger)
+		if err != nil {
+			log.Fatalf("Failed to start metrics server: %v", err)
+		}
+		defer stopMetricsServer(metricsServer)
 	}
 
-	// Set logger
-	srv.SetLogger(logger)
-
-	// Start the server
-	if err := srv.Start(); err != nil {
-		log.Fatalf("Failed to start ABCI server: %v", err)
+	// Start the ABCI server or the embedded node
+	var svc service.Service
+	switch cfg.Mode {
+	case config.ModeABCI:
+		svc, err = startABCIServer(cfg, application, logger)
+	case config.ModeNode:
+		svc, err = startNode(cfg, application, logger)
+	}
+	if err != nil {
+		log.Fatalf("Failed to start %s mode: %v", cfg.Mode, err)
 	}
-	defer srv.Stop()
+	defer svc.Stop()
 
 	// Wait for interrupt signal
 	c := make(chan os.Signal, 1)
@@ -65,20 +98,72 @@ func main() {
 	fmt.Println("Shutting down...")
 }
 
-// loadConfig loads the configuration from a file
-func loadConfig(path string) (*Configuration, error) {
-	// Open the file
-	file, err := os.Open(path)
+// newApplication creates the application configured by cfg. It loads the
+// state saved by an earlier run, including the keys of the account owners.
+func newApplication(cfg *config.Config, logger cmtlog.Logger) (*app.Application, error) {
+	application := app.NewApplication(cfg.StateFile, logger)
+	application.SetBlockLimits(cfg.Block.MaxTxs, cfg.Block.MaxOps)
+	application.SetSnapshotInterval(cfg.SnapshotInterval)
+	if err := application.SetStatePersistence(cfg.StatePersistence); err != nil {
+		application.Close()
+		return nil, fmt.Errorf("failed to configure state persistence: %w", err)
+	}
+	return application, nil
+}
+
+// runConfigCommand runs the "config" subcommands
+func runConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		return fmt.Errorf("usage: %s config init [-o path] [-force]", os.Args[0])
+	}
+
+	flags := flag.NewFlagSet("config init", flag.ExitOnError)
+	output := flags.String("o", "config.json", "Path of the configuration file to write")
+	force := flags.Bool("force", false, "Overwrite an existing file")
+	flags.Parse(args[1:])
+
+	if err := config.WriteTemplate(*output, *force); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote configuration template to %s\n", *output)
+	return nil
+}
+
+// newLogger creates a logger with the configured format and level
+func newLogger(cfg config.LogConfig) (cmtlog.Logger, error) {
+	var logger cmtlog.Logger
+	if cfg.Format == config.LogFormatJSON {
+		logger = cmtlog.NewTMJSONLogger(cmtlog.NewSyncWriter(os.Stdout))
+	} else {
+		logger = cmtlog.NewTMLogger(cmtlog.NewSyncWriter(os.Stdout))
+	}
+
+	level, err := cmtlog.AllowLevel(cfg.Level)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open configuration file: %w", err)
+		return nil, err
+	}
+	return cmtlog.NewFilter(logger, level), nil
+}
+
+// startABCIServer serves the application over the configured ABCI transport
+func startABCIServer(cfg *config.Config, application abci.Application, logger cmtlog.Logger) (service.Service, error) {
+	// The gRPC server calls the application concurrently, unlike the socket server
+	if cfg.ABCI.Transport == config.TransportGRPC {
+		application = app.NewSyncApplication(application)
 	}
-	defer file.Close()
 
-	// Decode the JSON
-	var config Configuration
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to decode configuration: %w", err)
+	// Create ABCI server
+	srv, err := abciserver.NewServer(cfg.ABCI.Address, cfg.ABCI.Transport, application)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ABCI server: %w", err)
 	}
 
-	return &config, nil
+	// Set logger
+	srv.SetLogger(logger)
+
+	// Start the server
+	if err := srv.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ABCI server: %w", err)
+	}
+	return srv, nil
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
+	"github.com/xmonader/test_batched_tx_tendermint/export"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// runMigrateCommand upgrades the state file, or the storage backend, to the
+// version used by this build
+func runMigrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "Path to the configuration file")
+	toStorage := flags.Bool("storage", false, "Migrate the configured storage backend instead of the state file")
+	dryRun := flags.Bool("dry-run", false, "Show the migrations that would run without writing anything")
+	backupDir := flags.String("backup-dir", "data/backups", "Directory of the storage backup written before migrating")
+	noBackup := flags.Bool("no-backup", false, "Migrate the storage backend without backing it up first")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	if *toStorage {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		return migrateStorage(ctx, cfg.Storage, app.NewMetrics(), *dryRun, *backupDir, *noBackup)
+	}
+	return migrateStateFile(cfg.StateFile, *dryRun)
+}
+
+// migrateStateFile upgrades the state file and its log. The old files are
+// always backed up next to them. A dry run applies the migrations in memory,
+// so it also checks that they succeed.
+func migrateStateFile(stateFile string, dryRun bool) error {
+	migrations, err := app.MigrateStateFile(stateFile, dryRun)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		fmt.Printf("State %s is at version %d, nothing to migrate\n", stateFile, types.StateVersion)
+		return nil
+	}
+
+	for _, migration := range migrations {
+		fmt.Printf("  v%d -> v%d: %s\n", migration.From, migration.From+1, migration.Description)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: state %s would be migrated to version %d\n", stateFile, types.StateVersion)
+	} else {
+		fmt.Printf("Migrated state %s to version %d\n", stateFile, types.StateVersion)
+	}
+	return nil
+}
+
+// migrateStorage upgrades the data of the storage backend, after exporting
+// its accounts to the backup directory
+func migrateStorage(ctx context.Context, cfg config.StorageConfig, metrics *app.Metrics, dryRun bool, backupDir string, noBackup bool) error {
+	store, err := newStorage(ctx, cfg, metrics)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	pending, err := storage.PendingMigrations(version)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("%s storage is at version %d, nothing to migrate\n", cfg.Backend, storage.SchemaVersion)
+		return nil
+	}
+	for _, migration := range pending {
+		fmt.Printf("  v%d -> v%d: %s\n", migration.From, migration.From+1, migration.Description)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %s storage would be migrated from version %d to %d\n", cfg.Backend, version, storage.SchemaVersion)
+		return nil
+	}
+
+	if !noBackup {
+		path, err := backupStorage(ctx, store, cfg.Backend, version, backupDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up %s storage to %s\n", cfg.Backend, path)
+	}
+
+	if _, err := storage.Migrate(ctx, store, cfg.Backend, false); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %s storage from version %d to %d\n", cfg.Backend, version, storage.SchemaVersion)
+	return nil
+}
+
+// backupStorage exports the accounts of a storage backend to a new file in
+// the backup directory and returns its path. It can be restored with the
+// import command.
+func backupStorage(ctx context.Context, store storage.ContextStorage, backend string, version int, backupDir string) (string, error) {
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-v%d-%s.jsonl", backend, version, time.Now().UTC().Format("20060102T150405"))
+	path := filepath.Join(backupDir, name)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer out.Close()
+
+	err = writeAccountsExport(ctx, out, export.Header{}, store)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to back up %s storage: %w", backend, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+	cmtcfg "github.com/cometbft/cometbft/config"
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+	"github.com/cometbft/cometbft/libs/service"
+	"github.com/cometbft/cometbft/node"
+	"github.com/cometbft/cometbft/p2p"
+	"github.com/cometbft/cometbft/privval"
+	"github.com/cometbft/cometbft/proxy"
+	"github.com/spf13/viper"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
+)
+
+// startNode runs a CometBFT node in this process, connected to the application
+// through a local client, using the configuration and keys in the CometBFT home
+func startNode(cfg *config.Config, application abci.Application, logger cmtlog.Logger) (service.Service, error) {
+	// Load the CometBFT configuration
+	cmtConfig, err := loadCometBFTConfig(cfg.CometBFTHome)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the validator and node keys
+	pv := privval.LoadFilePV(cmtConfig.PrivValidatorKeyFile(), cmtConfig.PrivValidatorStateFile())
+	nodeKey, err := p2p.LoadNodeKey(cmtConfig.NodeKeyFile())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node key: %w", err)
+	}
+
+	// Create the node
+	n, err := node.NewNode(
+		context.Background(),
+		cmtConfig,
+		pv,
+		nodeKey,
+		proxy.NewLocalClientCreator(application),
+		node.DefaultGenesisDocProviderFunc(cmtConfig),
+		cmtcfg.DefaultDBProvider,
+		node.DefaultMetricsProvider(cmtConfig.Instrumentation),
+		logger,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node: %w", err)
+	}
+
+	// Start the node
+	if err := n.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start node: %w", err)
+	}
+	return n, nil
+}
+
+// loadCometBFTConfig reads config/config.toml from a CometBFT home directory
+func loadCometBFTConfig(home string) (*cmtcfg.Config, error) {
+	cfg := cmtcfg.DefaultConfig()
+	cfg.SetRoot(home)
+
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(home, "config", "config.toml"))
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read CometBFT config: %w", err)
+	}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode CometBFT config: %w", err)
+	}
+
+	// Unmarshalling resets the root directory
+	cfg.SetRoot(home)
+	if err := cfg.ValidateBasic(); err != nil {
+		return nil, fmt.Errorf("invalid CometBFT config: %w", err)
+	}
+	return cfg, nil
+}
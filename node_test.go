@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+	cmtcfg "github.com/cometbft/cometbft/config"
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+	"github.com/cometbft/cometbft/node"
+	"github.com/cometbft/cometbft/p2p"
+	"github.com/cometbft/cometbft/privval"
+	"github.com/cometbft/cometbft/rpc/client/local"
+	cmttypes "github.com/cometbft/cometbft/types"
+	"github.com/xmonader/test_batched_tx_tendermint/client"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// initCometBFTHome writes the configuration, keys and genesis file of a
+// single-validator chain, with the given application state
+func initCometBFTHome(t *testing.T, home string, chainID string, appState types.GenesisState) {
+	t.Helper()
+
+	cmtConfig := cmtcfg.DefaultConfig()
+	cmtConfig.SetRoot(home)
+	cmtcfg.EnsureRoot(home)
+	cmtConfig.Consensus = cmtcfg.TestConsensusConfig()
+	cmtConfig.P2P.ListenAddress = "tcp://127.0.0.1:0"
+	cmtConfig.RPC.ListenAddress = ""
+	cmtcfg.WriteConfigFile(filepath.Join(home, "config", "config.toml"), cmtConfig)
+
+	pv, err := privval.GenFilePV(cmtConfig.PrivValidatorKeyFile(), cmtConfig.PrivValidatorStateFile(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate validator key: %v", err)
+	}
+	pv.Save()
+	if _, err := p2p.LoadOrGenNodeKey(cmtConfig.NodeKeyFile()); err != nil {
+		t.Fatalf("Failed to generate node key: %v", err)
+	}
+
+	state, err := json.Marshal(appState)
+	if err != nil {
+		t.Fatalf("Failed to marshal genesis state: %v", err)
+	}
+	pubKey, err := pv.GetPubKey()
+	if err != nil {
+		t.Fatalf("Failed to get validator key: %v", err)
+	}
+	genesis := &cmttypes.GenesisDoc{
+		ChainID:         chainID,
+		GenesisTime:     time.Now(),
+		ConsensusParams: cmttypes.DefaultConsensusParams(),
+		Validators:      []cmttypes.GenesisValidator{{Address: pubKey.Address(), PubKey: pubKey, Power: 10}},
+		AppState:        state,
+	}
+	if err := genesis.SaveAs(cmtConfig.GenesisFile()); err != nil {
+		t.Fatalf("Failed to save genesis file: %v", err)
+	}
+}
+
+func TestNodeAcceptsGenesisKeys(t *testing.T) {
+	dir := t.TempDir()
+	sender := client.NewClient(1)
+	sender.SetChainID("test-chain")
+
+	// The sender's key is registered by the genesis account
+	home := filepath.Join(dir, "cometbft")
+	initCometBFTHome(t, home, "test-chain", types.GenesisState{Accounts: []types.Account{{
+		ID:      1,
+		Balance: 100,
+		PubKey:  sender.GetPublicKeyBase64(),
+		KeyType: string(sender.GetKeyType()),
+	}}})
+
+	// Build the node from a configuration file
+	configFile := filepath.Join(dir, "config.json")
+	data, err := json.Marshal(map[string]interface{}{
+		"mode":          config.ModeNode,
+		"state_file":    filepath.Join(dir, "state.json"),
+		"cometbft_home": home,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	application, err := newApplication(cfg, cmtlog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Failed to create application: %v", err)
+	}
+	defer application.Close()
+	svc, err := startNode(cfg, application, cmtlog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	defer svc.Stop()
+
+	// A signed transfer is committed
+	tx, err := sender.CreateTransaction([]types.Operation{sender.CreateTransferOperation(2, 30)})
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	txBytes, err := tx.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize transaction: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := local.New(svc.(*node.Node)).BroadcastTxCommit(ctx, txBytes)
+	if err != nil {
+		t.Fatalf("Failed to broadcast transaction: %v", err)
+	}
+	if res.CheckTx.Code != 0 || res.TxResult.Code != 0 {
+		t.Fatalf("Transfer failed: check %d %q, result %d %q", res.CheckTx.Code, res.CheckTx.Log, res.TxResult.Code, res.TxResult.Log)
+	}
+	query, err := application.Query(ctx, &abci.QueryRequest{Path: "account", Data: []byte("2")})
+	if err != nil || query.Code != 0 {
+		t.Fatalf("Failed to query recipient: %v %s", err, query.Log)
+	}
+	var recipient types.Account
+	if err := json.Unmarshal(query.Value, &recipient); err != nil || recipient.Balance != 30 {
+		t.Errorf("Recipient is %+v (%v), want a balance of 30", recipient, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/config"
+	"github.com/xmonader/test_batched_tx_tendermint/replay"
+)
+
+// runReplayCommand re-executes the blocks of a stopped CometBFT node and
+// reports the first height whose results differ from the recorded ones
+func runReplayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "Path to the configuration file")
+	home := flags.String("home", "", "CometBFT home directory of the node, overriding cometbft_home")
+	toHeight := flags.Int64("to", 0, "Last height to replay, the last block when zero")
+	toStorage := flags.Bool("storage", false, "Also write the replayed balances to the configured storage backend, which must be empty, and check them")
+	verbose := flags.Bool("v", false, "Print every height replayed")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if *home != "" {
+		cfg.CometBFTHome = *home
+	}
+
+	// Open the node's databases
+	cmtConfig, err := loadCometBFTConfig(cfg.CometBFTHome)
+	if err != nil {
+		return err
+	}
+	source, err := replay.OpenDataDir(cmtConfig)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	// Replay into a fresh application that keeps its state in memory
+	application := app.NewApplication("", cmtlog.NewNopLogger())
+
+	opts := replay.Options{ToHeight: *toHeight}
+	if *toStorage {
+		store, err := openStorage(ctx, cfg.Storage, application.Metrics())
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		opts.Storage = store
+	}
+	if *verbose {
+		opts.Progress = func(height int64) { fmt.Printf("Replayed height %d\n", height) }
+	}
+
+	report, err := replay.Run(ctx, source, application, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Replayed heights %d to %d, %d verified against recorded results\n",
+		report.FirstHeight, report.LastHeight, report.Verified)
+	if report.Divergence != nil {
+		return fmt.Errorf("divergence at %w", report.Divergence)
+	}
+	fmt.Println("No divergence found")
+	return nil
+}
@@ -0,0 +1,118 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+
+	dbm "github.com/cometbft/cometbft-db"
+	cmtcfg "github.com/cometbft/cometbft/config"
+	sm "github.com/cometbft/cometbft/state"
+	"github.com/cometbft/cometbft/store"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// DataDir reads the blocks and results recorded in a CometBFT data directory.
+// Its databases are opened directly, so the node must be stopped.
+type DataDir struct {
+	genesis    *cmttypes.GenesisDoc
+	blockDB    dbm.DB
+	stateDB    dbm.DB
+	blockStore *store.BlockStore
+	stateStore sm.Store
+}
+
+var _ Source = (*DataDir)(nil)
+
+// OpenDataDir opens the genesis file, block store and state database of a CometBFT node
+func OpenDataDir(cfg *cmtcfg.Config) (*DataDir, error) {
+	genesis, err := cmttypes.GenesisDocFromFile(cfg.GenesisFile())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genesis file: %w", err)
+	}
+
+	blockDB, err := cmtcfg.DefaultDBProvider(&cmtcfg.DBContext{ID: "blockstore", Config: cfg})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block store: %w", err)
+	}
+	stateDB, err := cmtcfg.DefaultDBProvider(&cmtcfg.DBContext{ID: "state", Config: cfg})
+	if err != nil {
+		blockDB.Close()
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+
+	return &DataDir{
+		genesis:    genesis,
+		blockDB:    blockDB,
+		stateDB:    stateDB,
+		blockStore: store.NewBlockStore(blockDB, store.WithDBKeyLayout(cfg.Storage.ExperimentalKeyLayout)),
+		stateStore: sm.NewStore(stateDB, sm.StoreOptions{
+			DiscardABCIResponses: cfg.Storage.DiscardABCIResponses,
+			DBKeyLayout:          cfg.Storage.ExperimentalKeyLayout,
+		}),
+	}, nil
+}
+
+// Close closes the databases
+func (d *DataDir) Close() error {
+	return errors.Join(d.blockDB.Close(), d.stateDB.Close())
+}
+
+// Genesis returns the genesis document of the chain
+func (d *DataDir) Genesis() *cmttypes.GenesisDoc {
+	return d.genesis
+}
+
+// Base returns the first height in the block store
+func (d *DataDir) Base() int64 {
+	return d.blockStore.Base()
+}
+
+// Height returns the last height in the block store
+func (d *DataDir) Height() int64 {
+	return d.blockStore.Height()
+}
+
+// LoadBlock returns the block at a height, nil if it is not in the block store
+func (d *DataDir) LoadBlock(height int64) *cmttypes.Block {
+	block, _ := d.blockStore.LoadBlock(height)
+	return block
+}
+
+// Recorded returns the results the node recorded for a height. The
+// FinalizeBlock response is used when the node kept it. Otherwise only the
+// hashes are known, from the header of the next block or, for the last
+// height, from the saved consensus state.
+func (d *DataDir) Recorded(height int64) (*Recorded, error) {
+	response, err := d.stateStore.LoadFinalizeBlockResponse(height)
+	switch {
+	case err == nil:
+		return &Recorded{
+			AppHash:     response.AppHash,
+			ResultsHash: sm.TxResultsHash(response.TxResults),
+			TxResults:   response.TxResults,
+		}, nil
+	case errors.Is(err, sm.ErrFinalizeBlockResponsesNotPersisted), errors.As(err, &sm.ErrNoABCIResponsesForHeight{}):
+		// Fall back to the hashes
+	default:
+		return nil, fmt.Errorf("failed to load results of height %d: %w", height, err)
+	}
+
+	if meta := d.blockStore.LoadBlockMeta(height + 1); meta != nil {
+		return &Recorded{
+			AppHash:     meta.Header.AppHash,
+			ResultsHash: meta.Header.LastResultsHash,
+		}, nil
+	}
+
+	state, err := d.stateStore.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load consensus state: %w", err)
+	}
+	if state.LastBlockHeight == height {
+		return &Recorded{
+			AppHash:     state.AppHash,
+			ResultsHash: state.LastResultsHash,
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,378 @@
+// Package replay re-executes the blocks of a chain through a fresh
+// application, offline, and compares the results with those recorded by the
+// node that executed them, to find the first height where they diverge.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+	sm "github.com/cometbft/cometbft/state"
+	cmttypes "github.com/cometbft/cometbft/types"
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// Source provides the blocks of a chain and the results recorded when they were executed
+type Source interface {
+	// Genesis returns the genesis document of the chain
+	Genesis() *cmttypes.GenesisDoc
+	// Base returns the first height available
+	Base() int64
+	// Height returns the last height available
+	Height() int64
+	// LoadBlock returns the block at a height, nil if it is not available
+	LoadBlock(height int64) *cmttypes.Block
+	// Recorded returns the results recorded for a height, nil if they are not known
+	Recorded(height int64) (*Recorded, error)
+}
+
+// Recorded holds the results a node recorded for a height
+type Recorded struct {
+	AppHash     []byte
+	ResultsHash []byte
+	TxResults   []*abci.ExecTxResult // Nil when the node did not keep them
+}
+
+// Divergence describes where replayed results first differ from the recorded ones
+type Divergence struct {
+	Height  int64
+	TxIndex int    // Index of the transaction in the block, -1 when it is not known
+	TxHash  []byte // Hash of the transaction, nil when it is not known
+	Reason  string // What differs
+}
+
+// Error returns a description of the divergence
+func (d *Divergence) Error() string {
+	if d.TxIndex < 0 {
+		return fmt.Sprintf("height %d: %s", d.Height, d.Reason)
+	}
+	return fmt.Sprintf("height %d, tx %d (%X): %s", d.Height, d.TxIndex, d.TxHash, d.Reason)
+}
+
+// Options configures a replay
+type Options struct {
+	// ToHeight is the last height replayed, the last height of the source when zero
+	ToHeight int64
+	// Storage, when set, receives the balances of the replayed state after
+	// every block, which are read back and compared with the replayed ones.
+	// It must not hold any account.
+	Storage storage.ContextStorage
+	// Progress, when set, is called after every height replayed
+	Progress func(height int64)
+}
+
+// Report summarizes a replay
+type Report struct {
+	FirstHeight int64       // First height replayed
+	LastHeight  int64       // Last height replayed, lower than FirstHeight if none was
+	Verified    int64       // Heights whose results were compared with recorded ones
+	Divergence  *Divergence // First divergence found, nil if there was none
+}
+
+// Run initializes a fresh application with the genesis of the source, then
+// executes every block up to the last height, stopping at the first one
+// whose results differ from the recorded ones. The application must not
+// have been initialized, and should not persist its state.
+func Run(ctx context.Context, source Source, application *app.Application, opts Options) (*Report, error) {
+	genesis := source.Genesis()
+	initialHeight := genesis.InitialHeight
+	if initialHeight < 1 {
+		initialHeight = 1
+	}
+	if base := source.Base(); base > initialHeight {
+		return nil, fmt.Errorf("blocks are pruned below height %d, replaying needs every block from height %d", base, initialHeight)
+	}
+
+	toHeight := source.Height()
+	if opts.ToHeight > 0 {
+		if opts.ToHeight > toHeight {
+			return nil, fmt.Errorf("height %d is above the last height %d", opts.ToHeight, toHeight)
+		}
+		toHeight = opts.ToHeight
+	}
+
+	// Initialize the chain as the node did
+	_, err := application.InitChain(ctx, &abci.InitChainRequest{
+		Time:          genesis.GenesisTime,
+		ChainId:       genesis.ChainID,
+		InitialHeight: initialHeight,
+		AppStateBytes: genesis.AppState,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize chain: %w", err)
+	}
+
+	var mirror *storageMirror
+	if opts.Storage != nil {
+		if mirror, err = newStorageMirror(ctx, opts.Storage, application.StateStore()); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &Report{FirstHeight: initialHeight, LastHeight: initialHeight - 1}
+	for height := initialHeight; height <= toHeight; height++ {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		block := source.LoadBlock(height)
+		if block == nil {
+			return report, fmt.Errorf("block %d is missing", height)
+		}
+
+		// Execute the block
+		response, divergence := executeBlock(ctx, application, block)
+		if divergence == nil {
+			report.LastHeight = height
+			if divergence, err = verifyBlock(source, block, response, report); err != nil {
+				return report, err
+			}
+		}
+
+		// Check the storage backend once the results match
+		if divergence == nil && mirror != nil {
+			if divergence, err = mirror.sync(ctx, height, block.Txs, response.TxResults); err != nil {
+				return report, err
+			}
+		}
+		if divergence != nil {
+			report.Divergence = divergence
+			return report, nil
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(height)
+		}
+	}
+
+	return report, nil
+}
+
+// executeBlock finalizes and commits a block. An error, including a halt on
+// a broken invariant, is a divergence, since the node executed the block.
+func executeBlock(ctx context.Context, application *app.Application, block *cmttypes.Block) (response *abci.FinalizeBlockResponse, divergence *Divergence) {
+	height := block.Height
+	defer func() {
+		if r := recover(); r != nil {
+			divergence = &Divergence{Height: height, TxIndex: -1, Reason: fmt.Sprintf("application halted: %v", r)}
+		}
+	}()
+
+	response, err := application.FinalizeBlock(ctx, &abci.FinalizeBlockRequest{
+		Txs:                block.Txs.ToSliceOfBytes(),
+		Hash:               block.Hash(),
+		Height:             height,
+		Time:               block.Time,
+		NextValidatorsHash: block.NextValidatorsHash,
+		ProposerAddress:    block.ProposerAddress,
+	})
+	if err == nil {
+		_, err = application.Commit(ctx, &abci.CommitRequest{})
+	}
+	if err != nil {
+		return nil, &Divergence{Height: height, TxIndex: -1, Reason: fmt.Sprintf("application failed: %v", err)}
+	}
+	return response, nil
+}
+
+// verifyBlock compares the results of a block with the recorded ones, if any
+func verifyBlock(source Source, block *cmttypes.Block, response *abci.FinalizeBlockResponse, report *Report) (*Divergence, error) {
+	recorded, err := source.Recorded(block.Height)
+	if err != nil || recorded == nil {
+		return nil, err
+	}
+	report.Verified++
+	return compareResults(block, response, recorded), nil
+}
+
+// compareResults compares the results of a block with the recorded ones.
+// Transaction results are compared first, when recorded, so a divergence
+// points at the first transaction that differs.
+func compareResults(block *cmttypes.Block, response *abci.FinalizeBlockResponse, recorded *Recorded) *Divergence {
+	height := block.Height
+	if recorded.TxResults != nil {
+		if len(response.TxResults) != len(recorded.TxResults) {
+			return &Divergence{
+				Height:  height,
+				TxIndex: -1,
+				Reason:  fmt.Sprintf("%d transaction results, recorded %d", len(response.TxResults), len(recorded.TxResults)),
+			}
+		}
+		for i, result := range response.TxResults {
+			if reason := compareTxResult(result, recorded.TxResults[i]); reason != "" {
+				return &Divergence{Height: height, TxIndex: i, TxHash: block.Txs[i].Hash(), Reason: reason}
+			}
+		}
+	}
+
+	if resultsHash := sm.TxResultsHash(response.TxResults); !bytes.Equal(resultsHash, recorded.ResultsHash) {
+		return &Divergence{
+			Height:  height,
+			TxIndex: -1,
+			Reason:  fmt.Sprintf("results hash %X, recorded %X", resultsHash, recorded.ResultsHash),
+		}
+	}
+	if !bytes.Equal(response.AppHash, recorded.AppHash) {
+		return &Divergence{
+			Height:  height,
+			TxIndex: -1,
+			Reason:  fmt.Sprintf("app hash %X, recorded %X", response.AppHash, recorded.AppHash),
+		}
+	}
+	return nil
+}
+
+// compareTxResult compares the fields of a transaction result that are part
+// of the results hash, and describes the first one that differs
+func compareTxResult(result, recorded *abci.ExecTxResult) string {
+	switch {
+	case result.Code != recorded.Code:
+		return fmt.Sprintf("code %d (%s), recorded %d (%s)", result.Code, result.Log, recorded.Code, recorded.Log)
+	case !bytes.Equal(result.Data, recorded.Data):
+		return fmt.Sprintf("data %X, recorded %X", result.Data, recorded.Data)
+	case result.GasWanted != recorded.GasWanted:
+		return fmt.Sprintf("gas wanted %d, recorded %d", result.GasWanted, recorded.GasWanted)
+	case result.GasUsed != recorded.GasUsed:
+		return fmt.Sprintf("gas used %d, recorded %d", result.GasUsed, recorded.GasUsed)
+	}
+	return ""
+}
+
+// storageMirror writes the balances of the replayed state to a storage
+// backend, and checks that the backend returns them
+type storageMirror struct {
+	store    storage.ContextStorage
+	state    *app.StateStore
+	balances map[int]uint64 // Balances written to the backend
+}
+
+// newStorageMirror creates a mirror, writing the genesis accounts to an empty backend
+func newStorageMirror(ctx context.Context, store storage.ContextStorage, state *app.StateStore) (*storageMirror, error) {
+	existing, err := store.ListAccounts(ctx, storage.MinAccountID, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage accounts: %w", err)
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("storage backend holds account %d, replaying needs an empty one", existing[0].ID)
+	}
+
+	m := &storageMirror{
+		store:    store,
+		state:    state,
+		balances: make(map[int]uint64),
+	}
+	accounts, err := state.GetAllAccounts()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(accounts))
+	for i, acc := range accounts {
+		ids[i] = acc.ID
+	}
+	if err := m.write(ctx, ids); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sync writes the balances of the accounts used by the successful
+// transactions of a block, then reads them back
+func (m *storageMirror) sync(ctx context.Context, height int64, txs cmttypes.Txs, results []*abci.ExecTxResult) (*Divergence, error) {
+	ids := blockAccounts(txs, results)
+	if err := m.write(ctx, ids); err != nil {
+		return nil, fmt.Errorf("height %d: %w", height, err)
+	}
+
+	for _, id := range ids {
+		want, written := m.balances[id]
+		balance, err := m.store.GetBalance(ctx, id)
+		if errors.Is(err, storage.ErrAccountNotFound) && !written {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("height %d: failed to read account %d from storage: %w", height, id, err)
+		}
+		if balance != want {
+			return &Divergence{
+				Height:  height,
+				TxIndex: -1,
+				Reason:  fmt.Sprintf("storage balance of account %d is %d, replayed %d", id, balance, want),
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// write applies the replayed balances of the given accounts to the backend
+// in one transaction, as differences from the balances written before
+func (m *storageMirror) write(ctx context.Context, ids []int) error {
+	tx, err := m.store.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin storage transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Balances are recorded once the transaction commits
+	written := make(map[int]uint64, len(ids))
+
+	for _, id := range ids {
+		balance := m.state.GetAccount(id).Balance
+		previous, exists := m.balances[id]
+
+		var err error
+		switch {
+		case !exists && balance == 0:
+			continue // Accounts without funds are only created once they receive some
+		case !exists:
+			err = tx.CreateAccount(ctx, id, balance)
+		case balance > previous:
+			err = tx.Credit(ctx, id, balance-previous)
+		case balance < previous:
+			err = tx.Debit(ctx, id, previous-balance)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write account %d to storage: %w", id, err)
+		}
+		written[id] = balance
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit storage transaction: %w", err)
+	}
+	for id, balance := range written {
+		m.balances[id] = balance
+	}
+	return nil
+}
+
+// blockAccounts returns the accounts used by the successful transactions of a block, in order
+func blockAccounts(txs cmttypes.Txs, results []*abci.ExecTxResult) []int {
+	seen := make(map[int]bool)
+	for i, txBytes := range txs {
+		if i >= len(results) || results[i].Code != 0 {
+			continue
+		}
+		tx, err := types.ParseTransaction(txBytes)
+		if err != nil {
+			continue
+		}
+		for _, op := range tx.Operations {
+			seen[op.From] = true
+			seen[op.To] = true
+		}
+	}
+	delete(seen, 0)
+
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,182 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/libs/log"
+	sm "github.com/cometbft/cometbft/state"
+	cmttypes "github.com/cometbft/cometbft/types"
+	"github.com/xmonader/test_batched_tx_tendermint/app"
+	"github.com/xmonader/test_batched_tx_tendermint/client"
+	"github.com/xmonader/test_batched_tx_tendermint/storage"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// memorySource is a chain held in memory, with the results of a first execution
+type memorySource struct {
+	genesis  *cmttypes.GenesisDoc
+	blocks   []*cmttypes.Block
+	recorded []*Recorded
+}
+
+func (s *memorySource) Genesis() *cmttypes.GenesisDoc { return s.genesis }
+func (s *memorySource) Base() int64                   { return 1 }
+func (s *memorySource) Height() int64                 { return int64(len(s.blocks)) }
+
+func (s *memorySource) LoadBlock(height int64) *cmttypes.Block {
+	return s.blocks[height-1]
+}
+
+func (s *memorySource) Recorded(height int64) (*Recorded, error) {
+	return s.recorded[height-1], nil
+}
+
+// newApplication creates an application knowing the sender's key
+func newApplication(t *testing.T, sender *client.Client) *app.Application {
+	t.Helper()
+
+	application := app.NewApplication("", log.NewNopLogger())
+	if err := application.RegisterUserKey(sender.GetUserID(), string(sender.GetKeyType()), sender.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("Failed to register key: %v", err)
+	}
+	return application
+}
+
+// newChain executes blocks of transfers from a funded sender, some of them
+// failing, and records their results as a node would
+func newChain(t *testing.T, sender *client.Client) *memorySource {
+	t.Helper()
+
+	appState, err := json.Marshal(types.GenesisState{Accounts: []types.Account{{ID: 1, Balance: 100}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &memorySource{genesis: &cmttypes.GenesisDoc{ChainID: "test-chain", InitialHeight: 1, AppState: appState}}
+	sender.SetChainID("test-chain")
+
+	ctx := context.Background()
+	node := newApplication(t, sender)
+	if _, err := node.InitChain(ctx, &abci.InitChainRequest{ChainId: "test-chain", AppStateBytes: appState}); err != nil {
+		t.Fatalf("Failed to init chain: %v", err)
+	}
+
+	for height := int64(1); height <= 3; height++ {
+		// The last transfer of each block overdraws the sender
+		var txs []cmttypes.Tx
+		for _, amount := range []uint64{10, 20, 1000} {
+			tx, err := sender.CreateTransaction([]types.Operation{sender.CreateTransferOperation(int(height)+1, amount)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := tx.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, data)
+		}
+		block := cmttypes.MakeBlock(height, txs, &cmttypes.Commit{}, nil)
+
+		response, err := node.FinalizeBlock(ctx, &abci.FinalizeBlockRequest{Txs: block.Txs.ToSliceOfBytes(), Height: height})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Commit(ctx, &abci.CommitRequest{})
+
+		source.blocks = append(source.blocks, block)
+		source.recorded = append(source.recorded, &Recorded{
+			AppHash:     response.AppHash,
+			ResultsHash: sm.TxResultsHash(response.TxResults),
+			TxResults:   response.TxResults,
+		})
+	}
+	return source
+}
+
+func TestReplay(t *testing.T) {
+	sender := client.NewClient(1)
+	source := newChain(t, sender)
+	ctx := context.Background()
+
+	// Replaying the recorded chain finds no divergence
+	report, err := Run(ctx, source, newApplication(t, sender), Options{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if report.Divergence != nil || report.LastHeight != 3 || report.Verified != 3 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	// A node that accepted the failed transfer of block 2 diverges there
+	source.recorded[1].TxResults[2] = &abci.ExecTxResult{Code: 0}
+	report, err = Run(ctx, source, newApplication(t, sender), Options{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	d := report.Divergence
+	if d == nil || d.Height != 2 || d.TxIndex != 2 || !strings.HasPrefix(d.Reason, "code 2") {
+		t.Fatalf("Expected a divergence at height 2, tx 2, got %v", d)
+	}
+
+	// Without transaction results, only the height is known
+	source.recorded[1].TxResults = nil
+	source.recorded[1].ResultsHash = []byte("other")
+	report, _ = Run(ctx, source, newApplication(t, sender), Options{})
+	if d := report.Divergence; d == nil || d.Height != 2 || d.TxIndex != -1 {
+		t.Fatalf("Expected a divergence at height 2, got %v", d)
+	}
+}
+
+func TestReplayToStorage(t *testing.T) {
+	sender := client.NewClient(1)
+	source := newChain(t, sender)
+
+	ctx := context.Background()
+	store, err := storage.NewMemoryStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	report, err := Run(ctx, source, newApplication(t, sender), Options{Storage: store})
+	if err != nil || report.Divergence != nil {
+		t.Fatalf("Replay to storage failed: %v, %v", err, report.Divergence)
+	}
+
+	// The backend holds the replayed balances
+	for id, want := range map[int]uint64{1: 10, 2: 30, 3: 30, 4: 30} {
+		if balance, err := store.GetBalance(ctx, id); err != nil || balance != want {
+			t.Errorf("Account %d has balance %d (%v), want %d", id, balance, err, want)
+		}
+	}
+}
+
+func TestReplayAppHash(t *testing.T) {
+	sender := client.NewClient(1)
+	source := newChain(t, sender)
+	if len(source.recorded[0].AppHash) == 0 {
+		t.Fatal("The chain recorded no app hash")
+	}
+
+	// A node whose state differs in an account no transaction touches
+	// returns the same results, but not the same app hash
+	other := client.NewClient(9)
+	application := newApplication(t, sender)
+	if err := application.RegisterUserKey(other.GetUserID(), string(other.GetKeyType()), other.GetPublicKeyBase64()); err != nil {
+		t.Fatalf("Failed to register key: %v", err)
+	}
+	report, err := Run(context.Background(), source, application, Options{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	d := report.Divergence
+	if d == nil || d.Height != 1 || d.TxIndex != -1 || !strings.HasPrefix(d.Reason, "app hash") {
+		t.Fatalf("Expected an app hash divergence at height 1, got %v", d)
+	}
+}
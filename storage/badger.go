@@ -1,25 +1,29 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
 
-	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v4"
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
-// BadgerStorage implements the Storage interface using BadgerDB
+// BadgerStorage implements the ContextStorage interface using BadgerDB.
+// The database is embedded, so calls only check their context before
+// committing and while iterating over accounts.
 type BadgerStorage struct {
+	autoCommit
 	db          *badger.DB
 	initialized bool
 	dbPath      string
-	txn         *badger.Txn
 }
 
 // NewBadgerStorage creates a new BadgerDB storage instance
-func NewBadgerStorage(config map[string]interface{}) (Storage, error) {
+func NewBadgerStorage(config map[string]interface{}) (ContextStorage, error) {
 	// Get the database path from config
 	dbPathInterface, ok := config["db_path"]
 	if !ok {
@@ -36,13 +40,15 @@ func NewBadgerStorage(config map[string]interface{}) (Storage, error) {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	return &BadgerStorage{
+	s := &BadgerStorage{
 		dbPath: dbPath,
-	}, nil
+	}
+	s.autoCommit = autoCommit{begin: s.Begin}
+	return s, nil
 }
 
 // Initialize initializes the storage
-func (s *BadgerStorage) Initialize() error {
+func (s *BadgerStorage) Initialize(ctx context.Context) error {
 	if s.initialized {
 		return ErrAlreadyInitialized
 	}
@@ -66,11 +72,6 @@ func (s *BadgerStorage) Close() error {
 		return ErrNotInitialized
 	}
 
-	if s.txn != nil {
-		s.txn.Discard()
-		s.txn = nil
-	}
-
 	if err := s.db.Close(); err != nil {
 		return fmt.Errorf("failed to close database: %w", err)
 	}
@@ -86,160 +87,239 @@ func accountKey(id int) []byte {
 	return key
 }
 
-// GetAccount retrieves an account by ID
-func (s *BadgerStorage) GetAccount(id int) (*types.Account, error) {
+// schemaVersionKey is the key of the schema version. It is longer than the
+// account keys, which is how iterating over the accounts skips it.
+var schemaVersionKey = []byte("meta:schema_version")
+
+// isAccountKey reports whether a key holds an account
+func isAccountKey(key []byte) bool {
+	return len(key) == 8
+}
+
+// Begin starts a BadgerDB transaction. They are serializable snapshots:
+// Commit fails with ErrTransactionConflict when another transaction
+// committed changes to the accounts this one read.
+func (s *BadgerStorage) Begin(ctx context.Context) (ContextTx, error) {
 	if !s.initialized {
 		return nil, ErrNotInitialized
 	}
+	return &badgerTx{txn: s.db.NewTransaction(true)}, nil
+}
 
-	key := accountKey(id)
-	var account *types.Account
+// ListAccounts returns a page of accounts ordered by ID, seeking to the key
+// of startID
+func (s *BadgerStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	if !s.initialized {
+		return nil, ErrNotInitialized
+	}
 
-	// Use the transaction if one is active
-	if s.txn != nil {
-		item, err := s.txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			return nil, ErrAccountNotFound
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to get account: %w", err)
+	accounts := []*types.Account{}
+
+	// Iterate in a read-only transaction
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		// Keys order the IDs as unsigned integers, which puts negative IDs
+		// after the others, from the key of MinAccountID on. List them
+		// first, then start over at 0 up to their keys.
+		var err error
+		if startID < 0 {
+			accounts, err = scanAccounts(ctx, it, accountKey(startID), nil, accounts, limit)
+			if err != nil {
+				return err
+			}
+			startID = 0
 		}
+		accounts, err = scanAccounts(ctx, it, accountKey(startID), accountKey(MinAccountID), accounts, limit)
+		return err
+	})
 
-		err = item.Value(func(val []byte) error {
+	if err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+// scanAccounts appends to accounts the ones whose keys are from start up to
+// end, or the last key if end is nil, until it holds limit accounts
+func scanAccounts(ctx context.Context, it *badger.Iterator, start, end []byte, accounts []*types.Account, limit int) ([]*types.Account, error) {
+	for it.Seek(start); it.Valid(); it.Next() {
+		if limit > 0 && len(accounts) >= limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		item := it.Item()
+		if end != nil && bytes.Compare(item.Key(), end) >= 0 {
+			break
+		}
+		if !isAccountKey(item.Key()) {
+			continue
+		}
+		var account types.Account
+		err := item.Value(func(val []byte) error {
 			return json.Unmarshal(val, &account)
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal account: %w", err)
 		}
+		accounts = append(accounts, &account)
+	}
+	return accounts, nil
+}
 
-		return account, nil
+// SchemaVersion returns the version of the stored data layout
+func (s *BadgerStorage) SchemaVersion(ctx context.Context) (int, error) {
+	if !s.initialized {
+		return 0, ErrNotInitialized
 	}
 
-	// No active transaction, use a read-only transaction
+	version := 0
 	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
+		item, err := txn.Get(schemaVersionKey)
 		if err == badger.ErrKeyNotFound {
-			return ErrAccountNotFound
+			return nil
 		}
 		if err != nil {
-			return fmt.Errorf("failed to get account: %w", err)
+			return err
 		}
-
 		return item.Value(func(val []byte) error {
-			account = &types.Account{}
-			return json.Unmarshal(val, account)
+			if len(val) != 8 {
+				return fmt.Errorf("invalid schema version of %d bytes", len(val))
+			}
+			version = int(binary.BigEndian.Uint64(val))
+			return nil
 		})
 	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return version, nil
+}
 
-	if err == ErrAccountNotFound {
-		return nil, err
+// SetSchemaVersion records the version of the stored data layout
+func (s *BadgerStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	if !s.initialized {
+		return ErrNotInitialized
 	}
+
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(version))
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(schemaVersionKey, val)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get account: %w", err)
+		return fmt.Errorf("failed to set schema version: %w", err)
 	}
+	return nil
+}
 
-	return account, nil
+// badgerTx is a transaction of a BadgerStorage. BadgerDB transactions do not
+// nest, so while a savepoint is marked, every write records the value it
+// replaces, which RollbackTo writes back.
+type badgerTx struct {
+	txn        *badger.Txn
+	undo       []badgerUndo
+	savepoints []badgerSavepoint
+	done       bool
 }
 
-// AccountExists checks if an account exists
-func (s *BadgerStorage) AccountExists(id int) (bool, error) {
-	if !s.initialized {
-		return false, ErrNotInitialized
-	}
+// badgerUndo is the value of a key before a write, nil if it did not exist
+type badgerUndo struct {
+	key   []byte
+	value []byte
+}
 
-	key := accountKey(id)
+// badgerSavepoint is a savepoint of a badgerTx, with the length of the undo
+// log when it was marked
+type badgerSavepoint struct {
+	name string
+	mark int
+}
 
-	// Use the transaction if one is active
-	if s.txn != nil {
-		_, err := s.txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			return false, nil
-		}
-		if err != nil {
-			return false, fmt.Errorf("failed to check account existence: %w", err)
-		}
-		return true, nil
+// GetAccount retrieves an account by ID
+func (tx *badgerTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
 	}
 
-	// No active transaction, use a read-only transaction
-	var exists bool
-	err := s.db.View(func(txn *badger.Txn) error {
-		_, err := txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			exists = false
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("failed to check account existence: %w", err)
-		}
-		exists = true
-		return nil
-	})
+	item, err := tx.txn.Get(accountKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
 
+	var account types.Account
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &account)
+	})
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("failed to unmarshal account: %w", err)
 	}
+	return &account, nil
+}
 
-	return exists, nil
+// AccountExists checks if an account exists
+func (tx *badgerTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	_, err := tx.GetAccount(ctx, id)
+	if err == ErrAccountNotFound {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-// UpdateBalance updates an account's balance
-func (s *BadgerStorage) UpdateBalance(id int, delta int) error {
-	if !s.initialized {
-		return ErrNotInitialized
+// GetBalance gets an account's current balance
+func (tx *badgerTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	account, err := tx.GetAccount(ctx, id)
+	if err != nil {
+		return 0, err
 	}
+	return account.Balance, nil
+}
 
+// Credit adds an amount to an account's balance
+func (tx *badgerTx) Credit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, false)
+}
+
+// Debit subtracts an amount from an account's balance
+func (tx *badgerTx) Debit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, true)
+}
+
+// updateBalance debits or credits an account's balance
+func (tx *badgerTx) updateBalance(ctx context.Context, id int, amount uint64, debit bool) error {
 	// Get the account
-	account, err := s.GetAccount(id)
+	account, err := tx.GetAccount(ctx, id)
 	if err != nil {
-		// If account doesn't exist, create it with the delta as initial balance
-		// (only if delta is positive)
-		if err == ErrAccountNotFound && delta > 0 {
-			return s.CreateAccount(id, delta)
+		// If account doesn't exist, create it with the amount as initial
+		// balance (only if it is credited)
+		if err == ErrAccountNotFound && !debit && amount > 0 {
+			return tx.setAccount(&types.Account{ID: id, Balance: amount})
 		}
 		return err
 	}
 
-	// Check if the balance would go negative
-	newBalance := account.Balance + delta
-	if newBalance < 0 {
-		return ErrInsufficientBalance
+	// Check that the balance stays representable
+	newBalance, err := changeBalance(account.Balance, amount, debit)
+	if err != nil {
+		return err
 	}
 
 	// Update the balance
 	account.Balance = newBalance
-
-	// Serialize the account
-	accountData, err := json.Marshal(account)
-	if err != nil {
-		return fmt.Errorf("failed to marshal account: %w", err)
-	}
-
-	// Use the transaction if one is active
-	if s.txn != nil {
-		if err := s.txn.Set(accountKey(id), accountData); err != nil {
-			return fmt.Errorf("failed to update account: %w", err)
-		}
-		return nil
-	}
-
-	// No active transaction, use a new transaction
-	return s.db.Update(func(txn *badger.Txn) error {
-		if err := txn.Set(accountKey(id), accountData); err != nil {
-			return fmt.Errorf("failed to update account: %w", err)
-		}
-		return nil
-	})
+	return tx.setAccount(account)
 }
 
 // CreateAccount creates a new account
-func (s *BadgerStorage) CreateAccount(id int, initialBalance int) error {
-	if !s.initialized {
-		return ErrNotInitialized
-	}
-
+func (tx *badgerTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
 	// Check if account already exists
-	exists, err := s.AccountExists(id)
+	exists, err := tx.AccountExists(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -247,159 +327,165 @@ func (s *BadgerStorage) CreateAccount(id int, initialBalance int) error {
 		return ErrAccountAlreadyExists
 	}
 
-	// Create the account
-	account := &types.Account{
-		ID:      id,
-		Balance: initialBalance,
-	}
+	return tx.setAccount(&types.Account{ID: id, Balance: initialBalance})
+}
 
-	// Serialize the account
-	accountData, err := json.Marshal(account)
+// CreateAccounts creates new accounts, once it checked that none exists
+func (tx *badgerTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	ids, err := newAccountIDs(accounts)
 	if err != nil {
-		return fmt.Errorf("failed to marshal account: %w", err)
+		return err
 	}
-
-	// Use the transaction if one is active
-	if s.txn != nil {
-		if err := s.txn.Set(accountKey(id), accountData); err != nil {
-			return fmt.Errorf("failed to create account: %w", err)
+	for _, id := range ids {
+		exists, err := tx.AccountExists(ctx, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: account %d", ErrAccountAlreadyExists, id)
 		}
-		return nil
 	}
 
-	// No active transaction, use a new transaction
-	return s.db.Update(func(txn *badger.Txn) error {
-		if err := txn.Set(accountKey(id), accountData); err != nil {
-			return fmt.Errorf("failed to create account: %w", err)
+	for _, acc := range accounts {
+		if err := tx.setAccount(&types.Account{ID: acc.ID, Balance: acc.Balance}); err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
-// Commit commits any pending changes
-func (s *BadgerStorage) Commit() error {
-	if !s.initialized {
-		return ErrNotInitialized
+// setAccount writes an account to the transaction
+func (tx *badgerTx) setAccount(account *types.Account) error {
+	accountData, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account: %w", err)
 	}
 
-	// If no transaction is active, nothing to commit
-	if s.txn == nil {
-		return nil
+	// Record the value replaced, unless no savepoint can restore it
+	key := accountKey(account.ID)
+	if len(tx.savepoints) > 0 {
+		undo := badgerUndo{key: key}
+		item, err := tx.txn.Get(key)
+		if err == nil {
+			undo.value, err = item.ValueCopy(nil)
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to get account: %w", err)
+		}
+		tx.undo = append(tx.undo, undo)
 	}
 
-	// Commit the transaction
-	if err := s.txn.Commit(); err != nil {
-		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
+	if err := tx.txn.Set(key, accountData); err == badger.ErrTxnTooBig {
+		return fmt.Errorf("%w: %v", ErrTransactionTooLarge, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to update account: %w", err)
 	}
-
-	// Clear the transaction
-	s.txn = nil
-
 	return nil
 }
 
-// Rollback rolls back any pending changes
-func (s *BadgerStorage) Rollback() error {
-	if !s.initialized {
-		return ErrNotInitialized
+// ApplyTransfers applies a batch of transfers to the transaction
+func (tx *badgerTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	// Read the accounts used by the batch
+	accounts := make(map[int]*types.Account)
+	balances := make(map[int]uint64)
+	for _, id := range transferAccounts(transfers) {
+		account, err := tx.GetAccount(ctx, id)
+		if err == ErrAccountNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		accounts[id] = account
+		balances[id] = account.Balance
 	}
 
-	// If no transaction is active, nothing to rollback
-	if s.txn == nil {
-		return nil
-	}
+	results, changed := planTransfers(balances, transfers, mode)
 
-	// Discard the transaction
-	s.txn.Discard()
-	s.txn = nil
+	// Write the new balances
+	for id, balance := range changed {
+		account, exists := accounts[id]
+		if !exists {
+			account = &types.Account{ID: id}
+		}
+		account.Balance = balance
+		if err := tx.setAccount(account); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
 
+// Savepoint marks the current end of the undo log
+func (tx *badgerTx) Savepoint(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.savepoints = append(tx.savepoints, badgerSavepoint{name: name, mark: len(tx.undo)})
 	return nil
 }
 
-// BeginTransaction begins a new transaction
-func (s *BadgerStorage) BeginTransaction() error {
-	if !s.initialized {
-		return ErrNotInitialized
+// RollbackTo writes back the values replaced since a savepoint, latest first
+func (tx *badgerTx) RollbackTo(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	i := len(tx.savepoints) - 1
+	for i >= 0 && tx.savepoints[i].name != name {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSavepointNotFound, name)
 	}
 
-	// If a transaction is already active, commit it first
-	if s.txn != nil {
-		if err := s.Commit(); err != nil {
-			return err
+	mark := tx.savepoints[i].mark
+	for j := len(tx.undo) - 1; j >= mark; j-- {
+		var err error
+		if undo := tx.undo[j]; undo.value == nil {
+			err = tx.txn.Delete(undo.key)
+		} else {
+			err = tx.txn.Set(undo.key, undo.value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to roll back to savepoint %s: %w", name, err)
 		}
 	}
-
-	// Start a new transaction
-	s.txn = s.db.NewTransaction(true)
-
+	tx.undo = tx.undo[:mark]
+	tx.savepoints = tx.savepoints[:i+1]
 	return nil
 }
 
-// GetBalance gets an account's current balance
-func (s *BadgerStorage) GetBalance(id int) (int, error) {
-	account, err := s.GetAccount(id)
-	if err != nil {
-		return 0, err
+// Commit commits the transaction, unless the caller gave up
+func (tx *badgerTx) Commit(ctx context.Context) error {
+	if tx.done {
+		return ErrTransactionDone
 	}
-	return account.Balance, nil
-}
+	tx.done = true
+	defer tx.txn.Discard()
 
-// GetAllAccounts gets all accounts
-func (s *BadgerStorage) GetAllAccounts() ([]*types.Account, error) {
-	if !s.initialized {
-		return nil, ErrNotInitialized
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	var accounts []*types.Account
-
-	// Use the transaction if one is active
-	if s.txn != nil {
-		it := s.txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			var account types.Account
-			err := item.Value(func(val []byte) error {
-				return json.Unmarshal(val, &account)
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failed to unmarshal account: %w", err)
-			}
-			accounts = append(accounts, &account)
-		}
-
-		return accounts, nil
+	err := tx.txn.Commit()
+	if err == badger.ErrConflict {
+		return fmt.Errorf("%w: %v", ErrTransactionConflict, err)
 	}
-
-	// No active transaction, use a read-only transaction
-	err := s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			var account types.Account
-			err := item.Value(func(val []byte) error {
-				return json.Unmarshal(val, &account)
-			})
-			if err != nil {
-				return fmt.Errorf("failed to unmarshal account: %w", err)
-			}
-			accounts = append(accounts, &account)
-		}
-
-		return nil
-	})
-
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
 	}
+	return nil
+}
 
-	return accounts, nil
+// Rollback discards the transaction
+func (tx *badgerTx) Rollback(ctx context.Context) error {
+	if !tx.done {
+		tx.done = true
+		tx.txn.Discard()
+	}
+	return nil
 }
 
 func init() {
 	// Register the BadgerDB storage backend
-	RegisterStorage("badger", NewBadgerStorage)
+	RegisterContextStorage("badger", NewBadgerStorage)
 }
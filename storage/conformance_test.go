@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// conformanceBackend describes how the conformance suite runs against a
+// storage backend
+type conformanceBackend struct {
+	// open creates a backend over the data at location, a directory of its
+	// own for each case, which is the same when the case reopens the backend
+	open func(t *testing.T, location string) (ContextStorage, error)
+	// skip is the reason to skip the backend, when it is not available
+	skip string
+	// persistent backends keep their data once closed and opened again
+	persistent bool
+	// sharedIDs backends keep accounts across runs and cases, so every case
+	// uses account IDs no other case uses
+	sharedIDs bool
+}
+
+// conformanceBackends holds the backends the conformance suite runs against, by name
+var conformanceBackends = make(map[string]conformanceBackend)
+
+// registerConformanceBackend adds a backend to the conformance suite
+func registerConformanceBackend(name string, backend conformanceBackend) {
+	conformanceBackends[name] = backend
+}
+
+// conformanceCases are the behaviors every backend must have
+var conformanceCases = []struct {
+	name string
+	run  func(t *testing.T, b *backendTest)
+}{
+	{"Accounts", testAccounts},
+	{"CreateAccounts", testCreateAccounts},
+	{"InsufficientBalance", testInsufficientBalance},
+	{"BalanceOverflow", testBalanceOverflow},
+	{"Rollback", testRollback},
+	{"CommitVisibility", testCommitVisibility},
+	{"Savepoints", testSavepoints},
+	{"ApplyTransfers", testApplyTransfers},
+	{"ListAccounts", testListAccounts},
+	{"Reopen", testReopen},
+	{"Concurrency", testConcurrency},
+}
+
+// idBase is the last base of the account IDs given to a case of a backend
+// with shared IDs, starting from the time so runs do not reuse them
+var idBase atomic.Int64
+
+func init() {
+	idBase.Store(time.Now().UnixNano())
+
+	registerConformanceBackend("memory", conformanceBackend{
+		open: func(t *testing.T, location string) (ContextStorage, error) {
+			return NewMemoryStorage(nil)
+		},
+	})
+	registerConformanceBackend("badger", conformanceBackend{
+		open: func(t *testing.T, location string) (ContextStorage, error) {
+			return NewBadgerStorage(map[string]interface{}{"db_path": filepath.Join(location, "badger")})
+		},
+		persistent: true,
+	})
+	registerConformanceBackend("sqlite", conformanceBackend{
+		open: func(t *testing.T, location string) (ContextStorage, error) {
+			return NewSQLiteStorage(map[string]interface{}{"db_path": filepath.Join(location, "sqlite.db")})
+		},
+		persistent: true,
+	})
+
+	// Servers only run when their address is given, and cases keep apart
+	// with a key prefix for Redis, a table for PostgreSQL and account IDs
+	// for TigerBeetle
+	redisAddress := os.Getenv("STORAGE_TEST_REDIS_ADDRESS")
+	registerConformanceBackend("redis", conformanceBackend{
+		open: func(t *testing.T, location string) (ContextStorage, error) {
+			prefix := "conformance:" + location + ":"
+			t.Cleanup(func() { deleteRedisKeys(redisAddress, prefix) })
+			return NewRedisStorage(map[string]interface{}{"address": redisAddress, "key_prefix": prefix})
+		},
+		skip:       skipUnset("STORAGE_TEST_REDIS_ADDRESS", redisAddress),
+		persistent: true,
+	})
+	postgresDSN := os.Getenv("STORAGE_TEST_POSTGRES_DSN")
+	registerConformanceBackend("postgres", conformanceBackend{
+		open: func(t *testing.T, location string) (ContextStorage, error) {
+			table := postgresTable(location)
+			t.Cleanup(func() { dropPostgresTable(postgresDSN, table) })
+			return NewPostgresStorage(map[string]interface{}{"dsn": postgresDSN, "table": table})
+		},
+		skip:       skipUnset("STORAGE_TEST_POSTGRES_DSN", postgresDSN),
+		persistent: true,
+	})
+	tigerBeetleAddress := os.Getenv("STORAGE_TEST_TIGERBEETLE_ADDRESS")
+	registerConformanceBackend("tigerbeetle", conformanceBackend{
+		open: func(t *testing.T, location string) (ContextStorage, error) {
+			return NewTigerBeetleStorage(map[string]interface{}{
+				"addresses":  []interface{}{tigerBeetleAddress},
+				"cluster_id": float64(0),
+			})
+		},
+		skip:       skipUnset("STORAGE_TEST_TIGERBEETLE_ADDRESS", tigerBeetleAddress),
+		persistent: true,
+		sharedIDs:  true,
+	})
+}
+
+// skipUnset returns the reason to skip a backend whose address is not set
+func skipUnset(variable, value string) string {
+	if value != "" {
+		return ""
+	}
+	return "set " + variable + " to run against a server"
+}
+
+// deleteRedisKeys deletes the keys written by a case under a key prefix
+func deleteRedisKeys(address, prefix string) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: address})
+	defer client.Close()
+
+	keys := []string{"account_ids:" + prefix, "schema_version:" + prefix}
+	iter := client.Scan(ctx, 0, prefix+"*", indexScanCount).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	client.Del(ctx, keys...)
+}
+
+// postgresTable returns the name of the table of the case at location
+func postgresTable(location string) string {
+	h := fnv.New64a()
+	h.Write([]byte(location))
+	return fmt.Sprintf("conformance_%x", h.Sum64())
+}
+
+// dropPostgresTable drops the table written by a case
+func dropPostgresTable(dsn, table string) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return
+	}
+	defer conn.Close(ctx)
+	conn.Exec(ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{table}.Sanitize())
+}
+
+// backendTest is a conformance case running against a backend
+type backendTest struct {
+	backend  conformanceBackend
+	location string
+	base     int // Added to the account IDs of the case
+}
+
+// open creates and initializes the backend of the case, closed at its end
+func (b *backendTest) open(t *testing.T) ContextStorage {
+	t.Helper()
+
+	s, err := b.backend.open(t, b.location)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	if err := s.Initialize(context.Background()); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// id returns the account ID the case uses for n
+func (b *backendTest) id(n int) int {
+	return b.base + n
+}
+
+// balances returns want with the IDs the case uses
+func (b *backendTest) balances(want map[int]uint64) map[int]uint64 {
+	balances := make(map[int]uint64, len(want))
+	for n, balance := range want {
+		balances[b.id(n)] = balance
+	}
+	return balances
+}
+
+// TestConformance runs every conformance case against every registered
+// backend, each case over new data
+func TestConformance(t *testing.T) {
+	names := make([]string, 0, len(conformanceBackends))
+	for name := range conformanceBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		backend := conformanceBackends[name]
+		t.Run(name, func(t *testing.T) {
+			if backend.skip != "" {
+				t.Skip(backend.skip)
+			}
+			for _, c := range conformanceCases {
+				t.Run(c.name, func(t *testing.T) {
+					b := &backendTest{backend: backend, location: t.TempDir()}
+					if backend.sharedIDs {
+						b.base = int(idBase.Add(1 << 20))
+					}
+					c.run(t, b)
+				})
+			}
+		})
+	}
+}
+
+func testAccounts(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one, two := b.id(1), b.id(2)
+
+	// An account is created once, with its initial balance
+	if err := s.CreateAccount(ctx, one, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateAccount(ctx, one, 5); !errors.Is(err, ErrAccountAlreadyExists) {
+		t.Errorf("Creating an existing account: got %v, want %v", err, ErrAccountAlreadyExists)
+	}
+	account, err := s.GetAccount(ctx, one)
+	if err != nil || account.ID != one || account.Balance != 100 {
+		t.Errorf("Got account %+v (%v), want ID %d with balance 100", account, err, one)
+	}
+	if exists, err := s.AccountExists(ctx, one); err != nil || !exists {
+		t.Errorf("Account %d exists: got %v (%v), want true", one, exists, err)
+	}
+
+	// A missing account is not found, and only a credit creates it
+	if _, err := s.GetAccount(ctx, two); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Getting a missing account: got %v, want %v", err, ErrAccountNotFound)
+	}
+	if exists, err := s.AccountExists(ctx, two); err != nil || exists {
+		t.Errorf("Account %d exists: got %v (%v), want false", two, exists, err)
+	}
+	if err := s.Debit(ctx, two, 1); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Debiting a missing account: got %v, want %v", err, ErrAccountNotFound)
+	}
+	if err := s.Credit(ctx, two, 0); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Crediting nothing to a missing account: got %v, want %v", err, ErrAccountNotFound)
+	}
+	checkMissing(t, s, two)
+	if err := s.Credit(ctx, two, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	// Credits and debits change the balance
+	if err := s.Credit(ctx, one, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Debit(ctx, one, 50); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 70, 2: 30}))
+}
+
+func testCreateAccounts(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	if err := s.CreateAccount(ctx, b.id(3), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// An account that exists, or appears twice, fails the whole batch and
+	// leaves the transaction usable
+	for _, ids := range [][]int{{1, 2, 3}, {1, 2, 1}} {
+		accounts := make([]*types.Account, len(ids))
+		for i, n := range ids {
+			accounts[i] = &types.Account{ID: b.id(n), Balance: 10}
+		}
+		if err := tx.CreateAccounts(ctx, accounts); !errors.Is(err, ErrAccountAlreadyExists) {
+			t.Errorf("Creating accounts %v: got %v, want %v", ids, err, ErrAccountAlreadyExists)
+		}
+	}
+	if exists, err := tx.AccountExists(ctx, b.id(1)); err != nil || exists {
+		t.Errorf("Account %d exists after a failed batch: got %v (%v), want false", b.id(1), exists, err)
+	}
+
+	// Otherwise every account is created with its balance
+	err = tx.CreateAccounts(ctx, []*types.Account{{ID: b.id(1), Balance: 10}, {ID: b.id(2), Balance: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 10, 2: 20, 3: 5}))
+}
+
+func testInsufficientBalance(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one := b.id(1)
+	if err := s.CreateAccount(ctx, one, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// A debit past the balance fails and changes nothing, while one of the
+	// whole balance empties the account
+	if err := s.Debit(ctx, one, 11); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Overdrawing debit: got %v, want %v", err, ErrInsufficientBalance)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 10}))
+	if err := s.Debit(ctx, one, 10); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 0}))
+
+	// In a transaction, the failed debit leaves the transaction usable
+	if err := s.Credit(ctx, one, 10); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	if err := tx.Debit(ctx, one, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Debit(ctx, one, 7); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Overdrawing debit in a transaction: got %v, want %v", err, ErrInsufficientBalance)
+	}
+	if err := tx.Debit(ctx, one, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 0}))
+}
+
+func testReopen(t *testing.T, b *backendTest) {
+	if !b.backend.persistent {
+		t.Skip("backend does not keep its data")
+	}
+	ctx := context.Background()
+	s := b.open(t)
+	if err := s.CreateAccount(ctx, b.id(1), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := transfer(ctx, s, b.id(1), b.id(2), 40); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolled back changes are not kept
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Credit(ctx, b.id(3), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The committed accounts are read back once the backend is opened again
+	s = b.open(t)
+	checkBalances(t, s, b.balances(map[int]uint64{1: 60, 2: 40}))
+	checkMissing(t, s, b.id(3))
+	if err := s.Debit(ctx, b.id(2), 40); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{2: 0}))
+}
@@ -0,0 +1,690 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// ContextStorage is the interface of storage backends whose calls take a
+// context. A call returns the context's error once it is cancelled or past
+// its deadline, without waiting for a backend that does not respond.
+// Changes made outside a transaction started by Begin are committed by the
+// call making them.
+type ContextStorage interface {
+	// Initialize initializes the storage backend
+	Initialize(ctx context.Context) error
+
+	// Close closes the storage backend
+	Close() error
+
+	// GetAccount retrieves an account by ID
+	GetAccount(ctx context.Context, id int) (*types.Account, error)
+
+	// AccountExists checks if an account exists
+	AccountExists(ctx context.Context, id int) (bool, error)
+
+	// Credit adds an amount to an account's balance, creating the account
+	// if it doesn't exist. It fails with ErrBalanceOverflow rather than wrap
+	// the balance around.
+	Credit(ctx context.Context, id int, amount uint64) error
+
+	// Debit subtracts an amount from an account's balance, failing with
+	// ErrInsufficientBalance if the balance is lower
+	Debit(ctx context.Context, id int, amount uint64) error
+
+	// CreateAccount creates a new account
+	CreateAccount(ctx context.Context, id int, initialBalance uint64) error
+
+	// Begin starts a transaction. Any number of transactions may be open at
+	// once, isolated as described by ContextTx.
+	Begin(ctx context.Context) (ContextTx, error)
+
+	// GetBalance gets an account's current balance
+	GetBalance(ctx context.Context, id int) (uint64, error)
+
+	// ListAccounts returns up to limit accounts in ascending order of ID,
+	// starting with the first one whose ID is at least startID. A limit of
+	// zero or less returns all of them. See AccountIterator to go through
+	// the accounts one page at a time.
+	ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error)
+
+	// SchemaVersion returns the version of the stored data layout, zero for
+	// data written before the version was recorded
+	SchemaVersion(ctx context.Context) (int, error)
+
+	// SetSchemaVersion records the version of the stored data layout
+	SetSchemaVersion(ctx context.Context, version int) error
+
+	// ApplyTransfers applies a batch of transfers and returns the result of
+	// each. Like Credit, a transfer creates the account it credits
+	// when it does not exist, and a transfer may spend funds received earlier
+	// in the batch. The error is only set when the backend fails.
+	ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error)
+}
+
+// adaptedStorage implements ContextStorage with a Storage
+type adaptedStorage struct {
+	backend Storage
+}
+
+// AdaptStorage adapts a storage backend without context support to
+// ContextStorage. The context is checked before every call, but a call that
+// has started runs to completion.
+func AdaptStorage(backend Storage) ContextStorage {
+	if s, ok := backend.(*backgroundStorage); ok {
+		return s.backend
+	}
+	return &adaptedStorage{backend: backend}
+}
+
+// Initialize initializes the storage backend
+func (s *adaptedStorage) Initialize(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.backend.Initialize()
+}
+
+// Close closes the storage backend
+func (s *adaptedStorage) Close() error {
+	return s.backend.Close()
+}
+
+// GetAccount retrieves an account by ID
+func (s *adaptedStorage) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.backend.GetAccount(id)
+}
+
+// AccountExists checks if an account exists
+func (s *adaptedStorage) AccountExists(ctx context.Context, id int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.backend.AccountExists(id)
+}
+
+// Credit adds an amount to an account's balance
+func (s *adaptedStorage) Credit(ctx context.Context, id int, amount uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.backend.Credit(id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (s *adaptedStorage) Debit(ctx context.Context, id int, amount uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.backend.Debit(id, amount)
+}
+
+// CreateAccount creates a new account
+func (s *adaptedStorage) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.backend.CreateAccount(id, initialBalance)
+}
+
+// Begin starts a transaction
+func (s *adaptedStorage) Begin(ctx context.Context) (ContextTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx, err := s.backend.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &adaptedTx{tx: tx}, nil
+}
+
+// GetBalance gets an account's current balance
+func (s *adaptedStorage) GetBalance(ctx context.Context, id int) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.backend.GetBalance(id)
+}
+
+// ListAccounts returns a page of accounts ordered by ID
+func (s *adaptedStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.backend.ListAccounts(startID, limit)
+}
+
+// SchemaVersion returns the version of the stored data layout
+func (s *adaptedStorage) SchemaVersion(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.backend.SchemaVersion()
+}
+
+// SetSchemaVersion records the version of the stored data layout
+func (s *adaptedStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.backend.SetSchemaVersion(version)
+}
+
+// backgroundStorage implements Storage with a ContextStorage
+type backgroundStorage struct {
+	backend ContextStorage
+	timeout time.Duration
+}
+
+// BackgroundStorage adapts a context-aware storage backend to Storage.
+// Every call gets a background context, limited to the timeout unless it is zero.
+func BackgroundStorage(backend ContextStorage, timeout time.Duration) Storage {
+	if s, ok := backend.(*adaptedStorage); ok && timeout == 0 {
+		return s.backend
+	}
+	return &backgroundStorage{backend: backend, timeout: timeout}
+}
+
+// context returns the context of a call and the function releasing it
+func (s *backgroundStorage) context() (context.Context, context.CancelFunc) {
+	if s.timeout == 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// Initialize initializes the storage backend
+func (s *backgroundStorage) Initialize() error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.Initialize(ctx)
+}
+
+// Close closes the storage backend
+func (s *backgroundStorage) Close() error {
+	return s.backend.Close()
+}
+
+// GetAccount retrieves an account by ID
+func (s *backgroundStorage) GetAccount(id int) (*types.Account, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.GetAccount(ctx, id)
+}
+
+// AccountExists checks if an account exists
+func (s *backgroundStorage) AccountExists(id int) (bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.AccountExists(ctx, id)
+}
+
+// Credit adds an amount to an account's balance
+func (s *backgroundStorage) Credit(id int, amount uint64) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.Credit(ctx, id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (s *backgroundStorage) Debit(id int, amount uint64) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.Debit(ctx, id, amount)
+}
+
+// CreateAccount creates a new account
+func (s *backgroundStorage) CreateAccount(id int, initialBalance uint64) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.CreateAccount(ctx, id, initialBalance)
+}
+
+// Begin starts a transaction, whose calls get contexts like the storage's
+func (s *backgroundStorage) Begin() (Tx, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	tx, err := s.backend.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &backgroundTx{tx: tx, storage: s}, nil
+}
+
+// GetBalance gets an account's current balance
+func (s *backgroundStorage) GetBalance(id int) (uint64, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.GetBalance(ctx, id)
+}
+
+// ListAccounts returns a page of accounts ordered by ID
+func (s *backgroundStorage) ListAccounts(startID, limit int) ([]*types.Account, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.ListAccounts(ctx, startID, limit)
+}
+
+// SchemaVersion returns the version of the stored data layout
+func (s *backgroundStorage) SchemaVersion() (int, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.SchemaVersion(ctx)
+}
+
+// SetSchemaVersion records the version of the stored data layout
+func (s *backgroundStorage) SetSchemaVersion(version int) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.SetSchemaVersion(ctx, version)
+}
+
+// timeoutStorage limits the duration of every call to a ContextStorage
+type timeoutStorage struct {
+	backend ContextStorage
+	timeout time.Duration
+}
+
+// WithCallTimeout limits every call to a storage backend to the timeout,
+// within the deadline of the caller's context. A zero timeout returns the
+// backend unchanged.
+func WithCallTimeout(backend ContextStorage, timeout time.Duration) ContextStorage {
+	if timeout == 0 {
+		return backend
+	}
+	return &timeoutStorage{backend: backend, timeout: timeout}
+}
+
+// Initialize initializes the storage backend
+func (s *timeoutStorage) Initialize(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.Initialize(ctx)
+}
+
+// Close closes the storage backend
+func (s *timeoutStorage) Close() error {
+	return s.backend.Close()
+}
+
+// GetAccount retrieves an account by ID
+func (s *timeoutStorage) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.GetAccount(ctx, id)
+}
+
+// AccountExists checks if an account exists
+func (s *timeoutStorage) AccountExists(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.AccountExists(ctx, id)
+}
+
+// Credit adds an amount to an account's balance
+func (s *timeoutStorage) Credit(ctx context.Context, id int, amount uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.Credit(ctx, id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (s *timeoutStorage) Debit(ctx context.Context, id int, amount uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.Debit(ctx, id, amount)
+}
+
+// CreateAccount creates a new account
+func (s *timeoutStorage) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.CreateAccount(ctx, id, initialBalance)
+}
+
+// Begin starts a transaction, whose calls are limited to the timeout too
+func (s *timeoutStorage) Begin(ctx context.Context) (ContextTx, error) {
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	tx, err := s.backend.Begin(callCtx)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutTx{tx: tx, timeout: s.timeout}, nil
+}
+
+// GetBalance gets an account's current balance
+func (s *timeoutStorage) GetBalance(ctx context.Context, id int) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.GetBalance(ctx, id)
+}
+
+// ListAccounts returns a page of accounts ordered by ID
+func (s *timeoutStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.ListAccounts(ctx, startID, limit)
+}
+
+// SchemaVersion returns the version of the stored data layout
+func (s *timeoutStorage) SchemaVersion(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.SchemaVersion(ctx)
+}
+
+// SetSchemaVersion records the version of the stored data layout
+func (s *timeoutStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.SetSchemaVersion(ctx, version)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (s *adaptedStorage) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.backend.ApplyTransfers(transfers, mode)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (s *backgroundStorage) ApplyTransfers(transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.backend.ApplyTransfers(ctx, transfers, mode)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (s *timeoutStorage) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.backend.ApplyTransfers(ctx, transfers, mode)
+}
+
+// adaptedTx implements ContextTx with a Tx
+type adaptedTx struct {
+	tx Tx
+}
+
+// GetAccount retrieves an account by ID
+func (t *adaptedTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.tx.GetAccount(id)
+}
+
+// AccountExists checks if an account exists
+func (t *adaptedTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return t.tx.AccountExists(id)
+}
+
+// GetBalance gets an account's current balance
+func (t *adaptedTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return t.tx.GetBalance(id)
+}
+
+// Credit adds an amount to an account's balance
+func (t *adaptedTx) Credit(ctx context.Context, id int, amount uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.tx.Credit(id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (t *adaptedTx) Debit(ctx context.Context, id int, amount uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.tx.Debit(id, amount)
+}
+
+// CreateAccount creates a new account
+func (t *adaptedTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.tx.CreateAccount(id, initialBalance)
+}
+
+// CreateAccounts creates new accounts at once
+func (t *adaptedTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.tx.CreateAccounts(accounts)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (t *adaptedTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.tx.ApplyTransfers(transfers, mode)
+}
+
+// Savepoint marks the changes made so far under a name
+func (t *adaptedTx) Savepoint(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.tx.Savepoint(name)
+}
+
+// RollbackTo discards the changes made since a savepoint
+func (t *adaptedTx) RollbackTo(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.tx.RollbackTo(name)
+}
+
+// Commit makes the changes visible to the other transactions
+func (t *adaptedTx) Commit(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		t.tx.Rollback()
+		return err
+	}
+	return t.tx.Commit()
+}
+
+// Rollback discards the changes. It runs even once the context is done, so
+// a cancelled caller can still release its transaction.
+func (t *adaptedTx) Rollback(_ context.Context) error {
+	return t.tx.Rollback()
+}
+
+// backgroundTx implements Tx with a ContextTx, with the contexts of a backgroundStorage
+type backgroundTx struct {
+	tx      ContextTx
+	storage *backgroundStorage
+}
+
+// GetAccount retrieves an account by ID
+func (t *backgroundTx) GetAccount(id int) (*types.Account, error) {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.GetAccount(ctx, id)
+}
+
+// AccountExists checks if an account exists
+func (t *backgroundTx) AccountExists(id int) (bool, error) {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.AccountExists(ctx, id)
+}
+
+// GetBalance gets an account's current balance
+func (t *backgroundTx) GetBalance(id int) (uint64, error) {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.GetBalance(ctx, id)
+}
+
+// Credit adds an amount to an account's balance
+func (t *backgroundTx) Credit(id int, amount uint64) error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.Credit(ctx, id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (t *backgroundTx) Debit(id int, amount uint64) error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.Debit(ctx, id, amount)
+}
+
+// CreateAccount creates a new account
+func (t *backgroundTx) CreateAccount(id int, initialBalance uint64) error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.CreateAccount(ctx, id, initialBalance)
+}
+
+// CreateAccounts creates new accounts at once
+func (t *backgroundTx) CreateAccounts(accounts []*types.Account) error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.CreateAccounts(ctx, accounts)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (t *backgroundTx) ApplyTransfers(transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.ApplyTransfers(ctx, transfers, mode)
+}
+
+// Savepoint marks the changes made so far under a name
+func (t *backgroundTx) Savepoint(name string) error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.Savepoint(ctx, name)
+}
+
+// RollbackTo discards the changes made since a savepoint
+func (t *backgroundTx) RollbackTo(name string) error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.RollbackTo(ctx, name)
+}
+
+// Commit makes the changes visible to the other transactions
+func (t *backgroundTx) Commit() error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.Commit(ctx)
+}
+
+// Rollback discards the changes
+func (t *backgroundTx) Rollback() error {
+	ctx, cancel := t.storage.context()
+	defer cancel()
+	return t.tx.Rollback(ctx)
+}
+
+// timeoutTx limits the duration of every call to a ContextTx
+type timeoutTx struct {
+	tx      ContextTx
+	timeout time.Duration
+}
+
+// GetAccount retrieves an account by ID
+func (t *timeoutTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.GetAccount(ctx, id)
+}
+
+// AccountExists checks if an account exists
+func (t *timeoutTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.AccountExists(ctx, id)
+}
+
+// GetBalance gets an account's current balance
+func (t *timeoutTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.GetBalance(ctx, id)
+}
+
+// Credit adds an amount to an account's balance
+func (t *timeoutTx) Credit(ctx context.Context, id int, amount uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.Credit(ctx, id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (t *timeoutTx) Debit(ctx context.Context, id int, amount uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.Debit(ctx, id, amount)
+}
+
+// CreateAccount creates a new account
+func (t *timeoutTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.CreateAccount(ctx, id, initialBalance)
+}
+
+// CreateAccounts creates new accounts at once
+func (t *timeoutTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.CreateAccounts(ctx, accounts)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (t *timeoutTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.ApplyTransfers(ctx, transfers, mode)
+}
+
+// Savepoint marks the changes made so far under a name
+func (t *timeoutTx) Savepoint(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.Savepoint(ctx, name)
+}
+
+// RollbackTo discards the changes made since a savepoint
+func (t *timeoutTx) RollbackTo(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.RollbackTo(ctx, name)
+}
+
+// Commit makes the changes visible to the other transactions
+func (t *timeoutTx) Commit(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.Commit(ctx)
+}
+
+// Rollback discards the changes
+func (t *timeoutTx) Rollback(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.tx.Rollback(ctx)
+}
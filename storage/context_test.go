@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingStorage is a backend whose GetBalance waits for its context to end,
+// like a backend that does not respond
+type blockingStorage struct {
+	ContextStorage
+}
+
+func (s *blockingStorage) GetBalance(ctx context.Context, id int) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestCallTimeout(t *testing.T) {
+	backend, err := NewMemoryStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := WithCallTimeout(&blockingStorage{backend}, 10*time.Millisecond)
+
+	// A call to a backend that does not respond fails once the timeout expires
+	if _, err := store.GetBalance(context.Background(), 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+
+	// Other calls reach the backend
+	ctx := context.Background()
+	if err := store.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.CreateAccount(ctx, 1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.AccountExists(ctx, 1); err != nil || !exists {
+		t.Errorf("Account was not created: %v", err)
+	}
+}
+
+func TestAdaptStorage(t *testing.T) {
+	backend, err := NewMemoryStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Adapting a context-aware backend back and forth returns it unchanged
+	store := BackgroundStorage(backend, 0)
+	if AdaptStorage(store) != backend {
+		t.Error("Adapting a background storage did not return its backend")
+	}
+	if err := store.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.CreateAccount(1, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// A storage without context support is not called once the context is done
+	adapted := AdaptStorage(&legacyStorage{store})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := adapted.GetBalance(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the call to be cancelled, got %v", err)
+	}
+	if balance, err := adapted.GetBalance(context.Background(), 1); err != nil || balance != 100 {
+		t.Errorf("Got balance %d (%v), want 100", balance, err)
+	}
+}
+
+// legacyStorage hides the type of a Storage, as a backend implementing only
+// the interface without contexts
+type legacyStorage struct {
+	Storage
+}
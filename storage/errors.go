@@ -1,16 +1,27 @@
 package storage
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
 
 // Error definitions for the storage package
 var (
 	ErrStorageNotFound      = errors.New("storage backend not found")
 	ErrAccountNotFound      = errors.New("account not found")
-	ErrInsufficientBalance  = errors.New("insufficient balance")
+	ErrInsufficientBalance  = types.ErrInsufficientBalance
+	ErrBalanceOverflow      = types.ErrBalanceOverflow
 	ErrAccountAlreadyExists = errors.New("account already exists")
 	ErrTransactionFailed    = errors.New("transaction failed")
+	ErrTransactionConflict  = errors.New("transaction conflicts with another committed meanwhile")
+	ErrTransactionDone      = errors.New("transaction already committed or rolled back")
+	ErrTransactionTooLarge  = errors.New("transaction too large for the storage backend")
+	ErrSavepointNotFound    = errors.New("savepoint not found")
 	ErrNotInitialized       = errors.New("storage not initialized")
 	ErrAlreadyInitialized   = errors.New("storage already initialized")
 	ErrInvalidConfiguration = errors.New("invalid configuration")
 	ErrConnectionFailed     = errors.New("connection failed")
+	ErrInvalidTransfer      = errors.New("invalid transfer")
+	ErrTransferAborted      = errors.New("transfer aborted by a failed transfer of the batch")
 )
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// InstrumentedStorage wraps a storage backend and reports the latency of every call
+type InstrumentedStorage struct {
+	backend ContextStorage
+	observe func(method string, duration time.Duration)
+}
+
+// NewInstrumentedStorage wraps a storage backend so that observe is called
+// with the method name and duration of every call
+func NewInstrumentedStorage(backend ContextStorage, observe func(method string, duration time.Duration)) ContextStorage {
+	return &InstrumentedStorage{
+		backend: backend,
+		observe: observe,
+	}
+}
+
+// since reports the time elapsed since start for a method
+func (s *InstrumentedStorage) since(method string, start time.Time) {
+	s.observe(method, time.Since(start))
+}
+
+// Initialize initializes the storage
+func (s *InstrumentedStorage) Initialize(ctx context.Context) error {
+	defer s.since("Initialize", time.Now())
+	return s.backend.Initialize(ctx)
+}
+
+// Close closes the storage
+func (s *InstrumentedStorage) Close() error {
+	defer s.since("Close", time.Now())
+	return s.backend.Close()
+}
+
+// GetAccount retrieves an account by ID
+func (s *InstrumentedStorage) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	defer s.since("GetAccount", time.Now())
+	return s.backend.GetAccount(ctx, id)
+}
+
+// AccountExists checks if an account exists
+func (s *InstrumentedStorage) AccountExists(ctx context.Context, id int) (bool, error) {
+	defer s.since("AccountExists", time.Now())
+	return s.backend.AccountExists(ctx, id)
+}
+
+// Credit adds an amount to an account's balance
+func (s *InstrumentedStorage) Credit(ctx context.Context, id int, amount uint64) error {
+	defer s.since("Credit", time.Now())
+	return s.backend.Credit(ctx, id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (s *InstrumentedStorage) Debit(ctx context.Context, id int, amount uint64) error {
+	defer s.since("Debit", time.Now())
+	return s.backend.Debit(ctx, id, amount)
+}
+
+// CreateAccount creates a new account
+func (s *InstrumentedStorage) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	defer s.since("CreateAccount", time.Now())
+	return s.backend.CreateAccount(ctx, id, initialBalance)
+}
+
+// Begin starts a transaction, whose calls are reported too
+func (s *InstrumentedStorage) Begin(ctx context.Context) (ContextTx, error) {
+	defer s.since("Begin", time.Now())
+	tx, err := s.backend.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{tx: tx, storage: s}, nil
+}
+
+// GetBalance gets an account's current balance
+func (s *InstrumentedStorage) GetBalance(ctx context.Context, id int) (uint64, error) {
+	defer s.since("GetBalance", time.Now())
+	return s.backend.GetBalance(ctx, id)
+}
+
+// ListAccounts returns a page of accounts ordered by ID
+func (s *InstrumentedStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	defer s.since("ListAccounts", time.Now())
+	return s.backend.ListAccounts(ctx, startID, limit)
+}
+
+// SchemaVersion returns the version of the stored data layout
+func (s *InstrumentedStorage) SchemaVersion(ctx context.Context) (int, error) {
+	defer s.since("SchemaVersion", time.Now())
+	return s.backend.SchemaVersion(ctx)
+}
+
+// SetSchemaVersion records the version of the stored data layout
+func (s *InstrumentedStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	defer s.since("SetSchemaVersion", time.Now())
+	return s.backend.SetSchemaVersion(ctx, version)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (s *InstrumentedStorage) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	defer s.since("ApplyTransfers", time.Now())
+	return s.backend.ApplyTransfers(ctx, transfers, mode)
+}
+
+// instrumentedTx reports the latency of every call to a transaction, under
+// the method name prefixed with "Tx."
+type instrumentedTx struct {
+	tx      ContextTx
+	storage *InstrumentedStorage
+}
+
+// GetAccount retrieves an account by ID
+func (t *instrumentedTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	defer t.storage.since("Tx.GetAccount", time.Now())
+	return t.tx.GetAccount(ctx, id)
+}
+
+// AccountExists checks if an account exists
+func (t *instrumentedTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	defer t.storage.since("Tx.AccountExists", time.Now())
+	return t.tx.AccountExists(ctx, id)
+}
+
+// GetBalance gets an account's current balance
+func (t *instrumentedTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	defer t.storage.since("Tx.GetBalance", time.Now())
+	return t.tx.GetBalance(ctx, id)
+}
+
+// Credit adds an amount to an account's balance
+func (t *instrumentedTx) Credit(ctx context.Context, id int, amount uint64) error {
+	defer t.storage.since("Tx.Credit", time.Now())
+	return t.tx.Credit(ctx, id, amount)
+}
+
+// Debit subtracts an amount from an account's balance
+func (t *instrumentedTx) Debit(ctx context.Context, id int, amount uint64) error {
+	defer t.storage.since("Tx.Debit", time.Now())
+	return t.tx.Debit(ctx, id, amount)
+}
+
+// CreateAccount creates a new account
+func (t *instrumentedTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	defer t.storage.since("Tx.CreateAccount", time.Now())
+	return t.tx.CreateAccount(ctx, id, initialBalance)
+}
+
+// CreateAccounts creates new accounts at once
+func (t *instrumentedTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	defer t.storage.since("Tx.CreateAccounts", time.Now())
+	return t.tx.CreateAccounts(ctx, accounts)
+}
+
+// ApplyTransfers applies a batch of transfers
+func (t *instrumentedTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	defer t.storage.since("Tx.ApplyTransfers", time.Now())
+	return t.tx.ApplyTransfers(ctx, transfers, mode)
+}
+
+// Savepoint marks the changes made so far under a name
+func (t *instrumentedTx) Savepoint(ctx context.Context, name string) error {
+	defer t.storage.since("Tx.Savepoint", time.Now())
+	return t.tx.Savepoint(ctx, name)
+}
+
+// RollbackTo discards the changes made since a savepoint
+func (t *instrumentedTx) RollbackTo(ctx context.Context, name string) error {
+	defer t.storage.since("Tx.RollbackTo", time.Now())
+	return t.tx.RollbackTo(ctx, name)
+}
+
+// Commit makes the changes visible to the other transactions
+func (t *instrumentedTx) Commit(ctx context.Context) error {
+	defer t.storage.since("Tx.Commit", time.Now())
+	return t.tx.Commit(ctx)
+}
+
+// Rollback discards the changes
+func (t *instrumentedTx) Rollback(ctx context.Context) error {
+	defer t.storage.since("Tx.Rollback", time.Now())
+	return t.tx.Rollback(ctx)
+}
@@ -4,7 +4,9 @@ import (
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
-// Storage defines the interface for all storage backends
+// Storage defines the interface for all storage backends.
+// Backends implement ContextStorage, and BackgroundStorage adapts them to this interface.
+// Changes made outside a transaction are committed by the call making them.
 type Storage interface {
 	// Initialize initializes the storage backend
 	Initialize() error
@@ -18,44 +20,81 @@ type Storage interface {
 	// AccountExists checks if an account exists
 	AccountExists(id int) (bool, error)
 
-	// UpdateBalance updates an account's balance
-	UpdateBalance(id int, delta int) error
+	// Credit adds an amount to an account's balance, creating the account
+	// if it doesn't exist. It fails with ErrBalanceOverflow rather than wrap
+	// the balance around.
+	Credit(id int, amount uint64) error
+
+	// Debit subtracts an amount from an account's balance, failing with
+	// ErrInsufficientBalance if the balance is lower
+	Debit(id int, amount uint64) error
 
 	// CreateAccount creates a new account
-	CreateAccount(id int, initialBalance int) error
+	CreateAccount(id int, initialBalance uint64) error
+
+	// Begin starts a transaction, see ContextStorage
+	Begin() (Tx, error)
 
-	// Commit commits any pending changes
-	Commit() error
+	// GetBalance gets an account's current balance
+	GetBalance(id int) (uint64, error)
 
-	// Rollback rolls back any pending changes
-	Rollback() error
+	// ListAccounts returns up to limit accounts ordered by ID, see ContextStorage
+	ListAccounts(startID, limit int) ([]*types.Account, error)
 
-	// BeginTransaction begins a new transaction
-	BeginTransaction() error
+	// SchemaVersion returns the version of the stored data layout, zero for
+	// data written before the version was recorded
+	SchemaVersion() (int, error)
 
-	// GetBalance gets an account's current balance
-	GetBalance(id int) (int, error)
+	// SetSchemaVersion records the version of the stored data layout
+	SetSchemaVersion(version int) error
 
-	// GetAllAccounts gets all accounts
-	GetAllAccounts() ([]*types.Account, error)
+	// ApplyTransfers applies a batch of transfers and returns the result of
+	// each. Like Credit, a transfer creates the account it credits
+	// when it does not exist, and a transfer may spend funds received earlier
+	// in the batch. The error is only set when the backend fails.
+	ApplyTransfers(transfers []Transfer, mode TransferMode) ([]TransferResult, error)
 }
 
 // StorageFactory is a function that creates a new storage instance
 type StorageFactory func(config map[string]interface{}) (Storage, error)
 
+// ContextStorageFactory is a function that creates a new context-aware storage instance
+type ContextStorageFactory func(config map[string]interface{}) (ContextStorage, error)
+
 // StorageRegistry keeps track of available storage backends
-var StorageRegistry = make(map[string]StorageFactory)
+var StorageRegistry = make(map[string]ContextStorageFactory)
 
-// RegisterStorage registers a storage backend
-func RegisterStorage(name string, factory StorageFactory) {
+// RegisterContextStorage registers a context-aware storage backend
+func RegisterContextStorage(name string, factory ContextStorageFactory) {
 	StorageRegistry[name] = factory
 }
 
-// GetStorage returns a storage backend by name
-func GetStorage(name string, config map[string]interface{}) (Storage, error) {
+// RegisterStorage registers a storage backend without context support.
+// Its calls cannot be interrupted once started, see AdaptStorage.
+func RegisterStorage(name string, factory StorageFactory) {
+	StorageRegistry[name] = func(config map[string]interface{}) (ContextStorage, error) {
+		s, err := factory(config)
+		if err != nil {
+			return nil, err
+		}
+		return AdaptStorage(s), nil
+	}
+}
+
+// GetContextStorage returns a context-aware storage backend by name
+func GetContextStorage(name string, config map[string]interface{}) (ContextStorage, error) {
 	factory, exists := StorageRegistry[name]
 	if !exists {
 		return nil, ErrStorageNotFound
 	}
 	return factory(config)
 }
+
+// GetStorage returns a storage backend by name, whose calls are not limited in time
+func GetStorage(name string, config map[string]interface{}) (Storage, error) {
+	s, err := GetContextStorage(name, config)
+	if err != nil {
+		return nil, err
+	}
+	return BackgroundStorage(s, 0), nil
+}
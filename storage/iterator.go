@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"math"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// MinAccountID is the lowest account ID, from which ListAccounts and
+// AccountIterator start to go through every account
+const MinAccountID = math.MinInt
+
+// DefaultPageSize is the number of accounts an AccountIterator reads at once
+// when it is not given a page size
+const DefaultPageSize = 1000
+
+// AccountLister lists accounts in ascending order of ID, as
+// ContextStorage.ListAccounts does. It lets an AccountIterator go through
+// accounts kept outside of a storage backend, like the application state.
+type AccountLister interface {
+	ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error)
+}
+
+// AccountIterator goes through the accounts of a storage backend in
+// ascending order of ID, reading them one page at a time:
+//
+//	it := storage.NewAccountIterator(s, storage.MinAccountID, 0)
+//	for it.Next(ctx) {
+//		account := it.Account()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Each page is read on its own, so changes committed while iterating may
+// only show in the pages read after them, but no account is returned twice.
+type AccountIterator struct {
+	storage  AccountLister
+	next     int // ID the next page starts at
+	pageSize int
+	page     []*types.Account // Accounts of the current page left to return
+	last     bool             // The current page is the last one
+	account  *types.Account
+	err      error
+}
+
+// NewAccountIterator creates an iterator over the accounts whose ID is at
+// least startID, reading pageSize accounts at once, or DefaultPageSize if
+// pageSize is zero or less
+func NewAccountIterator(s AccountLister, startID, pageSize int) *AccountIterator {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return &AccountIterator{
+		storage:  s,
+		next:     startID,
+		pageSize: pageSize,
+	}
+}
+
+// Next advances to the next account, reading the next page when the current
+// one is exhausted. It returns false at the end of the accounts or when
+// reading a page fails, which Err then returns.
+func (it *AccountIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+
+	if len(it.page) == 0 {
+		if it.last {
+			it.account = nil
+			return false
+		}
+		page, err := it.storage.ListAccounts(ctx, it.next, it.pageSize)
+		if err != nil {
+			it.account = nil
+			it.err = err
+			return false
+		}
+
+		// A short page is the last one, and so is one ending at the
+		// highest ID, after which the next page cannot start
+		it.last = len(page) < it.pageSize
+		if len(page) > 0 {
+			lastID := page[len(page)-1].ID
+			if lastID == math.MaxInt {
+				it.last = true
+			} else {
+				it.next = lastID + 1
+			}
+		}
+		it.page = page
+		if len(page) == 0 {
+			it.account = nil
+			return false
+		}
+	}
+
+	it.account, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Account returns the account Next advanced to
+func (it *AccountIterator) Account() *types.Account {
+	return it.account
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *AccountIterator) Err() error {
+	return it.err
+}
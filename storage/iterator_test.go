@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// accountIDs returns the IDs of accounts
+func accountIDs(accounts []*types.Account) []int {
+	ids := make([]int, len(accounts))
+	for i, acc := range accounts {
+		ids[i] = acc.ID
+	}
+	return ids
+}
+
+// sameIDs reports whether two lists of IDs are equal
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testListAccounts(t *testing.T, b *backendTest) {
+	if b.backend.sharedIDs {
+		t.Skip("the case needs the lowest and highest IDs to itself")
+	}
+	ctx := context.Background()
+	s := b.open(t)
+
+	// Created out of order, with IDs whose keys do not sort like them
+	ids := []int{7, -3, 1 << 60, 2, math.MaxInt, 300, -1 << 40, 5, 1}
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+
+	if err := s.SetSchemaVersion(ctx, SchemaVersion); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err := s.CreateAccount(ctx, id, uint64(len(ids))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		startID, limit int
+		want           []int
+	}{
+		{MinAccountID, 0, sorted},
+		{MinAccountID, 3, sorted[:3]},
+		{0, 0, []int{1, 2, 5, 7, 300, 1 << 60, math.MaxInt}},
+		{3, 2, []int{5, 7}},
+		{-3, 3, []int{-3, 1, 2}},
+		{math.MaxInt, 5, []int{math.MaxInt}},
+		{301, 1, []int{1 << 60}},
+	} {
+		accounts, err := s.ListAccounts(ctx, test.startID, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := accountIDs(accounts); !sameIDs(got, test.want) {
+			t.Errorf("ListAccounts(%d, %d) = %v, want %v", test.startID, test.limit, got, test.want)
+		}
+	}
+
+	// The iterator goes through every page, including the last
+	// account, after which no page can start
+	for _, pageSize := range []int{1, 2, len(ids), 0} {
+		var got []int
+		it := NewAccountIterator(s, MinAccountID, pageSize)
+		for it.Next(ctx) {
+			got = append(got, it.Account().ID)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !sameIDs(got, sorted) {
+			t.Errorf("Iterating by %d accounts got %v, want %v", pageSize, got, sorted)
+		}
+	}
+
+	// The schema version is not an account
+	accounts, err := s.ListAccounts(ctx, MinAccountID, 0)
+	if err != nil || len(accounts) != len(ids) {
+		t.Errorf("Listed %d accounts (%v), want %d", len(accounts), err, len(ids))
+	}
+}
+
+func TestRedisIndexMembers(t *testing.T) {
+	// The members of the account index sort like the IDs
+	ids := []int{math.MinInt, -1 << 40, -1, 0, 1, 2, 10, 1<<53 + 1, math.MaxInt}
+	for i, id := range ids {
+		got, err := memberID(indexMember(id))
+		if err != nil || got != id {
+			t.Errorf("Member of %d read back as %d (%v)", id, got, err)
+		}
+		if i > 0 && indexMember(ids[i-1]) >= indexMember(id) {
+			t.Errorf("Member of %d does not sort before the one of %d", ids[i-1], id)
+		}
+	}
+}
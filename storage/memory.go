@@ -1,30 +1,36 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"slices"
 	"sync"
 
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
-// MemoryStorage implements the Storage interface using in-memory data structures
+// MemoryStorage implements the ContextStorage interface using in-memory data
+// structures. Its calls never block, so they ignore their context.
 type MemoryStorage struct {
+	autoCommit
 	accounts    map[int]*types.Account
+	ids         []int // IDs of the accounts, in ascending order
 	mutex       sync.RWMutex
 	initialized bool
-	inTx        bool
-	txAccounts  map[int]*types.Account // Accounts in the current transaction
+	version     int // Schema version
 }
 
 // NewMemoryStorage creates a new memory storage instance
-func NewMemoryStorage(config map[string]interface{}) (Storage, error) {
-	return &MemoryStorage{
-		accounts:   make(map[int]*types.Account),
-		txAccounts: make(map[int]*types.Account),
-	}, nil
+func NewMemoryStorage(config map[string]interface{}) (ContextStorage, error) {
+	s := &MemoryStorage{
+		accounts: make(map[int]*types.Account),
+	}
+	s.autoCommit = autoCommit{begin: s.Begin}
+	return s, nil
 }
 
 // Initialize initializes the storage
-func (s *MemoryStorage) Initialize() error {
+func (s *MemoryStorage) Initialize(ctx context.Context) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -33,7 +39,8 @@ func (s *MemoryStorage) Initialize() error {
 	}
 
 	s.accounts = make(map[int]*types.Account)
-	s.txAccounts = make(map[int]*types.Account)
+	s.ids = nil
+	s.version = 0
 	s.initialized = true
 	return nil
 }
@@ -48,94 +55,45 @@ func (s *MemoryStorage) Close() error {
 	}
 
 	s.accounts = nil
-	s.txAccounts = nil
+	s.ids = nil
 	s.initialized = false
 	return nil
 }
 
-// GetAccount retrieves an account by ID
-func (s *MemoryStorage) GetAccount(id int) (*types.Account, error) {
+// Begin starts a transaction, whose changes are kept in memory until it
+// commits. Commit fails with ErrTransactionConflict when an account the
+// transaction read was changed by another commit since.
+func (s *MemoryStorage) Begin(ctx context.Context) (ContextTx, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	if !s.initialized {
 		return nil, ErrNotInitialized
 	}
-
-	// If in a transaction, check the transaction accounts first
-	if s.inTx {
-		if acc, exists := s.txAccounts[id]; exists {
-			return acc, nil
-		}
-	}
-
-	// Check the main accounts
-	if acc, exists := s.accounts[id]; exists {
-		// If in a transaction, make a copy for the transaction
-		if s.inTx {
-			accCopy := &types.Account{
-				ID:      acc.ID,
-				Balance: acc.Balance,
-			}
-			s.txAccounts[id] = accCopy
-			return accCopy, nil
-		}
-		return acc, nil
-	}
-
-	return nil, ErrAccountNotFound
+	return newBufferedTx(s), nil
 }
 
-// AccountExists checks if an account exists
-func (s *MemoryStorage) AccountExists(id int) (bool, error) {
+// loadAccounts returns copies of the committed accounts among ids
+func (s *MemoryStorage) loadAccounts(ctx context.Context, ids []int) (map[int]*types.Account, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return false, ErrNotInitialized
-	}
-
-	// If in a transaction, check the transaction accounts first
-	if s.inTx {
-		if _, exists := s.txAccounts[id]; exists {
-			return true, nil
-		}
-	}
-
-	_, exists := s.accounts[id]
-	return exists, nil
-}
-
-// UpdateBalance updates an account's balance
-func (s *MemoryStorage) UpdateBalance(id int, delta int) error {
-	if !s.initialized {
-		return ErrNotInitialized
+		return nil, ErrNotInitialized
 	}
 
-	// Get the account (this will handle transaction state)
-	acc, err := s.GetAccount(id)
-	if err != nil {
-		// If account doesn't exist, create it with the delta as initial balance
-		// (only if delta is positive)
-		if err == ErrAccountNotFound && delta > 0 {
-			return s.CreateAccount(id, delta)
+	accounts := make(map[int]*types.Account, len(ids))
+	for _, id := range ids {
+		if acc, exists := s.accounts[id]; exists {
+			accounts[id] = acc.Copy()
 		}
-		return err
 	}
-
-	// Check if the balance would go negative
-	newBalance := acc.Balance + delta
-	if newBalance < 0 {
-		return ErrInsufficientBalance
-	}
-
-	// Update the balance
-	acc.Balance = newBalance
-	return nil
+	return accounts, nil
 }
 
-// CreateAccount creates a new account
-func (s *MemoryStorage) CreateAccount(id int, initialBalance int) error {
+// storeAccounts writes the accounts changed by a transaction under a single
+// lock, unless one of the accounts it read changed
+func (s *MemoryStorage) storeAccounts(ctx context.Context, read, written map[int]*types.Account) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -143,156 +101,106 @@ func (s *MemoryStorage) CreateAccount(id int, initialBalance int) error {
 		return ErrNotInitialized
 	}
 
-	// Check if account already exists
-	if s.inTx {
-		if _, exists := s.txAccounts[id]; exists {
-			return ErrAccountAlreadyExists
+	for id, acc := range read {
+		if !sameAccount(s.accounts[id], acc) {
+			return fmt.Errorf("%w: account %d changed", ErrTransactionConflict, id)
 		}
 	}
-
-	if _, exists := s.accounts[id]; exists && !s.inTx {
-		return ErrAccountAlreadyExists
-	}
-
-	// Create the account
-	acc := &types.Account{
-		ID:      id,
-		Balance: initialBalance,
-	}
-
-	// Store the account
-	if s.inTx {
-		s.txAccounts[id] = acc
-	} else {
-		s.accounts[id] = acc
+	for _, acc := range written {
+		s.setAccount(acc)
 	}
-
 	return nil
 }
 
-// Commit commits any pending changes
-func (s *MemoryStorage) Commit() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	if !s.initialized {
-		return ErrNotInitialized
-	}
-
-	// If not in a transaction, nothing to commit
-	if !s.inTx {
-		return nil
-	}
-
-	// Apply transaction changes to the main accounts
-	for id, acc := range s.txAccounts {
-		s.accounts[id] = acc
+// setAccount writes a committed account, adding its ID to the sorted IDs
+// when it is new
+func (s *MemoryStorage) setAccount(acc *types.Account) {
+	if _, exists := s.accounts[acc.ID]; !exists {
+		i, _ := slices.BinarySearch(s.ids, acc.ID)
+		s.ids = slices.Insert(s.ids, i, acc.ID)
 	}
-
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
-	return nil
+	s.accounts[acc.ID] = acc
 }
 
-// Rollback rolls back any pending changes
-func (s *MemoryStorage) Rollback() error {
+// ApplyTransfers applies a batch of transfers to the committed accounts under
+// a single lock. Transactions reading the accounts it changes fail to
+// commit, as they would after any other commit.
+func (s *MemoryStorage) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if !s.initialized {
-		return ErrNotInitialized
+		return nil, ErrNotInitialized
 	}
 
-	// If not in a transaction, nothing to rollback
-	if !s.inTx {
-		return nil
+	balances := make(map[int]uint64)
+	for _, id := range transferAccounts(transfers) {
+		if acc, exists := s.accounts[id]; exists {
+			balances[id] = acc.Balance
+		}
 	}
+	results, changed := planTransfers(balances, transfers, mode)
 
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
-	return nil
+	// Replace the accounts with updated copies, which transactions compare
+	// against the accounts they read
+	for id, balance := range changed {
+		account := &types.Account{ID: id}
+		if acc, exists := s.accounts[id]; exists {
+			account = acc.Copy()
+		}
+		account.Balance = balance
+		s.setAccount(account)
+	}
+	return results, nil
 }
 
-// BeginTransaction begins a new transaction
-func (s *MemoryStorage) BeginTransaction() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// ListAccounts returns a page of accounts ordered by ID, from the sorted IDs
+func (s *MemoryStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return ErrNotInitialized
+		return nil, ErrNotInitialized
 	}
 
-	// If already in a transaction, commit it first
-	if s.inTx {
-		// Apply transaction changes to the main accounts
-		for id, acc := range s.txAccounts {
-			s.accounts[id] = acc
-		}
+	start, _ := slices.BinarySearch(s.ids, startID)
+	ids := s.ids[start:]
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
 	}
 
-	// Start a new transaction
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = true
-
-	return nil
-}
-
-// GetBalance gets an account's current balance
-func (s *MemoryStorage) GetBalance(id int) (int, error) {
-	acc, err := s.GetAccount(id)
-	if err != nil {
-		return 0, err
+	// Return copies, which the caller may change
+	accounts := make([]*types.Account, len(ids))
+	for i, id := range ids {
+		accounts[i] = s.accounts[id].Copy()
 	}
-	return acc.Balance, nil
+	return accounts, nil
 }
 
-// GetAllAccounts gets all accounts
-func (s *MemoryStorage) GetAllAccounts() ([]*types.Account, error) {
+// SchemaVersion returns the version of the stored data layout
+func (s *MemoryStorage) SchemaVersion(ctx context.Context) (int, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return nil, ErrNotInitialized
+		return 0, ErrNotInitialized
 	}
+	return s.version, nil
+}
 
-	accounts := make([]*types.Account, 0, len(s.accounts))
-
-	// If in a transaction, use the transaction state
-	if s.inTx {
-		// Start with all accounts from the main state
-		accountMap := make(map[int]*types.Account)
-		for id, acc := range s.accounts {
-			// Make a copy to avoid modifying the original
-			accountMap[id] = &types.Account{
-				ID:      acc.ID,
-				Balance: acc.Balance,
-			}
-		}
-
-		// Apply transaction changes
-		for id, acc := range s.txAccounts {
-			accountMap[id] = acc
-		}
+// SetSchemaVersion records the version of the stored data layout
+func (s *MemoryStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		// Convert map to slice
-		for _, acc := range accountMap {
-			accounts = append(accounts, acc)
-		}
-	} else {
-		// Just use the main state
-		for _, acc := range s.accounts {
-			accounts = append(accounts, acc)
-		}
+	if !s.initialized {
+		return ErrNotInitialized
 	}
-
-	return accounts, nil
+	s.version = version
+	return nil
 }
 
 func init() {
 	// Register the memory storage backend
-	RegisterStorage("memory", NewMemoryStorage)
+	RegisterContextStorage("memory", NewMemoryStorage)
 }
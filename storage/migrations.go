@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// SchemaVersion is the version of the data layout written by this code.
+// Increase it along with registering a migration from the previous version.
+const SchemaVersion = 2
+
+// Migration upgrades the data of a storage backend from one schema version to the next
+type Migration struct {
+	From        int    // Version the migration upgrades from, to From+1
+	Description string // Shown by the migrate command
+	// Apply upgrades the data of the named backend, with transactions of its
+	// own for the changes that must be applied together
+	Apply func(ctx context.Context, backend string, s ContextStorage) error
+}
+
+// migrations holds the registered migrations by the version they upgrade from
+var migrations = make(map[int]Migration)
+
+// RegisterMigration registers a storage migration
+func RegisterMigration(migration Migration) {
+	migrations[migration.From] = migration
+}
+
+// PendingMigrations returns the migrations upgrading data of the given
+// version to SchemaVersion, in the order they apply
+func PendingMigrations(version int) ([]Migration, error) {
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("storage schema version %d is newer than the supported version %d", version, SchemaVersion)
+	}
+
+	pending := make([]Migration, 0, SchemaVersion-version)
+	for from := version; from < SchemaVersion; from++ {
+		migration, exists := migrations[from]
+		if !exists {
+			return nil, fmt.Errorf("no storage migration from version %d", from)
+		}
+		pending = append(pending, migration)
+	}
+	return pending, nil
+}
+
+// Migrate upgrades the data of an initialized storage backend to
+// SchemaVersion, one version at a time, and returns the migrations applied.
+// With dryRun, it only returns the migrations that would be applied.
+func Migrate(ctx context.Context, s ContextStorage, backend string, dryRun bool) ([]Migration, error) {
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := PendingMigrations(version)
+	if err != nil || dryRun {
+		return pending, err
+	}
+
+	for i, migration := range pending {
+		// Each step is applied, and its version recorded, on its own, so a
+		// failed step leaves the data at the version before it
+		if err := migration.Apply(ctx, backend, s); err != nil {
+			return pending[:i], fmt.Errorf("migration from version %d failed: %w", migration.From, err)
+		}
+		if err := s.SetSchemaVersion(ctx, migration.From+1); err != nil {
+			return pending[:i], err
+		}
+	}
+	return pending, nil
+}
+
+// CheckSchemaVersion returns an error unless the data of a storage backend
+// is at SchemaVersion. A backend without accounts is new and gets the
+// current version recorded.
+func CheckSchemaVersion(ctx context.Context, s ContextStorage) error {
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+
+	if version == 0 {
+		accounts, err := s.ListAccounts(ctx, MinAccountID, 1)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			return s.SetSchemaVersion(ctx, SchemaVersion)
+		}
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("storage schema version %d is newer than the supported version %d", version, SchemaVersion)
+	}
+	return fmt.Errorf("storage schema version %d is older than %d, run the migrate command", version, SchemaVersion)
+}
+
+func init() {
+	// Data written before versions were recorded has the same layout as version 1
+	RegisterMigration(Migration{
+		From:        0,
+		Description: "record the schema version",
+		Apply:       func(context.Context, string, ContextStorage) error { return nil },
+	})
+
+	// Redis lists the accounts in order from a sorted set of their IDs,
+	// which the other backends do not need
+	RegisterMigration(Migration{
+		From:        1,
+		Description: "index the account IDs of Redis storage",
+		Apply: func(ctx context.Context, backend string, s ContextStorage) error {
+			if r, ok := unwrapStorage(s).(*RedisStorage); ok {
+				return r.indexAccounts(ctx)
+			}
+			return nil
+		},
+	})
+}
+
+// unwrapStorage returns the backend under the wrappers of this package
+func unwrapStorage(s ContextStorage) ContextStorage {
+	for {
+		switch w := s.(type) {
+		case *timeoutStorage:
+			s = w.backend
+		case *InstrumentedStorage:
+			s = w.backend
+		default:
+			return s
+		}
+	}
+}
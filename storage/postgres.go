@@ -0,0 +1,530 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// PostgresStorage implements the ContextStorage interface using PostgreSQL,
+// through a pool of connections. Balances are kept in a NUMERIC column bounded
+// to the range of uint64.
+type PostgresStorage struct {
+	autoCommit
+	pool        *pgxpool.Pool
+	initialized bool
+	dsn         string
+	table       string         // Name of the accounts table
+	isolation   pgx.TxIsoLevel // Isolation level of the transactions
+	maxConns    int32          // Size of the pool, zero for the pgx default
+}
+
+// postgresMaxBalance is the largest balance, the largest uint64
+const postgresMaxBalance = "18446744073709551615"
+
+// NewPostgresStorage creates a new PostgreSQL storage instance
+func NewPostgresStorage(config map[string]interface{}) (ContextStorage, error) {
+	// Get the connection string from config
+	dsnInterface, ok := config["dsn"]
+	if !ok {
+		return nil, fmt.Errorf("%w: dsn is required", ErrInvalidConfiguration)
+	}
+	dsn, ok := dsnInterface.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: dsn must be a string", ErrInvalidConfiguration)
+	}
+
+	s := &PostgresStorage{
+		dsn:       dsn,
+		table:     "accounts",
+		isolation: pgx.Serializable,
+	}
+
+	if tableInterface, ok := config["table"]; ok {
+		table, ok := tableInterface.(string)
+		if !ok || table == "" {
+			return nil, fmt.Errorf("%w: table must be a non-empty string", ErrInvalidConfiguration)
+		}
+		s.table = table
+	}
+
+	if isolationInterface, ok := config["isolation"]; ok {
+		isolation, _ := isolationInterface.(string)
+		switch isolation {
+		case "serializable":
+			s.isolation = pgx.Serializable
+		case "read_committed":
+			s.isolation = pgx.ReadCommitted
+		default:
+			return nil, fmt.Errorf("%w: isolation must be serializable or read_committed", ErrInvalidConfiguration)
+		}
+	}
+
+	if maxConnsInterface, ok := config["max_conns"]; ok {
+		maxConns, ok := maxConnsInterface.(float64)
+		if !ok || maxConns < 1 || maxConns != float64(int32(maxConns)) {
+			return nil, fmt.Errorf("%w: max_conns must be a positive integer", ErrInvalidConfiguration)
+		}
+		s.maxConns = int32(maxConns)
+	}
+
+	s.autoCommit = autoCommit{begin: s.Begin}
+	return s, nil
+}
+
+// Initialize connects the pool and creates the accounts table
+func (s *PostgresStorage) Initialize(ctx context.Context) error {
+	if s.initialized {
+		return ErrAlreadyInitialized
+	}
+
+	config, err := pgxpool.ParseConfig(s.dsn)
+	if err != nil {
+		return fmt.Errorf("%w: invalid dsn: %v", ErrInvalidConfiguration, err)
+	}
+	if s.maxConns > 0 {
+		config.MaxConns = s.maxConns
+	}
+
+	// The pool connects lazily, so ping the server to fail early
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
+	}
+
+	// Create the accounts table if it doesn't exist
+	_, err = pool.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id BIGINT PRIMARY KEY,
+			balance NUMERIC(20, 0) NOT NULL CHECK (balance BETWEEN 0 AND %s)
+		)
+	`, s.identifier(), postgresMaxBalance))
+	if err != nil {
+		pool.Close()
+		return fmt.Errorf("failed to create accounts table: %w", err)
+	}
+
+	s.pool = pool
+	s.initialized = true
+	return nil
+}
+
+// Close closes the connections of the pool
+func (s *PostgresStorage) Close() error {
+	if !s.initialized {
+		return ErrNotInitialized
+	}
+
+	s.pool.Close()
+	s.initialized = false
+	return nil
+}
+
+// identifier returns the quoted name of the accounts table
+func (s *PostgresStorage) identifier() string {
+	return pgx.Identifier{s.table}.Sanitize()
+}
+
+// Begin starts a PostgreSQL transaction at the configured isolation level.
+// Serializable transactions fail with ErrTransactionConflict when another
+// transaction changed what they read, while read committed ones only wait
+// for the rows they update, which each update reads again.
+func (s *PostgresStorage) Begin(ctx context.Context) (ContextTx, error) {
+	if !s.initialized {
+		return nil, ErrNotInitialized
+	}
+
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: s.isolation})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", postgresError(err))
+	}
+	return &postgresTx{storage: s, tx: tx}, nil
+}
+
+// postgresError returns ErrTransactionConflict for the errors of a
+// transaction that failed because of another one, and other errors unchanged
+func postgresError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01": // serialization_failure, deadlock_detected
+			return fmt.Errorf("%w: %v", ErrTransactionConflict, err)
+		}
+	}
+	return err
+}
+
+// ListAccounts returns a page of accounts ordered by ID, read along the
+// primary key
+func (s *PostgresStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	if !s.initialized {
+		return nil, ErrNotInitialized
+	}
+
+	// PostgreSQL reads a NULL limit as no limit
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	rows, err := s.pool.Query(ctx, fmt.Sprintf("SELECT id, balance FROM %s WHERE id >= $1 ORDER BY id LIMIT $2", s.identifier()), startID, limitArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accounts: %w", err)
+	}
+	defer rows.Close()
+
+	// Parse the accounts
+	accounts := []*types.Account{}
+	for rows.Next() {
+		var account types.Account
+		if err := rows.Scan(&account.ID, &account.Balance); err != nil {
+			return nil, fmt.Errorf("failed to scan account: %w", err)
+		}
+		accounts = append(accounts, &account)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating accounts: %w", err)
+	}
+
+	return accounts, nil
+}
+
+// SchemaVersion returns the version of the stored data layout, kept in the
+// comment of the accounts table
+func (s *PostgresStorage) SchemaVersion(ctx context.Context) (int, error) {
+	if !s.initialized {
+		return 0, ErrNotInitialized
+	}
+
+	var comment string
+	err := s.pool.QueryRow(ctx, "SELECT COALESCE(obj_description($1::text::regclass, 'pg_class'), '')", s.identifier()).Scan(&comment)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	if comment == "" {
+		return 0, nil
+	}
+	var version int
+	if _, err := fmt.Sscanf(comment, "schema version %d", &version); err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", comment, err)
+	}
+	return version, nil
+}
+
+// SetSchemaVersion records the version of the stored data layout
+func (s *PostgresStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	if !s.initialized {
+		return ErrNotInitialized
+	}
+
+	// COMMENT statements do not take parameters
+	if _, err := s.pool.Exec(ctx, fmt.Sprintf("COMMENT ON TABLE %s IS 'schema version %d'", s.identifier(), version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return nil
+}
+
+// postgresTx is a transaction of a PostgresStorage
+type postgresTx struct {
+	storage    *PostgresStorage
+	tx         pgx.Tx
+	savepoints []string // Names of the savepoints, the latest last
+	done       bool
+}
+
+// GetAccount retrieves an account by ID
+func (tx *postgresTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
+	}
+
+	var account types.Account
+	err := tx.tx.QueryRow(ctx, fmt.Sprintf("SELECT id, balance FROM %s WHERE id = $1", tx.storage.identifier()), id).
+		Scan(&account.ID, &account.Balance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query account: %w", postgresError(err))
+	}
+	return &account, nil
+}
+
+// AccountExists checks if an account exists
+func (tx *postgresTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	_, err := tx.GetAccount(ctx, id)
+	if err == ErrAccountNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetBalance gets an account's current balance
+func (tx *postgresTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	account, err := tx.GetAccount(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return account.Balance, nil
+}
+
+// Credit adds an amount to an account's balance
+func (tx *postgresTx) Credit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, false)
+}
+
+// Debit subtracts an amount from an account's balance
+func (tx *postgresTx) Debit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, true)
+}
+
+// updateBalance debits or credits an account's balance with one statement,
+// which only updates the balance if the new one stays in range
+func (tx *postgresTx) updateBalance(ctx context.Context, id int, amount uint64, debit bool) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+
+	delta := pgtype.Numeric{Int: new(big.Int).SetUint64(amount), Valid: true}
+	if debit {
+		delta.Int.Neg(delta.Int)
+	}
+	query := fmt.Sprintf("UPDATE %s SET balance = balance + $2 WHERE id = $1 AND balance + $2 BETWEEN 0 AND %s",
+		tx.storage.identifier(), postgresMaxBalance)
+	tag, err := tx.tx.Exec(ctx, query, id, delta)
+	if err != nil {
+		return fmt.Errorf("failed to update account balance: %w", postgresError(err))
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+
+	// Nothing was updated, so the account is missing or its balance would
+	// leave the range
+	account, err := tx.GetAccount(ctx, id)
+	if err == ErrAccountNotFound && !debit && amount > 0 {
+		// If the account doesn't exist and it is credited, create it
+		return tx.insertAccount(ctx, id, amount)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := changeBalance(account.Balance, amount, debit); err != nil {
+		return err
+	}
+
+	// Only a read committed transaction sees a balance committed since
+	// the update
+	return fmt.Errorf("%w: balance of account %d changed", ErrTransactionConflict, id)
+}
+
+// CreateAccount creates a new account
+func (tx *postgresTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (id, balance) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", tx.storage.identifier())
+	tag, err := tx.tx.Exec(ctx, query, id, initialBalance)
+	if err != nil {
+		return fmt.Errorf("failed to create account: %w", postgresError(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAccountAlreadyExists
+	}
+	return nil
+}
+
+// CreateAccounts creates new accounts with a single COPY. The copy runs in
+// a nested transaction, so an existing account fails it without aborting
+// this transaction.
+func (tx *postgresTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	if _, err := newAccountIDs(accounts); err != nil {
+		return err
+	}
+
+	rows := make([][]interface{}, len(accounts))
+	for i, acc := range accounts {
+		rows[i] = []interface{}{acc.ID, acc.Balance}
+	}
+
+	nested, err := tx.tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", postgresError(err))
+	}
+	_, err = nested.CopyFrom(ctx, pgx.Identifier{tx.storage.table}, []string{"id", "balance"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		if rollbackErr := nested.Rollback(ctx); rollbackErr != nil {
+			return fmt.Errorf("failed to roll back accounts: %w", postgresError(rollbackErr))
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+			return fmt.Errorf("%w: %s", ErrAccountAlreadyExists, pgErr.Detail)
+		}
+		return fmt.Errorf("failed to create accounts: %w", postgresError(err))
+	}
+	if err := nested.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", postgresError(err))
+	}
+	return nil
+}
+
+// insertAccount inserts an account known not to exist. Another transaction
+// may still have created it since, which is a conflict.
+func (tx *postgresTx) insertAccount(ctx context.Context, id int, balance uint64) error {
+	if err := tx.CreateAccount(ctx, id, balance); err != nil {
+		if err == ErrAccountAlreadyExists {
+			return fmt.Errorf("%w: account %d created by another transaction", ErrTransactionConflict, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// ApplyTransfers applies a batch of transfers with one statement locking
+// and reading the accounts, one updating the existing ones and one creating
+// the accounts credited for the first time
+func (tx *postgresTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
+	}
+
+	// Read the balances of the accounts used by the batch, locked in order
+	// of ID so that concurrent batches do not deadlock
+	ids := transferAccounts(transfers)
+	query := fmt.Sprintf("SELECT id, balance FROM %s WHERE id = ANY($1) ORDER BY id FOR UPDATE", tx.storage.identifier())
+	rows, err := tx.tx.Query(ctx, query, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accounts: %w", postgresError(err))
+	}
+	balances := make(map[int]uint64, len(ids))
+	for rows.Next() {
+		var id int
+		var balance uint64
+		if err := rows.Scan(&id, &balance); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan account: %w", err)
+		}
+		balances[id] = balance
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating accounts: %w", postgresError(err))
+	}
+
+	results, changed := planTransfers(balances, transfers, mode)
+
+	// Split the new balances between the accounts read and the new ones
+	var updatedIDs, createdIDs []int
+	var updated, created []uint64
+	for id, balance := range changed {
+		if _, ok := balances[id]; ok {
+			updatedIDs, updated = append(updatedIDs, id), append(updated, balance)
+		} else {
+			createdIDs, created = append(createdIDs, id), append(created, balance)
+		}
+	}
+
+	if len(updatedIDs) > 0 {
+		query := fmt.Sprintf(`UPDATE %s AS a SET balance = v.balance
+			FROM unnest($1::bigint[], $2::numeric[]) AS v(id, balance) WHERE a.id = v.id`, tx.storage.identifier())
+		if _, err := tx.tx.Exec(ctx, query, updatedIDs, updated); err != nil {
+			return nil, fmt.Errorf("failed to update account balances: %w", postgresError(err))
+		}
+	}
+	if len(createdIDs) > 0 {
+		query := fmt.Sprintf(`INSERT INTO %s (id, balance)
+			SELECT * FROM unnest($1::bigint[], $2::numeric[]) ON CONFLICT (id) DO NOTHING`, tx.storage.identifier())
+		tag, err := tx.tx.Exec(ctx, query, createdIDs, created)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create accounts: %w", postgresError(err))
+		}
+		if tag.RowsAffected() != int64(len(createdIDs)) {
+			return nil, fmt.Errorf("%w: accounts created by another transaction", ErrTransactionConflict)
+		}
+	}
+	return results, nil
+}
+
+// Savepoint creates a PostgreSQL savepoint
+func (tx *postgresTx) Savepoint(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	if _, err := tx.tx.Exec(ctx, "SAVEPOINT "+pgx.Identifier{name}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to create savepoint %s: %w", name, postgresError(err))
+	}
+	tx.savepoints = append(tx.savepoints, name)
+	return nil
+}
+
+// RollbackTo rolls back to a PostgreSQL savepoint, which PostgreSQL keeps
+// while releasing the savepoints created after it
+func (tx *postgresTx) RollbackTo(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	i := lastSavepoint(tx.savepoints, name)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSavepointNotFound, name)
+	}
+	if _, err := tx.tx.Exec(ctx, "ROLLBACK TO SAVEPOINT "+pgx.Identifier{name}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to roll back to savepoint %s: %w", name, postgresError(err))
+	}
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Commit commits the transaction. A serializable transaction that conflicts
+// with another one fails with ErrTransactionConflict.
+func (tx *postgresTx) Commit(ctx context.Context) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+
+	if err := ctx.Err(); err != nil {
+		tx.tx.Rollback(context.WithoutCancel(ctx))
+		return err
+	}
+	if err := tx.tx.Commit(ctx); err != nil {
+		err = postgresError(err)
+		if errors.Is(err, ErrTransactionConflict) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
+	}
+	return nil
+}
+
+// Rollback rolls back the transaction, even once the context is done
+func (tx *postgresTx) Rollback(ctx context.Context) error {
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+
+	if err := tx.tx.Rollback(context.WithoutCancel(ctx)); err != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
+	}
+	return nil
+}
+
+func init() {
+	// Register the PostgreSQL storage backend
+	RegisterContextStorage("postgres", NewPostgresStorage)
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -11,15 +12,12 @@ import (
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
-// RedisStorage implements the Storage interface using Redis
+// RedisStorage implements the ContextStorage interface using Redis
 type RedisStorage struct {
+	autoCommit
 	client      *redis.Client
 	initialized bool
-	ctx         context.Context
 	mutex       sync.RWMutex
-	accounts    map[int]*types.Account // Cache for accounts
-	txAccounts  map[int]*types.Account // Accounts in the current transaction
-	inTx        bool
 	keyPrefix   string
 	addr        string
 	password    string
@@ -27,7 +25,7 @@ type RedisStorage struct {
 }
 
 // NewRedisStorage creates a new Redis storage instance
-func NewRedisStorage(config map[string]interface{}) (Storage, error) {
+func NewRedisStorage(config map[string]interface{}) (ContextStorage, error) {
 	// Get the Redis address from config
 	addrInterface, ok := config["address"]
 	if !ok {
@@ -72,19 +70,18 @@ func NewRedisStorage(config map[string]interface{}) (Storage, error) {
 		keyPrefix = "account:"
 	}
 
-	return &RedisStorage{
-		ctx:        context.Background(),
-		accounts:   make(map[int]*types.Account),
-		txAccounts: make(map[int]*types.Account),
-		keyPrefix:  keyPrefix,
-		addr:       addr,
-		password:   password,
-		db:         db,
-	}, nil
+	s := &RedisStorage{
+		keyPrefix: keyPrefix,
+		addr:      addr,
+		password:  password,
+		db:        db,
+	}
+	s.autoCommit = autoCommit{begin: s.Begin}
+	return s, nil
 }
 
 // Initialize initializes the storage
-func (s *RedisStorage) Initialize() error {
+func (s *RedisStorage) Initialize(ctx context.Context) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -100,7 +97,7 @@ func (s *RedisStorage) Initialize() error {
 	})
 
 	// Ping the Redis server to check if it's available
-	if err := s.client.Ping(s.ctx).Err(); err != nil {
+	if err := s.client.Ping(ctx).Err(); err != nil {
 		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
 	}
 
@@ -117,10 +114,6 @@ func (s *RedisStorage) Close() error {
 		return ErrNotInitialized
 	}
 
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
 	// Close the Redis client
 	if err := s.client.Close(); err != nil {
 		return fmt.Errorf("failed to close Redis client: %w", err)
@@ -136,265 +129,248 @@ func (s *RedisStorage) accountKey(id int) string {
 	return s.keyPrefix + strconv.Itoa(id)
 }
 
-// GetAccount retrieves an account by ID
-func (s *RedisStorage) GetAccount(id int) (*types.Account, error) {
+// accountIndexKey returns the key of the sorted set indexing the IDs of the
+// accounts under the key prefix
+func (s *RedisStorage) accountIndexKey() string {
+	return "account_ids:" + s.keyPrefix
+}
+
+// indexMember returns the member of an account ID in the account index. All
+// members have the same score, so they sort by their bytes, which order the
+// IDs once the sign bit is flipped. Scores would lose IDs above 2^53.
+func indexMember(id int) string {
+	return fmt.Sprintf("%016x", uint64(id)^(1<<63))
+}
+
+// memberID returns the account ID of a member of the account index
+func memberID(member string) (int, error) {
+	key, err := strconv.ParseUint(member, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid account index member %q: %w", member, err)
+	}
+	return int(key ^ (1 << 63)), nil
+}
+
+// Begin starts a transaction, whose changes are kept in memory until it
+// commits. Commit fails with ErrTransactionConflict when an account the
+// transaction read was changed by another commit since, from any client.
+func (s *RedisStorage) Begin(ctx context.Context) (ContextTx, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	if !s.initialized {
 		return nil, ErrNotInitialized
 	}
+	return newBufferedTx(s), nil
+}
 
-	// If in a transaction, check the transaction accounts first
-	if s.inTx {
-		if acc, exists := s.txAccounts[id]; exists {
-			return acc, nil
-		}
-	}
-
-	// Check the cache
-	if acc, exists := s.accounts[id]; exists {
-		// If in a transaction, make a copy for the transaction
-		if s.inTx {
-			accCopy := &types.Account{
-				ID:      acc.ID,
-				Balance: acc.Balance,
-			}
-			s.txAccounts[id] = accCopy
-			return accCopy, nil
-		}
-		return acc, nil
-	}
-
-	// Get the account from Redis
-	key := s.accountKey(id)
-	val, err := s.client.Get(s.ctx, key).Result()
-	if err == redis.Nil {
-		return nil, ErrAccountNotFound
+// getAccounts reads the accounts among ids in one request, leaving out the
+// ones that do not exist
+func (s *RedisStorage) getAccounts(ctx context.Context, cmd redis.Cmdable, ids []int) (map[int]*types.Account, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.accountKey(id)
 	}
+	vals, err := cmd.MGet(ctx, keys...).Result()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get account: %w", err)
-	}
-
-	// Deserialize the account
-	var account types.Account
-	if err := json.Unmarshal([]byte(val), &account); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal account: %w", err)
+		return nil, fmt.Errorf("failed to get accounts: %w", err)
 	}
 
-	// Cache the account
-	s.accounts[id] = &account
-
-	// If in a transaction, make a copy for the transaction
-	if s.inTx {
-		accCopy := &types.Account{
-			ID:      account.ID,
-			Balance: account.Balance,
+	accounts := make(map[int]*types.Account, len(ids))
+	for i, val := range vals {
+		if val == nil {
+			continue
 		}
-		s.txAccounts[id] = accCopy
-		return accCopy, nil
+		var account types.Account
+		if err := json.Unmarshal([]byte(val.(string)), &account); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal account: %w", err)
+		}
+		accounts[ids[i]] = &account
 	}
-
-	return &account, nil
+	return accounts, nil
 }
 
-// AccountExists checks if an account exists
-func (s *RedisStorage) AccountExists(id int) (bool, error) {
+// loadAccounts returns the committed accounts among ids
+func (s *RedisStorage) loadAccounts(ctx context.Context, ids []int) (map[int]*types.Account, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return false, ErrNotInitialized
-	}
-
-	// If in a transaction, check the transaction accounts first
-	if s.inTx {
-		if _, exists := s.txAccounts[id]; exists {
-			return true, nil
-		}
-	}
-
-	// Check the cache
-	if _, exists := s.accounts[id]; exists {
-		return true, nil
-	}
-
-	// Check if the account exists in Redis
-	key := s.accountKey(id)
-	exists, err := s.client.Exists(s.ctx, key).Result()
-	if err != nil {
-		return false, fmt.Errorf("failed to check account existence: %w", err)
+		return nil, ErrNotInitialized
 	}
-
-	return exists > 0, nil
+	return s.getAccounts(ctx, s.client, ids)
 }
 
-// UpdateBalance updates an account's balance
-func (s *RedisStorage) UpdateBalance(id int, delta int) error {
+// storeAccounts writes the accounts changed by a transaction in a Redis
+// transaction watching the accounts it read, which fails if another client
+// changes one of them before it is applied
+func (s *RedisStorage) storeAccounts(ctx context.Context, read, written map[int]*types.Account) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	if !s.initialized {
 		return ErrNotInitialized
 	}
 
-	// Get the account
-	account, err := s.GetAccount(id)
-	if err != nil {
-		// If account doesn't exist, create it with the delta as initial balance
-		// (only if delta is positive)
-		if err == ErrAccountNotFound && delta > 0 {
-			return s.CreateAccount(id, delta)
-		}
-		return err
-	}
-
-	// Check if the balance would go negative
-	newBalance := account.Balance + delta
-	if newBalance < 0 {
-		return ErrInsufficientBalance
+	ids := make([]int, 0, len(read))
+	keys := make([]string, 0, len(read))
+	for id := range read {
+		ids = append(ids, id)
+		keys = append(keys, s.accountKey(id))
 	}
 
-	// Update the balance
-	account.Balance = newBalance
+	apply := func(tx *redis.Tx) error {
+		// Check that the accounts read are still the committed ones
+		current, err := s.getAccounts(ctx, tx, ids)
+		if err != nil {
+			return err
+		}
+		for id, acc := range read {
+			if !sameAccount(current[id], acc) {
+				return fmt.Errorf("%w: account %d changed", ErrTransactionConflict, id)
+			}
+		}
 
-	// If in a transaction, just update the transaction account
-	if s.inTx {
-		s.txAccounts[id] = account
-		return nil
+		// Write the accounts and index the new ones, unless a watched
+		// account changed
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for id, account := range written {
+				accountData, err := json.Marshal(account)
+				if err != nil {
+					return fmt.Errorf("failed to marshal account: %w", err)
+				}
+				pipe.Set(ctx, s.accountKey(id), accountData, 0)
+				if read[id] == nil {
+					pipe.ZAdd(ctx, s.accountIndexKey(), &redis.Z{Member: indexMember(id)})
+				}
+			}
+			return nil
+		})
+		return err
 	}
 
-	// Serialize the account
-	accountData, err := json.Marshal(account)
-	if err != nil {
-		return fmt.Errorf("failed to marshal account: %w", err)
+	err := s.client.Watch(ctx, apply, keys...)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("%w: %v", ErrTransactionConflict, err)
 	}
-
-	// Update the account in Redis
-	key := s.accountKey(id)
-	if err := s.client.Set(s.ctx, key, accountData, 0).Err(); err != nil {
-		return fmt.Errorf("failed to update account: %w", err)
+	if err != nil && !errors.Is(err, ErrTransactionConflict) {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
-
-	// Update the cache
-	s.accounts[id] = account
-
-	return nil
+	return err
 }
 
-// CreateAccount creates a new account
-func (s *RedisStorage) CreateAccount(id int, initialBalance int) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// ListAccounts returns a page of accounts ordered by ID, taking their IDs
+// from the account index
+func (s *RedisStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return ErrNotInitialized
+		return nil, ErrNotInitialized
 	}
 
-	// Check if account already exists
-	exists, err := s.AccountExists(id)
-	if err != nil {
-		return err
+	opt := &redis.ZRangeBy{Min: "[" + indexMember(startID), Max: "+"}
+	if limit > 0 {
+		opt.Count = int64(limit)
 	}
-	if exists {
-		return ErrAccountAlreadyExists
+	members, err := s.client.ZRangeByLex(ctx, s.accountIndexKey(), opt).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list account IDs: %w", err)
 	}
-
-	// Create the account
-	account := &types.Account{
-		ID:      id,
-		Balance: initialBalance,
+	if len(members) == 0 {
+		return []*types.Account{}, nil
 	}
 
-	// If in a transaction, just store the account in the transaction
-	if s.inTx {
-		s.txAccounts[id] = account
-		return nil
+	ids := make([]int, len(members))
+	for i, member := range members {
+		if ids[i], err = memberID(member); err != nil {
+			return nil, err
+		}
 	}
-
-	// Serialize the account
-	accountData, err := json.Marshal(account)
+	found, err := s.getAccounts(ctx, s.client, ids)
 	if err != nil {
-		return fmt.Errorf("failed to marshal account: %w", err)
+		return nil, err
 	}
 
-	// Store the account in Redis
-	key := s.accountKey(id)
-	if err := s.client.Set(s.ctx, key, accountData, 0).Err(); err != nil {
-		return fmt.Errorf("failed to create account: %w", err)
+	accounts := make([]*types.Account, 0, len(ids))
+	for _, id := range ids {
+		if account, exists := found[id]; exists {
+			accounts = append(accounts, account)
+		}
 	}
-
-	// Cache the account
-	s.accounts[id] = account
-
-	return nil
+	return accounts, nil
 }
 
-// Commit commits any pending changes
-func (s *RedisStorage) Commit() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// indexScanCount is the number of keys asked for by each SCAN call when
+// indexing the accounts
+const indexScanCount = 1000
+
+// indexAccounts adds the IDs of every account under the key prefix to the
+// account index, scanning the keys
+func (s *RedisStorage) indexAccounts(ctx context.Context) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	if !s.initialized {
 		return ErrNotInitialized
 	}
 
-	// If not in a transaction, nothing to commit
-	if !s.inTx {
-		return nil
-	}
-
-	// Use a Redis pipeline to batch the updates
-	pipe := s.client.Pipeline()
-
-	// Apply all transaction changes
-	for id, account := range s.txAccounts {
-		// Serialize the account
-		accountData, err := json.Marshal(account)
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, s.keyPrefix+"*", indexScanCount).Result()
 		if err != nil {
-			return fmt.Errorf("failed to marshal account: %w", err)
+			return fmt.Errorf("failed to scan account keys: %w", err)
 		}
 
-		// Store the account in Redis
-		key := s.accountKey(id)
-		pipe.Set(s.ctx, key, accountData, 0)
-
-		// Update the cache
-		s.accounts[id] = account
-	}
+		// Keep the keys made by accountKey, which skips the schema version
+		// and the index itself when the prefix is empty
+		members := make([]*redis.Z, 0, len(keys))
+		for _, key := range keys {
+			id, err := strconv.Atoi(key[len(s.keyPrefix):])
+			if err != nil || s.accountKey(id) != key {
+				continue
+			}
+			members = append(members, &redis.Z{Member: indexMember(id)})
+		}
+		if len(members) > 0 {
+			if err := s.client.ZAdd(ctx, s.accountIndexKey(), members...).Err(); err != nil {
+				return fmt.Errorf("failed to index accounts: %w", err)
+			}
+		}
 
-	// Execute the pipeline
-	if _, err := pipe.Exec(s.ctx); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		if next == 0 {
+			return nil
+		}
+		cursor = next
 	}
+}
 
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
-	return nil
+// schemaVersionKey returns the key of the schema version of the accounts under the key prefix
+func (s *RedisStorage) schemaVersionKey() string {
+	return "schema_version:" + s.keyPrefix
 }
 
-// Rollback rolls back any pending changes
-func (s *RedisStorage) Rollback() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// SchemaVersion returns the version of the stored data layout
+func (s *RedisStorage) SchemaVersion(ctx context.Context) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return ErrNotInitialized
+		return 0, ErrNotInitialized
 	}
 
-	// If not in a transaction, nothing to rollback
-	if !s.inTx {
-		return nil
+	version, err := s.client.Get(ctx, s.schemaVersionKey()).Int()
+	if err == redis.Nil {
+		return 0, nil
 	}
-
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
-	return nil
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return version, nil
 }
 
-// BeginTransaction begins a new transaction
-func (s *RedisStorage) BeginTransaction() error {
+// SetSchemaVersion records the version of the stored data layout
+func (s *RedisStorage) SetSchemaVersion(ctx context.Context, version int) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -402,32 +378,161 @@ func (s *RedisStorage) BeginTransaction() error {
 		return ErrNotInitialized
 	}
 
-	// If already in a transaction, commit it first
-	if s.inTx {
-		// Apply transaction changes to the main accounts
-		for id, acc := range s.txAccounts {
-			s.accounts[id] = acc
-		}
+	if err := s.client.Set(ctx, s.schemaVersionKey(), version, 0).Err(); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
 	}
-
-	// Start a new transaction
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = true
-
 	return nil
 }
 
-// GetBalance gets an account's current balance
-func (s *RedisStorage) GetBalance(id int) (int, error) {
-	account, err := s.GetAccount(id)
-	if err != nil {
-		return 0, err
-	}
-	return account.Balance, nil
+// transferScript applies a batch of transfers atomically on the server. KEYS
+// are the accounts used by the batch, then the account index. ARGV holds
+// their number, their IDs and their index members, then the mode, then the
+// indexes in KEYS of the accounts debited and credited and the amount of each
+// transfer. It returns the result of every transfer.
+//
+// Lua numbers are doubles, exact only up to 2^53, so balances and amounts are
+// kept as the decimal strings of the account JSON and added digit by digit,
+// failing a transfer whose credit would exceed the largest uint64.
+var transferScript = redis.NewScript(`
+local MAX_BALANCE = "18446744073709551615"
+
+local function less(a, b)
+	if #a ~= #b then
+		return #a < #b
+	end
+	return a < b
+end
+
+local function digits_string(digits)
+	local n = #digits
+	while n > 1 and digits[n] == 0 do
+		n = n - 1
+	end
+	local s = {}
+	for i = n, 1, -1 do
+		s[#s + 1] = digits[i]
+	end
+	return table.concat(s)
+end
+
+local function add(a, b)
+	local digits = {}
+	local carry = 0
+	local i, j = #a, #b
+	while i > 0 or j > 0 or carry > 0 do
+		local sum = carry
+		if i > 0 then
+			sum = sum + a:byte(i) - 48
+			i = i - 1
+		end
+		if j > 0 then
+			sum = sum + b:byte(j) - 48
+			j = j - 1
+		end
+		digits[#digits + 1] = sum % 10
+		carry = math.floor(sum / 10)
+	end
+	return digits_string(digits)
+end
+
+local function sub(a, b)
+	local digits = {}
+	local borrow = 0
+	local j = #b
+	for i = #a, 1, -1 do
+		local d = a:byte(i) - 48 - borrow
+		if j > 0 then
+			d = d - (b:byte(j) - 48)
+			j = j - 1
+		end
+		if d < 0 then
+			d = d + 10
+			borrow = 1
+		else
+			borrow = 0
+		end
+		digits[#digits + 1] = d
+	end
+	return digits_string(digits)
+end
+
+local n = tonumber(ARGV[1])
+local accounts = {}
+for i = 1, n do
+	local value = redis.call("GET", KEYS[i])
+	if value then
+		local head, balance, rest = string.match(value, '^({"id":%-?%d+,"balance":)(%d+)(.*)$')
+		if not head then
+			return redis.error_reply("account " .. ARGV[i + 1] .. " has no balance")
+		end
+		accounts[i] = {head = head, balance = balance, rest = rest}
+	end
+end
+
+local atomic = ARGV[2 * n + 2] == "atomic"
+local results = {}
+local changed = {}
+local failed = false
+for t = 2 * n + 3, #ARGV, 3 do
+	local from, to, amount = tonumber(ARGV[t]), tonumber(ARGV[t + 1]), ARGV[t + 2]
+	local result = "ok"
+	local credited
+	if amount == "0" or from == to then
+		result = "invalid"
+	elseif accounts[from] == nil then
+		result = "not_found"
+	elseif less(accounts[from].balance, amount) then
+		result = "insufficient"
+	else
+		local balance = "0"
+		if accounts[to] ~= nil then
+			balance = accounts[to].balance
+		end
+		credited = add(balance, amount)
+		if less(MAX_BALANCE, credited) then
+			result = "overflow"
+		end
+	end
+
+	if result == "ok" then
+		if accounts[to] == nil then
+			accounts[to] = {head = '{"id":' .. ARGV[to + 1] .. ',"balance":', balance = "0", rest = "}", created = true}
+		end
+		accounts[from].balance = sub(accounts[from].balance, amount)
+		accounts[to].balance = credited
+		changed[from] = true
+		changed[to] = true
+	else
+		failed = true
+	end
+	results[#results + 1] = result
+end
+
+if not (atomic and failed) then
+	for i in pairs(changed) do
+		local account = accounts[i]
+		redis.call("SET", KEYS[i], account.head .. account.balance .. account.rest)
+		if account.created then
+			redis.call("ZADD", KEYS[n + 1], 0, ARGV[n + i + 1])
+		end
+	end
+end
+return results
+`)
+
+// transferScriptErrors maps the results of transferScript to errors
+var transferScriptErrors = map[string]error{
+	"ok":           nil,
+	"invalid":      ErrInvalidTransfer,
+	"not_found":    ErrAccountNotFound,
+	"insufficient": ErrInsufficientBalance,
+	"overflow":     ErrBalanceOverflow,
 }
 
-// GetAllAccounts gets all accounts
-func (s *RedisStorage) GetAllAccounts() ([]*types.Account, error) {
+// ApplyTransfers applies a batch of transfers with a single script run on
+// the server. Transactions reading the accounts it changes fail to commit,
+// as they would after any other write.
+func (s *RedisStorage) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
@@ -435,67 +540,55 @@ func (s *RedisStorage) GetAllAccounts() ([]*types.Account, error) {
 		return nil, ErrNotInitialized
 	}
 
-	// Get all account keys from Redis
-	keys, err := s.client.Keys(s.ctx, s.keyPrefix+"*").Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get account keys: %w", err)
+	// Pass the accounts as keys and the transfers as indexes into them
+	ids := transferAccounts(transfers)
+	index := make(map[int]int, len(ids))
+	keys := make([]string, 0, len(ids)+1)
+	args := make([]interface{}, 0, 2+2*len(ids)+3*len(transfers))
+	args = append(args, len(ids))
+	for i, id := range ids {
+		index[id] = i + 1
+		keys = append(keys, s.accountKey(id))
+		args = append(args, id)
 	}
-
-	// If no accounts found, return an empty slice
-	if len(keys) == 0 {
-		return []*types.Account{}, nil
+	for _, id := range ids {
+		args = append(args, indexMember(id))
+	}
+	keys = append(keys, s.accountIndexKey())
+	args = append(args, mode.String())
+	for _, t := range transfers {
+		args = append(args, index[t.From], index[t.To], strconv.FormatUint(t.Amount, 10))
 	}
 
-	// Get all accounts in a single operation
-	vals, err := s.client.MGet(s.ctx, keys...).Result()
+	codes, err := transferScript.Run(ctx, s.client, keys, args...).StringSlice()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get accounts: %w", err)
+		return nil, fmt.Errorf("failed to apply transfers: %w", err)
+	}
+	if len(codes) != len(transfers) {
+		return nil, fmt.Errorf("failed to apply transfers: %d results for %d transfers", len(codes), len(transfers))
 	}
 
-	// Parse the accounts
-	accounts := make([]*types.Account, 0, len(vals))
-	for _, val := range vals {
-		if val == nil {
-			continue
-		}
-
-		var account types.Account
-		if err := json.Unmarshal([]byte(val.(string)), &account); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal account: %w", err)
+	results := make([]TransferResult, len(transfers))
+	failed := false
+	for i, code := range codes {
+		err, known := transferScriptErrors[code]
+		if !known {
+			return nil, fmt.Errorf("failed to apply transfers: unknown result %q", code)
 		}
-
-		// If in a transaction, check if the account has been modified
-		if s.inTx {
-			if acc, exists := s.txAccounts[account.ID]; exists {
-				accounts = append(accounts, acc)
-				continue
-			}
-		}
-
-		accounts = append(accounts, &account)
+		results[i].Err = err
+		failed = failed || err != nil
 	}
-
-	// If in a transaction, add any new accounts
-	if s.inTx {
-		for id, acc := range s.txAccounts {
-			// Check if the account is already in the list
-			found := false
-			for _, a := range accounts {
-				if a.ID == id {
-					found = true
-					break
-				}
-			}
-			if !found {
-				accounts = append(accounts, acc)
+	if failed && mode == TransfersAtomic {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = ErrTransferAborted
 			}
 		}
 	}
-
-	return accounts, nil
+	return results, nil
 }
 
 func init() {
 	// Register the Redis storage backend
-	RegisterStorage("redis", NewRedisStorage)
+	RegisterContextStorage("redis", NewRedisStorage)
 }
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// checkTxBalances fails unless the accounts have the given balances in a
+// transaction, where a zero balance stands for an account that does not exist
+func checkTxBalances(t *testing.T, tx ContextTx, want map[int]uint64) {
+	t.Helper()
+
+	for id, balance := range want {
+		got, err := tx.GetBalance(context.Background(), id)
+		if balance == 0 && errors.Is(err, ErrAccountNotFound) {
+			continue
+		}
+		if err != nil || got != balance {
+			t.Errorf("Account %d has balance %d (%v) in the transaction, want %d", id, got, err, balance)
+		}
+	}
+}
+
+func testSavepoints(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one, two, three := b.id(1), b.id(2), b.id(3)
+	if err := s.CreateAccount(ctx, one, 100); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Rolling back to a savepoint discards the changes made since,
+	// including the accounts created
+	step := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	step(tx.Debit(ctx, one, 10))
+	step(tx.Savepoint(ctx, "a"))
+	step(tx.Debit(ctx, one, 20))
+	step(tx.Credit(ctx, two, 20))
+	step(tx.RollbackTo(ctx, "a"))
+	checkTxBalances(t, tx, b.balances(map[int]uint64{1: 90, 2: 0}))
+
+	// The savepoint is kept, and a name used again hides the
+	// earlier savepoint until rolling back past it
+	step(tx.Credit(ctx, three, 5))
+	step(tx.Savepoint(ctx, "b"))
+	step(tx.Debit(ctx, one, 5))
+	step(tx.Savepoint(ctx, "a"))
+	step(tx.Debit(ctx, one, 5))
+	step(tx.RollbackTo(ctx, "a"))
+	checkTxBalances(t, tx, b.balances(map[int]uint64{1: 85, 3: 5}))
+	step(tx.RollbackTo(ctx, "b"))
+	checkTxBalances(t, tx, b.balances(map[int]uint64{1: 90, 3: 5}))
+	step(tx.RollbackTo(ctx, "a"))
+	checkTxBalances(t, tx, b.balances(map[int]uint64{1: 90, 3: 0}))
+	if err := tx.RollbackTo(ctx, "b"); !errors.Is(err, ErrSavepointNotFound) {
+		t.Errorf("Rollback to a released savepoint: got %v, want %v", err, ErrSavepointNotFound)
+	}
+
+	// A failed operation of a batch is undone alone
+	batch := []Transfer{{From: one, To: two, Amount: 50}, {From: two, To: three, Amount: 30}, {From: three, To: one, Amount: 40}}
+	for i, transfer := range batch {
+		step(tx.Savepoint(ctx, "op"))
+		err := tx.Credit(ctx, transfer.To, transfer.Amount)
+		if err == nil {
+			err = tx.Debit(ctx, transfer.From, transfer.Amount)
+		}
+		if err != nil {
+			if i != 2 || !errors.Is(err, ErrInsufficientBalance) {
+				t.Errorf("Transfer %d failed: %v", i, err)
+			}
+			step(tx.RollbackTo(ctx, "op"))
+		}
+	}
+	step(tx.Commit(ctx))
+	checkBalances(t, s, b.balances(map[int]uint64{1: 40, 2: 20, 3: 30}))
+}
@@ -1,24 +1,48 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
-// SQLiteStorage implements the Storage interface using SQLite
+// SQLiteStorage implements the ContextStorage interface using SQLite
 type SQLiteStorage struct {
+	autoCommit
 	db          *sql.DB
 	initialized bool
 	dbPath      string
-	tx          *sql.Tx
+}
+
+// sqliteBalance stores a balance in an INTEGER column. SQLite integers are
+// signed, so a balance above math.MaxInt64 is kept as the negative integer
+// with the same bits.
+type sqliteBalance uint64
+
+// Value converts the balance to the integer stored
+func (b sqliteBalance) Value() (driver.Value, error) {
+	return int64(b), nil
+}
+
+// Scan reads the balance from a stored integer
+func (b *sqliteBalance) Scan(src interface{}) error {
+	value, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("invalid balance %v", src)
+	}
+	*b = sqliteBalance(value)
+	return nil
 }
 
 // NewSQLiteStorage creates a new SQLite storage instance
-func NewSQLiteStorage(config map[string]interface{}) (Storage, error) {
+func NewSQLiteStorage(config map[string]interface{}) (ContextStorage, error) {
 	// Get the database path from config
 	dbPathInterface, ok := config["db_path"]
 	if !ok {
@@ -35,25 +59,28 @@ func NewSQLiteStorage(config map[string]interface{}) (Storage, error) {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	return &SQLiteStorage{
+	s := &SQLiteStorage{
 		dbPath: dbPath,
-	}, nil
+	}
+	s.autoCommit = autoCommit{begin: s.Begin}
+	return s, nil
 }
 
 // Initialize initializes the storage
-func (s *SQLiteStorage) Initialize() error {
+func (s *SQLiteStorage) Initialize(ctx context.Context) error {
 	if s.initialized {
 		return ErrAlreadyInitialized
 	}
 
-	// Open the SQLite database
-	db, err := sql.Open("sqlite3", s.dbPath)
+	// Open the SQLite database in WAL mode, where transactions reading a
+	// snapshot do not block the one writing
+	db, err := sql.Open("sqlite3", s.dbPath+"?_journal_mode=WAL")
 	if err != nil {
 		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
 	}
 
 	// Create the accounts table if it doesn't exist
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS accounts (
 			id INTEGER PRIMARY KEY,
 			balance INTEGER NOT NULL
@@ -75,11 +102,6 @@ func (s *SQLiteStorage) Close() error {
 		return ErrNotInitialized
 	}
 
-	if s.tx != nil {
-		s.tx.Rollback()
-		s.tx = nil
-	}
-
 	if err := s.db.Close(); err != nil {
 		return fmt.Errorf("failed to close database: %w", err)
 	}
@@ -88,305 +110,369 @@ func (s *SQLiteStorage) Close() error {
 	return nil
 }
 
-// GetAccount retrieves an account by ID
-func (s *SQLiteStorage) GetAccount(id int) (*types.Account, error) {
+// Begin starts an SQLite transaction. It reads a snapshot of the database
+// and takes its write lock on the first write, waiting for the transaction
+// holding it. The write fails with ErrTransactionConflict when another
+// transaction committed since the snapshot was taken.
+func (s *SQLiteStorage) Begin(ctx context.Context) (ContextTx, error) {
 	if !s.initialized {
 		return nil, ErrNotInitialized
 	}
 
-	var query string
-	var queryArgs []interface{}
-	var rows *sql.Rows
-	var err error
+	// The transaction outlives this call, so it must not be rolled back
+	// when the call's context ends
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", sqliteError(err))
+	}
+	return &sqliteTx{tx: tx}, nil
+}
 
-	query = "SELECT id, balance FROM accounts WHERE id = ?"
-	queryArgs = []interface{}{id}
+// sqliteError returns ErrTransactionConflict for the errors of a
+// transaction that could not take the write lock, and other errors unchanged
+func sqliteError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrBusy {
+		return fmt.Errorf("%w: %v", ErrTransactionConflict, err)
+	}
+	return err
+}
 
-	// Use the transaction if one is active
-	if s.tx != nil {
-		rows, err = s.tx.Query(query, queryArgs...)
-	} else {
-		rows, err = s.db.Query(query, queryArgs...)
+// ListAccounts returns a page of accounts ordered by ID, read along the
+// primary key
+func (s *SQLiteStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	if !s.initialized {
+		return nil, ErrNotInitialized
 	}
 
+	// SQLite reads a negative limit as no limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT id, balance FROM accounts WHERE id >= ? ORDER BY id LIMIT ?", startID, limit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query account: %w", err)
+		return nil, fmt.Errorf("failed to query accounts: %w", err)
 	}
 	defer rows.Close()
 
-	// Check if the account exists
-	if !rows.Next() {
-		return nil, ErrAccountNotFound
+	// Parse the accounts
+	accounts := []*types.Account{}
+	for rows.Next() {
+		var account types.Account
+		if err := rows.Scan(&account.ID, (*sqliteBalance)(&account.Balance)); err != nil {
+			return nil, fmt.Errorf("failed to scan account: %w", err)
+		}
+		accounts = append(accounts, &account)
 	}
 
-	// Parse the account
-	var account types.Account
-	if err := rows.Scan(&account.ID, &account.Balance); err != nil {
-		return nil, fmt.Errorf("failed to scan account: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating accounts: %w", err)
 	}
 
-	return &account, nil
+	return accounts, nil
 }
 
-// AccountExists checks if an account exists
-func (s *SQLiteStorage) AccountExists(id int) (bool, error) {
+// SchemaVersion returns the version of the stored data layout, kept in the
+// user_version of the database
+func (s *SQLiteStorage) SchemaVersion(ctx context.Context) (int, error) {
 	if !s.initialized {
-		return false, ErrNotInitialized
+		return 0, ErrNotInitialized
 	}
 
-	var query string
-	var queryArgs []interface{}
-	var row *sql.Row
-
-	query = "SELECT 1 FROM accounts WHERE id = ? LIMIT 1"
-	queryArgs = []interface{}{id}
-
-	// Use the transaction if one is active
-	if s.tx != nil {
-		row = s.tx.QueryRow(query, queryArgs...)
-	} else {
-		row = s.db.QueryRow(query, queryArgs...)
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
 	}
+	return version, nil
+}
 
-	var exists int
-	err := row.Scan(&exists)
-	if err == sql.ErrNoRows {
-		return false, nil
+// SetSchemaVersion records the version of the stored data layout
+func (s *SQLiteStorage) SetSchemaVersion(ctx context.Context, version int) error {
+	if !s.initialized {
+		return ErrNotInitialized
 	}
-	if err != nil {
-		return false, fmt.Errorf("failed to check account existence: %w", err)
+
+	// PRAGMA statements do not take parameters
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
 	}
+	return nil
+}
 
-	return true, nil
+// sqliteBatchRows is the number of accounts read or written by one statement,
+// which keeps the number of parameters under the limit of SQLite
+const sqliteBatchRows = 5000
+
+// sqliteTx is a transaction of an SQLiteStorage
+type sqliteTx struct {
+	tx         *sql.Tx
+	savepoints []string // Names of the savepoints, the latest last
+	done       bool
 }
 
-// UpdateBalance updates an account's balance
-func (s *SQLiteStorage) UpdateBalance(id int, delta int) error {
-	if !s.initialized {
-		return ErrNotInitialized
+// GetAccount retrieves an account by ID
+func (tx *sqliteTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
 	}
 
-	// Check if the account exists
-	exists, err := s.AccountExists(id)
+	var account types.Account
+	err := tx.tx.QueryRowContext(ctx, "SELECT id, balance FROM accounts WHERE id = ?", id).
+		Scan(&account.ID, (*sqliteBalance)(&account.Balance))
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to query account: %w", sqliteError(err))
 	}
+	return &account, nil
+}
 
-	// If the account doesn't exist and delta is positive, create it
-	if !exists {
-		if delta <= 0 {
-			return ErrAccountNotFound
-		}
-		return s.CreateAccount(id, delta)
+// AccountExists checks if an account exists
+func (tx *sqliteTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	_, err := tx.GetAccount(ctx, id)
+	if err == ErrAccountNotFound {
+		return false, nil
 	}
+	return err == nil, err
+}
 
-	// Get the current balance
-	account, err := s.GetAccount(id)
+// GetBalance gets an account's current balance
+func (tx *sqliteTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	account, err := tx.GetAccount(ctx, id)
 	if err != nil {
-		return err
-	}
-
-	// Check if the balance would go negative
-	newBalance := account.Balance + delta
-	if newBalance < 0 {
-		return ErrInsufficientBalance
+		return 0, err
 	}
+	return account.Balance, nil
+}
 
-	// Update the balance
-	var query string
-	var queryArgs []interface{}
-	var result sql.Result
+// Credit adds an amount to an account's balance
+func (tx *sqliteTx) Credit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, false)
+}
 
-	query = "UPDATE accounts SET balance = ? WHERE id = ?"
-	queryArgs = []interface{}{newBalance, id}
+// Debit subtracts an amount from an account's balance
+func (tx *sqliteTx) Debit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, true)
+}
 
-	// Use the transaction if one is active
-	if s.tx != nil {
-		result, err = s.tx.Exec(query, queryArgs...)
-	} else {
-		result, err = s.db.Exec(query, queryArgs...)
+// updateBalance debits or credits an account's balance
+func (tx *sqliteTx) updateBalance(ctx context.Context, id int, amount uint64, debit bool) error {
+	// Get the current balance
+	account, err := tx.GetAccount(ctx, id)
+	if err == ErrAccountNotFound && !debit && amount > 0 {
+		// If the account doesn't exist and it is credited, create it
+		return tx.insertAccount(ctx, id, amount)
 	}
-
 	if err != nil {
-		return fmt.Errorf("failed to update account balance: %w", err)
+		return err
 	}
 
-	// Check if the update was successful
-	rowsAffected, err := result.RowsAffected()
+	// Check that the balance stays representable
+	newBalance, err := changeBalance(account.Balance, amount, debit)
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
-	if rowsAffected == 0 {
-		return ErrAccountNotFound
+		return err
 	}
 
+	// Update the balance
+	_, err = tx.tx.ExecContext(ctx, "UPDATE accounts SET balance = ? WHERE id = ?", sqliteBalance(newBalance), id)
+	if err != nil {
+		return fmt.Errorf("failed to update account balance: %w", sqliteError(err))
+	}
 	return nil
 }
 
 // CreateAccount creates a new account
-func (s *SQLiteStorage) CreateAccount(id int, initialBalance int) error {
-	if !s.initialized {
-		return ErrNotInitialized
-	}
-
+func (tx *sqliteTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
 	// Check if the account already exists
-	exists, err := s.AccountExists(id)
+	exists, err := tx.AccountExists(ctx, id)
 	if err != nil {
 		return err
 	}
 	if exists {
 		return ErrAccountAlreadyExists
 	}
+	return tx.insertAccount(ctx, id, initialBalance)
+}
 
-	// Create the account
-	var query string
-	var queryArgs []interface{}
-	var result sql.Result
-
-	query = "INSERT INTO accounts (id, balance) VALUES (?, ?)"
-	queryArgs = []interface{}{id, initialBalance}
-
-	// Use the transaction if one is active
-	if s.tx != nil {
-		result, err = s.tx.Exec(query, queryArgs...)
-	} else {
-		result, err = s.db.Exec(query, queryArgs...)
+// CreateAccounts creates new accounts with one statement per
+// sqliteBatchRows accounts, once it checked that none exists
+func (tx *sqliteTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	if tx.done {
+		return ErrTransactionDone
 	}
-
+	ids, err := newAccountIDs(accounts)
 	if err != nil {
-		return fmt.Errorf("failed to create account: %w", err)
+		return err
 	}
 
-	// Check if the insert was successful
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("failed to create account: no rows affected")
+	for start := 0; start < len(ids); start += sqliteBatchRows {
+		chunk := ids[start:min(start+sqliteBatchRows, len(ids))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		query := "SELECT id FROM accounts WHERE id IN (?" + strings.Repeat(", ?", len(chunk)-1) + ") LIMIT 1"
+		var id int
+		err := tx.tx.QueryRowContext(ctx, query, args...).Scan(&id)
+		if err == nil {
+			return fmt.Errorf("%w: account %d", ErrAccountAlreadyExists, id)
+		}
+		if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to query accounts: %w", sqliteError(err))
+		}
 	}
 
+	for start := 0; start < len(accounts); start += sqliteBatchRows {
+		chunk := accounts[start:min(start+sqliteBatchRows, len(accounts))]
+		args := make([]interface{}, 0, 2*len(chunk))
+		for _, acc := range chunk {
+			args = append(args, acc.ID, sqliteBalance(acc.Balance))
+		}
+		query := "INSERT INTO accounts (id, balance) VALUES (?, ?)" + strings.Repeat(", (?, ?)", len(chunk)-1)
+		if _, err := tx.tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to create accounts: %w", sqliteError(err))
+		}
+	}
 	return nil
 }
 
-// Commit commits any pending changes
-func (s *SQLiteStorage) Commit() error {
-	if !s.initialized {
-		return ErrNotInitialized
-	}
-
-	// If no transaction is active, nothing to commit
-	if s.tx == nil {
-		return nil
-	}
-
-	// Commit the transaction
-	if err := s.tx.Commit(); err != nil {
-		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
+// insertAccount inserts an account known not to exist
+func (tx *sqliteTx) insertAccount(ctx context.Context, id int, balance uint64) error {
+	_, err := tx.tx.ExecContext(ctx, "INSERT INTO accounts (id, balance) VALUES (?, ?)", id, sqliteBalance(balance))
+	if err != nil {
+		return fmt.Errorf("failed to create account: %w", sqliteError(err))
 	}
-
-	// Clear the transaction
-	s.tx = nil
-
 	return nil
 }
 
-// Rollback rolls back any pending changes
-func (s *SQLiteStorage) Rollback() error {
-	if !s.initialized {
-		return ErrNotInitialized
+// ApplyTransfers applies a batch of transfers with one statement reading the
+// accounts and one writing their new balances
+func (tx *sqliteTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
+	}
+
+	// Read the balances of the accounts used by the batch
+	ids := transferAccounts(transfers)
+	balances := make(map[int]uint64, len(ids))
+	for start := 0; start < len(ids); start += sqliteBatchRows {
+		chunk := ids[start:min(start+sqliteBatchRows, len(ids))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		query := "SELECT id, balance FROM accounts WHERE id IN (?" + strings.Repeat(", ?", len(chunk)-1) + ")"
+		rows, err := tx.tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts: %w", sqliteError(err))
+		}
+		for rows.Next() {
+			var id int
+			var balance sqliteBalance
+			if err := rows.Scan(&id, &balance); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan account: %w", err)
+			}
+			balances[id] = uint64(balance)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error iterating accounts: %w", err)
+		}
 	}
 
-	// If no transaction is active, nothing to rollback
-	if s.tx == nil {
-		return nil
-	}
+	results, changed := planTransfers(balances, transfers, mode)
 
-	// Rollback the transaction
-	if err := s.tx.Rollback(); err != nil {
-		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
+	// Write the new balances, creating the accounts credited for the first time
+	changedIDs := make([]int, 0, len(changed))
+	for id := range changed {
+		changedIDs = append(changedIDs, id)
 	}
-
-	// Clear the transaction
-	s.tx = nil
-
-	return nil
+	for start := 0; start < len(changedIDs); start += sqliteBatchRows {
+		chunk := changedIDs[start:min(start+sqliteBatchRows, len(changedIDs))]
+		args := make([]interface{}, 0, 2*len(chunk))
+		for _, id := range chunk {
+			args = append(args, id, sqliteBalance(changed[id]))
+		}
+		query := "INSERT INTO accounts (id, balance) VALUES (?, ?)" + strings.Repeat(", (?, ?)", len(chunk)-1) +
+			" ON CONFLICT (id) DO UPDATE SET balance = excluded.balance"
+		if _, err := tx.tx.ExecContext(ctx, query, args...); err != nil {
+			return nil, fmt.Errorf("failed to update account balances: %w", sqliteError(err))
+		}
+	}
+	return results, nil
 }
 
-// BeginTransaction begins a new transaction
-func (s *SQLiteStorage) BeginTransaction() error {
-	if !s.initialized {
-		return ErrNotInitialized
-	}
+// sqliteIdentifier quotes a name for use as an SQL identifier
+func sqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
 
-	// If a transaction is already active, commit it first
-	if s.tx != nil {
-		if err := s.Commit(); err != nil {
-			return err
-		}
+// Savepoint creates an SQLite savepoint
+func (tx *sqliteTx) Savepoint(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
 	}
-
-	// Start a new transaction
-	tx, err := s.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+	if _, err := tx.tx.ExecContext(ctx, "SAVEPOINT "+sqliteIdentifier(name)); err != nil {
+		return fmt.Errorf("failed to create savepoint %s: %w", name, sqliteError(err))
 	}
-
-	s.tx = tx
+	tx.savepoints = append(tx.savepoints, name)
 	return nil
 }
 
-// GetBalance gets an account's current balance
-func (s *SQLiteStorage) GetBalance(id int) (int, error) {
-	account, err := s.GetAccount(id)
-	if err != nil {
-		return 0, err
+// RollbackTo rolls back to an SQLite savepoint, which SQLite keeps while
+// releasing the savepoints created after it
+func (tx *sqliteTx) RollbackTo(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
 	}
-	return account.Balance, nil
+	i := lastSavepoint(tx.savepoints, name)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSavepointNotFound, name)
+	}
+	if _, err := tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+sqliteIdentifier(name)); err != nil {
+		return fmt.Errorf("failed to roll back to savepoint %s: %w", name, sqliteError(err))
+	}
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
 }
 
-// GetAllAccounts gets all accounts
-func (s *SQLiteStorage) GetAllAccounts() ([]*types.Account, error) {
-	if !s.initialized {
-		return nil, ErrNotInitialized
+// Commit commits the transaction
+func (tx *sqliteTx) Commit(ctx context.Context) error {
+	if tx.done {
+		return ErrTransactionDone
 	}
+	tx.done = true
 
-	var query string
-	var rows *sql.Rows
-	var err error
-
-	query = "SELECT id, balance FROM accounts"
-
-	// Use the transaction if one is active
-	if s.tx != nil {
-		rows, err = s.tx.Query(query)
-	} else {
-		rows, err = s.db.Query(query)
+	if err := ctx.Err(); err != nil {
+		tx.tx.Rollback()
+		return err
 	}
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to query accounts: %w", err)
+	if err := tx.tx.Commit(); err != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionFailed, sqliteError(err))
 	}
-	defer rows.Close()
+	return nil
+}
 
-	// Parse the accounts
-	var accounts []*types.Account
-	for rows.Next() {
-		var account types.Account
-		if err := rows.Scan(&account.ID, &account.Balance); err != nil {
-			return nil, fmt.Errorf("failed to scan account: %w", err)
-		}
-		accounts = append(accounts, &account)
+// Rollback rolls back the transaction
+func (tx *sqliteTx) Rollback(ctx context.Context) error {
+	if tx.done {
+		return nil
 	}
+	tx.done = true
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating accounts: %w", err)
+	if err := tx.tx.Rollback(); err != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionFailed, err)
 	}
-
-	return accounts, nil
+	return nil
 }
 
 func init() {
 	// Register the SQLite storage backend
-	RegisterStorage("sqlite", NewSQLiteStorage)
+	RegisterContextStorage("sqlite", NewSQLiteStorage)
 }
@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"cmp"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math/big"
 	"path/filepath"
+	"slices"
 	"sync"
 
 	tigerbeetle "github.com/tigerbeetle/tigerbeetle-go"
@@ -12,20 +15,18 @@ import (
 	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
-// TigerBeetleStorage implements the Storage interface using TigerBeetle
+// TigerBeetleStorage implements the ContextStorage interface using TigerBeetle
 type TigerBeetleStorage struct {
+	autoCommit
 	client      tigerbeetle.Client
 	initialized bool
 	addresses   []string
 	clusterID   tbtypes.Uint128
 	mutex       sync.RWMutex
-	accounts    map[int]*types.Account // Cache for accounts
-	txAccounts  map[int]*types.Account // Accounts in the current transaction
-	inTx        bool
 }
 
 // NewTigerBeetleStorage creates a new TigerBeetle storage instance
-func NewTigerBeetleStorage(config map[string]interface{}) (Storage, error) {
+func NewTigerBeetleStorage(config map[string]interface{}) (ContextStorage, error) {
 	// Get the addresses from config
 	addressesInterface, ok := config["addresses"]
 	if !ok {
@@ -74,22 +75,25 @@ func NewTigerBeetleStorage(config map[string]interface{}) (Storage, error) {
 		}
 	}
 
-	return &TigerBeetleStorage{
-		addresses:  addresses,
-		clusterID:  clusterID,
-		accounts:   make(map[int]*types.Account),
-		txAccounts: make(map[int]*types.Account),
-	}, nil
+	s := &TigerBeetleStorage{
+		addresses: addresses,
+		clusterID: clusterID,
+	}
+	s.autoCommit = autoCommit{begin: s.Begin}
+	return s, nil
 }
 
 // Initialize initializes the storage
-func (s *TigerBeetleStorage) Initialize() error {
+func (s *TigerBeetleStorage) Initialize(ctx context.Context) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if s.initialized {
 		return ErrAlreadyInitialized
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Create a TigerBeetle client
 	client, err := tigerbeetle.NewClient(s.clusterID, s.addresses)
@@ -111,10 +115,6 @@ func (s *TigerBeetleStorage) Close() error {
 		return ErrNotInitialized
 	}
 
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
 	// Close the client
 	s.client.Close()
 	s.client = nil
@@ -129,179 +129,96 @@ func accountID(id int) tbtypes.Uint128 {
 	return tbtypes.BytesToUint128(bytes)
 }
 
-// GetAccount retrieves an account by ID
-func (s *TigerBeetleStorage) GetAccount(id int) (*types.Account, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	if !s.initialized {
-		return nil, ErrNotInitialized
-	}
-
-	// If in a transaction, check the transaction accounts first
-	if s.inTx {
-		if acc, exists := s.txAccounts[id]; exists {
-			return acc, nil
-		}
-	}
-
-	// Check the cache
-	if acc, exists := s.accounts[id]; exists {
-		// If in a transaction, make a copy for the transaction
-		if s.inTx {
-			accCopy := &types.Account{
-				ID:      acc.ID,
-				Balance: acc.Balance,
-			}
-			s.txAccounts[id] = accCopy
-			return accCopy, nil
-		}
-		return acc, nil
+// tbAccountID converts a TigerBeetle account ID back to an account ID. It
+// returns false for the system account and the schema version markers.
+func tbAccountID(id tbtypes.Uint128) (int, bool) {
+	bytes := id.Bytes()
+	if binary.BigEndian.Uint64(bytes[:8]) != 0 {
+		return 0, false
 	}
+	accountID := int(binary.BigEndian.Uint64(bytes[8:]))
+	return accountID, accountID != 0
+}
 
-	// Lookup the account in TigerBeetle
-	tbID := accountID(id)
-	accounts, err := s.client.LookupAccounts([]tbtypes.Uint128{tbID})
-	if err != nil {
-		return nil, fmt.Errorf("failed to lookup account: %w", err)
+// tbRequest sends a request to TigerBeetle, returning the context's error once
+// it is done. The client cannot cancel a request, so one the caller gave up
+// on still completes in the background, and a write may still be applied.
+func tbRequest[T any](ctx context.Context, request func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
 	}
 
-	// Check if the account exists
-	if len(accounts) == 0 {
-		return nil, ErrAccountNotFound
+	type response struct {
+		value T
+		err   error
 	}
+	done := make(chan response, 1)
+	go func() {
+		value, err := request()
+		done <- response{value, err}
+	}()
 
-	// Convert the TigerBeetle account to our account type
-	tbAccount := accounts[0]
-
-	// In TigerBeetle, the balance is CreditsPosted - DebitsPosted
-	creditsPosted := tbAccount.CreditsPosted.BigInt()
-	debitsPosted := tbAccount.DebitsPosted.BigInt()
-	balanceBigInt := new(big.Int).Sub(&creditsPosted, &debitsPosted)
-
-	// Convert to int (assuming balance fits in int)
-	balance := int(balanceBigInt.Int64())
-
-	account := &types.Account{
-		ID:      id,
-		Balance: balance,
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
 	}
+}
 
-	// Cache the account
-	s.accounts[id] = account
-
-	// If in a transaction, make a copy for the transaction
-	if s.inTx {
-		accCopy := &types.Account{
-			ID:      account.ID,
-			Balance: account.Balance,
-		}
-		s.txAccounts[id] = accCopy
-		return accCopy, nil
-	}
+// maxTigerBeetleSchemaVersion bounds the schema versions looked up
+const maxTigerBeetleSchemaVersion = 64
 
-	return account, nil
+// schemaVersionID returns the ID of the account marking a schema version.
+// Accounts are immutable apart from their balances, so each version has its
+// own marker account, with the high byte set so it cannot collide with accountID.
+func schemaVersionID(version int) tbtypes.Uint128 {
+	var bytes [16]byte
+	bytes[0] = 0xff
+	binary.BigEndian.PutUint64(bytes[8:], uint64(version))
+	return tbtypes.BytesToUint128(bytes)
 }
 
-// AccountExists checks if an account exists
-func (s *TigerBeetleStorage) AccountExists(id int) (bool, error) {
+// Begin starts a transaction, whose changes are kept in memory until it
+// commits. Commit fails with ErrTransactionConflict when the balance of an
+// account the transaction read changed since. TigerBeetle cannot make the
+// check and the write atomic, so a commit from another client may still come
+// in between them.
+func (s *TigerBeetleStorage) Begin(ctx context.Context) (ContextTx, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return false, ErrNotInitialized
-	}
-
-	// If in a transaction, check the transaction accounts first
-	if s.inTx {
-		if _, exists := s.txAccounts[id]; exists {
-			return true, nil
-		}
-	}
-
-	// Check the cache
-	if _, exists := s.accounts[id]; exists {
-		return true, nil
-	}
-
-	// Lookup the account in TigerBeetle
-	tbID := accountID(id)
-	accounts, err := s.client.LookupAccounts([]tbtypes.Uint128{tbID})
-	if err != nil {
-		return false, fmt.Errorf("failed to lookup account: %w", err)
+		return nil, ErrNotInitialized
 	}
-
-	return len(accounts) > 0, nil
+	return newBufferedTx(s), nil
 }
 
-// UpdateBalance updates an account's balance
-func (s *TigerBeetleStorage) UpdateBalance(id int, delta int) error {
-	if !s.initialized {
-		return ErrNotInitialized
-	}
-
-	// Get the account
-	account, err := s.GetAccount(id)
-	if err != nil {
-		// If account doesn't exist, create it with the delta as initial balance
-		// (only if delta is positive)
-		if err == ErrAccountNotFound && delta > 0 {
-			return s.CreateAccount(id, delta)
-		}
-		return err
-	}
-
-	// Check if the balance would go negative
-	newBalance := account.Balance + delta
-	if newBalance < 0 {
-		return ErrInsufficientBalance
-	}
-
-	// Update the balance
-	account.Balance = newBalance
+// loadAccounts returns the accounts among ids that exist in TigerBeetle
+func (s *TigerBeetleStorage) loadAccounts(ctx context.Context, ids []int) (map[int]*types.Account, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	// If in a transaction, just update the transaction account
-	if s.inTx {
-		s.txAccounts[id] = account
-		return nil
+	if !s.initialized {
+		return nil, ErrNotInitialized
 	}
 
-	// Create a transfer to update the balance
-	transfer := tbtypes.Transfer{
-		ID:              tbtypes.ToUint128(uint64(id)),
-		DebitAccountID:  accountID(0), // System account
-		CreditAccountID: accountID(id),
-		Amount:          tbtypes.ToUint128(uint64(delta)),
-		PendingID:       tbtypes.ToUint128(0),
-		UserData128:     tbtypes.ToUint128(0),
-		UserData64:      0,
-		UserData32:      0,
-		Timeout:         0,
-		Ledger:          0,
-		Code:            0,
-		Flags:           0,
-		Timestamp:       0,
-	}
-
-	// Execute the transfer
-	result, err := s.client.CreateTransfers([]tbtypes.Transfer{transfer})
+	balances, err := s.lookupBalances(ctx, ids)
 	if err != nil {
-		return fmt.Errorf("failed to update account balance: %w", err)
+		return nil, err
 	}
-
-	// Check for errors
-	if len(result) > 0 {
-		return fmt.Errorf("failed to update account balance: %v", result[0])
+	accounts := make(map[int]*types.Account, len(balances))
+	for id, balance := range balances {
+		accounts[id] = &types.Account{ID: id, Balance: balance}
 	}
-
-	// Update the cache
-	s.accounts[id] = account
-
-	return nil
+	return accounts, nil
 }
 
-// CreateAccount creates a new account
-func (s *TigerBeetleStorage) CreateAccount(id int, initialBalance int) error {
+// storeAccounts checks that the accounts read by a transaction still have
+// the balances it read, then creates the new accounts and submits the
+// balance changes as one chain of linked transfers
+func (s *TigerBeetleStorage) storeAccounts(ctx context.Context, read, written map[int]*types.Account) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -309,248 +226,338 @@ func (s *TigerBeetleStorage) CreateAccount(id int, initialBalance int) error {
 		return ErrNotInitialized
 	}
 
-	// Check if account already exists
-	exists, err := s.AccountExists(id)
+	// Check the accounts read
+	ids := make([]int, 0, len(read))
+	for id := range read {
+		ids = append(ids, id)
+	}
+	current, err := s.lookupBalances(ctx, ids)
 	if err != nil {
 		return err
 	}
-	if exists {
-		return ErrAccountAlreadyExists
-	}
-
-	// Create the account
-	account := &types.Account{
-		ID:      id,
-		Balance: initialBalance,
+	for id, acc := range read {
+		balance, exists := current[id]
+		if exists != (acc != nil) || (exists && balance != acc.Balance) {
+			return fmt.Errorf("%w: account %d changed", ErrTransactionConflict, id)
+		}
 	}
 
-	// If in a transaction, just store the account in the transaction
-	if s.inTx {
-		s.txAccounts[id] = account
-		return nil
+	// Create the new accounts, with their balances transferred to them
+	var created []tbtypes.Account
+	for id := range written {
+		if read[id] == nil {
+			created = append(created, tbtypes.Account{ID: accountID(id)})
+		}
 	}
-
-	// Create a TigerBeetle account
-	tbAccount := tbtypes.Account{
-		ID:             accountID(id),
-		DebitsPending:  tbtypes.ToUint128(0),
-		DebitsPosted:   tbtypes.ToUint128(0),
-		CreditsPending: tbtypes.ToUint128(0),
-		CreditsPosted:  tbtypes.ToUint128(uint64(initialBalance)),
-		UserData128:    tbtypes.ToUint128(0),
-		UserData64:     0,
-		UserData32:     0,
-		Reserved:       0,
-		Ledger:         0,
-		Code:           0,
-		Flags:          0,
-		Timestamp:      0,
+	if len(created) > 0 {
+		events, err := tbRequest(ctx, func() ([]tbtypes.AccountEventResult, error) {
+			return s.client.CreateAccounts(created)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create account: %w", err)
+		}
+		for _, event := range events {
+			if event.Result != tbtypes.AccountExists {
+				return fmt.Errorf("failed to create account: %v", event)
+			}
+		}
 	}
 
-	// Create the account in TigerBeetle
-	result, err := s.client.CreateAccounts([]tbtypes.Account{tbAccount})
-	if err != nil {
-		return fmt.Errorf("failed to create account: %w", err)
+	// Change the balances in one chain, applied as a whole or not at all
+	var batch []tbtypes.Transfer
+	for id, acc := range written {
+		var from uint64
+		if read[id] != nil {
+			from = read[id].Balance
+		}
+		if acc.Balance != from {
+			batch = append(batch, balanceTransfer(id, from, acc.Balance))
+		}
 	}
-
-	// Check for errors
-	if len(result) > 0 {
-		return fmt.Errorf("failed to create account: %v", result[0])
+	if len(batch) > 0 {
+		for i := range batch[:len(batch)-1] {
+			batch[i].Flags = tbtypes.TransferFlags{Linked: true}.ToUint16()
+		}
+		events, err := tbRequest(ctx, func() ([]tbtypes.TransferEventResult, error) {
+			return s.client.CreateTransfers(batch)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update account balances: %w", err)
+		}
+		if len(events) > 0 {
+			// Report the transfer that failed the chain
+			cause := events[0]
+			for _, event := range events {
+				if event.Result != tbtypes.TransferLinkedEventFailed {
+					cause = event
+					break
+				}
+			}
+			return fmt.Errorf("%w: %v", ErrTransactionFailed, cause)
+		}
 	}
-
-	// Cache the account
-	s.accounts[id] = account
-
 	return nil
 }
 
-// Commit commits any pending changes
-func (s *TigerBeetleStorage) Commit() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// tbQueryLimit is the number of accounts queried at once, the most
+// TigerBeetle returns for one request with its default batch size
+const tbQueryLimit = 8189
+
+// ListAccounts returns a page of accounts ordered by ID. TigerBeetle only
+// queries accounts in the order they were created, so every page scans all
+// the accounts, keeping the ones from startID on.
+func (s *TigerBeetleStorage) ListAccounts(ctx context.Context, startID, limit int) ([]*types.Account, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return ErrNotInitialized
+		return nil, ErrNotInitialized
 	}
 
-	// If not in a transaction, nothing to commit
-	if !s.inTx {
-		return nil
-	}
-
-	// Create accounts that don't exist
-	for id, account := range s.txAccounts {
-		if _, exists := s.accounts[id]; !exists {
-			// Create a TigerBeetle account
-			tbAccount := tbtypes.Account{
-				ID:             accountID(id),
-				DebitsPending:  tbtypes.ToUint128(0),
-				DebitsPosted:   tbtypes.ToUint128(0),
-				CreditsPending: tbtypes.ToUint128(0),
-				CreditsPosted:  tbtypes.ToUint128(uint64(account.Balance)),
-				UserData128:    tbtypes.ToUint128(0),
-				UserData64:     0,
-				UserData32:     0,
-				Reserved:       0,
-				Ledger:         0,
-				Code:           0,
-				Flags:          0,
-				Timestamp:      0,
+	var accounts []*types.Account
+	filter := tbtypes.QueryFilter{Limit: tbQueryLimit}
+	for {
+		batch, err := tbRequest(ctx, func() ([]tbtypes.Account, error) {
+			return s.client.QueryAccounts(filter)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts: %w", err)
+		}
+		for _, account := range batch {
+			id, ok := tbAccountID(account.ID)
+			if !ok || id < startID {
+				continue
 			}
-
-			// Create the account in TigerBeetle
-			result, err := s.client.CreateAccounts([]tbtypes.Account{tbAccount})
+			balance, err := tbBalance(account)
 			if err != nil {
-				return fmt.Errorf("failed to create account: %w", err)
-			}
-
-			// Check for errors
-			if len(result) > 0 {
-				return fmt.Errorf("failed to create account: %v", result[0])
-			}
-		} else {
-			// Update the account balance
-			delta := account.Balance - s.accounts[id].Balance
-			if delta != 0 {
-				// Create a transfer to update the balance
-				transfer := tbtypes.Transfer{
-					ID:              tbtypes.ToUint128(uint64(id)),
-					DebitAccountID:  accountID(0), // System account
-					CreditAccountID: accountID(id),
-					Amount:          tbtypes.ToUint128(uint64(delta)),
-					PendingID:       tbtypes.ToUint128(0),
-					UserData128:     tbtypes.ToUint128(0),
-					UserData64:      0,
-					UserData32:      0,
-					Timeout:         0,
-					Ledger:          0,
-					Code:            0,
-					Flags:           0,
-					Timestamp:       0,
-				}
-
-				// Execute the transfer
-				result, err := s.client.CreateTransfers([]tbtypes.Transfer{transfer})
-				if err != nil {
-					return fmt.Errorf("failed to update account balance: %w", err)
-				}
-
-				// Check for errors
-				if len(result) > 0 {
-					return fmt.Errorf("failed to update account balance: %v", result[0])
-				}
+				return nil, fmt.Errorf("account %d: %w", id, err)
 			}
+			accounts = append(accounts, &types.Account{ID: id, Balance: balance})
 		}
-
-		// Update the cache
-		s.accounts[id] = account
+		if len(batch) < tbQueryLimit {
+			break
+		}
+		filter.TimestampMin = batch[len(batch)-1].Timestamp + 1
 	}
 
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
-	return nil
+	slices.SortFunc(accounts, func(a, b *types.Account) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if limit > 0 && len(accounts) > limit {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
 }
 
-// Rollback rolls back any pending changes
-func (s *TigerBeetleStorage) Rollback() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// SchemaVersion returns the version of the stored data layout, the highest
+// version with a marker account
+func (s *TigerBeetleStorage) SchemaVersion(ctx context.Context) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	if !s.initialized {
-		return ErrNotInitialized
+		return 0, ErrNotInitialized
 	}
 
-	// If not in a transaction, nothing to rollback
-	if !s.inTx {
-		return nil
+	ids := make([]tbtypes.Uint128, maxTigerBeetleSchemaVersion)
+	for i := range ids {
+		ids[i] = schemaVersionID(i + 1)
+	}
+	markers, err := tbRequest(ctx, func() ([]tbtypes.Account, error) {
+		return s.client.LookupAccounts(ids)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
 	}
 
-	// Clear transaction state
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = false
-
-	return nil
+	version := 0
+	for _, marker := range markers {
+		if v := int(marker.UserData32); v > version {
+			version = v
+		}
+	}
+	return version, nil
 }
 
-// BeginTransaction begins a new transaction
-func (s *TigerBeetleStorage) BeginTransaction() error {
+// SetSchemaVersion records the version of the stored data layout
+func (s *TigerBeetleStorage) SetSchemaVersion(ctx context.Context, version int) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if !s.initialized {
 		return ErrNotInitialized
 	}
+	if version <= 0 || version > maxTigerBeetleSchemaVersion {
+		return fmt.Errorf("%w: schema version %d out of range", ErrInvalidConfiguration, version)
+	}
 
-	// If already in a transaction, commit it first
-	if s.inTx {
-		// Apply transaction changes to the main accounts
-		for id, acc := range s.txAccounts {
-			s.accounts[id] = acc
-		}
+	marker := tbtypes.Account{
+		ID:         schemaVersionID(version),
+		UserData32: uint32(version),
 	}
+	result, err := tbRequest(ctx, func() ([]tbtypes.AccountEventResult, error) {
+		return s.client.CreateAccounts([]tbtypes.Account{marker})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	// The marker may already exist from an earlier run
+	if len(result) > 0 && result[0].Result != tbtypes.AccountExists {
+		return fmt.Errorf("failed to set schema version: %v", result[0])
+	}
+	return nil
+}
 
-	// Start a new transaction
-	s.txAccounts = make(map[int]*types.Account)
-	s.inTx = true
+// tbBalance returns the balance of a TigerBeetle account, CreditsPosted -
+// DebitsPosted. TigerBeetle amounts have 128 bits, so a balance that does
+// not fit in 64 bits fails with ErrBalanceOverflow.
+func tbBalance(account tbtypes.Account) (uint64, error) {
+	creditsPosted := account.CreditsPosted.BigInt()
+	debitsPosted := account.DebitsPosted.BigInt()
+	balance := new(big.Int).Sub(&creditsPosted, &debitsPosted)
+	if !balance.IsUint64() {
+		return 0, fmt.Errorf("%w: balance %s", ErrBalanceOverflow, balance)
+	}
+	return balance.Uint64(), nil
+}
 
-	return nil
+// balanceTransfer returns a transfer between the system account and an
+// account that changes its balance from one amount to another
+func balanceTransfer(id int, from, to uint64) tbtypes.Transfer {
+	transfer := tbtypes.Transfer{
+		ID:              tbtypes.ID(),
+		DebitAccountID:  accountID(0), // System account
+		CreditAccountID: accountID(id),
+		Amount:          tbtypes.ToUint128(to - from),
+	}
+	if to < from {
+		transfer.DebitAccountID, transfer.CreditAccountID = transfer.CreditAccountID, transfer.DebitAccountID
+		transfer.Amount = tbtypes.ToUint128(from - to)
+	}
+	return transfer
+}
+
+// transferResultError maps the result of a TigerBeetle transfer to an error
+func transferResultError(result tbtypes.CreateTransferResult) error {
+	switch result {
+	case tbtypes.TransferLinkedEventFailed:
+		return ErrTransferAborted
+	case tbtypes.TransferExceedsCredits:
+		return ErrInsufficientBalance
+	case tbtypes.TransferDebitAccountNotFound, tbtypes.TransferCreditAccountNotFound:
+		return ErrAccountNotFound
+	case tbtypes.TransferAccountsMustBeDifferent:
+		return ErrInvalidTransfer
+	default:
+		return fmt.Errorf("%w: %v", ErrTransactionFailed, result)
+	}
 }
 
-// GetBalance gets an account's current balance
-func (s *TigerBeetleStorage) GetBalance(id int) (int, error) {
-	account, err := s.GetAccount(id)
+// lookupBalances returns the balances of the accounts that exist in TigerBeetle
+func (s *TigerBeetleStorage) lookupBalances(ctx context.Context, ids []int) (map[int]uint64, error) {
+	tbIDs := make([]tbtypes.Uint128, len(ids))
+	byTBID := make(map[tbtypes.Uint128]int, len(ids))
+	for i, id := range ids {
+		tbIDs[i] = accountID(id)
+		byTBID[tbIDs[i]] = id
+	}
+	accounts, err := tbRequest(ctx, func() ([]tbtypes.Account, error) {
+		return s.client.LookupAccounts(tbIDs)
+	})
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("failed to lookup accounts: %w", err)
 	}
-	return account.Balance, nil
+
+	balances := make(map[int]uint64, len(accounts))
+	for _, account := range accounts {
+		balance, err := tbBalance(account)
+		if err != nil {
+			return nil, fmt.Errorf("account %d: %w", byTBID[account.ID], err)
+		}
+		balances[byTBID[account.ID]] = balance
+	}
+	return balances, nil
 }
 
-// GetAllAccounts gets all accounts
-func (s *TigerBeetleStorage) GetAllAccounts() ([]*types.Account, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+// ApplyTransfers applies a batch of transfers with a single CreateTransfers
+// request, whose transfers are linked into one chain in atomic mode. The
+// accounts have no balance limits in TigerBeetle, so the batch is first
+// checked against their balances, looked up in one request. In a
+// transaction, the batch is applied to the transaction accounts and written
+// on commit, as changes of their balances.
+func (s *TigerBeetleStorage) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	if !s.initialized {
 		return nil, ErrNotInitialized
 	}
 
-	// TigerBeetle doesn't have a way to get all accounts, so we just return the cached accounts
-	accounts := make([]*types.Account, 0, len(s.accounts))
+	balances, err := s.lookupBalances(ctx, transferAccounts(transfers))
+	if err != nil {
+		return nil, err
+	}
+	results, changed := planTransfers(balances, transfers, mode)
+	if len(changed) == 0 {
+		return results, nil
+	}
 
-	// If in a transaction, use the transaction state
-	if s.inTx {
-		// Start with all accounts from the main state
-		accountMap := make(map[int]*types.Account)
-		for id, acc := range s.accounts {
-			// Make a copy to avoid modifying the original
-			accountMap[id] = &types.Account{
-				ID:      acc.ID,
-				Balance: acc.Balance,
-			}
+	// Create the accounts credited for the first time. In atomic mode, they
+	// remain if the transfers fail.
+	var created []tbtypes.Account
+	for id := range changed {
+		if _, exists := balances[id]; !exists {
+			created = append(created, tbtypes.Account{ID: accountID(id)})
 		}
-
-		// Apply transaction changes
-		for id, acc := range s.txAccounts {
-			accountMap[id] = acc
+	}
+	if len(created) > 0 {
+		events, err := tbRequest(ctx, func() ([]tbtypes.AccountEventResult, error) {
+			return s.client.CreateAccounts(created)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create account: %w", err)
 		}
+		for _, event := range events {
+			if event.Result != tbtypes.AccountExists {
+				return nil, fmt.Errorf("failed to create account: %v", event)
+			}
+		}
+	}
 
-		// Convert map to slice
-		for _, acc := range accountMap {
-			accounts = append(accounts, acc)
+	// Submit the transfers that passed the check
+	batch := make([]tbtypes.Transfer, 0, len(transfers))
+	indexes := make([]int, 0, len(transfers))
+	for i, t := range transfers {
+		if results[i].Err != nil {
+			continue
 		}
-	} else {
-		// Just use the main state
-		for _, acc := range s.accounts {
-			accounts = append(accounts, acc)
+		batch = append(batch, tbtypes.Transfer{
+			ID:              tbtypes.ID(),
+			DebitAccountID:  accountID(t.From),
+			CreditAccountID: accountID(t.To),
+			Amount:          tbtypes.ToUint128(t.Amount),
+		})
+		indexes = append(indexes, i)
+	}
+	if mode == TransfersAtomic {
+		for i := range batch[:len(batch)-1] {
+			batch[i].Flags = tbtypes.TransferFlags{Linked: true}.ToUint16()
 		}
 	}
+	events, err := tbRequest(ctx, func() ([]tbtypes.TransferEventResult, error) {
+		return s.client.CreateTransfers(batch)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transfers: %w", err)
+	}
+	for _, event := range events {
+		results[indexes[event.Index]].Err = transferResultError(event.Result)
+	}
 
-	return accounts, nil
+	return results, nil
 }
 
 func init() {
 	// Register the TigerBeetle storage backend
-	RegisterStorage("tigerbeetle", NewTigerBeetleStorage)
+	RegisterContextStorage("tigerbeetle", NewTigerBeetleStorage)
 }
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// Transfer moves an amount from one account to another
+type Transfer struct {
+	From   int
+	To     int
+	Amount uint64
+}
+
+// TransferMode selects what ApplyTransfers does when some transfers fail
+type TransferMode int
+
+const (
+	// TransfersAtomic applies every transfer or, when one fails, none of them
+	TransfersAtomic TransferMode = iota
+	// TransfersPartial applies the transfers that succeed, in order, and
+	// skips the others
+	TransfersPartial
+)
+
+// String returns the name of the mode
+func (m TransferMode) String() string {
+	if m == TransfersPartial {
+		return "partial"
+	}
+	return "atomic"
+}
+
+// TransferResult is the outcome of one transfer passed to ApplyTransfers
+type TransferResult struct {
+	// Err is nil when the transfer was applied. ErrInvalidTransfer,
+	// ErrAccountNotFound, ErrInsufficientBalance and ErrBalanceOverflow
+	// reject a transfer, and ErrTransferAborted marks the transfers of an
+	// atomic batch that were not applied because another one failed.
+	Err error
+}
+
+// transferAccounts returns the accounts used by a batch of transfers, sorted
+func transferAccounts(transfers []Transfer) []int {
+	seen := make(map[int]bool, 2*len(transfers))
+	ids := make([]int, 0, 2*len(transfers))
+	for _, t := range transfers {
+		for _, id := range []int{t.From, t.To} {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// planTransfers runs a batch of transfers against the balances of the
+// existing accounts it uses, and returns the result of every transfer along
+// with the final balances of the accounts changed by the applied ones. The
+// balances passed in are not modified.
+func planTransfers(balances map[int]uint64, transfers []Transfer, mode TransferMode) ([]TransferResult, map[int]uint64) {
+	results := make([]TransferResult, len(transfers))
+	changed := make(map[int]uint64)
+	balance := func(id int) (uint64, bool) {
+		if b, ok := changed[id]; ok {
+			return b, true
+		}
+		b, ok := balances[id]
+		return b, ok
+	}
+
+	failed := false
+	for i, t := range transfers {
+		from, exists := balance(t.From)
+		to, _ := balance(t.To)
+		credited, err := types.AddAmounts(to, t.Amount)
+		switch {
+		case t.Amount == 0 || t.From == t.To:
+			results[i].Err = ErrInvalidTransfer
+		case !exists:
+			results[i].Err = ErrAccountNotFound
+		case from < t.Amount:
+			results[i].Err = ErrInsufficientBalance
+		case err != nil:
+			results[i].Err = ErrBalanceOverflow
+		default:
+			changed[t.From] = from - t.Amount
+			changed[t.To] = credited
+			continue
+		}
+		failed = true
+	}
+
+	// A failure aborts the whole of an atomic batch
+	if failed && mode == TransfersAtomic {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = ErrTransferAborted
+			}
+		}
+		return results, nil
+	}
+	return results, changed
+}
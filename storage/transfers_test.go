@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+// checkBalances fails unless the accounts have the given balances
+func checkBalances(t *testing.T, s ContextStorage, want map[int]uint64) {
+	t.Helper()
+
+	for id, balance := range want {
+		got, err := s.GetBalance(context.Background(), id)
+		if err != nil || got != balance {
+			t.Errorf("Account %d has balance %d (%v), want %d", id, got, err, balance)
+		}
+	}
+}
+
+// checkMissing fails unless the accounts do not exist
+func checkMissing(t *testing.T, s ContextStorage, ids ...int) {
+	t.Helper()
+
+	for _, id := range ids {
+		if balance, err := s.GetBalance(context.Background(), id); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("Account %d exists with balance %d (%v)", id, balance, err)
+		}
+	}
+}
+
+func testApplyTransfers(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one, two, three, four := b.id(1), b.id(2), b.id(3), b.id(4)
+	if err := s.CreateAccount(ctx, one, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second transfer spends funds received by the first, and
+	// the third overdraws, which aborts the atomic batch
+	batch := []Transfer{{From: one, To: two, Amount: 60}, {From: two, To: three, Amount: 50}, {From: one, To: three, Amount: 50}}
+	results, err := s.ApplyTransfers(ctx, batch, TransfersAtomic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []error{ErrTransferAborted, ErrTransferAborted, ErrInsufficientBalance} {
+		if !errors.Is(results[i].Err, want) {
+			t.Errorf("Transfer %d: got %v, want %v", i, results[i].Err, want)
+		}
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 100}))
+	checkMissing(t, s, two, three)
+
+	// In partial mode, the transfers that succeed are applied
+	batch = append(batch, Transfer{From: four, To: one, Amount: 1}, Transfer{From: one, To: one, Amount: 1})
+	results, err = s.ApplyTransfers(ctx, batch, TransfersPartial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []error{nil, nil, ErrInsufficientBalance, ErrAccountNotFound, ErrInvalidTransfer} {
+		if !errors.Is(results[i].Err, want) {
+			t.Errorf("Transfer %d: got %v, want %v", i, results[i].Err, want)
+		}
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 40, 2: 10, 3: 50}))
+	checkMissing(t, s, four)
+
+	// Inside a transaction, the batch is rolled back with it
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = tx.ApplyTransfers(ctx, []Transfer{{From: three, To: one, Amount: 50}}, TransfersAtomic)
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("Transfer failed: %v, %v", err, results)
+	}
+	if balance, err := tx.GetBalance(ctx, one); err != nil || balance != 90 {
+		t.Errorf("Transaction sees balance %d (%v), want 90", balance, err)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 40, 3: 50}))
+}
+
+func testBalanceOverflow(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one, two := b.id(1), b.id(2)
+
+	// The largest balance is stored and read back whole
+	if err := s.CreateAccount(ctx, one, math.MaxUint64); err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := s.GetBalance(ctx, one); err != nil || balance != math.MaxUint64 {
+		t.Fatalf("Got balance %d (%v), want %d", balance, err, uint64(math.MaxUint64))
+	}
+	if err := s.CreateAccount(ctx, two, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Credits that would wrap the balance around are rejected
+	if err := s.Credit(ctx, one, 1); !errors.Is(err, ErrBalanceOverflow) {
+		t.Errorf("Overflowing credit: got %v, want %v", err, ErrBalanceOverflow)
+	}
+	if err := s.Debit(ctx, two, 11); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Overdrawing debit: got %v, want %v", err, ErrInsufficientBalance)
+	}
+	results, err := s.ApplyTransfers(ctx, []Transfer{{From: two, To: one, Amount: 5}}, TransfersPartial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[0].Err, ErrBalanceOverflow) {
+		t.Errorf("Overflowing transfer: got %v, want %v", results[0].Err, ErrBalanceOverflow)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: math.MaxUint64, 2: 10}))
+}
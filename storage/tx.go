@@ -0,0 +1,538 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
+)
+
+// ContextTx is a transaction of a ContextStorage, started by Begin. Its
+// changes are only seen by its own calls until Commit. A transaction is used
+// by one goroutine at a time, but any number of them may be open at once; how
+// they are isolated from each other depends on the backend:
+//
+//   - memory and Redis buffer the changes until Commit, which fails with
+//     ErrTransactionConflict when an account the transaction read was
+//     changed by another commit since, so transactions are serializable
+//   - BadgerDB transactions are serializable snapshots, checked on Commit
+//     like the memory ones. They hold a bounded number of writes, past which
+//     a write fails with ErrTransactionTooLarge.
+//   - SQLite transactions read a snapshot and take the single write lock of
+//     the database on their first write, waiting for the transaction that
+//     holds it. A write fails with ErrTransactionConflict once another
+//     transaction committed since the snapshot.
+//   - PostgreSQL transactions run at the configured isolation level.
+//     Serializable ones fail with ErrTransactionConflict when they conflict
+//     with another transaction, while read committed ones only wait for the
+//     rows they update.
+//   - TigerBeetle buffers the changes like memory, but the accounts are
+//     checked just before they are written, so a commit from another client
+//     can still slip in between
+type ContextTx interface {
+	// GetAccount retrieves an account by ID
+	GetAccount(ctx context.Context, id int) (*types.Account, error)
+
+	// AccountExists checks if an account exists
+	AccountExists(ctx context.Context, id int) (bool, error)
+
+	// GetBalance gets an account's current balance
+	GetBalance(ctx context.Context, id int) (uint64, error)
+
+	// Credit adds an amount to an account's balance, creating the account
+	// if it doesn't exist. It fails with ErrBalanceOverflow rather than wrap
+	// the balance around.
+	Credit(ctx context.Context, id int, amount uint64) error
+
+	// Debit subtracts an amount from an account's balance, failing with
+	// ErrInsufficientBalance if the balance is lower
+	Debit(ctx context.Context, id int, amount uint64) error
+
+	// CreateAccount creates a new account
+	CreateAccount(ctx context.Context, id int, initialBalance uint64) error
+
+	// CreateAccounts creates new accounts with the IDs and balances of
+	// accounts at once. It creates none of them and fails with
+	// ErrAccountAlreadyExists when one exists or appears twice.
+	CreateAccounts(ctx context.Context, accounts []*types.Account) error
+
+	// ApplyTransfers applies a batch of transfers, see ContextStorage
+	ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error)
+
+	// Savepoint marks the changes made so far under a name, which
+	// RollbackTo returns to. A name used again marks a new savepoint,
+	// hiding the earlier one until RollbackTo discards it.
+	Savepoint(ctx context.Context, name string) error
+
+	// RollbackTo discards the changes made since the latest savepoint with
+	// the name, along with the savepoints marked after it, and keeps the
+	// savepoint itself. It fails with ErrSavepointNotFound for an unknown name.
+	RollbackTo(ctx context.Context, name string) error
+
+	// Commit makes the changes visible to the other transactions. The
+	// transaction ends even when it fails, without any of its changes.
+	Commit(ctx context.Context) error
+
+	// Rollback discards the changes. It must succeed even once the context
+	// is done, so a cancelled caller can release its transaction, and it
+	// does nothing once the transaction ended, so it can be deferred.
+	Rollback(ctx context.Context) error
+}
+
+// Tx is a transaction of a Storage, see ContextTx
+type Tx interface {
+	// GetAccount retrieves an account by ID
+	GetAccount(id int) (*types.Account, error)
+
+	// AccountExists checks if an account exists
+	AccountExists(id int) (bool, error)
+
+	// GetBalance gets an account's current balance
+	GetBalance(id int) (uint64, error)
+
+	// Credit adds an amount to an account's balance, creating the account
+	// if it doesn't exist
+	Credit(id int, amount uint64) error
+
+	// Debit subtracts an amount from an account's balance
+	Debit(id int, amount uint64) error
+
+	// CreateAccount creates a new account
+	CreateAccount(id int, initialBalance uint64) error
+
+	// CreateAccounts creates new accounts at once, or none of them
+	CreateAccounts(accounts []*types.Account) error
+
+	// ApplyTransfers applies a batch of transfers
+	ApplyTransfers(transfers []Transfer, mode TransferMode) ([]TransferResult, error)
+
+	// Savepoint marks the changes made so far under a name
+	Savepoint(name string) error
+
+	// RollbackTo discards the changes made since a savepoint
+	RollbackTo(name string) error
+
+	// Commit makes the changes visible to the other transactions
+	Commit() error
+
+	// Rollback discards the changes, doing nothing once the transaction ended
+	Rollback() error
+}
+
+// autoCommitAttempts is how many times a call made outside a transaction is
+// run when it conflicts with transactions committed meanwhile
+const autoCommitAttempts = 10
+
+// autoCommit implements the calls a ContextStorage accepts outside a
+// transaction by running each in a transaction of its own
+type autoCommit struct {
+	begin func(ctx context.Context) (ContextTx, error)
+}
+
+// run runs a function in a new transaction, committed when it succeeds, and
+// runs it again when the commit conflicts with another transaction
+func (a autoCommit) run(ctx context.Context, f func(tx ContextTx) error) error {
+	var err error
+	for attempt := 0; attempt < autoCommitAttempts; attempt++ {
+		var tx ContextTx
+		if tx, err = a.begin(ctx); err != nil {
+			return err
+		}
+		if err = f(tx); err == nil {
+			err = tx.Commit(ctx)
+		} else {
+			tx.Rollback(ctx)
+		}
+		if !errors.Is(err, ErrTransactionConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// GetAccount retrieves an account by ID
+func (a autoCommit) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	var account *types.Account
+	err := a.run(ctx, func(tx ContextTx) (err error) {
+		account, err = tx.GetAccount(ctx, id)
+		return err
+	})
+	return account, err
+}
+
+// AccountExists checks if an account exists
+func (a autoCommit) AccountExists(ctx context.Context, id int) (bool, error) {
+	var exists bool
+	err := a.run(ctx, func(tx ContextTx) (err error) {
+		exists, err = tx.AccountExists(ctx, id)
+		return err
+	})
+	return exists, err
+}
+
+// GetBalance gets an account's current balance
+func (a autoCommit) GetBalance(ctx context.Context, id int) (uint64, error) {
+	var balance uint64
+	err := a.run(ctx, func(tx ContextTx) (err error) {
+		balance, err = tx.GetBalance(ctx, id)
+		return err
+	})
+	return balance, err
+}
+
+// Credit adds an amount to an account's balance
+func (a autoCommit) Credit(ctx context.Context, id int, amount uint64) error {
+	return a.run(ctx, func(tx ContextTx) error {
+		return tx.Credit(ctx, id, amount)
+	})
+}
+
+// Debit subtracts an amount from an account's balance
+func (a autoCommit) Debit(ctx context.Context, id int, amount uint64) error {
+	return a.run(ctx, func(tx ContextTx) error {
+		return tx.Debit(ctx, id, amount)
+	})
+}
+
+// CreateAccount creates a new account
+func (a autoCommit) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	return a.run(ctx, func(tx ContextTx) error {
+		return tx.CreateAccount(ctx, id, initialBalance)
+	})
+}
+
+// ApplyTransfers applies a batch of transfers in a transaction of its own
+func (a autoCommit) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	var results []TransferResult
+	err := a.run(ctx, func(tx ContextTx) (err error) {
+		results, err = tx.ApplyTransfers(ctx, transfers, mode)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// accountStore is implemented by the backends whose transactions are
+// bufferedTx, keeping their changes in memory until they commit
+type accountStore interface {
+	// loadAccounts returns the committed accounts among ids, leaving out
+	// the ones that do not exist
+	loadAccounts(ctx context.Context, ids []int) (map[int]*types.Account, error)
+
+	// storeAccounts writes the accounts changed by a transaction, failing
+	// with ErrTransactionConflict unless the accounts it read, nil for the
+	// ones that did not exist, are still the committed ones
+	storeAccounts(ctx context.Context, read, written map[int]*types.Account) error
+}
+
+// newAccountIDs returns the IDs of accounts to create, failing with
+// ErrAccountAlreadyExists when one appears twice
+func newAccountIDs(accounts []*types.Account) ([]int, error) {
+	seen := make(map[int]bool, len(accounts))
+	ids := make([]int, len(accounts))
+	for i, acc := range accounts {
+		if seen[acc.ID] {
+			return nil, fmt.Errorf("%w: account %d appears twice", ErrAccountAlreadyExists, acc.ID)
+		}
+		seen[acc.ID] = true
+		ids[i] = acc.ID
+	}
+	return ids, nil
+}
+
+// sameAccount reports whether two versions of an account, nil when it does
+// not exist, are equal
+func sameAccount(a, b *types.Account) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// bufferedTx is a transaction reading the committed accounts of an
+// accountStore the first time it uses them, and writing its changes when it
+// commits. The changes are kept in layers, a new one starting at every
+// savepoint, so rolling back to a savepoint drops the layers above it.
+type bufferedTx struct {
+	store      accountStore
+	read       map[int]*types.Account   // Committed accounts as first read, nil if missing
+	layers     []map[int]*types.Account // Accounts changed by the transaction, the latest layer last
+	savepoints []string                 // Name of the savepoint starting each layer but the first
+	done       bool
+}
+
+// newBufferedTx starts a transaction of an accountStore
+func newBufferedTx(store accountStore) *bufferedTx {
+	return &bufferedTx{
+		store:  store,
+		read:   make(map[int]*types.Account),
+		layers: []map[int]*types.Account{make(map[int]*types.Account)},
+	}
+}
+
+// written returns the latest version of an account changed by the transaction
+func (tx *bufferedTx) written(id int) (*types.Account, bool) {
+	for i := len(tx.layers) - 1; i >= 0; i-- {
+		if acc, exists := tx.layers[i][id]; exists {
+			return acc, true
+		}
+	}
+	return nil, false
+}
+
+// write records a change of an account in the latest layer
+func (tx *bufferedTx) write(acc *types.Account) {
+	tx.layers[len(tx.layers)-1][acc.ID] = acc
+}
+
+// changes returns the accounts changed by the transaction, merging the layers
+func (tx *bufferedTx) changes() map[int]*types.Account {
+	if len(tx.layers) == 1 {
+		return tx.layers[0]
+	}
+	changes := make(map[int]*types.Account)
+	for _, layer := range tx.layers {
+		for id, acc := range layer {
+			changes[id] = acc
+		}
+	}
+	return changes
+}
+
+// accounts returns the accounts among ids as the transaction sees them, nil
+// for the ones that do not exist, loading the ones it has not read yet in
+// one request
+func (tx *bufferedTx) accounts(ctx context.Context, ids []int) (map[int]*types.Account, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
+	}
+
+	var missing []int
+	for _, id := range ids {
+		if _, seen := tx.read[id]; !seen {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		found, err := tx.store.loadAccounts(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range missing {
+			tx.read[id] = found[id]
+		}
+	}
+
+	accounts := make(map[int]*types.Account, len(ids))
+	for _, id := range ids {
+		if acc, exists := tx.written(id); exists {
+			accounts[id] = acc
+		} else {
+			accounts[id] = tx.read[id]
+		}
+	}
+	return accounts, nil
+}
+
+// account returns an account as the transaction sees it, nil if it does not exist
+func (tx *bufferedTx) account(ctx context.Context, id int) (*types.Account, error) {
+	accounts, err := tx.accounts(ctx, []int{id})
+	if err != nil {
+		return nil, err
+	}
+	return accounts[id], nil
+}
+
+// GetAccount retrieves an account by ID
+func (tx *bufferedTx) GetAccount(ctx context.Context, id int) (*types.Account, error) {
+	acc, err := tx.account(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		return nil, ErrAccountNotFound
+	}
+	return acc.Copy(), nil
+}
+
+// AccountExists checks if an account exists
+func (tx *bufferedTx) AccountExists(ctx context.Context, id int) (bool, error) {
+	acc, err := tx.account(ctx, id)
+	return acc != nil, err
+}
+
+// GetBalance gets an account's current balance
+func (tx *bufferedTx) GetBalance(ctx context.Context, id int) (uint64, error) {
+	acc, err := tx.GetAccount(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return acc.Balance, nil
+}
+
+// Credit adds an amount to an account's balance
+func (tx *bufferedTx) Credit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, false)
+}
+
+// Debit subtracts an amount from an account's balance
+func (tx *bufferedTx) Debit(ctx context.Context, id int, amount uint64) error {
+	return tx.updateBalance(ctx, id, amount, true)
+}
+
+// updateBalance debits or credits an account's balance
+func (tx *bufferedTx) updateBalance(ctx context.Context, id int, amount uint64, debit bool) error {
+	acc, err := tx.account(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// If account doesn't exist, create it with the amount as initial
+	// balance (only if it is credited)
+	if acc == nil {
+		if debit || amount == 0 {
+			return ErrAccountNotFound
+		}
+		tx.write(&types.Account{ID: id, Balance: amount})
+		return nil
+	}
+
+	// Check that the balance stays representable
+	newBalance, err := changeBalance(acc.Balance, amount, debit)
+	if err != nil {
+		return err
+	}
+
+	// Update a copy of the account, leaving the one read intact
+	acc = acc.Copy()
+	acc.Balance = newBalance
+	tx.write(acc)
+	return nil
+}
+
+// CreateAccount creates a new account
+func (tx *bufferedTx) CreateAccount(ctx context.Context, id int, initialBalance uint64) error {
+	acc, err := tx.account(ctx, id)
+	if err != nil {
+		return err
+	}
+	if acc != nil {
+		return ErrAccountAlreadyExists
+	}
+
+	tx.write(&types.Account{ID: id, Balance: initialBalance})
+	return nil
+}
+
+// CreateAccounts creates new accounts, reading the ones it has not read yet
+// in one request
+func (tx *bufferedTx) CreateAccounts(ctx context.Context, accounts []*types.Account) error {
+	ids, err := newAccountIDs(accounts)
+	if err != nil {
+		return err
+	}
+	existing, err := tx.accounts(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if existing[id] != nil {
+			return fmt.Errorf("%w: account %d", ErrAccountAlreadyExists, id)
+		}
+	}
+
+	for _, acc := range accounts {
+		tx.write(&types.Account{ID: acc.ID, Balance: acc.Balance})
+	}
+	return nil
+}
+
+// ApplyTransfers applies a batch of transfers to the transaction
+func (tx *bufferedTx) ApplyTransfers(ctx context.Context, transfers []Transfer, mode TransferMode) ([]TransferResult, error) {
+	accounts, err := tx.accounts(ctx, transferAccounts(transfers))
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make(map[int]uint64, len(accounts))
+	for id, acc := range accounts {
+		if acc != nil {
+			balances[id] = acc.Balance
+		}
+	}
+	results, changed := planTransfers(balances, transfers, mode)
+
+	// Write copies of the accounts to the transaction
+	for id, balance := range changed {
+		account := &types.Account{ID: id}
+		if acc := accounts[id]; acc != nil {
+			account = acc.Copy()
+		}
+		account.Balance = balance
+		tx.write(account)
+	}
+	return results, nil
+}
+
+// Commit writes the changes of the transaction
+func (tx *bufferedTx) Commit(ctx context.Context) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+
+	// A single account read is consistent on its own
+	changes := tx.changes()
+	if len(changes) == 0 && len(tx.read) <= 1 {
+		return nil
+	}
+	return tx.store.storeAccounts(ctx, tx.read, changes)
+}
+
+// Savepoint starts a new layer of changes
+func (tx *bufferedTx) Savepoint(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.layers = append(tx.layers, make(map[int]*types.Account))
+	tx.savepoints = append(tx.savepoints, name)
+	return nil
+}
+
+// RollbackTo drops the layers of changes made since a savepoint. The
+// accounts read meanwhile stay read, so they are still checked on commit.
+func (tx *bufferedTx) RollbackTo(ctx context.Context, name string) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	i := lastSavepoint(tx.savepoints, name)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSavepointNotFound, name)
+	}
+
+	// Layer i+1 starts at the savepoint, and is kept empty
+	tx.layers = tx.layers[:i+2]
+	tx.layers[i+1] = make(map[int]*types.Account)
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// lastSavepoint returns the index of the latest savepoint with a name, or -1
+func lastSavepoint(savepoints []string, name string) int {
+	for i := len(savepoints) - 1; i >= 0; i-- {
+		if savepoints[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rollback discards the changes of the transaction
+func (tx *bufferedTx) Rollback(ctx context.Context) error {
+	tx.done = true
+	return nil
+}
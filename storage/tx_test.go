@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func testRollback(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one, two := b.id(1), b.id(2)
+	if err := s.CreateAccount(ctx, one, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolling back discards every change of the transaction, including the
+	// accounts it created
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Debit(ctx, one, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.CreateAccount(ctx, two, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 100}))
+	checkMissing(t, s, two)
+
+	// A transaction ends with its rollback, and rolling back again does nothing
+	if err := tx.Credit(ctx, one, 1); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Call after rollback: got %v, want %v", err, ErrTransactionDone)
+	}
+	if err := tx.Commit(ctx); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Commit after rollback: got %v, want %v", err, ErrTransactionDone)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Errorf("Second rollback failed: %v", err)
+	}
+
+	// Beginning a transaction leaves the others open
+	first, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Credit(ctx, one, 5); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 105}))
+}
+
+func testCommitVisibility(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	one, two := b.id(1), b.id(2)
+	if err := s.CreateAccount(ctx, one, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are only seen by the transaction until it commits
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Debit(ctx, one, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Credit(ctx, two, 30); err != nil {
+		t.Fatal(err)
+	}
+	checkTxBalances(t, tx, b.balances(map[int]uint64{1: 70, 2: 30}))
+	checkBalances(t, s, b.balances(map[int]uint64{1: 100}))
+	checkMissing(t, s, two)
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 70, 2: 30}))
+
+	// A transaction ends with its commit, and can still be rolled back
+	if _, err := tx.GetBalance(ctx, one); !errors.Is(err, ErrTransactionDone) {
+		t.Errorf("Call after commit: got %v, want %v", err, ErrTransactionDone)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Errorf("Rollback after commit failed: %v", err)
+	}
+
+	// Of two transactions updating the same account, the second
+	// to write fails once the first committed
+	first, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Rollback(ctx)
+	if _, err := first.GetBalance(ctx, one); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Debit(ctx, one, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err = first.Debit(ctx, one, 20)
+	if err == nil {
+		err = first.Commit(ctx)
+	}
+	if !errors.Is(err, ErrTransactionConflict) {
+		t.Errorf("Conflicting transaction: got %v, want %v", err, ErrTransactionConflict)
+	}
+	checkBalances(t, s, b.balances(map[int]uint64{1: 60, 2: 30}))
+}
+
+func testConcurrency(t *testing.T, b *backendTest) {
+	ctx := context.Background()
+	s := b.open(t)
+	for n := 1; n <= 4; n++ {
+		if err := s.CreateAccount(ctx, b.id(n), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every goroutine moves funds around the accounts, retrying the
+	// transactions that conflict
+	const workers, transfers = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < transfers; i++ {
+				from, to := b.id(1+(w+i)%4), b.id(1+(w+i+1)%4)
+				for {
+					err := transfer(ctx, s, from, to, 1)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrTransactionConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every transfer was applied once, so no funds were created or lost
+	var total uint64
+	for n := 1; n <= 4; n++ {
+		balance, err := s.GetBalance(ctx, b.id(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += balance
+	}
+	if total != 4000 {
+		t.Errorf("Accounts hold %d in total, want 4000", total)
+	}
+}
+
+// transfer moves an amount between two accounts in a transaction
+func transfer(ctx context.Context, s ContextStorage, from, to int, amount uint64) error {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := tx.Debit(ctx, from, amount); err != nil {
+		return err
+	}
+	if err := tx.Credit(ctx, to, amount); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
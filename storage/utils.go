@@ -2,6 +2,8 @@ package storage
 
 import (
 	"os"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types"
 )
 
 // createDirIfNotExists creates a directory if it doesn't exist
@@ -15,3 +17,15 @@ func createDirIfNotExists(dir string) error {
 	}
 	return nil
 }
+
+// changeBalance returns a balance after debiting or crediting an amount,
+// or ErrInsufficientBalance or ErrBalanceOverflow if it cannot be represented
+func changeBalance(balance uint64, amount uint64, debit bool) (uint64, error) {
+	if debit {
+		if balance < amount {
+			return 0, ErrInsufficientBalance
+		}
+		return balance - amount, nil
+	}
+	return types.AddAmounts(balance, amount)
+}
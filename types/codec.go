@@ -0,0 +1,136 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Names of the built-in transaction codecs
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+	EncodingCompact  = "compact"
+)
+
+// ErrCodecNotFound is returned when a codec is not registered
+var ErrCodecNotFound = errors.New("codec not found")
+
+// Codec encodes and decodes transactions. Every encoded transaction starts
+// with the codec's prefix byte, which ParseTransaction uses to pick the codec.
+type Codec interface {
+	// Name returns the name the codec is registered under
+	Name() string
+
+	// Prefix returns the first byte of every transaction the codec encodes
+	Prefix() byte
+
+	// Encode serializes a transaction, including the prefix byte
+	Encode(tx *Transaction) ([]byte, error)
+
+	// Decode parses a transaction, including the prefix byte
+	Decode(data []byte) (*Transaction, error)
+}
+
+// DefaultCodec is the name of the codec used by Transaction.Serialize
+const DefaultCodec = EncodingJSON
+
+// CodecRegistry keeps track of available transaction codecs by name
+var CodecRegistry = make(map[string]Codec)
+
+// codecsByPrefix maps prefix bytes to the registered codecs
+var codecsByPrefix = make(map[byte]Codec)
+
+// RegisterCodec registers a transaction codec. It panics if another codec
+// already uses the same prefix byte, since transactions could not be told apart.
+func RegisterCodec(codec Codec) {
+	if other, exists := codecsByPrefix[codec.Prefix()]; exists && other.Name() != codec.Name() {
+		panic(fmt.Sprintf("codec %s uses prefix %#x of codec %s", codec.Name(), codec.Prefix(), other.Name()))
+	}
+	if previous, exists := CodecRegistry[codec.Name()]; exists {
+		delete(codecsByPrefix, previous.Prefix())
+	}
+	CodecRegistry[codec.Name()] = codec
+	codecsByPrefix[codec.Prefix()] = codec
+}
+
+// GetCodec returns a codec by name
+func GetCodec(name string) (Codec, error) {
+	codec, exists := CodecRegistry[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrCodecNotFound, name)
+	}
+	return codec, nil
+}
+
+// CodecNames returns the names of the registered codecs, sorted
+func CodecNames() []string {
+	names := make([]string, 0, len(CodecRegistry))
+	for name := range CodecRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonWhitespace holds the bytes JSON allows before a value
+const jsonWhitespace = " \t\r\n"
+
+// ParseTransaction parses a transaction with the codec identified by its
+// first byte, after any leading JSON whitespace
+func ParseTransaction(data []byte) (*Transaction, error) {
+	data = bytes.TrimLeft(data, jsonWhitespace)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("failed to parse transaction: empty data")
+	}
+	codec, exists := codecsByPrefix[data[0]]
+	if !exists {
+		return nil, fmt.Errorf("failed to parse transaction: unknown encoding prefix %#x", data[0])
+	}
+	return codec.Decode(data)
+}
+
+// Serialize serializes a transaction with the default codec
+func (tx *Transaction) Serialize() ([]byte, error) {
+	return tx.SerializeAs(DefaultCodec)
+}
+
+// SerializeAs serializes a transaction with the named codec
+func (tx *Transaction) SerializeAs(name string) ([]byte, error) {
+	codec, err := GetCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Encode(tx)
+}
+
+// jsonCodec encodes transactions as JSON objects, which always start with '{'
+type jsonCodec struct{}
+
+// Name returns the name of the codec
+func (jsonCodec) Name() string { return EncodingJSON }
+
+// Prefix returns the first byte of every encoded transaction
+func (jsonCodec) Prefix() byte { return '{' }
+
+// Encode serializes a transaction to JSON
+func (jsonCodec) Encode(tx *Transaction) ([]byte, error) {
+	return json.Marshal(tx)
+}
+
+// Decode parses a JSON transaction
+func (jsonCodec) Decode(data []byte) (*Transaction, error) {
+	var tx Transaction
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction: %w", err)
+	}
+	return &tx, nil
+}
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(protobufCodec{})
+	RegisterCodec(compactCodec{})
+}
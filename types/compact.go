@@ -0,0 +1,255 @@
+package types
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CompactPrefix is the version byte that starts every compact-encoded transaction
+const CompactPrefix byte = 0x02
+
+// The compact encoding is a hand-rolled binary format built for throughput:
+//
+//	prefix       byte (CompactPrefix)
+//	flags        byte: bit 0 batch signature, bit 1 aggregate signature
+//	sender       varint, only with a batch signature
+//	signature    bytes, only with a batch or aggregate signature
+//	op count     uvarint
+//	operations
+//
+// Each operation is a header byte holding the operation type in its low
+// four bits and a limits flag in bit 4, followed by from and to (varints),
+// amount and nonce (uvarints), expiry (varint), the limits if flagged (max
+// amount per window as a uvarint, then two varints) and the signature.
+// Signatures are stored raw, as a uvarint length followed by the bytes,
+// instead of base64.
+//
+// Transfers decode with an empty type, whether or not it was set, which
+// leaves their sign bytes unchanged.
+
+// Transaction flags of the compact encoding
+const (
+	compactFlagBatch     byte = 1 << 0
+	compactFlagAggregate byte = 1 << 1
+)
+
+// compactFlagLimits marks operations that carry limits
+const compactFlagLimits byte = 1 << 4
+
+// compactOpTypes maps operation types to their compact codes; the index is the code
+var compactOpTypes = []string{OpTypeTransfer, OpTypeMint, OpTypeBurn, OpTypeSetLimits}
+
+// errCompactTruncated is returned when compact data ends in the middle of a field
+var errCompactTruncated = errors.New("truncated data")
+
+// compactCodec encodes transactions in the compact binary format
+type compactCodec struct{}
+
+// Name returns the name of the codec
+func (compactCodec) Name() string { return EncodingCompact }
+
+// Prefix returns the first byte of every encoded transaction
+func (compactCodec) Prefix() byte { return CompactPrefix }
+
+// Encode serializes a transaction to the compact format
+func (compactCodec) Encode(tx *Transaction) ([]byte, error) {
+	// Most of an operation is its 64-byte signature
+	buf := make([]byte, 0, 2+len(tx.Operations)*80)
+	buf = append(buf, CompactPrefix)
+
+	var flags byte
+	if tx.IsBatchSigned() {
+		flags |= compactFlagBatch
+	}
+	if tx.IsAggregateSigned() {
+		flags |= compactFlagAggregate
+	}
+	buf = append(buf, flags)
+
+	var err error
+	if tx.IsBatchSigned() {
+		buf = binary.AppendVarint(buf, int64(tx.Sender))
+		if buf, err = appendCompactSignature(buf, tx.Signature); err != nil {
+			return nil, fmt.Errorf("invalid batch signature: %w", err)
+		}
+	}
+	if tx.IsAggregateSigned() {
+		if buf, err = appendCompactSignature(buf, tx.AggregateSignature); err != nil {
+			return nil, fmt.Errorf("invalid aggregate signature: %w", err)
+		}
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(tx.Operations)))
+	for i := range tx.Operations {
+		op := &tx.Operations[i]
+
+		// Header byte with the type code and limits flag
+		header, err := compactOpType(op.OpType())
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		if op.Limits != nil {
+			header |= compactFlagLimits
+		}
+		buf = append(buf, header)
+
+		buf = binary.AppendVarint(buf, int64(op.From))
+		buf = binary.AppendVarint(buf, int64(op.To))
+		buf = binary.AppendUvarint(buf, op.Amount)
+		buf = binary.AppendUvarint(buf, op.Nonce)
+		buf = binary.AppendVarint(buf, op.Expiry)
+		if op.Limits != nil {
+			buf = binary.AppendUvarint(buf, op.Limits.MaxAmountPerWindow)
+			buf = binary.AppendVarint(buf, op.Limits.WindowBlocks)
+			buf = binary.AppendVarint(buf, int64(op.Limits.MaxOpsPerBlock))
+		}
+		if buf, err = appendCompactSignature(buf, op.Signature); err != nil {
+			return nil, fmt.Errorf("invalid signature in operation %d: %w", i, err)
+		}
+	}
+
+	return buf, nil
+}
+
+// Decode parses a compact transaction
+func (compactCodec) Decode(data []byte) (*Transaction, error) {
+	r := &compactReader{data: data[1:]}
+	tx := &Transaction{}
+
+	flags := r.byte()
+	if flags&compactFlagBatch != 0 {
+		tx.Sender = int(r.varint())
+		tx.Signature = r.signature()
+	}
+	if flags&compactFlagAggregate != 0 {
+		tx.AggregateSignature = r.signature()
+	}
+
+	// Every operation takes at least seven bytes, which bounds the count of a valid transaction
+	count := r.uvarint()
+	if r.err == nil && count > uint64(len(r.data))/7 {
+		return nil, fmt.Errorf("failed to parse transaction: %d operations in %d bytes", count, len(r.data))
+	}
+
+	tx.Operations = make([]Operation, count)
+	for i := range tx.Operations {
+		op := &tx.Operations[i]
+
+		header := r.byte()
+		code := int(header & 0x0f)
+		if r.err == nil && code >= len(compactOpTypes) {
+			return nil, fmt.Errorf("failed to parse transaction: operation %d has unknown type code %d", i, code)
+		}
+		if code > 0 {
+			op.Type = compactOpTypes[code]
+		}
+
+		op.From = int(r.varint())
+		op.To = int(r.varint())
+		op.Amount = r.uvarint()
+		op.Nonce = r.uvarint()
+		op.Expiry = r.varint()
+		if header&compactFlagLimits != 0 {
+			op.Limits = &AccountLimits{
+				MaxAmountPerWindow: r.uvarint(),
+				WindowBlocks:       r.varint(),
+				MaxOpsPerBlock:     int(r.varint()),
+			}
+		}
+		op.Signature = r.signature()
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse transaction: %w", r.err)
+	}
+	if len(r.data) > 0 {
+		return nil, fmt.Errorf("failed to parse transaction: %d trailing bytes", len(r.data))
+	}
+	return tx, nil
+}
+
+// compactOpType returns the compact code of an operation type
+func compactOpType(opType string) (byte, error) {
+	for code, name := range compactOpTypes {
+		if name == opType {
+			return byte(code), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown operation type %q", opType)
+}
+
+// appendCompactSignature appends a base64 signature as length-prefixed raw bytes
+func appendCompactSignature(buf []byte, signature string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(raw)))
+	return append(buf, raw...), nil
+}
+
+// compactReader reads the fields of a compact transaction.
+// After the first error, every read returns a zero value and err is kept.
+type compactReader struct {
+	data []byte
+	err  error
+}
+
+// byte reads a single byte
+func (r *compactReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = errCompactTruncated
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+// varint reads a signed varint
+func (r *compactReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errCompactTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// uvarint reads an unsigned varint
+func (r *compactReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errCompactTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// signature reads a length-prefixed raw signature and returns it in base64
+func (r *compactReader) signature() string {
+	length := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(len(r.data)) {
+		r.err = errCompactTruncated
+		return ""
+	}
+	raw := r.data[:length]
+	r.data = r.data[length:]
+	return encodeSignature(raw)
+}
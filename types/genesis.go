@@ -0,0 +1,104 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// GenesisState represents the initial application state passed in InitChain
+type GenesisState struct {
+	MintAuthority  *Authority `json:"mint_authority,omitempty"`
+	AdminAuthority *Authority `json:"admin_authority,omitempty"`
+	SupplyCap      uint64     `json:"supply_cap,omitempty"`
+	Params         *Params    `json:"params,omitempty"` // DefaultParams when unset
+	Accounts       []Account  `json:"accounts,omitempty"`
+}
+
+// GetParams returns the genesis params, or the defaults if they are unset
+func (g *GenesisState) GetParams() Params {
+	if g.Params == nil {
+		return DefaultParams()
+	}
+	return *g.Params
+}
+
+// ParseGenesisState parses the JSON application state from the genesis file.
+// Empty data yields an empty genesis state.
+func ParseGenesisState(data []byte) (*GenesisState, error) {
+	var genesis GenesisState
+	if len(data) == 0 {
+		return &genesis, nil
+	}
+
+	if err := json.Unmarshal(data, &genesis); err != nil {
+		return nil, fmt.Errorf("failed to parse genesis state: %w", err)
+	}
+	return &genesis, nil
+}
+
+// Validate performs basic validation on the genesis state
+func (g *GenesisState) Validate() error {
+	if err := g.MintAuthority.validate("mint"); err != nil {
+		return err
+	}
+	if err := g.AdminAuthority.validate("admin"); err != nil {
+		return err
+	}
+	if err := g.GetParams().Validate(); err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+
+	var total uint64
+	seen := make(map[int]bool, len(g.Accounts))
+	for i, acc := range g.Accounts {
+		if acc.ID <= 0 {
+			return fmt.Errorf("account %d: invalid ID %d", i, acc.ID)
+		}
+		if acc.Limits != nil {
+			if err := acc.Limits.Validate(); err != nil {
+				return fmt.Errorf("account %d: %w", i, err)
+			}
+		}
+		if acc.PubKey != "" || acc.KeyType != "" {
+			if _, err := acc.Key(); err != nil {
+				return fmt.Errorf("account %d: invalid public key: %w", i, err)
+			}
+		}
+		if acc.BLSPubKey != "" {
+			if _, err := acc.BLSKey(); err != nil {
+				return fmt.Errorf("account %d: invalid BLS public key: %w", i, err)
+			}
+		}
+		if seen[acc.ID] {
+			return fmt.Errorf("account %d: duplicate ID %d", i, acc.ID)
+		}
+		seen[acc.ID] = true
+		sum, err := AddAmounts(total, acc.Balance)
+		if err != nil {
+			return fmt.Errorf("account %d: total of genesis balances: %w", i, err)
+		}
+		total = sum
+	}
+	if g.SupplyCap > 0 && total > g.SupplyCap {
+		return fmt.Errorf("genesis balances %d exceed supply cap %d", total, g.SupplyCap)
+	}
+
+	return nil
+}
+
+// validate performs basic validation on an optional authority
+func (a *Authority) validate(name string) error {
+	if a == nil {
+		return nil
+	}
+	if a.AccountID <= 0 {
+		return fmt.Errorf("invalid %s authority account ID %d", name, a.AccountID)
+	}
+	if a.PubKey == "" {
+		return fmt.Errorf("%s authority is missing a public key", name)
+	}
+	if _, err := a.Key(); err != nil {
+		return fmt.Errorf("invalid %s authority key: %w", name, err)
+	}
+	return nil
+}
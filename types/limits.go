@@ -0,0 +1,150 @@
+package types
+
+import (
+	"fmt"
+	"math"
+)
+
+// AccountLimits configures the risk limits of an account. Zero values mean unlimited.
+type AccountLimits struct {
+	MaxAmountPerWindow uint64 `json:"max_amount_per_window,omitempty"` // Maximum amount sent within the window
+	WindowBlocks       int64  `json:"window_blocks,omitempty"`         // Size of the rolling window in blocks
+	MaxOpsPerBlock     int    `json:"max_ops_per_block,omitempty"`     // Maximum number of operations sent per block
+}
+
+// IsZero reports whether the limits impose no restriction
+func (l *AccountLimits) IsZero() bool {
+	return l == nil || (l.MaxAmountPerWindow == 0 && l.MaxOpsPerBlock == 0)
+}
+
+// Validate performs basic validation on the limits
+func (l *AccountLimits) Validate() error {
+	if l.MaxOpsPerBlock < 0 {
+		return fmt.Errorf("invalid max operations per block %d", l.MaxOpsPerBlock)
+	}
+	if l.WindowBlocks < 0 {
+		return fmt.Errorf("invalid window size %d", l.WindowBlocks)
+	}
+	if l.MaxAmountPerWindow > 0 && l.WindowBlocks == 0 {
+		return fmt.Errorf("max amount per window requires a window size")
+	}
+	return nil
+}
+
+// UsageEntry records what an account sent in a single block
+type UsageEntry struct {
+	Height int64  `json:"height"`
+	Amount uint64 `json:"amount"`
+	Ops    int    `json:"ops"`
+}
+
+// WindowUsage returns the amount sent within the window ending at height,
+// and the number of operations sent at height. An amount too large to
+// represent is reported as the largest one.
+func (acc *Account) WindowUsage(height int64) (uint64, int) {
+	var amount uint64
+	ops := 0
+	if acc.Limits == nil {
+		return amount, ops
+	}
+
+	for _, entry := range acc.Usage {
+		if entry.Height > height-acc.Limits.WindowBlocks {
+			amount = SaturatingAdd(amount, entry.Amount)
+		}
+		if entry.Height == height {
+			ops += entry.Ops
+		}
+	}
+	return amount, ops
+}
+
+// SetLimits sets or clears the limits of an account
+func (s *State) SetLimits(id int, limits *AccountLimits, byAdmin bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acc, exists := s.Accounts[id]
+	if !exists {
+		acc = &Account{
+			ID:      id,
+			Balance: 0,
+		}
+		s.Accounts[id] = acc
+	}
+
+	if limits.IsZero() {
+		acc.Limits = nil
+		acc.LimitsByAdmin = false
+		acc.Usage = nil
+		return
+	}
+
+	limitsCopy := *limits
+	acc.Limits = &limitsCopy
+	acc.LimitsByAdmin = byAdmin
+}
+
+// RecordUsage records an amount sent by an account at the given height.
+// Usage is only tracked for accounts with limits, and entries that fall
+// out of the rolling window are pruned.
+func (s *State) RecordUsage(id int, height int64, amount uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acc, exists := s.Accounts[id]
+	if !exists || acc.Limits == nil {
+		return
+	}
+
+	// Prune entries outside the window, keeping the current block for the ops limit
+	window := acc.Limits.WindowBlocks
+	if window < 1 {
+		window = 1
+	}
+	usage := acc.Usage[:0]
+	for _, entry := range acc.Usage {
+		if entry.Height > height-window {
+			usage = append(usage, entry)
+		}
+	}
+
+	// Add to the entry for this height
+	if n := len(usage); n > 0 && usage[n-1].Height == height {
+		usage[n-1].Amount = SaturatingAdd(usage[n-1].Amount, amount)
+		usage[n-1].Ops++
+	} else {
+		usage = append(usage, UsageEntry{Height: height, Amount: amount, Ops: 1})
+	}
+	acc.Usage = usage
+}
+
+// SaturatingAdd adds two amounts, capping the sum at the largest amount. It
+// suits usage totals compared against limits, which must not wrap around.
+func SaturatingAdd(a, b uint64) uint64 {
+	if sum, err := AddAmounts(a, b); err == nil {
+		return sum
+	}
+	return math.MaxUint64
+}
+
+// GetAdminAuthority returns the admin authority, or nil if none is configured
+func (s *State) GetAdminAuthority() *Authority {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.AdminAuthority
+}
+
+// GetHeight returns the height of the last finalized block
+func (s *State) GetHeight() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Height
+}
+
+// SetHeight sets the height of the last finalized block
+func (s *State) SetHeight(height int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Height = height
+}
@@ -0,0 +1,145 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// StateVersion is the version of the persisted state written by this code
+const StateVersion = 2
+
+// StateMigration upgrades a persisted state from version From to From+1.
+// Apply works on the decoded JSON document, since the state types only
+// describe the current version. Numbers are decoded as json.Number.
+type StateMigration struct {
+	From        int
+	Description string
+	Apply       func(doc map[string]interface{}) error
+}
+
+// stateMigrations keeps track of the state migrations by the version they upgrade from
+var stateMigrations = make(map[int]StateMigration)
+
+// RegisterStateMigration registers a state migration
+func RegisterStateMigration(migration StateMigration) {
+	stateMigrations[migration.From] = migration
+}
+
+// PendingStateMigrations returns the migrations that upgrade a state from
+// the given version to StateVersion, in order
+func PendingStateMigrations(version int) ([]StateMigration, error) {
+	if version > StateVersion {
+		return nil, fmt.Errorf("state version %d is newer than the supported version %d", version, StateVersion)
+	}
+
+	var pending []StateMigration
+	for from := version; from < StateVersion; from++ {
+		migration, exists := stateMigrations[from]
+		if !exists {
+			return nil, fmt.Errorf("no state migration from version %d", from)
+		}
+		pending = append(pending, migration)
+	}
+	return pending, nil
+}
+
+// StateVersionOf returns the version of a persisted state, 0 for states saved before versioning
+func StateVersionOf(data []byte) (int, error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, fmt.Errorf("failed to read state version: %w", err)
+	}
+	return header.Version, nil
+}
+
+// MigrateState upgrades a persisted state to StateVersion, one version at a
+// time. It returns the data unchanged if it is already current.
+func MigrateState(data []byte) ([]byte, []StateMigration, error) {
+	version, err := StateVersionOf(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, err := PendingStateMigrations(version)
+	if err != nil || len(pending) == 0 {
+		return data, nil, err
+	}
+
+	// Decode the document, keeping numbers exact
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode state: %w", err)
+	}
+
+	for _, migration := range pending {
+		if err := migration.Apply(doc); err != nil {
+			return nil, nil, fmt.Errorf("state migration from version %d failed: %w", migration.From, err)
+		}
+		doc["version"] = migration.From + 1
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode migrated state: %w", err)
+	}
+	return migrated, pending, nil
+}
+
+// migrateTotalSupply sets the total supply of states saved before supply
+// tracking existed to the sum of their balances
+func migrateTotalSupply(doc map[string]interface{}) error {
+	if supply, exists := doc["total_supply"]; exists && supply != json.Number("0") {
+		return nil
+	}
+
+	accounts, _ := doc["accounts"].(map[string]interface{})
+	var total uint64
+	for id, value := range accounts {
+		acc, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("account %s is not an object", id)
+		}
+		balance, ok := acc["balance"].(json.Number)
+		if !ok {
+			continue
+		}
+		amount, err := strconv.ParseUint(balance.String(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("account %s: invalid balance %s", id, balance)
+		}
+		if total, err = AddAmounts(total, amount); err != nil {
+			return fmt.Errorf("total supply: %w", err)
+		}
+	}
+
+	doc["total_supply"] = total
+	return nil
+}
+
+// migrateParams sets the params of states saved before params existed to
+// DefaultParams. Params set at genesis, even to zero, are kept.
+func migrateParams(doc map[string]interface{}) error {
+	if _, exists := doc["params"]; exists {
+		return nil
+	}
+	doc["params"] = DefaultParams()
+	return nil
+}
+
+func init() {
+	RegisterStateMigration(StateMigration{
+		From:        0,
+		Description: "compute the total supply of states saved before supply tracking",
+		Apply:       migrateTotalSupply,
+	})
+	RegisterStateMigration(StateMigration{
+		From:        1,
+		Description: "set the default params of states saved before params existed",
+		Apply:       migrateParams,
+	})
+}
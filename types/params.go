@@ -0,0 +1,68 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrParamsExceeded is returned when a transaction exceeds the consensus params
+var ErrParamsExceeded = errors.New("transaction exceeds params")
+
+// Params are consensus-level limits on transactions, set at genesis.
+// A zero limit disables it.
+type Params struct {
+	MaxOpsPerTx    int    `json:"max_ops_per_tx"`    // Maximum number of operations in a transaction
+	MaxTxBytes     int    `json:"max_tx_bytes"`      // Maximum size of an encoded transaction
+	MaxAmountPerOp uint64 `json:"max_amount_per_op"` // Maximum amount of a single operation
+}
+
+// DefaultParams returns the params used when the genesis state does not set them
+func DefaultParams() Params {
+	return Params{
+		MaxOpsPerTx: 1000,
+		MaxTxBytes:  1 << 20, // 1 MiB
+	}
+}
+
+// Validate checks that the params are well-formed
+func (p Params) Validate() error {
+	if p.MaxOpsPerTx < 0 {
+		return fmt.Errorf("invalid max ops per tx %d", p.MaxOpsPerTx)
+	}
+	if p.MaxTxBytes < 0 {
+		return fmt.Errorf("invalid max tx bytes %d", p.MaxTxBytes)
+	}
+	return nil
+}
+
+// CheckTxBytes checks the size of an encoded transaction. It is cheap and
+// meant to run before the transaction is decoded.
+func (p Params) CheckTxBytes(size int) error {
+	if p.MaxTxBytes > 0 && size > p.MaxTxBytes {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrParamsExceeded, size, p.MaxTxBytes)
+	}
+	return nil
+}
+
+// CheckTransaction checks the operation count and amounts of a decoded
+// transaction. It does not verify signatures, so it can run before them.
+func (p Params) CheckTransaction(tx *Transaction) error {
+	if p.MaxOpsPerTx > 0 && len(tx.Operations) > p.MaxOpsPerTx {
+		return fmt.Errorf("%w: %d operations (max %d)", ErrParamsExceeded, len(tx.Operations), p.MaxOpsPerTx)
+	}
+	if p.MaxAmountPerOp > 0 {
+		for i := range tx.Operations {
+			if amount := tx.Operations[i].Amount; amount > p.MaxAmountPerOp {
+				return fmt.Errorf("%w: operation %d has amount %d (max %d)", ErrParamsExceeded, i, amount, p.MaxAmountPerOp)
+			}
+		}
+	}
+	return nil
+}
+
+// GetParams returns the consensus params
+func (s *State) GetParams() Params {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Params
+}
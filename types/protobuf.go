@@ -0,0 +1,138 @@
+package types
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/xmonader/test_batched_tx_tendermint/types/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc -I.. --go_out=.. --go_opt=module=github.com/xmonader/test_batched_tx_tendermint ../types/proto/transaction.proto
+
+// ProtobufPrefix is the version byte that starts every protobuf-encoded
+// transaction. JSON transactions start with '{', so the first byte tells
+// the encodings apart while clients migrate from JSON to protobuf.
+const ProtobufPrefix byte = 0x01
+
+// protobufCodec encodes transactions in their protobuf wire format, prefixed with ProtobufPrefix
+type protobufCodec struct{}
+
+// Name returns the name of the codec
+func (protobufCodec) Name() string { return EncodingProtobuf }
+
+// Prefix returns the first byte of every encoded transaction
+func (protobufCodec) Prefix() byte { return ProtobufPrefix }
+
+// Encode serializes a transaction to protobuf
+func (protobufCodec) Encode(tx *Transaction) ([]byte, error) {
+	msg, err := tx.toProto()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.MarshalAppend([]byte{ProtobufPrefix}, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction: %w", err)
+	}
+	return data, nil
+}
+
+// Decode parses a protobuf transaction
+func (protobufCodec) Decode(data []byte) (*Transaction, error) {
+	var msg pb.Transaction
+	if err := proto.Unmarshal(data[1:], &msg); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction: %w", err)
+	}
+	return transactionFromProto(&msg), nil
+}
+
+// toProto converts a transaction to its protobuf message.
+// Base64 signatures are decoded to raw bytes.
+func (tx *Transaction) toProto() (*pb.Transaction, error) {
+	msg := &pb.Transaction{
+		Operations: make([]*pb.Operation, len(tx.Operations)),
+		Sender:     int64(tx.Sender),
+	}
+
+	var err error
+	if msg.Signature, err = decodeSignature(tx.Signature); err != nil {
+		return nil, fmt.Errorf("invalid batch signature: %w", err)
+	}
+	if msg.AggregateSignature, err = decodeSignature(tx.AggregateSignature); err != nil {
+		return nil, fmt.Errorf("invalid aggregate signature: %w", err)
+	}
+
+	for i := range tx.Operations {
+		op := &tx.Operations[i]
+		opMsg := &pb.Operation{
+			Type:   op.Type,
+			From:   int64(op.From),
+			To:     int64(op.To),
+			Amount: op.Amount,
+			Nonce:  op.Nonce,
+			Expiry: op.Expiry,
+		}
+		if op.Limits != nil {
+			opMsg.Limits = &pb.AccountLimits{
+				MaxAmountPerWindow: op.Limits.MaxAmountPerWindow,
+				WindowBlocks:       op.Limits.WindowBlocks,
+				MaxOpsPerBlock:     int64(op.Limits.MaxOpsPerBlock),
+			}
+		}
+		if opMsg.Signature, err = decodeSignature(op.Signature); err != nil {
+			return nil, fmt.Errorf("invalid signature in operation %d: %w", i, err)
+		}
+		msg.Operations[i] = opMsg
+	}
+
+	return msg, nil
+}
+
+// transactionFromProto converts a protobuf message to a transaction
+func transactionFromProto(msg *pb.Transaction) *Transaction {
+	tx := &Transaction{
+		Operations:         make([]Operation, len(msg.Operations)),
+		Sender:             int(msg.Sender),
+		Signature:          encodeSignature(msg.Signature),
+		AggregateSignature: encodeSignature(msg.AggregateSignature),
+	}
+
+	for i, opMsg := range msg.Operations {
+		op := Operation{
+			Type:      opMsg.Type,
+			From:      int(opMsg.From),
+			To:        int(opMsg.To),
+			Amount:    opMsg.Amount,
+			Nonce:     opMsg.Nonce,
+			Expiry:    opMsg.Expiry,
+			Signature: encodeSignature(opMsg.Signature),
+		}
+		if opMsg.Limits != nil {
+			op.Limits = &AccountLimits{
+				MaxAmountPerWindow: opMsg.Limits.MaxAmountPerWindow,
+				WindowBlocks:       opMsg.Limits.WindowBlocks,
+				MaxOpsPerBlock:     int(opMsg.Limits.MaxOpsPerBlock),
+			}
+		}
+		tx.Operations[i] = op
+	}
+
+	return tx
+}
+
+// decodeSignature decodes a base64 signature, returning nil for no signature
+func decodeSignature(signature string) ([]byte, error) {
+	if signature == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(signature)
+}
+
+// encodeSignature encodes a raw signature to base64, returning "" for no signature
+func encodeSignature(signature []byte) string {
+	if len(signature) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
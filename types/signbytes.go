@@ -0,0 +1,84 @@
+package types
+
+import (
+	"encoding/binary"
+)
+
+// SignBytesVersion is the version of the sign bytes format
+const SignBytesVersion byte = 2
+
+// Domain tags separating the kinds of signed messages, so a signature over
+// one kind can never be valid for another
+const (
+	operationSignDomain = "batched-tx/operation"
+	batchSignDomain     = "batched-tx/batch"
+)
+
+// Sign bytes are the canonical encoding of the data covered by a signature.
+// They are built by hand rather than with a general-purpose encoder, so the
+// bytes only change when this format's version does. The layout is:
+//
+//	domain tag   string
+//	version      byte
+//	chain ID     string
+//	body         operation or batch fields
+//
+// Strings are encoded as a uvarint length followed by their bytes, unsigned
+// integers, including amounts, as uvarints and signed integers as zigzag
+// varints.
+//
+// The operation body is: type, from, to, amount, nonce, expiry, then a byte
+// that is 1 if limits follow (max amount per window, window blocks, max ops
+// per block) and 0 otherwise. Transfers are always encoded with type
+// "transfer", whether or not the type field is set.
+//
+// The batch body is: sender, number of operations, then every operation body.
+
+// SignBytes returns the bytes signed for an operation on the given chain
+func (op *Operation) SignBytes(chainID string) []byte {
+	buf := appendSignBytesHeader(nil, operationSignDomain, chainID)
+	return op.appendSignBody(buf)
+}
+
+// BatchSignBytes returns the bytes the sender signs for a batch-signed
+// transaction on the given chain: the sender followed by every operation,
+// in order, without signatures
+func (tx *Transaction) BatchSignBytes(chainID string) []byte {
+	buf := appendSignBytesHeader(nil, batchSignDomain, chainID)
+	buf = binary.AppendVarint(buf, int64(tx.Sender))
+	buf = binary.AppendUvarint(buf, uint64(len(tx.Operations)))
+	for i := range tx.Operations {
+		buf = tx.Operations[i].appendSignBody(buf)
+	}
+	return buf
+}
+
+// appendSignBytesHeader appends the domain tag, version and chain ID
+func appendSignBytesHeader(buf []byte, domain string, chainID string) []byte {
+	buf = appendString(buf, domain)
+	buf = append(buf, SignBytesVersion)
+	return appendString(buf, chainID)
+}
+
+// appendSignBody appends the operation fields covered by a signature
+func (op *Operation) appendSignBody(buf []byte) []byte {
+	buf = appendString(buf, op.OpType())
+	buf = binary.AppendVarint(buf, int64(op.From))
+	buf = binary.AppendVarint(buf, int64(op.To))
+	buf = binary.AppendUvarint(buf, op.Amount)
+	buf = binary.AppendUvarint(buf, op.Nonce)
+	buf = binary.AppendVarint(buf, op.Expiry)
+	if op.Limits == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, 1)
+	buf = binary.AppendUvarint(buf, op.Limits.MaxAmountPerWindow)
+	buf = binary.AppendVarint(buf, op.Limits.WindowBlocks)
+	return binary.AppendVarint(buf, int64(op.Limits.MaxOpsPerBlock))
+}
+
+// appendString appends a length-prefixed string
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
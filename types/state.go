@@ -2,25 +2,107 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"sort"
 	"sync"
+
+	"github.com/xmonader/test_batched_tx_tendermint/crypto"
+)
+
+// Errors returned by the checked balance arithmetic
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrBalanceOverflow     = errors.New("balance overflow")
 )
 
+// AddAmounts adds two amounts, failing with ErrBalanceOverflow instead of
+// wrapping around
+func AddAmounts(a, b uint64) (uint64, error) {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return 0, fmt.Errorf("%w: %d + %d", ErrBalanceOverflow, a, b)
+	}
+	return sum, nil
+}
+
 // Account represents a user account with a balance
 type Account struct {
-	ID      int `json:"id"`
-	Balance int `json:"balance"`
+	ID            int            `json:"id"`
+	Balance       uint64         `json:"balance"`
+	Limits        *AccountLimits `json:"limits,omitempty"`
+	LimitsByAdmin bool           `json:"limits_by_admin,omitempty"` // Limits set by the admin authority cannot be changed by the owner
+	Usage         []UsageEntry   `json:"usage,omitempty"`           // Rolling window of amounts sent, tracked only when limits are set
+	Nonce         uint64         `json:"nonce,omitempty"`           // Last nonce used by the account
+	PubKey        string         `json:"pub_key,omitempty"`         // Base64-encoded key verifying the owner's operations
+	KeyType       string         `json:"key_type,omitempty"`        // Type of PubKey, ed25519 when empty
+	BLSPubKey     string         `json:"bls_pub_key,omitempty"`     // Base64-encoded BLS key verifying aggregate signatures
+}
+
+// Key decodes the public key of the account's owner
+func (acc *Account) Key() (crypto.PubKey, error) {
+	keyType, err := crypto.ParseKeyType(acc.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.PublicKeyFromBase64OfType(keyType, acc.PubKey)
+}
+
+// BLSKey decodes the BLS public key of the account's owner
+func (acc *Account) BLSKey() (crypto.BLSPubKey, error) {
+	return crypto.BLSPublicKeyFromBase64(acc.BLSPubKey)
+}
+
+// Copy returns a deep copy of the account
+func (acc *Account) Copy() *Account {
+	accCopy := *acc
+	if acc.Limits != nil {
+		limits := *acc.Limits
+		accCopy.Limits = &limits
+	}
+	if acc.Usage != nil {
+		accCopy.Usage = append([]UsageEntry(nil), acc.Usage...)
+	}
+	return &accCopy
+}
+
+// Authority identifies an account allowed to perform privileged operations
+type Authority struct {
+	AccountID int    `json:"account_id"`
+	PubKey    string `json:"pub_key"`            // Base64-encoded public key
+	KeyType   string `json:"key_type,omitempty"` // Type of the public key, ed25519 when empty
+}
+
+// Key decodes the authority's public key
+func (a *Authority) Key() (crypto.PubKey, error) {
+	keyType, err := crypto.ParseKeyType(a.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.PublicKeyFromBase64OfType(keyType, a.PubKey)
 }
 
 // State represents the application state
 type State struct {
-	Accounts map[int]*Account `json:"accounts"`
-	mutex    sync.RWMutex     `json:"-"` // Mutex for thread safety, not serialized
+	Version        int              `json:"version"` // StateVersion when saved by this code, see MigrateState
+	Accounts       map[int]*Account `json:"accounts"`
+	ChainID        string           `json:"chain_id,omitempty"` // Chain ID from genesis, part of every signed message
+	Height         int64            `json:"height"`             // Height of the last finalized block
+	AppHash        []byte           `json:"app_hash,omitempty"` // Hash of the state after the last finalized block
+	TotalSupply    uint64           `json:"total_supply"`
+	SupplyCap      uint64           `json:"supply_cap,omitempty"` // Zero means uncapped
+	MintAuthority  *Authority       `json:"mint_authority,omitempty"`
+	AdminAuthority *Authority       `json:"admin_authority,omitempty"` // May configure the limits of any account
+	Params         Params           `json:"params"`                    // Consensus-level transaction limits
+	mutex          sync.RWMutex     `json:"-"`                         // Mutex for thread safety, not serialized
 }
 
 // NewState creates a new application state
 func NewState() *State {
 	return &State{
+		Version:  StateVersion,
 		Accounts: make(map[int]*Account),
 	}
 }
@@ -45,8 +127,33 @@ func (s *State) GetAccount(id int) *Account {
 	return acc
 }
 
-// UpdateBalance updates an account's balance
-func (s *State) UpdateBalance(id int, delta int) error {
+// PeekAccount returns a copy of an account and whether it exists, without
+// creating it. A missing account is returned empty, with only its ID set.
+func (s *State) PeekAccount(id int) (*Account, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if acc, exists := s.Accounts[id]; exists {
+		return acc.Copy(), true
+	}
+	return &Account{ID: id}, false
+}
+
+// GetBalance returns the balance of an account, zero if it doesn't exist
+func (s *State) GetBalance(id int) uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if acc, exists := s.Accounts[id]; exists {
+		return acc.Balance
+	}
+	return 0
+}
+
+// Credit adds an amount to an account's balance, creating the account if
+// it doesn't exist. A balance that would overflow is left unchanged and
+// ErrBalanceOverflow is returned.
+func (s *State) Credit(id int, amount uint64) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -59,15 +166,131 @@ func (s *State) UpdateBalance(id int, delta int) error {
 		s.Accounts[id] = acc
 	}
 
-	newBalance := acc.Balance + delta
-	if newBalance < 0 {
-		return fmt.Errorf("insufficient balance for account %d: %d < %d", id, acc.Balance, -delta)
+	newBalance, err := AddAmounts(acc.Balance, amount)
+	if err != nil {
+		return fmt.Errorf("failed to credit account %d: %w", id, err)
 	}
 
 	acc.Balance = newBalance
 	return nil
 }
 
+// Debit subtracts an amount from an account's balance
+func (s *State) Debit(id int, amount uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acc, exists := s.Accounts[id]
+	if !exists || acc.Balance < amount {
+		var balance uint64
+		if exists {
+			balance = acc.Balance
+		}
+		return fmt.Errorf("%w for account %d: %d < %d", ErrInsufficientBalance, id, balance, amount)
+	}
+
+	acc.Balance -= amount
+	return nil
+}
+
+// Mint creates new tokens in an account and adds them to the total supply
+func (s *State) Mint(id int, amount uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if amount == 0 {
+		return fmt.Errorf("invalid mint amount %d", amount)
+	}
+	totalSupply, err := AddAmounts(s.TotalSupply, amount)
+	if err != nil {
+		return fmt.Errorf("total supply: %w", err)
+	}
+	if s.SupplyCap > 0 && totalSupply > s.SupplyCap {
+		return fmt.Errorf("supply cap exceeded: %d + %d > %d", s.TotalSupply, amount, s.SupplyCap)
+	}
+
+	acc, exists := s.Accounts[id]
+	if !exists {
+		acc = &Account{
+			ID:      id,
+			Balance: 0,
+		}
+		s.Accounts[id] = acc
+	}
+
+	// Balances never exceed the total supply, so the balance cannot overflow
+	acc.Balance += amount
+	s.TotalSupply = totalSupply
+	return nil
+}
+
+// Burn destroys tokens from an account and removes them from the total supply
+func (s *State) Burn(id int, amount uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if amount == 0 {
+		return fmt.Errorf("invalid burn amount %d", amount)
+	}
+
+	acc, exists := s.Accounts[id]
+	if !exists || acc.Balance < amount {
+		var balance uint64
+		if exists {
+			balance = acc.Balance
+		}
+		return fmt.Errorf("%w for account %d: %d < %d", ErrInsufficientBalance, id, balance, amount)
+	}
+
+	acc.Balance -= amount
+	s.TotalSupply -= amount
+	return nil
+}
+
+// GetSupply returns the total supply and the supply cap
+func (s *State) GetSupply() (uint64, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.TotalSupply, s.SupplyCap
+}
+
+// GetMintAuthority returns the mint authority, or nil if minting is disabled
+func (s *State) GetMintAuthority() *Authority {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.MintAuthority
+}
+
+// GetAllAccounts returns a copy of every account, ordered by ID
+func (s *State) GetAllAccounts() []*Account {
+	return s.ListAccounts(math.MinInt, 0)
+}
+
+// ListAccounts returns a copy of up to limit accounts in ascending order of
+// ID, starting with the first one whose ID is at least startID. A limit of
+// zero or less returns all of them.
+func (s *State) ListAccounts(startID, limit int) []*Account {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ids := make([]int, 0, len(s.Accounts))
+	for id := range s.Accounts {
+		if id >= startID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	accounts := make([]*Account, len(ids))
+	for i, id := range ids {
+		accounts[i] = s.Accounts[id].Copy()
+	}
+	return accounts
+}
+
 // Serialize serializes the state to JSON
 func (s *State) Serialize() ([]byte, error) {
 	s.mutex.RLock()
@@ -75,13 +298,17 @@ func (s *State) Serialize() ([]byte, error) {
 	return json.Marshal(s)
 }
 
-// LoadState loads state from JSON
+// LoadState loads state from JSON. States saved with an older version must
+// be upgraded with MigrateState first.
 func LoadState(data []byte) (*State, error) {
 	var state State
 	err := json.Unmarshal(data, &state)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse state: %w", err)
 	}
+	if state.Version != StateVersion {
+		return nil, fmt.Errorf("state version %d does not match the supported version %d", state.Version, StateVersion)
+	}
 
 	// Initialize the mutex
 	state.mutex = sync.RWMutex{}
@@ -105,3 +332,150 @@ func (s *State) String() string {
 	}
 	return string(data)
 }
+
+// GetChainID returns the chain ID signed messages are bound to
+func (s *State) GetChainID() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ChainID
+}
+
+// SetChainID sets the chain ID signed messages are bound to
+func (s *State) SetChainID(chainID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ChainID = chainID
+}
+
+// GetAppHash returns the hash of the state after the last finalized block
+func (s *State) GetAppHash() []byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.AppHash
+}
+
+// SetAppHash sets the hash of the state after the last finalized block
+func (s *State) SetAppHash(appHash []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.AppHash = appHash
+}
+
+// SetPubKey sets the public key of an account's owner, creating the account
+// if it doesn't exist
+func (s *State) SetPubKey(id int, keyType crypto.KeyType, pubKey string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acc, exists := s.Accounts[id]
+	if !exists {
+		acc = &Account{ID: id}
+		s.Accounts[id] = acc
+	}
+	acc.PubKey = pubKey
+	acc.KeyType = string(keyType)
+}
+
+// SetBLSPubKey sets the BLS public key of an account's owner, creating the
+// account if it doesn't exist
+func (s *State) SetBLSPubKey(id int, pubKey string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acc, exists := s.Accounts[id]
+	if !exists {
+		acc = &Account{ID: id}
+		s.Accounts[id] = acc
+	}
+	acc.BLSPubKey = pubKey
+}
+
+// SetNonce records the last nonce used by an account
+func (s *State) SetNonce(id int, nonce uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acc, exists := s.Accounts[id]
+	if !exists {
+		acc = &Account{ID: id}
+		s.Accounts[id] = acc
+	}
+	acc.Nonce = nonce
+}
+
+// SnapshotAccounts returns copies of the given accounts, nil for the ones
+// that don't exist, along with the total supply
+func (s *State) SnapshotAccounts(ids []int) (map[int]*Account, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	accounts := make(map[int]*Account, len(ids))
+	for _, id := range ids {
+		accounts[id] = nil
+		if acc, exists := s.Accounts[id]; exists {
+			accounts[id] = acc.Copy()
+		}
+	}
+	return accounts, s.TotalSupply
+}
+
+// RestoreAccounts puts back the accounts and total supply returned by
+// SnapshotAccounts, removing the accounts that did not exist
+func (s *State) RestoreAccounts(accounts map[int]*Account, totalSupply uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, acc := range accounts {
+		if acc == nil {
+			delete(s.Accounts, id)
+		} else {
+			s.Accounts[id] = acc.Copy()
+		}
+	}
+	s.TotalSupply = totalSupply
+}
+
+// Changes returns a state holding copies of the given accounts along with
+// every field that is not an account. Applying it to an older copy of the
+// state brings those accounts and fields up to date.
+func (s *State) Changes(ids []int) *State {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	changes := &State{
+		Version:        s.Version,
+		Accounts:       make(map[int]*Account, len(ids)),
+		ChainID:        s.ChainID,
+		Height:         s.Height,
+		AppHash:        s.AppHash,
+		TotalSupply:    s.TotalSupply,
+		SupplyCap:      s.SupplyCap,
+		MintAuthority:  s.MintAuthority,
+		AdminAuthority: s.AdminAuthority,
+		Params:         s.Params,
+	}
+	for _, id := range ids {
+		if acc, exists := s.Accounts[id]; exists {
+			changes.Accounts[id] = acc.Copy()
+		}
+	}
+	return changes
+}
+
+// ApplyChanges applies changes returned by Changes
+func (s *State) ApplyChanges(changes *State) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ChainID = changes.ChainID
+	s.Height = changes.Height
+	s.AppHash = changes.AppHash
+	s.TotalSupply = changes.TotalSupply
+	s.SupplyCap = changes.SupplyCap
+	s.MintAuthority = changes.MintAuthority
+	s.AdminAuthority = changes.AdminAuthority
+	s.Params = changes.Params
+	for id, acc := range changes.Accounts {
+		s.Accounts[id] = acc.Copy()
+	}
+}
@@ -5,47 +5,58 @@ import (
 	"fmt"
 )
 
-// Operation represents a single token transfer operation with its own signature
+// Operation types
+const (
+	// OpTypeTransfer moves tokens from one account to another
+	OpTypeTransfer = "transfer"
+	// OpTypeMint creates new tokens in the recipient account, signed by the mint authority
+	OpTypeMint = "mint"
+	// OpTypeBurn destroys tokens from the mint authority's own balance
+	OpTypeBurn = "burn"
+	// OpTypeSetLimits configures the limits of the recipient account,
+	// signed by the account owner or the admin authority
+	OpTypeSetLimits = "set_limits"
+)
+
+// Operation represents a single token operation with its own signature.
+// The operation is always signed by the From account.
 type Operation struct {
-	From      int    `json:"from"`
-	To        int    `json:"to"`
-	Amount    int    `json:"amount"`
-	Signature string `json:"signature"`
+	Type      string         `json:"type,omitempty"`
+	From      int            `json:"from"`
+	To        int            `json:"to"`
+	Amount    uint64         `json:"amount"`
+	Limits    *AccountLimits `json:"limits,omitempty"` // Only used by set_limits operations
+	Nonce     uint64         `json:"nonce,omitempty"`  // Must be greater than the last nonce used by the sender
+	Expiry    int64          `json:"expiry,omitempty"` // Last block height the operation is valid at, zero for none
+	Signature string         `json:"signature"`
 }
 
-// Transaction represents a batch of operations, each with its own signature
+// Transaction represents a batch of operations. Either each operation carries
+// its own signature, or a single sender signs the whole batch once.
 type Transaction struct {
-	Operations []Operation `json:"operations"`
+	Operations         []Operation `json:"operations"`
+	Sender             int         `json:"sender,omitempty"`              // Signer of a batch-signed transaction
+	Signature          string      `json:"signature,omitempty"`           // Batch signature over all operations
+	AggregateSignature string      `json:"aggregate_signature,omitempty"` // BLS signatures of all operations, aggregated
 }
 
-// ParseTransaction parses a JSON transaction
-func ParseTransaction(data []byte) (*Transaction, error) {
-	var tx Transaction
-	err := json.Unmarshal(data, &tx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse transaction: %w", err)
+// OpType returns the operation type, defaulting to a transfer
+func (op *Operation) OpType() string {
+	if op.Type == "" {
+		return OpTypeTransfer
 	}
-	return &tx, nil
+	return op.Type
 }
 
-// Serialize serializes a transaction to JSON
-func (tx *Transaction) Serialize() ([]byte, error) {
-	return json.Marshal(tx)
+// IsBatchSigned reports whether the transaction carries a single signature for all operations
+func (tx *Transaction) IsBatchSigned() bool {
+	return tx.Signature != ""
 }
 
-// GetOperationForSigning returns the operation data that should be signed
-func (op *Operation) GetDataForSigning() ([]byte, error) {
-	// For signing, we only include the operation details, not the signature itself
-	opForSigning := struct {
-		From   int `json:"from"`
-		To     int `json:"to"`
-		Amount int `json:"amount"`
-	}{
-		From:   op.From,
-		To:     op.To,
-		Amount: op.Amount,
-	}
-	return json.Marshal(opForSigning)
+// IsAggregateSigned reports whether the operations are signed under BLS by their
+// senders and the transaction carries the aggregate of those signatures
+func (tx *Transaction) IsAggregateSigned() bool {
+	return tx.AggregateSignature != ""
 }
 
 // String returns a string representation of the transaction
@@ -63,18 +74,53 @@ func (tx *Transaction) Validate() error {
 		return fmt.Errorf("transaction must contain at least one operation")
 	}
 
-	for i, op := range tx.Operations {
-		if op.From <= 0 {
-			return fmt.Errorf("operation %d: invalid sender ID %d", i, op.From)
+	// Aggregate signature: transfers from any senders, none signed individually
+	if tx.IsAggregateSigned() {
+		if tx.IsBatchSigned() || tx.Sender != 0 {
+			return fmt.Errorf("transaction cannot carry both a batch and an aggregate signature")
 		}
-		if op.To <= 0 {
-			return fmt.Errorf("operation %d: invalid recipient ID %d", i, op.To)
+		for i := range tx.Operations {
+			op := &tx.Operations[i]
+			if err := validateOperationFields(op); err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			if op.OpType() != OpTypeTransfer {
+				return fmt.Errorf("operation %d: only transfers can be aggregate-signed, got %s", i, op.OpType())
+			}
+			if op.Signature != "" {
+				return fmt.Errorf("operation %d: aggregate-signed operations must not be signed individually", i)
+			}
+		}
+		return nil
+	}
+
+	// Per-operation signatures
+	if !tx.IsBatchSigned() {
+		if tx.Sender != 0 {
+			return fmt.Errorf("transaction has a sender but no batch signature")
 		}
-		if op.Amount <= 0 {
-			return fmt.Errorf("operation %d: invalid amount %d", i, op.Amount)
+		for i := range tx.Operations {
+			if err := ValidateOperation(&tx.Operations[i]); err != nil {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
 		}
-		if op.Signature == "" {
-			return fmt.Errorf("operation %d: missing signature", i)
+		return nil
+	}
+
+	// Batch signature: every operation is sent by the signer and carries no signature of its own
+	if tx.Sender <= 0 {
+		return fmt.Errorf("invalid batch sender ID %d", tx.Sender)
+	}
+	for i := range tx.Operations {
+		op := &tx.Operations[i]
+		if err := validateOperationFields(op); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+		if op.From != tx.Sender {
+			return fmt.Errorf("operation %d: sender %d does not match batch sender %d", i, op.From, tx.Sender)
+		}
+		if op.Signature != "" {
+			return fmt.Errorf("operation %d: batch-signed operations must not be signed individually", i)
 		}
 	}
 
@@ -83,17 +129,52 @@ func (tx *Transaction) Validate() error {
 
 // ValidateOperation performs basic validation on a single operation
 func ValidateOperation(op *Operation) error {
+	if err := validateOperationFields(op); err != nil {
+		return err
+	}
+	if op.Signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+	return nil
+}
+
+// validateOperationFields validates everything but the signature of an operation
+func validateOperationFields(op *Operation) error {
+	switch op.OpType() {
+	case OpTypeTransfer, OpTypeMint:
+		if op.To <= 0 {
+			return fmt.Errorf("invalid recipient ID %d", op.To)
+		}
+	case OpTypeBurn:
+		if op.To != 0 {
+			return fmt.Errorf("burn operation must not have a recipient, got %d", op.To)
+		}
+	case OpTypeSetLimits:
+		if op.To <= 0 {
+			return fmt.Errorf("invalid account ID %d", op.To)
+		}
+		if op.Amount != 0 {
+			return fmt.Errorf("set_limits operation must not have an amount, got %d", op.Amount)
+		}
+		if op.Limits != nil {
+			if err := op.Limits.Validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation type %q", op.Type)
+	}
 	if op.From <= 0 {
 		return fmt.Errorf("invalid sender ID %d", op.From)
 	}
-	if op.To <= 0 {
-		return fmt.Errorf("invalid recipient ID %d", op.To)
-	}
-	if op.Amount <= 0 {
+	if op.Amount == 0 && op.OpType() != OpTypeSetLimits {
 		return fmt.Errorf("invalid amount %d", op.Amount)
 	}
-	if op.Signature == "" {
-		return fmt.Errorf("missing signature")
+	if op.Expiry < 0 {
+		return fmt.Errorf("invalid expiry %d", op.Expiry)
+	}
+	if op.Limits != nil && op.OpType() != OpTypeSetLimits {
+		return fmt.Errorf("%s operation must not carry limits", op.OpType())
 	}
 	return nil
 }
@@ -1,7 +1,10 @@
 package types
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"math"
 	"testing"
 )
 
@@ -108,42 +111,59 @@ func TestTransactionSerialization(t *testing.T) {
 	}
 }
 
-func TestGetOperationDataForSigning(t *testing.T) {
+func TestOperationSignBytes(t *testing.T) {
 	// Create an operation
 	op := Operation{
 		From:      1,
 		To:        2,
 		Amount:    50,
+		Nonce:     7,
 		Signature: "test-signature",
 	}
 
-	// Get data for signing
-	data, err := op.GetDataForSigning()
-	if err != nil {
-		t.Fatalf("Failed to get operation data for signing: %v", err)
+	// Sign bytes are deterministic and do not include the signature
+	data := op.SignBytes("test-chain")
+	signed := op
+	signed.Signature = "other-signature"
+	if !bytes.Equal(data, signed.SignBytes("test-chain")) {
+		t.Error("Sign bytes depend on the signature")
 	}
 
-	// Parse the data
-	var opForSigning struct {
-		From   int `json:"from"`
-		To     int `json:"to"`
-		Amount int `json:"amount"`
-	}
-	if err := json.Unmarshal(data, &opForSigning); err != nil {
-		t.Fatalf("Failed to parse operation data for signing: %v", err)
+	// An unset type is encoded as a transfer
+	typed := op
+	typed.Type = OpTypeTransfer
+	if !bytes.Equal(data, typed.SignBytes("test-chain")) {
+		t.Error("Sign bytes differ for an explicit transfer type")
 	}
 
-	// Verify that the signature is not included
-	if opForSigning.From != op.From {
-		t.Errorf("From mismatch: got %d, want %d", opForSigning.From, op.From)
+	// Every signed field, the chain ID and the message kind change the bytes
+	changed := map[string][]byte{
+		"chain ID": op.SignBytes("other-chain"),
+		"batch":    (&Transaction{Operations: []Operation{op}}).BatchSignBytes("test-chain"),
 	}
-
-	if opForSigning.To != op.To {
-		t.Errorf("To mismatch: got %d, want %d", opForSigning.To, op.To)
+	for name, modify := range map[string]func(*Operation){
+		"type":   func(o *Operation) { o.Type = OpTypeBurn },
+		"from":   func(o *Operation) { o.From = 3 },
+		"to":     func(o *Operation) { o.To = 3 },
+		"amount": func(o *Operation) { o.Amount = 51 },
+		"nonce":  func(o *Operation) { o.Nonce = 8 },
+		"expiry": func(o *Operation) { o.Expiry = 100 },
+		"limits": func(o *Operation) { o.Limits = &AccountLimits{MaxOpsPerBlock: 1} },
+	} {
+		modified := op
+		modify(&modified)
+		changed[name] = modified.SignBytes("test-chain")
+	}
+	for name, other := range changed {
+		if bytes.Equal(data, other) {
+			t.Errorf("Sign bytes do not cover the %s", name)
+		}
 	}
 
-	if opForSigning.Amount != op.Amount {
-		t.Errorf("Amount mismatch: got %d, want %d", opForSigning.Amount, op.Amount)
+	// The format starts with the domain tag and version
+	if !bytes.HasPrefix(data, append([]byte{byte(len(operationSignDomain))}, operationSignDomain...)) ||
+		data[1+len(operationSignDomain)] != SignBytesVersion {
+		t.Errorf("Sign bytes do not start with the domain tag and version: %x", data)
 	}
 }
 
@@ -199,3 +219,140 @@ func TestBatchedTransactions(t *testing.T) {
 		t.Errorf("Operation count mismatch: got %d, want %d", len(parsedTx.Operations), len(largeOps))
 	}
 }
+
+func TestSupplyOperationValidation(t *testing.T) {
+	// Valid mint
+	mint := Operation{Type: OpTypeMint, From: 9, To: 2, Amount: 50, Signature: "test-signature"}
+	if err := ValidateOperation(&mint); err != nil {
+		t.Errorf("Valid mint failed validation: %v", err)
+	}
+
+	// Valid burn
+	burn := Operation{Type: OpTypeBurn, From: 9, Amount: 50, Signature: "test-signature"}
+	if err := ValidateOperation(&burn); err != nil {
+		t.Errorf("Valid burn failed validation: %v", err)
+	}
+
+	// Burn with a recipient
+	burn.To = 2
+	if err := ValidateOperation(&burn); err == nil {
+		t.Error("Burn with recipient passed validation")
+	}
+
+	// Unknown type
+	unknown := Operation{Type: "steal", From: 1, To: 2, Amount: 50, Signature: "test-signature"}
+	if err := ValidateOperation(&unknown); err == nil {
+		t.Error("Operation with unknown type passed validation")
+	}
+
+	// Supply cap
+	state := NewState()
+	state.SupplyCap = 100
+	if err := state.Mint(1, 80); err != nil {
+		t.Fatalf("Failed to mint: %v", err)
+	}
+	if err := state.Mint(2, 30); err == nil {
+		t.Error("Mint above supply cap succeeded")
+	}
+	if err := state.Burn(1, 30); err != nil {
+		t.Fatalf("Failed to burn: %v", err)
+	}
+	if total, _ := state.GetSupply(); total != 50 {
+		t.Errorf("Total supply mismatch: got %d, want %d", total, 50)
+	}
+}
+
+func TestCheckedBalances(t *testing.T) {
+	state := NewState()
+	if err := state.Mint(1, math.MaxUint64-10); err != nil {
+		t.Fatalf("Failed to mint: %v", err)
+	}
+
+	// Credits and mints that would wrap around are rejected and change nothing
+	if err := state.Credit(1, 11); !errors.Is(err, ErrBalanceOverflow) {
+		t.Errorf("Expected balance overflow, got %v", err)
+	}
+	if err := state.Mint(2, 11); !errors.Is(err, ErrBalanceOverflow) {
+		t.Errorf("Expected supply overflow, got %v", err)
+	}
+	if balance := state.GetAccount(1).Balance; balance != math.MaxUint64-10 {
+		t.Errorf("Balance changed by a rejected credit: got %d", balance)
+	}
+	if total, _ := state.GetSupply(); total != math.MaxUint64-10 {
+		t.Errorf("Supply changed by a rejected mint: got %d", total)
+	}
+
+	// The largest balance can be reached, and debits cannot go below zero
+	if err := state.Credit(1, 10); err != nil {
+		t.Errorf("Failed to credit up to the largest balance: %v", err)
+	}
+	if err := state.Debit(2, 1); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Expected insufficient balance, got %v", err)
+	}
+}
+
+func TestTransactionCodecs(t *testing.T) {
+	tx := Transaction{
+		Operations: []Operation{
+			{From: 1, To: 2, Amount: 50, Nonce: 1, Signature: "c2lnbmF0dXJlLTE="},
+			{Type: OpTypeSetLimits, From: 1, To: 1, Nonce: 2, Expiry: 10,
+				Limits: &AccountLimits{MaxAmountPerWindow: 100, WindowBlocks: 5}, Signature: "c2lnbmF0dXJlLTI="},
+			{From: 1, To: 3, Amount: math.MaxUint64, Nonce: 3, Signature: "c2lnbmF0dXJlLTM="},
+		},
+	}
+
+	// ParseTransaction detects the codec, so every encoding parses to the same transaction
+	for _, name := range CodecNames() {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatalf("Failed to get codec %s: %v", name, err)
+		}
+		data, err := tx.SerializeAs(name)
+		if err != nil {
+			t.Fatalf("Failed to serialize transaction with %s: %v", name, err)
+		}
+		if data[0] != codec.Prefix() {
+			t.Errorf("%s transaction starts with %#x, want %#x", name, data[0], codec.Prefix())
+		}
+
+		parsedTx, err := ParseTransaction(data)
+		if err != nil {
+			t.Fatalf("Failed to parse %s transaction: %v", name, err)
+		}
+		for i := range tx.Operations {
+			if !bytes.Equal(parsedTx.Operations[i].SignBytes(""), tx.Operations[i].SignBytes("")) ||
+				parsedTx.Operations[i].Signature != tx.Operations[i].Signature {
+				t.Errorf("%s transaction mismatch: got %s, want %s", name, parsedTx, &tx)
+			}
+		}
+
+		// Truncated data is rejected rather than parsed partially
+		if name != EncodingJSON {
+			if _, err := ParseTransaction(data[:len(data)-1]); err == nil {
+				t.Errorf("Truncated %s transaction parsed", name)
+			}
+		}
+	}
+
+	// Signatures must be base64 to be converted to raw bytes
+	tx.Operations[0].Signature = "not base64!"
+	if _, err := tx.SerializeAs(EncodingProtobuf); err == nil {
+		t.Error("Transaction with a non-base64 signature serialized to protobuf")
+	}
+	if _, err := ParseTransaction([]byte{0xff}); err == nil {
+		t.Error("Transaction with an unknown prefix parsed")
+	}
+
+	// JSON may start with whitespace, as long as something follows it
+	indented, err := json.MarshalIndent(Transaction{Operations: tx.Operations[1:]}, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal transaction: %v", err)
+	}
+	parsedTx, err := ParseTransaction(append([]byte(" \r\n\t"), indented...))
+	if err != nil || len(parsedTx.Operations) != 2 {
+		t.Errorf("Failed to parse JSON transaction with leading whitespace: %v", err)
+	}
+	if _, err := ParseTransaction([]byte(" \n")); err == nil {
+		t.Error("Transaction of only whitespace parsed")
+	}
+}